@@ -2,232 +2,862 @@ package CacheManager
 
 import (
 	"context"
+	"errors"
 	"log"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"fmt"
 	"github.com/andrewelkin/discap/DataNode"
-	"hash/maphash"
 	"sync"
+	"time"
 )
 
+// DefaultTimeout is how long the manager waits for a node by default
+const DefaultTimeout = 2 * time.Second
+
+// errNodeTimeout is returned when a node does not take a request or does not answer in time
+var errNodeTimeout = errors.New("node timeout")
+
+// CacheRequest is a request to the cache manager
+type CacheRequest struct {
+	Command     string            // one of the "get" "put" "add" "replace" "cas" "getset" "incr" "op" "del" "invalidate" "scan" "range" "inspect"
+	Keys        []string          // array of keys
+	Values      []any             // array of values (or empty if not a "put" command), []byte values are stored as they are. The numbers to add for an "incr"
+	Versions    []uint64          // "cas": the versions the records must have to be stored, zero if a record must be absent
+	TTL         time.Duration     // time to live of the records for a "put" or the ones an "incr" creates, zero means forever
+	Flags       uint32            // opaque client flags stored with the records of a "put"
+	ContentType string            // media type of the raw values of a "put", returned in their metadata
+	Tags        []string          // tags of the records of a "put", "invalidate" deletes the records having any of them
+	Prefix      string            // "del" deletes and "scan" lists the keys starting with it on all the nodes
+	Pattern     string            // "del" deletes and "scan" lists the keys matching this glob on all the nodes, path.Match syntax
+	Cursor      string            // "scan": the cursor of the page, "" or ScanDone for the first one
+	From        string            // "range": the first key listed, inclusive
+	To          string            // "range": the keys listed are less than this one, "" for no end
+	Count       int               // "scan" and "range": the most keys of the page, DefaultScanCount if not positive
+	WithMeta    bool              // "get" returns the metadata of the records too
+	WithRank    bool              // "inspect" gives the ranks of the records in the eviction order too, a node reads its whole order for it
+	Op          DataNode.StructOp // "op": the operation on the typed values of the keys, e.g. "lpush" or "zrange"
+	Namespace   string            // the keys, the prefix and the pattern are in this namespace, "" is the default one. A "del" of nothing deletes the namespace
+}
+
+// ManagerOptions are the cache manager settings
+type ManagerOptions struct {
+	Partitioner Partitioner   // key placement, a hash ring with DefaultVirtualNodes if nil
+	Replicas    int           // copies of every record (N), 1 if not positive
+	WriteQuorum int           // replicas which must confirm a write (W), majority of N if not positive
+	ReadQuorum  int           // replicas which must answer a read (R), majority of N if not positive
+	Timeout     time.Duration // how long to wait for a node, DefaultTimeout if not positive
+}
+
 // DateNodesManager is a cache manager.
-// It keeps two sets of channels, one to send requests to the nodes, the other to receive responses
+// It keeps the channels to send requests to the nodes, every request carries its own reply channel.
+// Nodes can be added and removed at runtime, the keys are moved to their new owners.
+// Every record is kept on N successive owners, writes wait for W of them and reads for R of them.
 type DateNodesManager struct {
-	nodeCh        []chan<- DataNode.DNRequest // nodes channels
-	nodeBackCh    []chan DataNode.DNResponse  // response channels
-	hash          maphash.Hash                // 64 bit hasher
-	numberOfNodes int
+	sync.RWMutex                                      // cache requests take it for reading, membership changes for writing
+	nodeCh       map[string]chan<- DataNode.DNRequest // node id -> node channel
+	partitioner  Partitioner                          // decides which nodes own a key
+	replicas     int                                  // N, copies of every record
+	writeQuorum  int                                  // W, acks needed for a write
+	readQuorum   int                                  // R, answers needed for a read
+	timeout      time.Duration                        // how long to wait for a node
+	lastVersion  atomic.Uint64                        // the last version given to a write
+	quotas       map[string]DataNode.Quota            // quotas of the namespaces, sent to the nodes added
+	membership   sync.Mutex                           // membership changes run one at a time
+	moveLock     sync.Mutex                           // guards moving, moveDone, written and writtenAll
+	moving       map[string]*moveCopy                 // key -> the copy a membership change is making, see settleMoves
+	moveDone     chan struct{}                        // closed when the copies of a membership change are made, nil if none is going on
+	written      map[string]bool                      // keys written while a membership change takes its snapshot, nil if none is, see catchUp
+	writtenAll   bool                                 // a write without keys was made during the snapshot
 }
 
-// New  constructs a new cache manager
+// New  constructs a new cache manager, keys are placed on a consistent hash ring with DefaultVirtualNodes
 // --> Input:
 // ctx              context.Context                 execution context
 // nodeChannels     []chan<- DataNode.DNRequest     fully initialized channels to send requests to the nodes. len() defines number of nodes available
 // <-- Output:
 // 1) *DateNodesManager     initialized cache manager
 func (m *DateNodesManager) New(ctx context.Context, nodeChannels []chan<- DataNode.DNRequest) *DateNodesManager {
+	return m.NewWithPartitioner(ctx, nodeChannels, (&HashRing{}).New(DefaultVirtualNodes, 0))
+}
+
+// NewWithPartitioner  constructs a new cache manager with a given key placement, every record is kept once
+// --> Input:
+// ctx              context.Context                 execution context
+// nodeChannels     []chan<- DataNode.DNRequest     fully initialized channels to send requests to the nodes. len() defines number of nodes available
+// partitioner      Partitioner                     empty partitioner, the nodes are added to it as "000", "001", ...
+// <-- Output:
+// 1) *DateNodesManager     initialized cache manager
+func (m *DateNodesManager) NewWithPartitioner(ctx context.Context, nodeChannels []chan<- DataNode.DNRequest, partitioner Partitioner) *DateNodesManager {
+	m, _ = m.NewWithOptions(ctx, nodeChannels, ManagerOptions{Partitioner: partitioner})
+	return m
+}
 
-	m.nodeCh = nodeChannels
-	m.numberOfNodes = len(nodeChannels)
-	m.nodeBackCh = make([]chan DataNode.DNResponse, m.numberOfNodes)
-	for i := 0; i < m.numberOfNodes; i++ {
-		m.nodeBackCh[i] = make(chan DataNode.DNResponse, 100)
+// NewWithOptions  constructs a new cache manager with replication
+// --> Input:
+// ctx              context.Context                 execution context
+// nodeChannels     []chan<- DataNode.DNRequest     fully initialized channels to send requests to the nodes, they are named "000", "001", ...
+// opts             ManagerOptions                  placement, replication factor, quorums and node timeout
+// <-- Output:
+// 1) *DateNodesManager     initialized cache manager
+// 2) error                 if the quorums are bigger than the replication factor
+func (m *DateNodesManager) NewWithOptions(ctx context.Context, nodeChannels []chan<- DataNode.DNRequest, opts ManagerOptions) (*DateNodesManager, error) {
+
+	if opts.Partitioner == nil {
+		opts.Partitioner = (&HashRing{}).New(DefaultVirtualNodes, 0)
+	}
+	if opts.Replicas <= 0 {
+		opts.Replicas = 1
+	}
+	if opts.WriteQuorum <= 0 {
+		opts.WriteQuorum = opts.Replicas/2 + 1
+	}
+	if opts.ReadQuorum <= 0 {
+		opts.ReadQuorum = opts.Replicas/2 + 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.WriteQuorum > opts.Replicas || opts.ReadQuorum > opts.Replicas {
+		return nil, fmt.Errorf("bad quorums W=%d R=%d, they can't be bigger than N=%d", opts.WriteQuorum, opts.ReadQuorum, opts.Replicas)
 	}
 
-	return m
+	m.partitioner = opts.Partitioner
+	m.replicas = opts.Replicas
+	m.writeQuorum = opts.WriteQuorum
+	m.readQuorum = opts.ReadQuorum
+	m.timeout = opts.Timeout
+	m.nodeCh = make(map[string]chan<- DataNode.DNRequest, len(nodeChannels))
+	m.quotas = make(map[string]DataNode.Quota)
+	for i, ch := range nodeChannels {
+		id := fmt.Sprintf("%03d", i)
+		m.nodeCh[id] = ch
+		m.partitioner.AddNode(id)
+	}
+
+	return m, nil
+}
+
+// NewWithAddresses  constructs a cache manager of the nodes served over the network by DataNode.ServeTCP
+// --> Input:
+// ctx              context.Context     execution context, cancelling it closes the connections
+// addresses        []string            node addresses host:port, the nodes are named "000", "001", ... in this order
+// opts             ManagerOptions      placement, replication factor, quorums and node timeout
+// <-- Output:
+// 1) *DateNodesManager     initialized cache manager
+// 2) error                 if a node can't be reached or the options are bad
+func (m *DateNodesManager) NewWithAddresses(ctx context.Context, addresses []string, opts ManagerOptions) (*DateNodesManager, error) {
+	nodeChannels := make([]chan<- DataNode.DNRequest, len(addresses))
+	for i, addr := range addresses {
+		node, err := (&DataNode.RemoteNode{}).Dial(ctx, addr)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %w", addr, err)
+		}
+		nodeChannels[i] = node.GetChannel()
+	}
+	return m.NewWithOptions(ctx, nodeChannels, opts)
+}
+
+// NodeStat is the state of a node
+type NodeStat struct {
+	Id     string         // node id
+	Length int            // number of records
+	Bytes  int64          // bytes taken by the records
+	Quota  DataNode.Quota // the quota of the namespace asked for
+	Err    error          // not nil if the node did not answer
+}
+
+// Stats asks all the nodes for their sizes
+// <-- Output:
+// 1) []NodeStat     node states sorted by id
+func (m *DateNodesManager) Stats() []NodeStat {
+	m.RLock()
+	defer m.RUnlock()
+	return m.stats("")
+}
+
+// the sizes of the nodes, or of a namespace on them
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) stats(ns string) []NodeStat {
+	requests := make(map[string]DataNode.DNRequest, len(m.nodeCh))
+	for id := range m.nodeCh {
+		requests[id] = DataNode.DNRequest{Command: "get", Namespace: ns}
+	}
+	var stats []NodeStat
+	for r := range m.fanOut(requests) {
+		stats = append(stats, NodeStat{Id: r.id, Length: r.resp.Count, Bytes: r.resp.Bytes, Quota: r.resp.Quota, Err: r.err})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Id < stats[j].Id })
+	return stats
+}
+
+// Replicas returns the replication factor, every record is kept on that many nodes
+func (m *DateNodesManager) Replicas() int {
+	return m.replicas
+}
+
+// NodeIds returns ids of the nodes, sorted
+func (m *DateNodesManager) NodeIds() []string {
+	m.RLock()
+	defer m.RUnlock()
+	return m.partitioner.Nodes()
+}
+
+// sends a request to a node and waits for the response.
+// every call gets a fresh reply channel so concurrent requests to the same node never see each other's responses.
+// A node which is gone or stuck gives errNodeTimeout instead of blocking the caller forever
+func (m *DateNodesManager) callNode(nodeCh chan<- DataNode.DNRequest, rq DataNode.DNRequest) (DataNode.DNResponse, error) {
+	rq.BackCh = make(chan DataNode.DNResponse, 1)
+	rq.Deadline = time.Now().Add(m.timeout)
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+
+	select {
+	case nodeCh <- rq: // send request to a node
+	case <-timer.C:
+		return DataNode.DNResponse{}, errNodeTimeout
+	}
+	select {
+	case resp := <-rq.BackCh: // get the response
+		return resp, nil
+	case <-timer.C:
+		return DataNode.DNResponse{}, errNodeTimeout
+	}
 }
 
-// calculates number of a node by the key (reminder)
-func (m *DateNodesManager) calcNodeIndex(key string) int {
-	m.hash.Reset()
-	_, _ = m.hash.WriteString(key)
-	sum := m.hash.Sum64()
-	return int(sum % (uint64(m.numberOfNodes)))
+// AddNode adds a node and copies to it the keys it owns now. The requests go on while the records are copied,
+// a record which could not be copied stays on its old nodes until the next membership change.
+// Nothing changes if a node can't tell what it holds
+// --> Input:
+// id         string                       unique node id
+// nodeCh     chan<- DataNode.DNRequest    fully initialized channel to send requests to the node
+// <-- Output:
+// 1) int       number of records moved to the new node
+// 2) error     if the id is taken or a node could not be dumped
+func (m *DateNodesManager) AddNode(id string, nodeCh chan<- DataNode.DNRequest) (int, error) {
+	m.membership.Lock()
+	defer m.membership.Unlock()
+
+	m.RLock()
+	_, exists := m.nodeCh[id]
+	m.RUnlock()
+	if exists {
+		return 0, fmt.Errorf("node %s exists already", id)
+	}
+
+	// what the nodes hold before the change, the new node is empty
+	dumps, err := m.snapshot()
+	if err != nil {
+		return 0, fmt.Errorf("node %s not added: %w", id, err)
+	}
+
+	// the requests wait while the snapshot catches up and the moves are planned, not while they are made
+	m.Lock()
+	if dumps, err = m.catchUp(dumps); err != nil {
+		m.Unlock()
+		return 0, fmt.Errorf("node %s not added: %w", id, err)
+	}
+	m.nodeCh[id] = nodeCh
+	if err := m.sendQuotas(id); err != nil {
+		delete(m.nodeCh, id)
+		m.Unlock()
+		return 0, err
+	}
+	m.partitioner.AddNode(id)
+	plan := m.planRebalance(dumps)
+	m.Unlock()
+
+	moved, failed := m.rebalance(plan)
+	if len(failed) > 0 {
+		log.Printf("[CMg] node %s added, %d records could not be moved and stay on their old nodes until the next change", id, len(failed))
+	}
+	log.Printf("[CMg] node %s added, %d records moved to it", id, moved)
+	return moved, nil
+}
+
+// RemoveNode removes a node, its keys are copied to their new owners while the requests go on.
+// The node itself is not stopped, it's up to the caller. If some records could not be copied,
+// the node stays without keys of its own, so they are not lost, and the error tells to remove it again.
+// Nothing changes if a node can't tell what it holds
+// --> Input:
+// id     string     node id
+// <-- Output:
+// 1) int       number of records moved from the node
+// 2) error     if there is no such node, it is the last one, a node could not be dumped or some records could not be moved
+func (m *DateNodesManager) RemoveNode(id string) (int, error) {
+	m.membership.Lock()
+	defer m.membership.Unlock()
+
+	m.RLock()
+	_, exists := m.nodeCh[id]
+	count := len(m.nodeCh)
+	m.RUnlock()
+	if !exists {
+		return 0, fmt.Errorf("node %s does not exist", id)
+	}
+	if count == 1 {
+		return 0, fmt.Errorf("node %s is the last one and cannot be removed", id)
+	}
+
+	dumps, err := m.snapshot()
+	if err != nil {
+		return 0, fmt.Errorf("node %s not removed: %w", id, err)
+	}
+
+	m.Lock()
+	if dumps, err = m.catchUp(dumps); err != nil {
+		m.Unlock()
+		return 0, fmt.Errorf("node %s not removed: %w", id, err)
+	}
+	m.partitioner.RemoveNode(id)
+
+	// now no key belongs to the node, its records go to the new owners
+	plan := m.planRebalance(dumps)
+	delete(m.nodeCh, id)
+	m.Unlock()
+
+	moved, failed := m.rebalance(plan)
+	if len(failed) > 0 {
+		// the node may keep the only copies, it stays without keys of its own until they are moved
+		m.Lock()
+		m.nodeCh[id] = plan.nodeCh[id]
+		m.Unlock()
+		return moved, fmt.Errorf("node %s owns no keys now, but %d records could not be moved from the nodes, remove it again to retry", id, len(failed))
+	}
+	log.Printf("[CMg] node %s removed, %d records moved from it", id, moved)
+	return moved, nil
 }
 
 // HandleCacheRequest passes requests and responses to/from nodes to web server. Parallelized requests to the nodes
 // --> Input:
 // command     string       command, one of the "get" "put "del"
 // keys        []string     array of keys
-// values      []string     array of values (or empty if not a "put" command)
+// values      []string     array of values (or empty if not a "put" command), HandleRequest takes values of any type
+// <-- Output:
+// 1) Response     returns an object to be sent to the operator
+func (m *DateNodesManager) HandleCacheRequest(command string, keys []string, values []string) Response {
+	rq := CacheRequest{
+		Command: command,
+		Keys:    keys,
+	}
+	for _, v := range values {
+		rq.Values = append(rq.Values, v)
+	}
+	return m.HandleRequest(rq)
+}
+
+// HandleRequest is HandleCacheRequest taking all the request options
+// --> Input:
+// rq     CacheRequest     the request
 // <-- Output:
-// 1) any     returns an object to be sent to the operator
-func (m *DateNodesManager) HandleCacheRequest(command string, keys []string, values []string) any {
+// 1) Response     returns an object to be sent to the operator
+func (m *DateNodesManager) HandleRequest(rq CacheRequest) Response {
 
-	switch command {
+	// membership changes wait until the request is done
+	m.RLock()
+	defer m.RUnlock()
 
-	case "del": // request to clear the cache
+	for _, k := range rq.Keys {
+		if strings.Contains(k, DataNode.NamespaceSeparator) {
+			return errorResponse(BadRequest, fmt.Sprintf("Bad key %q, the keys can't have the byte 0x1f", k))
+		}
+	}
+	if strings.Contains(rq.From+rq.To, DataNode.NamespaceSeparator) {
+		return errorResponse(BadRequest, fmt.Sprintf("Bad range %q - %q, the keys can't have the byte 0x1f", rq.From, rq.To))
+	}
+	if rq.Namespace == "" {
+		return m.handle(rq)
+	}
+	if err := DataNode.CheckNamespace(rq.Namespace); err != nil {
+		return errorResponse(BadRequest, err.Error())
+	}
+	return fromNamespace(rq.Namespace, m.handle(toNamespace(rq)))
+}
 
-		count := 0
-		var wg sync.WaitGroup
+// executes a request in the keys the nodes keep
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) handle(rq CacheRequest) Response {
 
-		for i := 0; i < m.numberOfNodes; i++ {
+	m.settleMoves(rq)
+	m.trackWrites(rq)
+	keys, values := rq.Keys, rq.Values
+	switch rq.Command {
 
-			wg.Add(1)
-			go func(nodeCh chan<- DataNode.DNRequest, bkCh chan DataNode.DNResponse) {
+	case "del": // request to delete some keys, the keys matching a prefix or a pattern, or to clear the cache
 
-				rq := DataNode.DNRequest{
-					Command: "del",
-					BackCh:  bkCh,
-				}
-				nodeCh <- rq   // send request to a node
-				resp := <-bkCh // get the response
-				count += resp.Count
-				wg.Done()
+		if len(values) > 0 {
+			return errorResponse(BadRequest, "For a del request there should be no values")
+		}
+		if len(keys) > 0 && (rq.Prefix != "" || rq.Pattern != "") {
+			return errorResponse(BadRequest, "For a del request there should be either keys or a prefix/pattern")
+		}
+		if _, err := path.Match(rq.Pattern, ""); err != nil {
+			return errorResponse(BadRequest, fmt.Sprintf("Bad pattern %q: %s", rq.Pattern, err))
+		}
+		if len(keys) > 0 || rq.Prefix != "" || rq.Pattern != "" {
+			var deleted []string
+			var err error
+			if len(keys) > 0 {
+				deleted, err = m.quorumDel(keys)
+			} else {
+				deleted, err = m.deleteMatching(rq.Prefix, rq.Pattern)
+			}
+			if err != nil {
+				log.Printf("[CMg] error: %s", err)
+				return errorResponse(Unavailable, err.Error())
+			}
+			log.Printf("[CMg] %d keys deleted", len(deleted))
+			return Response{
+				Status:  StatusOK,
+				Message: fmt.Sprintf("%d keys deleted", len(deleted)),
+				Deleted: deleted,
+			}
+		}
 
-			}(m.nodeCh[i], m.nodeBackCh[i])
+		requests := make(map[string]DataNode.DNRequest, len(m.nodeCh))
+		for id := range m.nodeCh {
+			requests[id] = DataNode.DNRequest{Command: "del"}
 		}
 
-		wg.Wait()
+		count := 0
+		var errMessages []string
+		for r := range m.fanOut(requests) {
+			if r.err != nil {
+				errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+				continue
+			}
+			count += r.resp.Count
+		}
 
+		if len(errMessages) != 0 {
+			sort.Strings(errMessages)
+			log.Printf("[CMg] error: %v ", errMessages)
+			return errorResponse(Unavailable, fmt.Sprintf("%v", errMessages))
+		}
 		log.Printf("[CMg] Cache deleted")
-		return map[string]any{
-			"status":  "OK",
-			"message": fmt.Sprintf("%d cache entries deleted", count),
+		return Response{
+			Status:  StatusOK,
+			Message: fmt.Sprintf("%d cache entries deleted", count),
+		}
+
+	case "invalidate": // request to delete the records having any of the tags on all the nodes
+
+		if len(keys) > 0 || len(values) > 0 {
+			return errorResponse(BadRequest, "For an invalidate request there should be no keys and values, only tags")
+		}
+		tags, err := DataNode.CheckTags(rq.Tags)
+		if err != nil {
+			return errorResponse(BadRequest, err.Error())
+		}
+		if len(tags) == 0 {
+			return errorResponse(BadRequest, "For an invalidate request there should be nonzero number of tags")
+		}
+		deleted, err := m.invalidateTags(rq.Namespace, tags)
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		}
+		log.Printf("[CMg] %d keys invalidated by the tags %v", len(deleted), tags)
+		return Response{
+			Status:  StatusOK,
+			Message: fmt.Sprintf("%d keys invalidated", len(deleted)),
+			Deleted: deleted,
+		}
+
+	case "scan": // request to list the keys of all the nodes, a page at a time
+
+		if len(keys) > 0 || len(values) > 0 {
+			return errorResponse(BadRequest, "For a scan request there should be no keys and values")
+		}
+		if _, err := path.Match(rq.Pattern, ""); err != nil {
+			return errorResponse(BadRequest, fmt.Sprintf("Bad pattern %q: %s", rq.Pattern, err))
+		}
+		count := rq.Count
+		if count <= 0 {
+			count = DefaultScanCount
+		}
+		if count > MaxScanCount {
+			return errorResponse(BadRequest, fmt.Sprintf("Bad count %d, it should be at most %d", count, MaxScanCount))
+		}
+		node, after, err := decodeCursor(rq.Cursor)
+		if err != nil {
+			return errorResponse(BadRequest, err.Error())
+		}
+		page, cursor, err := m.scan(node, after, count, rq.Prefix, rq.Pattern)
+		if errors.Is(err, errCursorNode) {
+			return errorResponse(BadRequest, err.Error())
+		}
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		}
+		log.Printf("[CMg] scan: %d keys listed", len(page))
+		return Response{
+			Status:  StatusOK,
+			Message: fmt.Sprintf("%d keys listed", len(page)),
+			Keys:    page,
+			Cursor:  cursor,
+		}
+
+	case "range": // request to list the keys between two keys of all the nodes in lexical order, a page at a time
+
+		if len(keys) > 0 || len(values) > 0 {
+			return errorResponse(BadRequest, "For a range request there should be no keys and values")
+		}
+		if rq.To != "" && rq.To < rq.From {
+			return errorResponse(BadRequest, fmt.Sprintf("Bad range, %q is before %q", rq.To, rq.From))
+		}
+		count := rq.Count
+		if count <= 0 {
+			count = DefaultScanCount
+		}
+		if count > MaxScanCount {
+			return errorResponse(BadRequest, fmt.Sprintf("Bad count %d, it should be at most %d", count, MaxScanCount))
+		}
+		page, next, err := m.rangeKeys(rq.From, rq.To, count)
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		}
+		log.Printf("[CMg] range: %d keys listed", len(page))
+		return Response{
+			Status:  StatusOK,
+			Message: fmt.Sprintf("%d keys listed", len(page)),
+			Keys:    page,
+			Next:    next,
+		}
+
+	case "inspect": // request to describe the records of the keys on their owners, not counted as a read
+
+		if len(keys) == 0 || len(values) > 0 {
+			return errorResponse(BadRequest, "For an inspect request there should be keys and no values")
+		}
+		owners, infos, err := m.inspect(keys, rq.WithRank)
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		}
+		return Response{
+			Status:  StatusOK,
+			Message: fmt.Sprintf("%d keys found", len(infos)),
+			Owners:  owners,
+			Info:    infos,
 		}
 
 	case "get": // request to find the keys in the cache. special case: empty keys array: sends status info about the nodes
 		if len(values) > 0 {
-			return map[string]string{
-				"status":  "Error",
-				"message": "For a get request there should be no values, only keys",
-			}
-
+			return errorResponse(BadRequest, "For a get request there should be no values, only keys")
 		}
 		if len(keys) == 0 { // status request
 			var results []string
-			for i := 0; i < m.numberOfNodes; i++ {
-				rq := DataNode.DNRequest{
-					Command: "get",
-					BackCh:  m.nodeBackCh[i],
+			for _, st := range m.stats(rq.Namespace) {
+				if st.Err != nil {
+					results = append(results, fmt.Sprintf("node %s unavailable: %s", st.Id, st.Err))
+				} else if rq.Namespace != "" {
+					results = append(results, fmt.Sprintf("node %s namespace %s length %d bytes %d quota %d entries %d bytes", st.Id, rq.Namespace, st.Length, st.Bytes, st.Quota.MaxSize, st.Quota.MaxBytes))
+				} else {
+					results = append(results, fmt.Sprintf("node %s length %d bytes %d", st.Id, st.Length, st.Bytes))
 				}
-				m.nodeCh[i] <- rq         // send request
-				resp := <-m.nodeBackCh[i] // get response
-				results = append(results, fmt.Sprintf("node %03d length %d", i, resp.Count))
 			}
 
-			return map[string]any{
-				"status":  "OK",
-				"message": results,
+			return Response{
+				Status:  StatusOK,
+				Message: fmt.Sprintf("%d nodes", len(results)),
+				Nodes:   results,
 			}
 		}
 
-		keyArrays := make([][]string, m.numberOfNodes)
-		results := make([]map[string]any, m.numberOfNodes)
-
-		for _, k := range keys {
-			keyArrays[m.calcNodeIndex(k)] = append(keyArrays[m.calcNodeIndex(k)], k)
+		latest, err := m.quorumGet(keys)
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		}
+		resp := Response{
+			Status: StatusOK,
+			Result: make(map[string]any, len(latest)),
+		}
+		resp.Versions = versions(latest)
+		for k, rv := range latest {
+			resp.Result[k] = rv.value
+		}
+		if rq.WithMeta {
+			resp.Meta = make(map[string]DataNode.EntryMeta, len(latest))
+			for k, rv := range latest {
+				resp.Meta[k] = rv.meta
+			}
 		}
-		var wg sync.WaitGroup
-		var count atomic.Int64
 
-		for i := 0; i < m.numberOfNodes; i++ {
-			results[i] = make(map[string]any)
-			if len(keyArrays[i]) > 0 {
+		log.Printf("[CMg] %d key/value pairs are retrieved from the cache", len(resp.Result))
+		return resp
 
-				wg.Add(1)
-				go func(keyAr []string, nodeCh chan<- DataNode.DNRequest, bkCh chan DataNode.DNResponse, result map[string]any) {
+	case "put", "add", "replace", "getset": // request to store/update the keys, "add" stores the absent keys only, "replace" the existing ones,
+		// "getset" returns the previous values too
 
-					rq := DataNode.DNRequest{
-						Command: "get",
-						Keys:    keyAr,
-						BackCh:  bkCh,
-					}
-					nodeCh <- rq   // send request to a node
-					resp := <-bkCh // get the response
-					for j, k := range resp.Keys {
-						count.Add(1)
-						result[k] = resp.Values[j]
-					}
-					wg.Done()
+		if len(values) != len(keys) || len(keys) == 0 {
+			em := "For a put request there should be equal nonzero number of keys and values"
+			log.Printf("[CMg] %s", em)
+			return errorResponse(BadRequest, em)
+		}
+		if rq.TTL < 0 {
+			em := fmt.Sprintf("Bad ttl %v, it should be positive or zero for no expiry", rq.TTL)
+			log.Printf("[CMg] %s", em)
+			return errorResponse(BadRequest, em)
+		}
+
+		tags, err := DataNode.CheckTags(rq.Tags)
+		if err != nil {
+			log.Printf("[CMg] %s", err)
+			return errorResponse(BadRequest, err.Error())
+		}
 
-				}(keyArrays[i], m.nodeCh[i], m.nodeBackCh[i], results[i])
+		meta := DataNode.EntryMeta{Version: m.nextVersion(), Flags: rq.Flags, ContentType: rq.ContentType, Tags: tags}
+		var results, stored []string
+		var previous map[string]replicaValue
+		if rq.Command == "add" || rq.Command == "replace" { // the first owners decide which keys are stored
+			results, stored, err = m.quorumConditional(rq.Command, keys, values, rq.TTL, meta)
+		} else {
+			results, previous, err = m.quorumPut(rq.Command, keys, values, rq.TTL, meta)
+		}
 
+		version := strconv.FormatUint(meta.Version, 10)
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		} else if rq.Command == "add" || rq.Command == "replace" {
+			log.Printf("[CMg] %s: %d of %d keys stored", rq.Command, len(stored), len(keys))
+			resp := Response{
+				Status:   StatusOK,
+				Message:  fmt.Sprintf("%d of %d keys stored", len(stored), len(keys)),
+				Stored:   stored,
+				Versions: make(map[string]string, len(stored)),
+				Debug:    results,
 			}
-		}
-		wg.Wait()
-		result := make(map[string]any)
-		for i := 0; i < m.numberOfNodes; i++ {
-			for k, v := range results[i] {
-				result[k] = v
+			skipped := make(map[string]bool, len(keys))
+			for _, k := range keys {
+				skipped[k] = true
+			}
+			for _, k := range stored {
+				resp.Versions[k] = version
+				delete(skipped, k)
+			}
+			resp.Skipped = sortedKeys(skipped)
+			return resp
+		} else {
+			log.Printf("[CMg] %d key/value pairs are sent to the cache", len(keys))
+			resp := Response{
+				Status:   StatusOK,
+				Message:  fmt.Sprintf("%d key/value pairs are sent to the cache", len(keys)),
+				Versions: make(map[string]string, len(keys)),
+				Debug:    results,
+			}
+			for _, k := range keys {
+				resp.Versions[k] = version
+			}
+			if previous != nil {
+				resp.Previous = make(map[string]any, len(previous))
+				for k, rv := range previous {
+					resp.Previous[k] = rv.value
+				}
 			}
+			return resp
 		}
 
-		log.Printf("[CMg] %d key/value pairs are retrieved from the cache", count.Load())
-		return map[string]any{
-			"status": "OK",
-			"result": result,
+	case "cas": // request to store the keys if their records have the versions given, or are absent for version zero
+
+		if len(values) != len(keys) || len(rq.Versions) != len(keys) || len(keys) == 0 {
+			em := "For a cas request there should be equal nonzero number of keys, values and versions"
+			log.Printf("[CMg] %s", em)
+			return errorResponse(BadRequest, em)
+		}
+		if rq.TTL < 0 {
+			em := fmt.Sprintf("Bad ttl %v, it should be positive or zero for no expiry", rq.TTL)
+			log.Printf("[CMg] %s", em)
+			return errorResponse(BadRequest, em)
 		}
 
-	case "put": // request to store/update the keys
+		tags, err := DataNode.CheckTags(rq.Tags)
+		if err != nil {
+			log.Printf("[CMg] %s", err)
+			return errorResponse(BadRequest, err.Error())
+		}
+
+		meta := DataNode.EntryMeta{Version: m.nextVersion(), Flags: rq.Flags, ContentType: rq.ContentType, Tags: tags}
+		stored, err := m.quorumCas(keys, values, rq.Versions, rq.TTL, meta)
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		}
+		resp := Response{
+			Status:   StatusOK,
+			Message:  fmt.Sprintf("%d keys stored", len(stored)),
+			Stored:   make([]string, 0, len(stored)),
+			Versions: versions(stored),
+		}
+		for k := range stored {
+			resp.Stored = append(resp.Stored, k)
+		}
+		sort.Strings(resp.Stored)
+		if requested := countUnique(keys); len(stored) < requested {
+			resp.Status, resp.Kind = StatusError, Conflict
+			resp.Message = fmt.Sprintf("version mismatch, %d of %d keys stored", len(stored), requested)
+		}
+		log.Printf("[CMg] cas: %s", resp.Message)
+		return resp
+
+	case "incr": // request to add the deltas to the numbers of the keys atomically, the missing keys are created
 
 		if len(values) != len(keys) || len(keys) == 0 {
-			em := "For a put request there should be equal nonzero number of keys and values"
+			em := "For an incr request there should be equal nonzero number of keys and deltas"
 			log.Printf("[CMg] %s", em)
-
-			return map[string]string{
-				"status":  "Error",
-				"message": em,
+			return errorResponse(BadRequest, em)
+		}
+		if rq.TTL < 0 {
+			em := fmt.Sprintf("Bad ttl %v, it should be positive or zero for no expiry", rq.TTL)
+			log.Printf("[CMg] %s", em)
+			return errorResponse(BadRequest, em)
+		}
+		deltas := make([]any, len(values))
+		for i, v := range values {
+			d, err := parseDelta(v)
+			if err != nil {
+				log.Printf("[CMg] %s", err)
+				return errorResponse(BadRequest, err.Error())
 			}
+			deltas[i] = d
 		}
 
-		keyArrays := make([][]string, m.numberOfNodes)
-		valueArrays := make([][]any, m.numberOfNodes)
-
-		for i, k := range keys {
-			keyArrays[m.calcNodeIndex(k)] = append(keyArrays[m.calcNodeIndex(k)], k)
-			valueArrays[m.calcNodeIndex(k)] = append(valueArrays[m.calcNodeIndex(k)], values[i])
+		latest, keyErrors, err := m.quorumIncr(keys, deltas, rq.TTL)
+		if err != nil {
+			log.Printf("[CMg] error: %s", err)
+			return errorResponse(Unavailable, err.Error())
+		}
+		result := make(map[string]any, len(latest))
+		for k, rv := range latest {
+			result[k] = rv.value
+		}
+		if len(keyErrors) > 0 {
+			log.Printf("[CMg] incr error: %v", keyErrors)
+			resp := errorResponse(BadRequest, fmt.Sprintf("%v", keyErrors))
+			resp.Result, resp.Versions = result, versions(latest)
+			return resp
+		}
+		log.Printf("[CMg] %d keys incremented", len(result))
+		return Response{
+			Status:   StatusOK,
+			Message:  fmt.Sprintf("%d keys incremented", len(result)),
+			Result:   result,
+			Versions: versions(latest),
 		}
 
-		var errMessages []string
-		var results []string
-		var wg sync.WaitGroup
-		var count atomic.Int64
-		for i := 0; i < m.numberOfNodes; i++ {
-			if len(keyArrays[i]) > 0 {
-				wg.Add(1)
-				go func(keyAr []string, valAr []any, nodeCh chan<- DataNode.DNRequest, bkCh chan DataNode.DNResponse, ndx int) {
-
-					rq := DataNode.DNRequest{
-						Command: "put",
-						Keys:    keyAr,
-						Values:  valAr,
-						BackCh:  bkCh,
-					}
-
-					nodeCh <- rq   // send request to a node
-					resp := <-bkCh // get the response
-					count.Add(int64(resp.Count))
-					wg.Done()
-					if resp.Status != "OK" {
-						errMessages = append(errMessages, fmt.Sprintf("node %d error: %s", ndx, resp.Message))
-					} else {
-						results = append(results, fmt.Sprintf("node %d:  %s", ndx, resp.Message))
-					}
-
-				}(keyArrays[i], valueArrays[i], m.nodeCh[i], m.nodeBackCh[i], i)
-			}
-		}
-		wg.Wait()
+	case "op": // request to apply an operation to the lists, hashes, sets or sorted sets of the keys, the missing keys are empty
 
-		if len(errMessages) != 0 {
-			log.Printf("[CMg] error: %v ", errMessages)
-			return map[string]any{
-				"status":  "Error",
-				"message": errMessages,
+		if len(keys) == 0 || len(values) > 0 {
+			em := "For an op request there should be nonzero number of keys and no values"
+			log.Printf("[CMg] %s", em)
+			return errorResponse(BadRequest, em)
+		}
+		if err := rq.Op.Check(); err != nil {
+			log.Printf("[CMg] %s", err)
+			return errorResponse(BadRequest, err.Error())
+		}
+		if rq.TTL < 0 {
+			em := fmt.Sprintf("Bad ttl %v, it should be positive or zero for no expiry", rq.TTL)
+			log.Printf("[CMg] %s", em)
+			return errorResponse(BadRequest, em)
+		}
+
+		var latest map[string]replicaValue
+		var results map[string]any
+		var keyErrors []string
+		if rq.Op.Writes() {
+			var err error
+			latest, results, keyErrors, err = m.quorumOp(keys, rq.Op, rq.TTL)
+			if err != nil {
+				log.Printf("[CMg] error: %s", err)
+				return errorResponse(Unavailable, err.Error())
 			}
-		} else {
-			log.Printf("[CMg] %d key/value pairs are sent to the cache", count.Load())
-			return map[string]any{
-				"status":  "OK",
-				"message": fmt.Sprintf("%d key/value pairs are sent to the cache", count.Load()),
-				"debug":   results,
+		} else { // reads apply to the latest replica here, the nodes are not changed
+			found, err := m.quorumGet(keys)
+			if err != nil {
+				log.Printf("[CMg] error: %s", err)
+				return errorResponse(Unavailable, err.Error())
+			}
+			latest, results = make(map[string]replicaValue), make(map[string]any, len(keys))
+			for _, k := range keys {
+				_, res, err := DataNode.ApplyOp(found[k].value, rq.Op)
+				if err != nil {
+					keyErrors = append(keyErrors, fmt.Sprintf("%s: %s", k, err))
+					continue
+				}
+				results[k] = res
+				if rv, ok := found[k]; ok {
+					latest[k] = rv
+				}
 			}
+			sort.Strings(keyErrors)
+		}
+		if len(keyErrors) > 0 {
+			log.Printf("[CMg] %s error: %v", rq.Op.Name, keyErrors)
+			resp := errorResponse(BadRequest, strings.Join(keyErrors, "; "))
+			resp.Result, resp.Versions = results, versions(latest)
+			return resp
 		}
+		log.Printf("[CMg] %s applied to %d keys", rq.Op.Name, len(results))
+		return Response{
+			Status:   StatusOK,
+			Message:  fmt.Sprintf("%s applied to %d keys", rq.Op.Name, len(results)),
+			Result:   results,
+			Versions: versions(latest),
+		}
+	}
+	return errorResponse(BadRequest, "Unknown request: "+rq.Command)
+}
+
+// the versions of the records in decimal
+func versions(records map[string]replicaValue) map[string]string {
+	res := make(map[string]string, len(records))
+	for k, rv := range records {
+		res[k] = strconv.FormatUint(rv.meta.Version, 10)
+	}
+	return res
+}
+
+// number of different keys
+func countUnique(keys []string) int {
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		set[k] = true
 	}
-	return map[string]string{
-		"status":  "Error",
-		"message": "Unknown request: " + command,
+	return len(set)
+}
+
+// the delta of an "incr" as the int64 or the float64 the nodes take
+func parseDelta(v any) (any, error) {
+	switch d := v.(type) {
+	case int:
+		return int64(d), nil
+	case int32:
+		return int64(d), nil
+	case int64:
+		return d, nil
+	case float32:
+		return float64(d), nil
+	case float64:
+		if !math.IsInf(d, 0) && !math.IsNaN(d) {
+			return d, nil
+		}
+	case string:
+		if i, err := strconv.ParseInt(d, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(d, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return f, nil
+		}
 	}
+	return nil, fmt.Errorf("Bad delta %v, it should be a number", v)
 }
@@ -0,0 +1,230 @@
+package CacheManager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// stress tests, meant to be run with -race:
+//   go test -race ./CacheManager/...
+
+// creates nodes and a manager on top of them, the nodes are stopped when the test ends
+func newTestManager(t *testing.T, numberOfNodes int, nodeMaxSize int) *DateNodesManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	nodeChannels := make([]chan<- DataNode.DNRequest, numberOfNodes)
+	for i := 0; i < numberOfNodes; i++ {
+		nodeChannels[i] = (&DataNode.SingleDataNode{}).New(ctx, fmt.Sprintf("%03d", i), nodeMaxSize).GetChannel()
+	}
+	return (&DateNodesManager{}).New(ctx, nodeChannels)
+}
+
+// every worker owns its keys, the value of a key is derived from the key itself,
+// so any crossed response shows up either as a foreign key or as a wrong value
+func stressValue(key string) string {
+	return "value-of-" + key
+}
+
+// checks a get response: only requested keys, only their own values
+func checkGetResponse(resp Response, keys []string) error {
+	if resp.Status != "OK" {
+		return fmt.Errorf("bad get response %v", resp)
+	}
+	result := resp.Result
+	if result == nil {
+		return fmt.Errorf("no result in get response %v", resp)
+	}
+	requested := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		requested[k] = true
+	}
+	for k, v := range result {
+		if !requested[k] {
+			return fmt.Errorf("got key %s which was not requested, requested %v", k, keys)
+		}
+		if v != stressValue(k) {
+			return fmt.Errorf("for the key %s expected %v, got %v", k, stressValue(k), v)
+		}
+	}
+	return nil
+}
+
+func TestDateNodesManager_ConcurrentPutGet(t *testing.T) {
+
+	workers := 32
+	rounds := 50
+	keysPerRequest := 8
+
+	// big enough so nothing is evicted, all keys must be found
+	m := newTestManager(t, 4, workers*rounds*keysPerRequest)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				keys := make([]string, keysPerRequest)
+				values := make([]string, keysPerRequest)
+				for i := range keys {
+					keys[i] = fmt.Sprintf("w%03d-r%03d-k%02d", w, r, i)
+					values[i] = stressValue(keys[i])
+				}
+				if resp := m.HandleCacheRequest("put", keys, values); resp.Status != "OK" {
+					errs <- fmt.Errorf("worker %d: put failed: %v", w, resp)
+					return
+				}
+				resp := m.HandleCacheRequest("get", keys, nil)
+				if err := checkGetResponse(resp, keys); err != nil {
+					errs <- fmt.Errorf("worker %d: %w", w, err)
+					return
+				}
+				if got := len(resp.Result); got != len(keys) {
+					errs <- fmt.Errorf("worker %d: expected %d keys, got %d", w, len(keys), got)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestDateNodesManager_ConcurrentPutGetDel(t *testing.T) {
+
+	workers := 16
+	rounds := 100
+
+	// small nodes: keys get evicted and the cache is flushed all the time,
+	// a get may miss keys but must never return somebody else's data
+	m := newTestManager(t, 3, 20)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers+2)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				keys := []string{
+					fmt.Sprintf("w%03d-a", w),
+					fmt.Sprintf("w%03d-b", w),
+					fmt.Sprintf("w%03d-c", w),
+				}
+				values := []string{stressValue(keys[0]), stressValue(keys[1]), stressValue(keys[2])}
+				m.HandleCacheRequest("put", keys, values)
+				if err := checkGetResponse(m.HandleCacheRequest("get", keys, nil), keys); err != nil {
+					errs <- fmt.Errorf("worker %d: %w", w, err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	// flusher
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for r := 0; r < rounds; r++ {
+			resp := m.HandleCacheRequest("del", nil, nil)
+			if resp.Status != "OK" || !strings.HasSuffix(resp.Message, "cache entries deleted") {
+				errs <- fmt.Errorf("flusher: bad del response %v", resp)
+				return
+			}
+		}
+	}()
+
+	// status reader: the status response must describe every node
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for r := 0; r < rounds; r++ {
+			resp := m.HandleCacheRequest("get", nil, nil)
+			if resp.Status != "OK" || len(resp.Nodes) != 3 {
+				errs <- fmt.Errorf("status: bad response %v", resp)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestDateNodesManager_ConcurrentMembershipChanges(t *testing.T) {
+
+	workers := 16
+	rounds := 50
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// big enough so nothing is evicted, keys must survive the moves between nodes
+	m := newTestManager(t, 3, workers*rounds)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers+1)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			var keys []string
+			for r := 0; r < rounds; r++ {
+				key := fmt.Sprintf("w%03d-r%03d", w, r)
+				keys = append(keys, key)
+				m.HandleCacheRequest("put", []string{key}, []string{stressValue(key)})
+				resp := m.HandleCacheRequest("get", keys, nil)
+				if err := checkGetResponse(resp, keys); err != nil {
+					errs <- fmt.Errorf("worker %d: %w", w, err)
+					return
+				}
+				if got := len(resp.Result); got != len(keys) {
+					errs <- fmt.Errorf("worker %d: expected %d keys, got %d", w, len(keys), got)
+					return
+				}
+			}
+		}(w)
+	}
+
+	// nodes come and go while the workers are running
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			id := fmt.Sprintf("extra%02d", i)
+			nodeCh := (&DataNode.SingleDataNode{}).New(ctx, id, workers*rounds).GetChannel()
+			if _, err := m.AddNode(id, nodeCh); err != nil {
+				errs <- err
+				return
+			}
+			if i%2 == 1 {
+				if _, err := m.RemoveNode(fmt.Sprintf("extra%02d", i-1)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
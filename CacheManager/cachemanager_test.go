@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/andrewelkin/discap/DataNode"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestDateNodesManager_HandleCacheRequest(t *testing.T) {
@@ -14,7 +18,8 @@ func TestDateNodesManager_HandleCacheRequest(t *testing.T) {
 	nodeMaxSize := 3
 
 	// prep
-	ctx, _ := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// create the data nodes and get their channels
 	nodeChannels := make([]chan<- DataNode.DNRequest, numberOfNodes)
@@ -38,18 +43,18 @@ func TestDateNodesManager_HandleCacheRequest(t *testing.T) {
 	resp := m.HandleCacheRequest("put", keys, values)
 
 	r, _ := json.MarshalIndent(resp, "", "\t")
-	if resp.(map[string]any)["status"].(string) != "OK" {
+	if resp.Status != "OK" {
 		t.Errorf("HandleCacheRequest put error, response was %v", string(r))
 
 	}
 	//fmt.Printf("%v", string(r))
 	resp = m.HandleCacheRequest("get", keys, nil)
 	r, _ = json.MarshalIndent(resp, "", "\t")
-	if resp.(map[string]any)["status"].(string) != "OK" {
+	if resp.Status != "OK" {
 		t.Errorf("HandleCacheRequest put error, response was %v", string(r))
 	}
 
-	result := resp.(map[string]any)["result"].(map[string]any)
+	result := resp.Result
 
 	for i, k := range keys {
 		if result[k] != values[i] {
@@ -59,3 +64,439 @@ func TestDateNodesManager_HandleCacheRequest(t *testing.T) {
 	//fmt.Printf("%v", result)
 	//fmt.Printf("%v", string(r))
 }
+
+func TestDateNodesManager_AddRemoveNode(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestManager(t, 3, 1000)
+
+	var keys, values []string
+	for i := 0; i < 300; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, fmt.Sprintf("value%d", i))
+	}
+	m.HandleCacheRequest("put", keys, values)
+
+	checkAll := func(stage string) {
+		result := m.HandleCacheRequest("get", keys, nil).Result
+		for i, k := range keys {
+			if result[k] != values[i] {
+				t.Errorf("%s: for the key %s expected %v, got %v", stage, k, values[i], result[k])
+			}
+		}
+	}
+
+	// add a node: some keys move to it, all keys are still found
+	newNode := (&DataNode.SingleDataNode{}).New(ctx, "new", 1000)
+	moved, err := m.AddNode("new", newNode.GetChannel())
+	if err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+	if moved == 0 || moved != newNode.Len() {
+		t.Errorf("AddNode() moved %d records, the new node has %d", moved, newNode.Len())
+	}
+	checkAll("after AddNode")
+
+	if _, err = m.AddNode("new", newNode.GetChannel()); err == nil {
+		t.Errorf("AddNode() with a taken id must fail")
+	}
+
+	// remove one of the original nodes, all keys are still found
+	if _, err = m.RemoveNode("001"); err != nil {
+		t.Fatalf("RemoveNode() error = %v", err)
+	}
+	checkAll("after RemoveNode")
+
+	if ids := m.NodeIds(); len(ids) != 3 || ids[0] != "000" || ids[1] != "002" || ids[2] != "new" {
+		t.Errorf("unexpected nodes after add/remove: %v", ids)
+	}
+
+	// nothing is left on the removed node: removing the rest but one keeps the data
+	for _, id := range []string{"000", "002"} {
+		if _, err = m.RemoveNode(id); err != nil {
+			t.Fatalf("RemoveNode() error = %v", err)
+		}
+	}
+	checkAll("on the last node")
+	if newNode.Len() != len(keys) {
+		t.Errorf("the last node must have all %d records, has %d", len(keys), newNode.Len())
+	}
+	if _, err = m.RemoveNode("new"); err == nil {
+		t.Errorf("RemoveNode() of the last node must fail")
+	}
+}
+
+// a node which answers the puts with an error while fail is set, it takes delay to answer them
+// without holding up the other requests
+func flakyNode(ctx context.Context, id string, fail *atomic.Bool, delay time.Duration) chan<- DataNode.DNRequest {
+	return flakyCommandNode(ctx, id, "put", fail, delay)
+}
+
+// a flakyNode failing and delaying the given command instead of the puts
+func flakyCommandNode(ctx context.Context, id string, command string, fail *atomic.Bool, delay time.Duration) chan<- DataNode.DNRequest {
+	nodeCh := (&DataNode.SingleDataNode{}).New(ctx, id, 1000).GetChannel()
+	ch := make(chan DataNode.DNRequest)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case rq := <-ch:
+				if rq.Command != command {
+					nodeCh <- rq
+					continue
+				}
+				go func(rq DataNode.DNRequest) {
+					time.Sleep(delay)
+					if fail.Load() {
+						rq.BackCh <- DataNode.DNResponse{Status: "Error", Message: "disk full"}
+					} else {
+						nodeCh <- rq
+					}
+				}(rq)
+			}
+		}
+	}()
+	return ch
+}
+
+func TestDateNodesManager_RebalanceFailures(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestManager(t, 2, 1000)
+	var keys, values []string
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, fmt.Sprintf("value%d", i))
+	}
+	m.HandleCacheRequest("put", keys, values)
+	found := func() int {
+		result := m.HandleCacheRequest("get", keys, nil).Result
+		count := 0
+		for i, k := range keys {
+			if result[k] == values[i] {
+				count++
+			}
+		}
+		return count
+	}
+
+	// the copies to the new node fail: its keys stay on the old nodes
+	var fail atomic.Bool
+	fail.Store(true)
+	if moved, err := m.AddNode("flaky", flakyNode(ctx, "flaky", &fail, 0)); err != nil || moved != 0 {
+		t.Fatalf("AddNode() = %d, %v", moved, err)
+	}
+	if n := found(); n == 0 || n == len(keys) {
+		t.Fatalf("%d keys found, the keys of the new node must be missing and the rest found", n)
+	}
+
+	// the next change moves them
+	fail.Store(false)
+	if _, err := m.AddNode("003", (&DataNode.SingleDataNode{}).New(ctx, "003", 1000).GetChannel()); err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+	if n := found(); n != len(keys) {
+		t.Fatalf("%d keys found after the next change, expected %d", n, len(keys))
+	}
+
+	// a removed node whose records could not be moved stays until they are
+	fail.Store(true)
+	if _, err := m.RemoveNode("000"); err == nil {
+		t.Fatalf("RemoveNode() must fail when the records are not moved")
+	}
+	if ids := m.NodeIds(); slices.Contains(ids, "000") {
+		t.Errorf("the node must own no keys, the nodes are %v", ids)
+	}
+	fail.Store(false)
+	if _, err := m.RemoveNode("000"); err != nil {
+		t.Fatalf("RemoveNode() error = %v", err)
+	}
+	if n := found(); n != len(keys) {
+		t.Errorf("%d keys found after the node was removed, expected %d", n, len(keys))
+	}
+}
+
+func TestDateNodesManager_RebalanceDoesNotBlock(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newTestManager(t, 3, 1000)
+	var keys, values []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, fmt.Sprintf("value%d", i))
+	}
+	m.HandleCacheRequest("put", keys, values)
+
+	// the copies to the new node are slow, the requests go on meanwhile
+	var fail atomic.Bool
+	added := make(chan error)
+	go func() {
+		_, err := m.AddNode("slow", flakyNode(ctx, "slow", &fail, 500*time.Millisecond))
+		added <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if resp := m.HandleCacheRequest("get", nil, nil); resp.Status != "OK" || len(resp.Nodes) != 4 {
+		t.Errorf("status request during the change returned %v", resp)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("status request waited %s for the records to be copied", elapsed)
+	}
+	// a key being moved is copied before it is read
+	result := m.HandleCacheRequest("get", keys, nil).Result
+	for i, k := range keys {
+		if result[k] != values[i] {
+			t.Errorf("during the change for the key %s expected %v, got %v", k, values[i], result[k])
+		}
+	}
+	if err := <-added; err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+}
+
+func TestDateNodesManager_SnapshotFailure(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var fail atomic.Bool
+	m := (&DateNodesManager{}).New(ctx, []chan<- DataNode.DNRequest{
+		flakyCommandNode(ctx, "000", "dump", &fail, 0),
+		(&DataNode.SingleDataNode{}).New(ctx, "001", 1000).GetChannel(),
+	})
+	var keys, values []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, fmt.Sprintf("value%d", i))
+	}
+	m.HandleCacheRequest("put", keys, values)
+
+	// a node which can't tell what it holds stops the change, nothing is changed
+	fail.Store(true)
+	if _, err := m.AddNode("002", (&DataNode.SingleDataNode{}).New(ctx, "002", 1000).GetChannel()); err == nil || !strings.Contains(err.Error(), "not added") {
+		t.Errorf("AddNode() with a node failing the dump returned %v", err)
+	}
+	if _, err := m.RemoveNode("001"); err == nil || !strings.Contains(err.Error(), "not removed") {
+		t.Errorf("RemoveNode() with a node failing the dump returned %v", err)
+	}
+	if ids := m.NodeIds(); !slices.Equal(ids, []string{"000", "001"}) {
+		t.Errorf("the nodes changed to %v", ids)
+	}
+	result := m.HandleCacheRequest("get", keys, nil).Result
+	for i, k := range keys {
+		if result[k] != values[i] {
+			t.Errorf("for the key %s expected %v, got %v", k, values[i], result[k])
+		}
+	}
+
+	fail.Store(false)
+	if _, err := m.AddNode("002", (&DataNode.SingleDataNode{}).New(ctx, "002", 1000).GetChannel()); err != nil {
+		t.Errorf("AddNode() error = %v", err)
+	}
+}
+
+func TestDateNodesManager_SnapshotCatchUp(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first node is slow to dump, the others have dumped already when the keys are written
+	var fail atomic.Bool
+	m := (&DateNodesManager{}).New(ctx, []chan<- DataNode.DNRequest{
+		flakyCommandNode(ctx, "000", "dump", &fail, 300*time.Millisecond),
+		(&DataNode.SingleDataNode{}).New(ctx, "001", 1000).GetChannel(),
+		(&DataNode.SingleDataNode{}).New(ctx, "002", 1000).GetChannel(),
+	})
+	var keys, values []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, fmt.Sprintf("value%d", i))
+	}
+	m.HandleCacheRequest("put", keys, values)
+
+	added := make(chan error)
+	go func() {
+		_, err := m.AddNode("new", (&DataNode.SingleDataNode{}).New(ctx, "new", 1000).GetChannel())
+		added <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// the writes go on during the snapshot
+	start := time.Now()
+	changed := make([]string, 50)
+	for i := range changed {
+		changed[i] = fmt.Sprintf("changed%d", i)
+	}
+	if resp := m.HandleCacheRequest("put", keys[:50], changed); resp.Status != StatusOK {
+		t.Errorf("put during the snapshot returned %v", resp)
+	}
+	if resp := m.HandleCacheRequest("del", keys[50:], nil); resp.Status != StatusOK {
+		t.Errorf("del during the snapshot returned %v", resp)
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("the writes waited %s for the snapshot", elapsed)
+	}
+	if err := <-added; err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+
+	// the records moved are the ones written last
+	result := m.HandleCacheRequest("get", keys, nil).Result
+	if len(result) != 50 {
+		t.Errorf("expected the 50 keys not deleted, got %d", len(result))
+	}
+	for i, k := range keys[:50] {
+		if result[k] != changed[i] {
+			t.Errorf("for the key %s expected %v, got %v", k, changed[i], result[k])
+		}
+	}
+}
+
+func TestDateNodesManager_HandleRequestTTL(t *testing.T) {
+
+	m := newTestManager(t, 3, 10)
+
+	resp := m.HandleRequest(CacheRequest{
+		Command: "put",
+		Keys:    []string{"key1", "key2"},
+		Values:  []any{"value1", "value2"},
+		TTL:     50 * time.Millisecond,
+	})
+	if resp.Status != "OK" {
+		t.Fatalf("HandleRequest put error, response was %v", resp)
+	}
+	m.HandleCacheRequest("put", []string{"key3"}, []string{"value3"})
+
+	result := m.HandleCacheRequest("get", []string{"key1", "key2", "key3"}, nil).Result
+	if len(result) != 3 {
+		t.Errorf("expected all keys before expiry, got %v", result)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	result = m.HandleCacheRequest("get", []string{"key1", "key2", "key3"}, nil).Result
+	if len(result) != 1 || result["key3"] != "value3" {
+		t.Errorf("expected only key3 after expiry, got %v", result)
+	}
+
+	resp = m.HandleRequest(CacheRequest{Command: "put", Keys: []string{"k"}, Values: []any{"v"}, TTL: -time.Second})
+	if resp.Status != "Error" || resp.Kind != BadRequest {
+		t.Errorf("negative ttl must be rejected, response was %v", resp)
+	}
+}
+
+func TestDateNodesManager_HandleRequestDel(t *testing.T) {
+
+	m := newTestManager(t, 3, 10)
+	m.HandleCacheRequest("put", []string{"user:1", "user:2", "user:10", "session:1", "session:2"}, []string{"a", "b", "c", "d", "e"})
+
+	// single keys, only the existing ones are reported
+	resp := m.HandleCacheRequest("del", []string{"user:1", "nokey"}, nil)
+	if resp.Status != "OK" || !slices.Equal(resp.Deleted, []string{"user:1"}) {
+		t.Errorf("del by keys response was %v", resp)
+	}
+
+	resp = m.HandleRequest(CacheRequest{Command: "del", Pattern: "user:?"})
+	if resp.Status != "OK" || !slices.Equal(resp.Deleted, []string{"user:2"}) {
+		t.Errorf("del by pattern response was %v", resp)
+	}
+	resp = m.HandleRequest(CacheRequest{Command: "del", Prefix: "user:"})
+	if resp.Status != "OK" || !slices.Equal(resp.Deleted, []string{"user:10"}) {
+		t.Errorf("del by prefix response was %v", resp)
+	}
+	if resp := m.HandleRequest(CacheRequest{Command: "del", Pattern: "[bad"}); resp.Status != "Error" || resp.Kind != BadRequest {
+		t.Errorf("a bad pattern must be rejected, response was %v", resp)
+	}
+
+	result := m.HandleCacheRequest("get", []string{"user:1", "user:2", "user:10", "session:1", "session:2"}, nil).Result
+	if len(result) != 2 || result["session:1"] != "d" {
+		t.Errorf("expected only the sessions left, got %v", result)
+	}
+
+	// no keys still clears everything
+	resp = m.HandleCacheRequest("del", nil, nil)
+	if resp.Message != "2 cache entries deleted" {
+		t.Errorf("flush response was %v", resp)
+	}
+}
+
+func TestDateNodesManager_Namespaces(t *testing.T) {
+
+	m := newTestManager(t, 3, 100)
+
+	// the same key in two namespaces and in the default one
+	for i, ns := range []string{"", "team", "other"} {
+		if resp := m.HandleRequest(CacheRequest{Command: "put", Namespace: ns, Keys: []string{"k1", "k2"}, Values: []any{i, i}}); resp.Status != "OK" || len(resp.Versions) != 2 || resp.Versions["k1"] == "" {
+			t.Errorf("put in the namespace %q response was %v", ns, resp)
+		}
+	}
+	resp := m.HandleRequest(CacheRequest{Command: "get", Namespace: "team", Keys: []string{"k1", "k2"}})
+	if len(resp.Result) != 2 || resp.Result["k1"] != 1 {
+		t.Errorf("get in the namespace response was %v", resp)
+	}
+
+	// a del of nothing deletes the namespace only
+	if resp = m.HandleRequest(CacheRequest{Command: "del", Namespace: "team"}); !slices.Equal(resp.Deleted, []string{"k1", "k2"}) {
+		t.Errorf("namespace flush response was %v", resp)
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "get", Namespace: "team", Keys: []string{"k1"}}); len(resp.Result) != 0 {
+		t.Errorf("the namespace was flushed, but got %v", resp.Result)
+	}
+	if result := m.HandleCacheRequest("get", []string{"k1"}, nil).Result; result["k1"] != 0 {
+		t.Errorf("the default namespace lost its keys: %v", result)
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "del", Namespace: "other", Prefix: "k", Pattern: "*2"}); !slices.Equal(resp.Deleted, []string{"k2"}) {
+		t.Errorf("del by pattern in the namespace response was %v", resp)
+	}
+
+	// bad namespaces and keys
+	for _, rq := range []CacheRequest{
+		{Command: "get", Namespace: "a/b", Keys: []string{"k1"}},
+		{Command: "put", Keys: []string{"team" + DataNode.NamespaceSeparator + "k1"}, Values: []any{"v"}},
+	} {
+		if resp = m.HandleRequest(rq); resp.Status != "Error" || resp.Kind != BadRequest {
+			t.Errorf("request %+v must be rejected, response was %v", rq, resp)
+		}
+	}
+
+	// a quota limits the namespace on every node, the others keep their records
+	keys := make([]string, 30)
+	values := make([]any, 30)
+	for i := range keys {
+		keys[i], values[i] = fmt.Sprintf("key%d", i), i
+	}
+	m.HandleRequest(CacheRequest{Command: "put", Namespace: "noisy", Keys: keys, Values: values})
+	if _, err := m.SetQuota("noisy", DataNode.Quota{MaxSize: 2}); err != nil {
+		t.Fatalf("SetQuota() error = %v", err)
+	}
+	m.HandleRequest(CacheRequest{Command: "put", Namespace: "noisy", Keys: keys, Values: values})
+	if result := m.HandleRequest(CacheRequest{Command: "get", Namespace: "noisy", Keys: keys}).Result; len(result) == 0 || len(result) > 6 {
+		t.Errorf("the namespace has %d keys over the quota of 2 on 3 nodes", len(result))
+	}
+	if result := m.HandleCacheRequest("get", []string{"k1", "k2"}, nil).Result; len(result) != 2 {
+		t.Errorf("the default namespace lost its keys: %v", result)
+	}
+	if _, err := m.SetQuota("noisy", DataNode.Quota{MaxSize: -1}); err == nil {
+		t.Errorf("SetQuota() must fail for a negative quota")
+	}
+	if quotas := m.Quotas(); len(quotas) != 1 || quotas["noisy"].MaxSize != 2 {
+		t.Errorf("Quotas() = %v", quotas)
+	}
+
+	// a new node gets the quotas
+	newNode := (&DataNode.SingleDataNode{}).New(context.Background(), "new", 100)
+	if _, err := m.AddNode("new", newNode.GetChannel()); err != nil {
+		t.Fatalf("AddNode() error = %v", err)
+	}
+	backCh := make(chan DataNode.DNResponse, 1)
+	newNode.GetChannel() <- DataNode.DNRequest{Command: "get", Namespace: "noisy", BackCh: backCh}
+	if resp := <-backCh; resp.Quota.MaxSize != 2 || resp.Count > 2 {
+		t.Errorf("the new node has the namespace usage %+v", resp)
+	}
+}
@@ -0,0 +1,170 @@
+package CacheManager
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// the request with the keys, the prefix and the pattern of its namespace the nodes keep.
+// A "del" without keys, prefix or pattern deletes the whole namespace rather than the cache, a "scan" lists it.
+// A "range" without an end stops at the end of the namespace
+func toNamespace(rq CacheRequest) CacheRequest {
+	ns := rq.Namespace
+	keys := make([]string, len(rq.Keys))
+	for i, k := range rq.Keys {
+		keys[i] = DataNode.NamespaceKey(ns, k)
+	}
+	rq.Keys = keys
+	if (rq.Command == "del" && len(keys) == 0) || rq.Command == "scan" {
+		rq.Prefix = DataNode.NamespaceKey(ns, rq.Prefix)
+		if rq.Pattern != "" {
+			rq.Pattern = DataNode.NamespaceKey(ns, rq.Pattern)
+		}
+	}
+	if rq.Command == "range" {
+		rq.From = DataNode.NamespaceKey(ns, rq.From)
+		if rq.To != "" {
+			rq.To = DataNode.NamespaceKey(ns, rq.To)
+		} else {
+			rq.To = ns + "\x20" // the byte after the separator
+		}
+	}
+	return rq
+}
+
+// the response with the keys of the namespace instead of the keys the nodes keep
+func fromNamespace(ns string, resp Response) Response {
+	strip := func(k string) string {
+		_, key := DataNode.SplitNamespace(k)
+		return key
+	}
+	stripMap := func(m map[string]any) map[string]any {
+		if m == nil {
+			return nil
+		}
+		res := make(map[string]any, len(m))
+		for k, v := range m {
+			res[strip(k)] = v
+		}
+		return res
+	}
+	stripSlice := func(s []string) []string {
+		if s == nil {
+			return nil
+		}
+		res := make([]string, len(s))
+		for i, k := range s {
+			res[i] = strip(k)
+		}
+		return res
+	}
+
+	resp.Result, resp.Previous = stripMap(resp.Result), stripMap(resp.Previous)
+	resp.Deleted, resp.Stored, resp.Skipped = stripSlice(resp.Deleted), stripSlice(resp.Stored), stripSlice(resp.Skipped)
+	resp.Keys = stripSlice(resp.Keys)
+	if resp.Next != "" {
+		resp.Next = strip(resp.Next)
+	}
+	if resp.Meta != nil {
+		meta := make(map[string]DataNode.EntryMeta, len(resp.Meta))
+		for k, v := range resp.Meta {
+			meta[strip(k)] = v
+		}
+		resp.Meta = meta
+	}
+	if resp.Owners != nil {
+		owners := make(map[string][]string, len(resp.Owners))
+		for k, v := range resp.Owners {
+			owners[strip(k)] = v
+		}
+		resp.Owners = owners
+	}
+	if resp.Info != nil {
+		info := make(map[string][]DataNode.EntryInfo, len(resp.Info))
+		for k, v := range resp.Info {
+			info[strip(k)] = v
+		}
+		resp.Info = info
+	}
+	if resp.Versions != nil {
+		versions := make(map[string]string, len(resp.Versions))
+		for k, v := range resp.Versions {
+			versions[strip(k)] = v
+		}
+		resp.Versions = versions
+	}
+	resp.Message = strings.ReplaceAll(resp.Message, DataNode.NamespaceKey(ns, ""), "") // the errors of the nodes name the keys
+	return resp
+}
+
+// SetQuota sets the quota of a namespace on every node, the nodes added later get it too.
+// A namespace over its quota evicts its own records, so it can't push the other namespaces out
+// --> Input:
+// ns        string            namespace
+// quota     DataNode.Quota    records and bytes the namespace can take on every node, zero values are not limited
+// <-- Output:
+// 1) int       number of records evicted to fit the new quota
+// 2) error     if the namespace is bad or a node did not answer
+func (m *DateNodesManager) SetQuota(ns string, quota DataNode.Quota) (int, error) {
+	if err := DataNode.CheckNamespace(ns); err != nil {
+		return 0, err
+	}
+	if quota.MaxSize < 0 || quota.MaxBytes < 0 {
+		return 0, fmt.Errorf("bad quota %+v, the limits can't be negative", quota)
+	}
+
+	// membership changes wait, so a node added meanwhile gets the quota
+	m.Lock()
+	defer m.Unlock()
+
+	if quota == (DataNode.Quota{}) {
+		delete(m.quotas, ns)
+	} else {
+		m.quotas[ns] = quota
+	}
+	requests := make(map[string]DataNode.DNRequest, len(m.nodeCh))
+	for id := range m.nodeCh {
+		requests[id] = DataNode.DNRequest{Command: "quota", Namespace: ns, Quota: quota}
+	}
+	evicted := 0
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		evicted += r.resp.Count
+	}
+	if len(errMessages) > 0 {
+		sort.Strings(errMessages)
+		return evicted, fmt.Errorf("quota not set: %v", errMessages)
+	}
+	log.Printf("[CMg] namespace %s quota %+v, %d records evicted", ns, quota, evicted)
+	return evicted, nil
+}
+
+// Quotas returns the quotas of the namespaces
+func (m *DateNodesManager) Quotas() map[string]DataNode.Quota {
+	m.RLock()
+	defer m.RUnlock()
+	res := make(map[string]DataNode.Quota, len(m.quotas))
+	for ns, q := range m.quotas {
+		res[ns] = q
+	}
+	return res
+}
+
+// sends the quotas to a new node
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) sendQuotas(id string) error {
+	for ns, quota := range m.quotas {
+		if _, err := m.callNode(m.nodeCh[id], DataNode.DNRequest{Command: "quota", Namespace: ns, Quota: quota}); err != nil {
+			return fmt.Errorf("node %s did not take the quota of %s: %w", id, ns, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package CacheManager
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points every node gets on the hash ring by default
+const DefaultVirtualNodes = 160
+
+// Partitioner decides which node owns a key. Nodes are identified by their ids.
+// Implementations must be safe for concurrent use.
+type Partitioner interface {
+	AddNode(node string)               // adds a node, no-op if it's there already
+	RemoveNode(node string)            // removes a node, no-op if it's not there
+	NodeFor(key string) string         // node owning the key, empty string if there are no nodes
+	Owners(key string, n int) []string // up to n distinct nodes keeping the key replicas, the owner first
+	Nodes() []string                   // ids of all nodes, sorted
+}
+
+// hashString is a deterministic seeded 64 bit hash: FNV-1a followed by a splitmix64 finalizer.
+// FNV alone spreads short similar strings ("node#1", "node#2") poorly, the finalizer fixes that.
+func hashString(seed uint64, s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64() ^ seed
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ModuloPartitioner is the classic hash(key) % number of nodes placement.
+// Cheap, but changing the number of nodes moves almost every key.
+type ModuloPartitioner struct {
+	sync.RWMutex
+	seed  uint64   // hash seed
+	nodes []string // sorted node ids
+}
+
+// New constructs a modulo partitioner
+// --> Input:
+// seed     uint64     hash seed, the same seed gives the same placement across restarts
+// <-- Output:
+// 1) *ModuloPartitioner     partitioner without nodes
+func (p *ModuloPartitioner) New(seed uint64) *ModuloPartitioner {
+	p.seed = seed
+	p.nodes = nil
+	return p
+}
+
+// AddNode adds a node
+func (p *ModuloPartitioner) AddNode(node string) {
+	p.Lock()
+	defer p.Unlock()
+	if ndx, found := slices.BinarySearch(p.nodes, node); !found {
+		p.nodes = slices.Insert(p.nodes, ndx, node)
+	}
+}
+
+// RemoveNode removes a node
+func (p *ModuloPartitioner) RemoveNode(node string) {
+	p.Lock()
+	defer p.Unlock()
+	if ndx, found := slices.BinarySearch(p.nodes, node); found {
+		p.nodes = slices.Delete(p.nodes, ndx, ndx+1)
+	}
+}
+
+// NodeFor returns the node owning the key
+func (p *ModuloPartitioner) NodeFor(key string) string {
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.nodes) == 0 {
+		return ""
+	}
+	return p.nodes[hashString(p.seed, key)%uint64(len(p.nodes))]
+}
+
+// Owners returns the owner of the key and the nodes following it
+func (p *ModuloPartitioner) Owners(key string, n int) []string {
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.nodes) == 0 {
+		return nil
+	}
+	first := int(hashString(p.seed, key) % uint64(len(p.nodes)))
+	owners := make([]string, 0, min(n, len(p.nodes)))
+	for i := 0; i < min(n, len(p.nodes)); i++ {
+		owners = append(owners, p.nodes[(first+i)%len(p.nodes)])
+	}
+	return owners
+}
+
+// Nodes returns sorted node ids
+func (p *ModuloPartitioner) Nodes() []string {
+	p.RLock()
+	defer p.RUnlock()
+	return slices.Clone(p.nodes)
+}
+
+// a point on the ring
+type ringPoint struct {
+	hash uint64 // position on the ring
+	node string // node owning the arc ending at this point
+}
+
+// HashRing is a consistent hash ring with virtual nodes.
+// Every node is placed on the ring many times, a key belongs to the first point clockwise from its hash.
+// Adding or removing a node moves only about 1/N of the keys.
+type HashRing struct {
+	sync.RWMutex
+	seed         uint64      // hash seed
+	virtualNodes int         // points per node
+	points       []ringPoint // sorted by hash
+	nodes        []string    // sorted node ids
+}
+
+// New constructs a hash ring
+// --> Input:
+// virtualNodes     int        number of points per node, DefaultVirtualNodes if not positive
+// seed             uint64     hash seed, the same seed gives the same placement across restarts
+// <-- Output:
+// 1) *HashRing     ring without nodes
+func (r *HashRing) New(virtualNodes int, seed uint64) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	r.seed = seed
+	r.virtualNodes = virtualNodes
+	r.points = nil
+	r.nodes = nil
+	return r
+}
+
+// AddNode places a node on the ring
+func (r *HashRing) AddNode(node string) {
+	r.Lock()
+	defer r.Unlock()
+
+	ndx, found := slices.BinarySearch(r.nodes, node)
+	if found {
+		return
+	}
+	r.nodes = slices.Insert(r.nodes, ndx, node)
+	for i := 0; i < r.virtualNodes; i++ {
+		r.points = append(r.points, ringPoint{
+			hash: hashString(r.seed, fmt.Sprintf("%s#%d", node, i)),
+			node: node,
+		})
+	}
+	// ties are broken by node id so the ring does not depend on the order nodes were added in
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+}
+
+// RemoveNode takes a node off the ring
+func (r *HashRing) RemoveNode(node string) {
+	r.Lock()
+	defer r.Unlock()
+
+	ndx, found := slices.BinarySearch(r.nodes, node)
+	if !found {
+		return
+	}
+	r.nodes = slices.Delete(r.nodes, ndx, ndx+1)
+	r.points = slices.DeleteFunc(r.points, func(p ringPoint) bool { return p.node == node })
+}
+
+// NodeFor returns the node owning the key
+func (r *HashRing) NodeFor(key string) string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashString(r.seed, key)
+	ndx := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if ndx == len(r.points) {
+		ndx = 0 // wrap around
+	}
+	return r.points[ndx].node
+}
+
+// Owners walks the ring clockwise from the key and returns the first n distinct nodes
+func (r *HashRing) Owners(key string, n int) []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.points) == 0 {
+		return nil
+	}
+	n = min(n, len(r.nodes))
+	owners := make([]string, 0, n)
+	h := hashString(r.seed, key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !slices.Contains(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// Nodes returns sorted node ids
+func (r *HashRing) Nodes() []string {
+	r.RLock()
+	defer r.RUnlock()
+	return slices.Clone(r.nodes)
+}
+
+// KeyRange is a range of keys kept by a node: the keys from From, inclusive, to To, exclusive, "" for no end
+type KeyRange struct {
+	From string
+	To   string
+	Node string // the owner of the range
+}
+
+// Ranger is a partitioner placing the keys by ranges, so the keys of a range query are on the owners of the ranges it
+// covers only, already in order
+type Ranger interface {
+	Partitioner
+	Ranges(from string, to string) []KeyRange // the ranges covering the keys from from to to, "" for no end, in order
+}
+
+// RangePartitioner splits the keys at the given boundaries, the ranges go to the nodes in turn.
+// A key does not move as long as the number of nodes is the same, but adding or removing a node moves most of them.
+// The keys of a namespace are kept together, in the ranges around the namespace name.
+type RangePartitioner struct {
+	sync.RWMutex
+	splits []string // sorted boundaries, range i is from splits[i-1] to splits[i]
+	nodes  []string // sorted node ids
+}
+
+// New constructs a range partitioner
+// --> Input:
+// splits     []string     boundaries of the ranges, n boundaries make n+1 ranges, the order and duplicates do not matter
+// <-- Output:
+// 1) *RangePartitioner     partitioner without nodes
+func (p *RangePartitioner) New(splits []string) *RangePartitioner {
+	p.splits = slices.DeleteFunc(slices.Clone(splits), func(s string) bool { return s == "" }) // "" is before every key
+	slices.Sort(p.splits)
+	p.splits = slices.Compact(p.splits)
+	p.nodes = nil
+	return p
+}
+
+// the index of the range keeping the key
+// warning: not protected by the mutex, the caller holds it
+func (p *RangePartitioner) rangeOf(key string) int {
+	return sort.Search(len(p.splits), func(i int) bool { return p.splits[i] > key })
+}
+
+// AddNode adds a node
+func (p *RangePartitioner) AddNode(node string) {
+	p.Lock()
+	defer p.Unlock()
+	if ndx, found := slices.BinarySearch(p.nodes, node); !found {
+		p.nodes = slices.Insert(p.nodes, ndx, node)
+	}
+}
+
+// RemoveNode removes a node
+func (p *RangePartitioner) RemoveNode(node string) {
+	p.Lock()
+	defer p.Unlock()
+	if ndx, found := slices.BinarySearch(p.nodes, node); found {
+		p.nodes = slices.Delete(p.nodes, ndx, ndx+1)
+	}
+}
+
+// NodeFor returns the node owning the range of the key
+func (p *RangePartitioner) NodeFor(key string) string {
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.nodes) == 0 {
+		return ""
+	}
+	return p.nodes[p.rangeOf(key)%len(p.nodes)]
+}
+
+// Owners returns the owner of the range of the key and the nodes following it
+func (p *RangePartitioner) Owners(key string, n int) []string {
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.nodes) == 0 {
+		return nil
+	}
+	first := p.rangeOf(key)
+	owners := make([]string, 0, min(n, len(p.nodes)))
+	for i := 0; i < min(n, len(p.nodes)); i++ {
+		owners = append(owners, p.nodes[(first+i)%len(p.nodes)])
+	}
+	return owners
+}
+
+// Nodes returns sorted node ids
+func (p *RangePartitioner) Nodes() []string {
+	p.RLock()
+	defer p.RUnlock()
+	return slices.Clone(p.nodes)
+}
+
+// Ranges returns the parts of the ranges between from and to with their owners, in order
+func (p *RangePartitioner) Ranges(from string, to string) []KeyRange {
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.nodes) == 0 || (to != "" && to <= from) {
+		return nil
+	}
+	var ranges []KeyRange
+	for r := p.rangeOf(from); r <= len(p.splits); r++ {
+		kr := KeyRange{From: from, To: to, Node: p.nodes[r%len(p.nodes)]}
+		if r > 0 {
+			kr.From = max(from, p.splits[r-1])
+		}
+		if r < len(p.splits) && (to == "" || p.splits[r] < to) {
+			kr.To = p.splits[r]
+		}
+		ranges = append(ranges, kr)
+		if kr.To == to {
+			break
+		}
+	}
+	return ranges
+}
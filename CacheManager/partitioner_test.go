@@ -0,0 +1,185 @@
+package CacheManager
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// places the keys and returns key -> node
+func placeKeys(p Partitioner, keys []string) map[string]string {
+	placement := make(map[string]string, len(keys))
+	for _, k := range keys {
+		placement[k] = p.NodeFor(k)
+	}
+	return placement
+}
+
+// share of the keys which changed their node
+func movedShare(before, after map[string]string) float64 {
+	moved := 0
+	for k, n := range before {
+		if after[k] != n {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(before))
+}
+
+func testKeys(count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	return keys
+}
+
+func addNodes(p Partitioner, count int) {
+	for i := 0; i < count; i++ {
+		p.AddNode(fmt.Sprintf("%03d", i))
+	}
+}
+
+func TestHashRing_KeyMovementOnAdd(t *testing.T) {
+
+	keys := testKeys(20000)
+	ring := (&HashRing{}).New(DefaultVirtualNodes, 42)
+	addNodes(ring, 10)
+
+	before := placeKeys(ring, keys)
+	ring.AddNode("010")
+	after := placeKeys(ring, keys)
+
+	// ideally 1/11 of the keys move, and only to the new node
+	share := movedShare(before, after)
+	t.Logf("hash ring: %.2f%% of the keys moved after adding 11th node", share*100)
+	if share > 2.0/11 {
+		t.Errorf("too many keys moved: %.2f%%", share*100)
+	}
+	for k, n := range after {
+		if n != before[k] && n != "010" {
+			t.Fatalf("key %s moved from %s to %s, not to the new node", k, before[k], n)
+		}
+	}
+
+	// compare with the modulo placement
+	modulo := (&ModuloPartitioner{}).New(42)
+	addNodes(modulo, 10)
+	before = placeKeys(modulo, keys)
+	modulo.AddNode("010")
+	moduloShare := movedShare(before, placeKeys(modulo, keys))
+	t.Logf("modulo: %.2f%% of the keys moved after adding 11th node", moduloShare*100)
+	if moduloShare < 0.8 {
+		t.Errorf("expected modulo placement to move most of the keys, moved %.2f%%", moduloShare*100)
+	}
+}
+
+func TestHashRing_KeyMovementOnRemove(t *testing.T) {
+
+	keys := testKeys(20000)
+	ring := (&HashRing{}).New(DefaultVirtualNodes, 42)
+	addNodes(ring, 10)
+
+	before := placeKeys(ring, keys)
+	ring.RemoveNode("003")
+	after := placeKeys(ring, keys)
+
+	// only the keys of the removed node move
+	for k, n := range before {
+		if n != "003" && after[k] != n {
+			t.Fatalf("key %s moved from %s to %s though its node is still there", k, n, after[k])
+		}
+		if after[k] == "003" {
+			t.Fatalf("key %s is still on the removed node", k)
+		}
+	}
+	share := movedShare(before, after)
+	t.Logf("hash ring: %.2f%% of the keys moved after removing 1 of 10 nodes", share*100)
+	if share > 2.0/10 {
+		t.Errorf("too many keys moved: %.2f%%", share*100)
+	}
+}
+
+func TestHashRing_Balance(t *testing.T) {
+
+	keys := testKeys(50000)
+	ring := (&HashRing{}).New(DefaultVirtualNodes, 42)
+	addNodes(ring, 8)
+
+	counts := make(map[string]int)
+	for _, n := range placeKeys(ring, keys) {
+		counts[n]++
+	}
+	mean := float64(len(keys)) / 8
+	for n, c := range counts {
+		if float64(c) < mean*0.7 || float64(c) > mean*1.3 {
+			t.Errorf("node %s got %d keys, mean is %.0f", n, c, mean)
+		}
+	}
+}
+
+func TestHashRing_Deterministic(t *testing.T) {
+
+	keys := testKeys(1000)
+
+	// same seed, nodes added in a different order: same placement
+	r1 := (&HashRing{}).New(50, 7)
+	r2 := (&HashRing{}).New(50, 7)
+	for _, n := range []string{"a", "b", "c"} {
+		r1.AddNode(n)
+	}
+	for _, n := range []string{"c", "a", "b"} {
+		r2.AddNode(n)
+	}
+	p1, p2 := placeKeys(r1, keys), placeKeys(r2, keys)
+	for k := range p1 {
+		if p1[k] != p2[k] {
+			t.Fatalf("key %s placed on %s and %s", k, p1[k], p2[k])
+		}
+	}
+
+	if (&HashRing{}).New(50, 7).NodeFor("key") != "" {
+		t.Errorf("empty ring must not return a node")
+	}
+}
+
+func TestRangePartitioner(t *testing.T) {
+
+	p := (&RangePartitioner{}).New([]string{"t", "g", "n", "g", ""})
+	if p.NodeFor("key") != "" || p.Ranges("", "") != nil {
+		t.Errorf("partitioner without nodes must not return a node")
+	}
+	for _, n := range []string{"c", "a", "b"} {
+		p.AddNode(n)
+	}
+
+	// the ranges go to the nodes in turn
+	for key, node := range map[string]string{"": "a", "apple": "a", "g": "b", "m": "b", "n": "c", "t": "a", "zebra": "a"} {
+		if got := p.NodeFor(key); got != node {
+			t.Errorf("NodeFor(%q) = %s, expected %s", key, got, node)
+		}
+	}
+	if owners := p.Owners("h", 2); !slices.Equal(owners, []string{"b", "c"}) {
+		t.Errorf("Owners() = %v", owners)
+	}
+	if owners := p.Owners("zz", 5); !slices.Equal(owners, []string{"a", "b", "c"}) {
+		t.Errorf("Owners() = %v", owners)
+	}
+
+	for _, tt := range []struct {
+		from, to string
+		expected []KeyRange
+	}{
+		{"h", "p", []KeyRange{{"h", "n", "b"}, {"n", "p", "c"}}},
+		{"", "", []KeyRange{{"", "g", "a"}, {"g", "n", "b"}, {"n", "t", "c"}, {"t", "", "a"}}},
+		{"n", "t", []KeyRange{{"n", "t", "c"}}},
+		{"a", "g", []KeyRange{{"a", "g", "a"}}},
+		{"u", "", []KeyRange{{"u", "", "a"}}},
+		{"t", "t", nil},
+		{"p", "h", nil},
+	} {
+		if got := p.Ranges(tt.from, tt.to); !slices.Equal(got, tt.expected) {
+			t.Errorf("Ranges(%q, %q) = %v, expected %v", tt.from, tt.to, got, tt.expected)
+		}
+	}
+}
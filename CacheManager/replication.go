@@ -0,0 +1,1163 @@
+package CacheManager
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// a response of one node to a request sent by fanOut
+type nodeReply struct {
+	id   string              // node id
+	keys []string            // keys of the request
+	resp DataNode.DNResponse // node response, valid if err is nil
+	err  error               // node did not answer
+}
+
+// gives a new version for a write: nanoseconds of the current time, always growing
+func (m *DateNodesManager) nextVersion() uint64 {
+	now := uint64(time.Now().UnixNano())
+	for {
+		last := m.lastVersion.Load()
+		v := max(now, last+1)
+		if m.lastVersion.CompareAndSwap(last, v) {
+			return v
+		}
+	}
+}
+
+// sends the requests to their nodes in parallel, the replies come in the order they arrive.
+// The channel is closed when all the nodes answered or timed out, the caller may stop reading earlier
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) fanOut(requests map[string]DataNode.DNRequest) <-chan nodeReply {
+	return m.fanOutTo(m.nodeCh, requests)
+}
+
+// fanOut over the given node channels, it needs no mutex
+func (m *DateNodesManager) fanOutTo(nodeCh map[string]chan<- DataNode.DNRequest, requests map[string]DataNode.DNRequest) <-chan nodeReply {
+	replies := make(chan nodeReply, len(requests))
+	var wg sync.WaitGroup
+	for id, rq := range requests {
+		wg.Add(1)
+		go func(id string, nodeCh chan<- DataNode.DNRequest, rq DataNode.DNRequest) {
+			defer wg.Done()
+			resp, err := m.callNode(nodeCh, rq)
+			replies <- nodeReply{id: id, keys: rq.Keys, resp: resp, err: err}
+		}(id, nodeCh[id], rq)
+	}
+	go func() {
+		wg.Wait()
+		close(replies)
+	}()
+	return replies
+}
+
+// a copy of a record seen on a replica, or its tombstone if meta.Deleted is set
+type replicaValue struct {
+	value any
+	meta  DataNode.EntryMeta
+}
+
+// adds the latest copy of a key to the requests bringing a replica up to date:
+// a put of the record, or a delete with the version of the tombstone
+func addLatest(puts map[string]DataNode.DNRequest, dels map[string]DataNode.DNRequest, id string, k string, rv replicaValue) {
+	requests, command := puts, "put"
+	if rv.meta.Deleted {
+		requests, command = dels, "del"
+	}
+	rq := requests[id]
+	rq.Command = command
+	rq.Keys = append(rq.Keys, k)
+	if !rv.meta.Deleted {
+		rq.Values = append(rq.Values, rv.value)
+	}
+	rq.Meta = append(rq.Meta, rv.meta)
+	requests[id] = rq
+}
+
+// reads the keys from all their owners and returns the latest copies once every key got ReadQuorum answers.
+// A key whose latest copy is a tombstone is absent.
+// Replicas which answered with an older version or without the record are repaired in the background,
+// the ones having an older copy of a deleted key get the delete. The nodes ignore a repair older than their copy,
+// so a repair arriving after a delete does not bring the record back
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumGet(keys []string) (map[string]replicaValue, error) {
+
+	latest, seen, err := m.quorumRead(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	// read repair: the replicas which answered with an old copy get the latest one
+	puts := make(map[string]DataNode.DNRequest)
+	dels := make(map[string]DataNode.DNRequest)
+	for k, best := range latest {
+		for id, v := range seen[k] {
+			if v < best.meta.Version && (v > 0 || !best.meta.Deleted) {
+				addLatest(puts, dels, id, k, best)
+			}
+		}
+		if best.meta.Deleted {
+			delete(latest, k)
+		}
+	}
+	if len(puts)+len(dels) > 0 {
+		nodeChs := make(map[string]chan<- DataNode.DNRequest)
+		for _, requests := range []map[string]DataNode.DNRequest{puts, dels} {
+			for id := range requests {
+				nodeChs[id] = m.nodeCh[id]
+			}
+		}
+		go func() {
+			for _, requests := range []map[string]DataNode.DNRequest{dels, puts} {
+				for id, rq := range requests {
+					if resp, err := m.callNode(nodeChs[id], rq); err != nil || resp.Status != "OK" {
+						log.Printf("[CMg] read repair of %d records on node %s failed: %v %s", len(rq.Keys), id, err, resp.Message)
+					}
+				}
+			}
+		}()
+	}
+
+	return latest, nil
+}
+
+// reads the keys from all their owners until every key got ReadQuorum answers.
+// Returns the latest copies, tombstones included, and the versions the nodes which answered have, zero for none
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumRead(keys []string) (latest map[string]replicaValue, seen map[string]map[string]uint64, err error) {
+
+	requests := make(map[string]DataNode.DNRequest)
+	answers := make(map[string]int) // key -> replicas answered
+	for _, k := range keys {
+		if _, ok := answers[k]; ok {
+			continue
+		}
+		answers[k] = 0
+		for _, id := range m.partitioner.Owners(k, m.replicas) {
+			rq := requests[id]
+			rq.Command = "get"
+			rq.Keys = append(rq.Keys, k)
+			rq.Deleted = true
+			requests[id] = rq
+		}
+	}
+
+	latest = make(map[string]replicaValue)    // key -> the latest copy
+	seen = make(map[string]map[string]uint64) // key -> node id -> version the node has, zero if none
+	waiting := len(answers)                   // keys without a quorum yet
+	var errMessages []string
+
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		found := make(map[string]replicaValue, len(r.resp.Keys))
+		for i, k := range r.resp.Keys {
+			found[k] = replicaValue{value: r.resp.Values[i], meta: r.resp.Meta[i]}
+		}
+		for _, k := range r.keys {
+			if seen[k] == nil {
+				seen[k] = make(map[string]uint64)
+			}
+			if rv, ok := found[k]; ok {
+				seen[k][r.id] = rv.meta.Version
+				if best, ok := latest[k]; !ok || rv.meta.Version > best.meta.Version {
+					latest[k] = rv
+				}
+			} else {
+				seen[k][r.id] = 0
+			}
+			answers[k]++
+			if answers[k] == m.readQuorum {
+				waiting--
+			}
+		}
+		if waiting == 0 {
+			break
+		}
+	}
+
+	if waiting > 0 {
+		sort.Strings(errMessages)
+		return nil, nil, fmt.Errorf("read quorum %d not reached for %d keys: %v", m.readQuorum, waiting, errMessages)
+	}
+	return latest, seen, nil
+}
+
+// writes the records to all their owners with the version of meta and waits until every key got WriteQuorum acks.
+// The command is "put", or "getset" which every replica answers with its previous copy.
+// The flags, the content type and the tags of meta are stored with every record.
+// Returns the node messages and for "getset" the latest previous copies the replicas which acked had
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumPut(command string, keys []string, values []any, ttl time.Duration, meta DataNode.EntryMeta) (results []string, previous map[string]replicaValue, err error) {
+
+	if ttl > 0 {
+		meta.ExpiresAt = time.Now().Add(ttl)
+	}
+
+	// all the records have the same version, so a key repeated in the request keeps its last value only
+	last := make(map[string]int, len(keys))
+	for i, k := range keys {
+		last[k] = i
+	}
+	requests := make(map[string]DataNode.DNRequest)
+	for i, k := range keys {
+		if last[k] != i {
+			continue
+		}
+		for _, id := range m.partitioner.Owners(k, m.replicas) {
+			rq := requests[id]
+			rq.Command = command
+			rq.Keys = append(rq.Keys, k)
+			rq.Values = append(rq.Values, values[i])
+			rq.Meta = append(rq.Meta, meta)
+			requests[id] = rq
+		}
+	}
+
+	acks := make(map[string]int, len(last)) // key -> replicas confirmed
+	waiting := len(last)                    // keys without a quorum yet
+	var errMessages []string
+	if command == "getset" {
+		previous = make(map[string]replicaValue)
+	}
+
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		results = append(results, fmt.Sprintf("node %s:  %s", r.id, r.resp.Message))
+		if command == "getset" {
+			for i, k := range r.resp.Keys {
+				if prev, ok := previous[k]; !ok || r.resp.Meta[i].Version > prev.meta.Version {
+					previous[k] = replicaValue{value: r.resp.Values[i], meta: r.resp.Meta[i]}
+				}
+			}
+		}
+		for _, k := range r.keys {
+			acks[k]++
+			if acks[k] == m.writeQuorum {
+				waiting--
+			}
+		}
+		if waiting == 0 {
+			break
+		}
+	}
+	sort.Strings(results)
+
+	if waiting > 0 {
+		sort.Strings(errMessages)
+		return results, nil, fmt.Errorf("write quorum %d not reached for %d keys: %v", m.writeQuorum, waiting, errMessages)
+	}
+	if len(errMessages) > 0 {
+		log.Printf("[CMg] write quorum reached despite errors: %v", errMessages)
+	}
+	return results, previous, nil
+}
+
+// adds the deltas to the keys on their first owners, which serialize the increments of a key, then writes
+// the new values to the other owners with the versions the first owners gave them.
+// Returns the new records and the errors of the keys which could not be incremented, e.g. not numbers
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumIncr(keys []string, deltas []any, ttl time.Duration) (latest map[string]replicaValue, keyErrors []string, err error) {
+	latest, _, keyErrors, err = m.firstOwnerWrite("incr", keys, deltas, DataNode.StructOp{}, ttl)
+	return latest, keyErrors, err
+}
+
+// applies the operation to the typed values of the keys on their first owners, which serialize the operations
+// on a key, then sends the operation to the other owners, see replicateOps.
+// Returns the metadata of the new records, the results of the operation and the errors of the keys, e.g. holding another type
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumOp(keys []string, op DataNode.StructOp, ttl time.Duration) (latest map[string]replicaValue, results map[string]any, keyErrors []string, err error) {
+	return m.firstOwnerWrite("op", keys, nil, op, ttl)
+}
+
+// the error of a write needing the first owners of the keys when some of them failed or are unavailable.
+// The next owners don't take the write over: a first owner which is slow rather than down would apply it too,
+// and the two would order the writes of a key differently
+func firstOwnerError(command string, errMessages []string) error {
+	sort.Strings(errMessages)
+	return fmt.Errorf("%s failed on the first owners of the keys, the other owners don't stand in for them: %v", command, errMessages)
+}
+
+// brings the first owners of the keys up to the latest copies or deletes a read quorum has, before a write the first owners
+// check against their own copies. A put is acked by WriteQuorum owners which may miss the first one, a read quorum
+// sees it as ReadQuorum + WriteQuorum > Replicas.
+// A put arriving during the write may still be lost: it is older than the write and the first owner drops it
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) syncFirstOwners(command string, keys []string) error {
+
+	latest, seen, err := m.quorumRead(keys)
+	if err != nil {
+		return err
+	}
+	puts := make(map[string]DataNode.DNRequest)
+	dels := make(map[string]DataNode.DNRequest)
+	for k, best := range latest {
+		id := m.partitioner.Owners(k, m.replicas)[0]
+		if v, ok := seen[k][id]; ok && v >= best.meta.Version {
+			continue
+		}
+		addLatest(puts, dels, id, k, best)
+	}
+	var errMessages []string
+	for _, requests := range []map[string]DataNode.DNRequest{dels, puts} {
+		for r := range m.fanOut(requests) {
+			if r.err == nil && r.resp.Status != "OK" {
+				r.err = fmt.Errorf("%s", r.resp.Message)
+			}
+			if r.err != nil {
+				errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			}
+		}
+	}
+	if len(errMessages) > 0 {
+		return firstOwnerError(command, errMessages)
+	}
+	return nil
+}
+
+// sends an "incr" or an "op" to the first owners of the keys, then replicates the records they have written:
+// the new values of the increments, the operation itself for an "op", see replicateOps.
+// A key repeated in the request is changed in turn, the last result is returned. The records of an "op" come without values.
+// The first owners start from the latest copies, see syncFirstOwners.
+// Nothing is written if a first owner is unavailable, see firstOwnerError
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) firstOwnerWrite(command string, keys []string, values []any, op DataNode.StructOp, ttl time.Duration) (latest map[string]replicaValue, results map[string]any, keyErrors []string, err error) {
+
+	if err = m.syncFirstOwners(command, keys); err != nil {
+		return nil, nil, nil, err
+	}
+
+	meta := DataNode.EntryMeta{Version: m.nextVersion()}
+	if ttl > 0 {
+		meta.ExpiresAt = time.Now().Add(ttl)
+	}
+	requests := make(map[string]DataNode.DNRequest)
+	for i, k := range keys {
+		id := m.partitioner.Owners(k, m.replicas)[0]
+		rq := requests[id]
+		rq.Command = command
+		rq.Keys = append(rq.Keys, k)
+		if values != nil {
+			rq.Values = append(rq.Values, values[i])
+		}
+		if command == "op" {
+			rq.Ops = append(rq.Ops, op)
+		}
+		rq.Meta = append(rq.Meta, meta)
+		requests[id] = rq
+	}
+
+	latest = make(map[string]replicaValue)
+	results = make(map[string]any)
+	var applied []appliedOp
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		if r.resp.Status != "OK" {
+			keyErrors = append(keyErrors, r.resp.Message)
+		}
+		for i, k := range r.resp.Keys { // a repeated key comes back in the order of the changes
+			if r.resp.Results != nil {
+				results[k] = r.resp.Results[i]
+			}
+			if r.resp.Meta[i].Version == 0 { // nothing written
+				delete(latest, k)
+				continue
+			}
+			if command == "op" {
+				latest[k] = replicaValue{meta: r.resp.Meta[i]}
+				applied = append(applied, appliedOp{key: k, base: r.resp.Versions[i], meta: r.resp.Meta[i]})
+				continue
+			}
+			latest[k] = replicaValue{value: r.resp.Values[i], meta: r.resp.Meta[i]}
+		}
+	}
+	sort.Strings(keyErrors)
+	if len(errMessages) > 0 {
+		return nil, nil, nil, firstOwnerError(command, errMessages)
+	}
+	if command == "op" {
+		err = m.replicateOps(op, applied)
+	} else {
+		err = m.replicate(latest)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return latest, results, keyErrors, nil
+}
+
+// stores the records on their first owners if the records there have the versions given, zero for the absent ones,
+// then writes the records stored to the other owners. The first owners serialize the writes of a key,
+// so of the concurrent writes expecting the same version one wins. They check the latest copies, see syncFirstOwners.
+// A key repeated in the request keeps its last value and version only.
+// Returns the records stored with their new version
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumCas(keys []string, values []any, versions []uint64, ttl time.Duration, meta DataNode.EntryMeta) (map[string]replicaValue, error) {
+
+	if err := m.syncFirstOwners("compare-and-swap", keys); err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		meta.ExpiresAt = time.Now().Add(ttl)
+	}
+	last := make(map[string]int, len(keys))
+	for i, k := range keys {
+		last[k] = i
+	}
+	requests := make(map[string]DataNode.DNRequest)
+	for i, k := range keys {
+		if last[k] != i {
+			continue
+		}
+		id := m.partitioner.Owners(k, m.replicas)[0]
+		rq := requests[id]
+		rq.Command = "cas"
+		rq.Keys = append(rq.Keys, k)
+		rq.Values = append(rq.Values, values[i])
+		rq.Versions = append(rq.Versions, versions[i])
+		rq.Meta = append(rq.Meta, meta)
+		requests[id] = rq
+	}
+
+	stored := make(map[string]replicaValue)
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		for _, k := range r.resp.Keys {
+			stored[k] = replicaValue{value: values[last[k]], meta: meta}
+		}
+	}
+	if len(errMessages) > 0 {
+		return nil, firstOwnerError("compare-and-swap", errMessages)
+	}
+	if err := m.replicate(stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// stores the records on their first owners, "add" the absent ones only and "replace" the existing ones,
+// then writes the records stored to the other owners. The first owners decide, so the replicas which missed
+// a write or a delete do not store a part of the keys on their own. They decide on the latest copies,
+// see syncFirstOwners.
+// A key repeated in the request keeps its last value only.
+// Returns the node messages and the keys stored, sorted
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumConditional(command string, keys []string, values []any, ttl time.Duration, meta DataNode.EntryMeta) ([]string, []string, error) {
+
+	if err := m.syncFirstOwners(command, keys); err != nil {
+		return nil, nil, err
+	}
+
+	if ttl > 0 {
+		meta.ExpiresAt = time.Now().Add(ttl)
+	}
+	last := make(map[string]int, len(keys))
+	for i, k := range keys {
+		last[k] = i
+	}
+	requests := make(map[string]DataNode.DNRequest)
+	for i, k := range keys {
+		if last[k] != i {
+			continue
+		}
+		id := m.partitioner.Owners(k, m.replicas)[0]
+		rq := requests[id]
+		rq.Command = command
+		rq.Keys = append(rq.Keys, k)
+		rq.Values = append(rq.Values, values[i])
+		rq.Meta = append(rq.Meta, meta)
+		requests[id] = rq
+	}
+
+	var results []string
+	stored := make(map[string]replicaValue)
+	storedKeys := make(map[string]bool)
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		results = append(results, fmt.Sprintf("node %s:  %s", r.id, r.resp.Message))
+		for _, k := range r.resp.Keys {
+			stored[k] = replicaValue{value: values[last[k]], meta: meta}
+			storedKeys[k] = true
+		}
+	}
+	sort.Strings(results)
+	if len(errMessages) > 0 {
+		return results, nil, firstOwnerError(command, errMessages)
+	}
+	if err := m.replicate(stored); err != nil {
+		return results, nil, err
+	}
+	return results, sortedKeys(storedKeys), nil
+}
+
+// writes the records a first owner has written already to the other owners and waits until every key
+// got WriteQuorum acks, the first owner being one of them
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) replicate(records map[string]replicaValue) error {
+
+	puts := make(map[string]DataNode.DNRequest)
+	acks := make(map[string]int, len(records)) // key -> replicas confirmed
+	waiting := 0                               // keys without a quorum yet
+	for k, rv := range records {
+		acks[k] = 1
+		if m.writeQuorum > 1 {
+			waiting++
+		}
+		for _, id := range m.partitioner.Owners(k, m.replicas)[1:] {
+			rq := puts[id]
+			rq.Command = "put"
+			rq.Keys = append(rq.Keys, k)
+			rq.Values = append(rq.Values, rv.value)
+			rq.Meta = append(rq.Meta, rv.meta)
+			puts[id] = rq
+		}
+	}
+	var errMessages []string
+	for replies := m.fanOut(puts); waiting > 0; {
+		r, ok := <-replies
+		if !ok {
+			break
+		}
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		for _, k := range r.keys {
+			acks[k]++
+			if acks[k] == m.writeQuorum {
+				waiting--
+			}
+		}
+	}
+	if waiting > 0 {
+		sort.Strings(errMessages)
+		return fmt.Errorf("write quorum %d not reached for %d keys: %v", m.writeQuorum, waiting, errMessages)
+	}
+	return nil
+}
+
+// an operation a first owner applied to a record: the version the record had before and its metadata after
+type appliedOp struct {
+	key  string
+	base uint64
+	meta DataNode.EntryMeta
+}
+
+// sends the operation the first owners applied to the records to the other owners, so a replica gets the operation
+// and not the whole value. A replica applies it only to a record having the version the first owner had before,
+// the replicas which missed a write of the record get the whole record from the first owner instead.
+// The operations of a key go in the order the first owner applied them.
+// Waits until every key got WriteQuorum acks, the first owner being one of them
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) replicateOps(op DataNode.StructOp, applied []appliedOp) error {
+
+	requests := make(map[string]DataNode.DNRequest)
+	final := make(map[string]uint64) // key -> version the first owner has after the operations
+	for _, a := range applied {
+		final[a.key] = a.meta.Version
+		for _, id := range m.partitioner.Owners(a.key, m.replicas)[1:] {
+			rq := requests[id]
+			rq.Command = "op"
+			rq.Keys = append(rq.Keys, a.key)
+			rq.Ops = append(rq.Ops, op)
+			rq.Meta = append(rq.Meta, a.meta)
+			rq.Versions = append(rq.Versions, a.base)
+			requests[id] = rq
+		}
+	}
+	acks := make(map[string]int, len(final)) // key -> replicas confirmed
+	waiting := 0                             // keys without a quorum yet
+	for k := range final {
+		acks[k] = 1
+		if m.writeQuorum > 1 {
+			waiting++
+		}
+	}
+	ack := func(k string) {
+		acks[k]++
+		if acks[k] == m.writeQuorum {
+			waiting--
+		}
+	}
+
+	var errMessages []string
+	stale := make(map[string][]string) // replica -> keys it has another version of
+	for replies := m.fanOut(requests); waiting > 0; {
+		r, ok := <-replies
+		if !ok {
+			break
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		if r.resp.Status != "OK" { // the keys which failed are copied below
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.resp.Message))
+		}
+		versions := make(map[string]uint64, len(r.resp.Keys))
+		for i, k := range r.resp.Keys {
+			versions[k] = r.resp.Meta[i].Version
+		}
+		done := make(map[string]bool, len(r.keys))
+		for _, k := range r.keys {
+			if done[k] {
+				continue
+			}
+			done[k] = true
+			if versions[k] == final[k] {
+				ack(k)
+			} else {
+				stale[r.id] = append(stale[r.id], k)
+			}
+		}
+	}
+	if len(stale) > 0 {
+		copied, messages := m.copyFromFirstOwners(stale)
+		errMessages = append(errMessages, messages...)
+		for _, keys := range copied {
+			for _, k := range keys {
+				ack(k)
+			}
+		}
+	}
+	if waiting > 0 {
+		sort.Strings(errMessages)
+		return fmt.Errorf("write quorum %d not reached for %d keys: %v", m.writeQuorum, waiting, errMessages)
+	}
+	return nil
+}
+
+// copies the records of the keys from their first owners to the replicas which missed a write of them.
+// Returns the keys each replica stored and the errors
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) copyFromFirstOwners(stale map[string][]string) (map[string][]string, []string) {
+
+	dumps := make(map[string]DataNode.DNRequest)
+	asked := make(map[string]bool)
+	for _, keys := range stale {
+		for _, k := range keys {
+			if asked[k] {
+				continue
+			}
+			asked[k] = true
+			id := m.partitioner.Owners(k, m.replicas)[0]
+			rq := dumps[id]
+			rq.Command = "dump"
+			rq.Keys = append(rq.Keys, k)
+			dumps[id] = rq
+		}
+	}
+	var errMessages []string
+	records := make(map[string]replicaValue)
+	for r := range m.fanOut(dumps) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		for i, k := range r.resp.Keys {
+			records[k] = replicaValue{value: r.resp.Values[i], meta: r.resp.Meta[i]}
+		}
+	}
+
+	puts := make(map[string]DataNode.DNRequest)
+	for id, keys := range stale {
+		for _, k := range keys {
+			if rv, ok := records[k]; ok {
+				addLatest(puts, nil, id, k, rv)
+			}
+		}
+	}
+	copied := make(map[string][]string)
+	for r := range m.fanOut(puts) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		copied[r.id] = r.keys
+	}
+	return copied, errMessages
+}
+
+// deletes the keys from all their owners and waits until every key got WriteQuorum acks.
+// The delete has a version like a write, the nodes keep a tombstone of the keys with it,
+// so the replicas which missed the delete don't bring the records back with the read repair.
+// Returns the keys which existed on any replica, sorted
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) quorumDel(keys []string) ([]string, error) {
+
+	meta := DataNode.EntryMeta{Version: m.nextVersion()}
+	requests := make(map[string]DataNode.DNRequest)
+	acks := make(map[string]int) // key -> replicas confirmed
+	for _, k := range keys {
+		if _, ok := acks[k]; ok {
+			continue
+		}
+		acks[k] = 0
+		for _, id := range m.partitioner.Owners(k, m.replicas) {
+			rq := requests[id]
+			rq.Command = "del"
+			rq.Keys = append(rq.Keys, k)
+			rq.Meta = append(rq.Meta, meta)
+			requests[id] = rq
+		}
+	}
+
+	waiting := len(acks) // keys without a quorum yet
+	existed := make(map[string]bool)
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		for _, k := range r.resp.Keys {
+			existed[k] = true
+		}
+		for _, k := range r.keys {
+			acks[k]++
+			if acks[k] == m.writeQuorum {
+				waiting--
+			}
+		}
+	}
+	if waiting > 0 {
+		sort.Strings(errMessages)
+		return nil, fmt.Errorf("write quorum %d not reached for %d keys: %v", m.writeQuorum, waiting, errMessages)
+	}
+	return sortedKeys(existed), nil
+}
+
+// deletes the keys starting with the prefix and matching the pattern on all the nodes.
+// Returns the keys which existed, sorted
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) deleteMatching(prefix string, pattern string) ([]string, error) {
+	return m.deleteOnAllNodes(DataNode.DNRequest{Command: "del", Prefix: prefix, Pattern: pattern})
+}
+
+// deletes the records of the namespace having any of the tags on all the nodes.
+// Returns the keys which existed, sorted
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) invalidateTags(ns string, tags []string) ([]string, error) {
+	return m.deleteOnAllNodes(DataNode.DNRequest{Command: "invalidate", Namespace: ns, Tags: tags})
+}
+
+// sends a delete request to all the nodes, returns the keys which existed, sorted
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) deleteOnAllNodes(rq DataNode.DNRequest) ([]string, error) {
+	requests := make(map[string]DataNode.DNRequest, len(m.nodeCh))
+	for id := range m.nodeCh {
+		requests[id] = rq
+	}
+	existed := make(map[string]bool)
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		for _, k := range r.resp.Keys {
+			existed[k] = true
+		}
+	}
+	if len(errMessages) > 0 {
+		sort.Strings(errMessages)
+		return nil, fmt.Errorf("%v", errMessages)
+	}
+	return sortedKeys(existed), nil
+}
+
+// asks all the owners of the keys about their records, without counting it as a read, with their eviction ranks if withRank is set.
+// Returns the owners of every key, the owner first, and what the owners keeping a record know about it, in the same order
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) inspect(keys []string, withRank bool) (map[string][]string, map[string][]DataNode.EntryInfo, error) {
+	owners := make(map[string][]string, len(keys))
+	requests := make(map[string]DataNode.DNRequest)
+	for _, k := range keys {
+		if _, ok := owners[k]; ok {
+			continue
+		}
+		owners[k] = m.partitioner.Owners(k, m.replicas)
+		for _, id := range owners[k] {
+			rq := requests[id]
+			rq.Command = "inspect"
+			rq.Keys = append(rq.Keys, k)
+			rq.WithRank = withRank
+			requests[id] = rq
+		}
+	}
+	found := make(map[string]map[string]DataNode.EntryInfo) // key -> node -> info
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		for i, k := range r.resp.Keys {
+			if found[k] == nil {
+				found[k] = make(map[string]DataNode.EntryInfo)
+			}
+			found[k][r.id] = r.resp.Info[i]
+		}
+	}
+	if len(errMessages) > 0 {
+		sort.Strings(errMessages)
+		return nil, nil, fmt.Errorf("%v", errMessages)
+	}
+	infos := make(map[string][]DataNode.EntryInfo, len(found))
+	for k, byNode := range found {
+		for _, id := range owners[k] {
+			if info, ok := byNode[id]; ok {
+				infos[k] = append(infos[k], info)
+			}
+		}
+	}
+	return owners, infos, nil
+}
+
+// keys of a set, sorted
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dumps the records of the nodes, all of them or the ones of the keys given.
+// Fails if a node does not answer: a membership change planned without its records could lose them
+func (m *DateNodesManager) dumpNodes(nodeCh map[string]chan<- DataNode.DNRequest, keys []string) (map[string]DataNode.DNResponse, error) {
+	requests := make(map[string]DataNode.DNRequest, len(nodeCh))
+	for id := range nodeCh {
+		requests[id] = DataNode.DNRequest{Command: "dump", Keys: keys}
+	}
+	dumps := make(map[string]DataNode.DNResponse, len(requests))
+	var errMessages []string
+	for r := range m.fanOutTo(nodeCh, requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		dumps[r.id] = r.resp
+	}
+	if len(errMessages) > 0 {
+		sort.Strings(errMessages)
+		return nil, fmt.Errorf("could not dump the nodes: %v", errMessages)
+	}
+	return dumps, nil
+}
+
+// takes the snapshot of the records for a membership change without holding the mutex, the requests go on meanwhile.
+// The keys they write are recorded until catchUp. The recording starts under the write lock,
+// so no write started before it lands after the nodes are dumped
+// warning: not protected by the mutex, the caller holds the membership lock
+func (m *DateNodesManager) snapshot() (map[string]DataNode.DNResponse, error) {
+	m.Lock()
+	nodeCh := maps.Clone(m.nodeCh)
+	m.moveLock.Lock()
+	m.written, m.writtenAll = make(map[string]bool), false
+	m.moveLock.Unlock()
+	m.Unlock()
+
+	dumps, err := m.dumpNodes(nodeCh, nil)
+	if err != nil {
+		m.moveLock.Lock()
+		m.written = nil
+		m.moveLock.Unlock()
+		return nil, err
+	}
+	return dumps, nil
+}
+
+// brings the snapshot of a membership change up to date with the writes made while it was taken:
+// the nodes dump the keys written again, or all their records if a write had no keys, e.g. a delete by prefix
+// warning: not protected by the mutex, membership changes call it under the write lock
+func (m *DateNodesManager) catchUp(dumps map[string]DataNode.DNResponse) (map[string]DataNode.DNResponse, error) {
+	m.moveLock.Lock()
+	written, all := m.written, m.writtenAll
+	m.written = nil
+	m.moveLock.Unlock()
+
+	if all {
+		return m.dumpNodes(m.nodeCh, nil)
+	}
+	if len(written) == 0 {
+		return dumps, nil
+	}
+	delta, err := m.dumpNodes(m.nodeCh, sortedKeys(written))
+	if err != nil {
+		return nil, err
+	}
+	for id, d := range delta {
+		// the records written are the most recent ones
+		for i, k := range dumps[id].Keys {
+			if !written[k] {
+				d.Keys = append(d.Keys, k)
+				d.Values = append(d.Values, dumps[id].Values[i])
+				d.Meta = append(d.Meta, dumps[id].Meta[i])
+			}
+		}
+		dumps[id] = d
+	}
+	log.Printf("[CMg] %d keys written during the snapshot dumped again", len(written))
+	return dumps, nil
+}
+
+// records the keys a request writes while a membership change takes its snapshot, see catchUp
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) trackWrites(rq CacheRequest) {
+	switch rq.Command {
+	case "get", "scan", "range", "inspect":
+		return
+	}
+	m.moveLock.Lock()
+	defer m.moveLock.Unlock()
+	if m.written == nil { // no snapshot is being taken
+		return
+	}
+	if len(rq.Keys) == 0 {
+		m.writtenAll = true
+	}
+	for _, k := range rq.Keys {
+		m.written[k] = true
+	}
+}
+
+// a record a membership change copies to its owners which don't have the latest copy
+type moveCopy struct {
+	targets []string           // the owners to copy to
+	value   any                // the latest copy
+	meta    DataNode.EntryMeta // its metadata and version
+}
+
+// the work of a membership change, planned under the write lock and done after it is released
+type rebalancePlan struct {
+	nodeCh  map[string]chan<- DataNode.DNRequest // the channels of the nodes, the removed one too
+	order   []string                             // the keys to copy, the oldest records first
+	deletes map[string][]string                  // node id -> the keys it does not own any more
+}
+
+// after a membership change works out the records to copy to their owners which don't have the latest copy
+// and the records to delete from the nodes which don't own them any more.
+// The oldest records are copied first so the most recent stay most recent on the new owner.
+// The copies are pending until rebalance is done, the requests to their keys make them first, see settleMoves
+// warning: not protected by the mutex, membership changes call it under the write lock
+func (m *DateNodesManager) planRebalance(dumps map[string]DataNode.DNResponse) rebalancePlan {
+
+	type holder struct {
+		id    string
+		index int
+	}
+	best := make(map[string]holder)                // key -> the node with the latest copy and its position in the dump
+	versions := make(map[string]map[string]uint64) // key -> node id -> version it has
+	for id, dump := range dumps {
+		for i, k := range dump.Keys {
+			if versions[k] == nil {
+				versions[k] = make(map[string]uint64)
+			}
+			versions[k][id] = dump.Meta[i].Version
+			if b, ok := best[k]; !ok || dump.Meta[i].Version > dumps[b.id].Meta[b.index].Version {
+				best[k] = holder{id, i}
+			}
+		}
+	}
+
+	plan := rebalancePlan{nodeCh: maps.Clone(m.nodeCh), deletes: make(map[string][]string)}
+	moving := make(map[string]*moveCopy)
+	ids := make([]string, 0, len(dumps))
+	for id := range dumps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		dump := dumps[id]
+		for i := len(dump.Keys) - 1; i >= 0; i-- {
+			k := dump.Keys[i]
+			owners := m.partitioner.Owners(k, m.replicas)
+			if !slices.Contains(owners, id) {
+				plan.deletes[id] = append(plan.deletes[id], k)
+			}
+			if best[k] != (holder{id, i}) {
+				continue
+			}
+			var targets []string
+			for _, to := range owners {
+				if v, ok := versions[k][to]; !ok || v < dump.Meta[i].Version {
+					targets = append(targets, to)
+				}
+			}
+			if len(targets) > 0 {
+				moving[k] = &moveCopy{targets: targets, value: dump.Values[i], meta: dump.Meta[i]}
+				plan.order = append(plan.order, k)
+			}
+		}
+	}
+
+	m.moveLock.Lock()
+	m.moving = moving
+	m.moveDone = make(chan struct{})
+	m.moveLock.Unlock()
+	return plan
+}
+
+// copies the records of a plan to their new owners and then deletes them from the nodes which don't own them.
+// Runs without the mutex, the requests go on meanwhile. A record which could not be copied is left where it was,
+// the next membership change moves it. Returns the number of the records copied and the keys not copied, sorted
+func (m *DateNodesManager) rebalance(plan rebalancePlan) (int, []string) {
+
+	m.moveLock.Lock()
+	copies := make(map[string]DataNode.DNRequest)
+	for _, k := range plan.order {
+		mc, ok := m.moving[k]
+		if !ok { // a request copied it already
+			continue
+		}
+		for _, to := range mc.targets {
+			rq := copies[to]
+			rq.Command = "put"
+			rq.Keys = append(rq.Keys, k)
+			rq.Values = append(rq.Values, mc.value)
+			rq.Meta = append(rq.Meta, mc.meta)
+			copies[to] = rq
+		}
+	}
+	m.moveLock.Unlock()
+
+	failed := make(map[string]bool)
+	for r := range m.fanOutTo(plan.nodeCh, copies) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			log.Printf("[CMg] error moving %d records to node %s, they stay where they were: %s", len(r.keys), r.id, r.err)
+			for _, k := range r.keys {
+				failed[k] = true
+			}
+		}
+	}
+	m.moveLock.Lock()
+	m.moving = nil
+	close(m.moveDone)
+	m.moveDone = nil
+	m.moveLock.Unlock()
+
+	// the copies are in place, now the old places can be cleaned
+	deletes := make(map[string]DataNode.DNRequest)
+	for id, keys := range plan.deletes {
+		keys = slices.DeleteFunc(keys, func(k string) bool { return failed[k] })
+		if len(keys) > 0 {
+			deletes[id] = DataNode.DNRequest{Command: "del", Keys: keys}
+		}
+	}
+	for r := range m.fanOutTo(plan.nodeCh, deletes) {
+		if r.err != nil {
+			log.Printf("[CMg] error deleting %d moved records from node %s: %s", len(r.keys), r.id, r.err)
+		}
+	}
+	return len(plan.order) - len(failed), sortedKeys(failed)
+}
+
+// makes the copies of the records a membership change is moving before a request uses their keys,
+// so the request finds them on their new owners. A delete waits until all the copies are made,
+// a copy made after it would bring a deleted record back
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) settleMoves(rq CacheRequest) {
+
+	m.moveLock.Lock()
+	if m.moveDone == nil { // no membership change is going on
+		m.moveLock.Unlock()
+		return
+	}
+	if rq.Command == "del" || rq.Command == "invalidate" {
+		done := m.moveDone
+		m.moveLock.Unlock()
+		<-done
+		return
+	}
+	// the lock is held until the copies are made, so the other requests to these keys do not overtake them
+	defer m.moveLock.Unlock()
+
+	copies := make(map[string]DataNode.DNRequest)
+	for _, k := range rq.Keys {
+		mc, ok := m.moving[k]
+		if !ok {
+			continue
+		}
+		delete(m.moving, k)
+		for _, to := range mc.targets {
+			copyRq := copies[to]
+			copyRq.Command = "put"
+			copyRq.Keys = append(copyRq.Keys, k)
+			copyRq.Values = append(copyRq.Values, mc.value)
+			copyRq.Meta = append(copyRq.Meta, mc.meta)
+			copies[to] = copyRq
+		}
+	}
+	for r := range m.fanOut(copies) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = fmt.Errorf("%s", r.resp.Message)
+		}
+		if r.err != nil {
+			log.Printf("[CMg] error copying %d moved records to node %s: %s", len(r.keys), r.id, r.err)
+		}
+	}
+}
@@ -0,0 +1,900 @@
+package CacheManager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// creates nodes which can be killed one by one and a replicating manager on top of them
+func newReplicatedManager(t *testing.T, numberOfNodes int, opts ManagerOptions) (*DateNodesManager, []*DataNode.SingleDataNode, []context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	nodes := make([]*DataNode.SingleDataNode, numberOfNodes)
+	stops := make([]context.CancelFunc, numberOfNodes)
+	nodeChannels := make([]chan<- DataNode.DNRequest, numberOfNodes)
+	for i := 0; i < numberOfNodes; i++ {
+		var nodeCtx context.Context
+		nodeCtx, stops[i] = context.WithCancel(ctx)
+		nodes[i] = (&DataNode.SingleDataNode{}).New(nodeCtx, fmt.Sprintf("%03d", i), 1000)
+		nodeChannels[i] = nodes[i].GetChannel()
+	}
+	m, err := (&DateNodesManager{}).NewWithOptions(ctx, nodeChannels, opts)
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	return m, nodes, stops
+}
+
+func TestDateNodesManager_NewWithOptions(t *testing.T) {
+
+	if _, err := (&DateNodesManager{}).NewWithOptions(context.Background(), nil, ManagerOptions{Replicas: 3, WriteQuorum: 4}); err == nil {
+		t.Errorf("NewWithOptions() must fail for W > N")
+	}
+	m, err := (&DateNodesManager{}).NewWithOptions(context.Background(), nil, ManagerOptions{Replicas: 3})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	if m.writeQuorum != 2 || m.readQuorum != 2 {
+		t.Errorf("expected majority quorums W=2 R=2, got W=%d R=%d", m.writeQuorum, m.readQuorum)
+	}
+}
+
+func TestDateNodesManager_ReplicationSurvivesNodeLoss(t *testing.T) {
+
+	m, nodes, stops := newReplicatedManager(t, 5, ManagerOptions{Replicas: 3, WriteQuorum: 2, ReadQuorum: 2, Timeout: 200 * time.Millisecond})
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	var values []string
+	for _, k := range keys {
+		values = append(values, stressValue(k))
+	}
+	if resp := m.HandleCacheRequest("put", keys, values); resp.Status != "OK" {
+		t.Fatalf("put failed: %v", resp)
+	}
+
+	// every key is on 3 nodes, the put returns after 2 of them so the last copies may be on their way
+	total := 0
+	for deadline := time.Now().Add(time.Second); total != 3*len(keys) && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		total = 0
+		for _, n := range nodes {
+			total += n.Len()
+		}
+	}
+	if total != 3*len(keys) {
+		t.Errorf("expected %d records on the nodes, got %d", 3*len(keys), total)
+	}
+
+	// kill a node, all the keys are still readable and writable
+	stops[2]()
+	resp := m.HandleCacheRequest("get", keys, nil)
+	if err := checkGetResponse(resp, keys); err != nil {
+		t.Fatalf("get with a dead node: %v", err)
+	}
+	if got := len(resp.Result); got != len(keys) {
+		t.Errorf("get with a dead node returned %d keys, expected %d", got, len(keys))
+	}
+	if resp := m.HandleCacheRequest("put", keys, values); resp.Status != "OK" {
+		t.Errorf("put with a dead node failed: %v", resp)
+	}
+
+	// with two dead nodes some keys have one replica left only, below the quorum
+	stops[3]()
+	if resp := m.HandleCacheRequest("put", keys, values); resp.Status != "Error" || resp.Kind != Unavailable {
+		t.Errorf("put must fail without a write quorum, got %v", resp)
+	}
+	if resp := m.HandleCacheRequest("get", keys, nil); resp.Status != "Error" || resp.Kind != Unavailable {
+		t.Errorf("get must fail without a read quorum, got %v", resp)
+	}
+}
+
+func TestDateNodesManager_VersionReconciliation(t *testing.T) {
+
+	m, nodes, _ := newReplicatedManager(t, 3, ManagerOptions{Replicas: 3, WriteQuorum: 3, ReadQuorum: 3})
+
+	if resp := m.HandleCacheRequest("put", []string{"key"}, []string{"new"}); resp.Status != "OK" {
+		t.Fatalf("put failed: %v", resp)
+	}
+
+	// a late write of an older version does not overwrite the newer one
+	callNode := func(n *DataNode.SingleDataNode, rq DataNode.DNRequest) DataNode.DNResponse {
+		resp, err := m.callNode(n.GetChannel(), rq)
+		if err != nil {
+			t.Fatalf("callNode() error = %v", err)
+		}
+		return resp
+	}
+	callNode(nodes[0], DataNode.DNRequest{Command: "put", Keys: []string{"key"}, Values: []any{"late"}, Meta: []DataNode.EntryMeta{{Version: 1}}})
+	if resp := callNode(nodes[0], DataNode.DNRequest{Command: "get", Keys: []string{"key"}}); resp.Values[0] != "new" {
+		t.Errorf("a stale write replaced the value, got %v", resp.Values[0])
+	}
+
+	// a replica lost the record: the read returns the newest copy and repairs the replica
+	callNode(nodes[1], DataNode.DNRequest{Command: "del", Keys: []string{"key"}})
+	resp := m.HandleCacheRequest("get", []string{"key"}, nil)
+	if v := resp.Result["key"]; v != "new" {
+		t.Errorf("expected the latest value, got %v", v)
+	}
+	deadline := time.Now().Add(time.Second)
+	for nodes[1].Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := callNode(nodes[1], DataNode.DNRequest{Command: "get", Keys: []string{"key"}}); len(r.Values) != 1 || r.Values[0] != "new" {
+		t.Errorf("read repair did not restore the replica, it has %v", r.Values)
+	}
+}
+
+func TestDateNodesManager_NewWithAddresses(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// three node servers on localhost
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error = %v", err)
+		}
+		node := (&DataNode.SingleDataNode{}).New(ctx, fmt.Sprintf("%03d", i), 1000)
+		go func() { _ = DataNode.ServeTCP(ctx, ln, node.GetChannel()) }()
+		addresses = append(addresses, ln.Addr().String())
+	}
+
+	m, err := (&DateNodesManager{}).NewWithAddresses(ctx, addresses, ManagerOptions{Replicas: 2})
+	if err != nil {
+		t.Fatalf("NewWithAddresses() error = %v", err)
+	}
+
+	var keys, values []string
+	for i := 0; i < 50; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		values = append(values, stressValue(keys[i]))
+	}
+	if resp := m.HandleCacheRequest("put", keys, values); resp.Status != "OK" {
+		t.Fatalf("put failed: %v", resp)
+	}
+	resp := m.HandleCacheRequest("get", keys, nil)
+	if err := checkGetResponse(resp, keys); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(resp.Result); got != len(keys) {
+		t.Errorf("get over the network returned %d keys, expected %d", got, len(keys))
+	}
+
+	if _, err = (&DateNodesManager{}).NewWithAddresses(ctx, []string{"127.0.0.1:1"}, ManagerOptions{}); err == nil {
+		t.Errorf("NewWithAddresses() must fail for an unreachable node")
+	}
+}
+
+func TestDateNodesManager_ConditionalPut(t *testing.T) {
+
+	m, _, _ := newReplicatedManager(t, 4, ManagerOptions{Replicas: 3})
+	m.HandleCacheRequest("put", []string{"key1"}, []string{"value1"})
+
+	resp := m.HandleRequest(CacheRequest{Command: "add", Keys: []string{"key1", "key2"}, Values: []any{"x", "value2"}, Flags: 5})
+	if resp.Status != "OK" || !slices.Equal(resp.Stored, []string{"key2"}) || !slices.Equal(resp.Skipped, []string{"key1"}) {
+		t.Errorf("add response was %v", resp)
+	}
+	resp = m.HandleRequest(CacheRequest{Command: "replace", Keys: []string{"key1", "key3"}, Values: []any{"value1.1", "x"}})
+	if resp.Status != "OK" || !slices.Equal(resp.Stored, []string{"key1"}) || !slices.Equal(resp.Skipped, []string{"key3"}) {
+		t.Errorf("replace response was %v", resp)
+	}
+
+	resp = m.HandleRequest(CacheRequest{Command: "get", Keys: []string{"key1", "key2", "key3"}, WithMeta: true})
+	result, meta := resp.Result, resp.Meta
+	if len(result) != 2 || result["key1"] != "value1.1" || result["key2"] != "value2" {
+		t.Errorf("expected key1 replaced and key2 added, got %v", result)
+	}
+	if meta["key2"].Flags != 5 || meta["key1"].Flags != 0 || meta["key1"].Version <= meta["key2"].Version {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+
+	resp = m.HandleRequest(CacheRequest{Command: "getset", Keys: []string{"key1", "key4"}, Values: []any{"value1.2", "value4"}})
+	if resp.Status != "OK" || !reflect.DeepEqual(resp.Previous, map[string]any{"key1": "value1.1"}) || resp.Versions["key4"] == "" {
+		t.Errorf("getset response was %v", resp)
+	}
+	resp = m.HandleCacheRequest("get", []string{"key1", "key4"}, nil)
+	if resp.Result["key1"] != "value1.2" || resp.Result["key4"] != "value4" {
+		t.Errorf("expected the values of getset, got %v", resp.Result)
+	}
+}
+
+func TestDateNodesManager_ConditionalPutStaleReplica(t *testing.T) {
+
+	m, nodes, _ := newReplicatedManager(t, 3, ManagerOptions{Replicas: 3, WriteQuorum: 3, ReadQuorum: 3})
+	m.HandleCacheRequest("put", []string{"key"}, []string{"value"})
+
+	// the last replica missed the write
+	owners := m.partitioner.Owners("key", 3)
+	stale, _ := strconv.Atoi(owners[2])
+	nodeValue := func(n *DataNode.SingleDataNode) any {
+		resp, err := m.callNode(n.GetChannel(), DataNode.DNRequest{Command: "get", Keys: []string{"key"}})
+		if err != nil || len(resp.Values) == 0 {
+			return nil
+		}
+		return resp.Values[0]
+	}
+	if _, err := m.callNode(nodes[stale].GetChannel(), DataNode.DNRequest{Command: "del", Keys: []string{"key"}}); err != nil {
+		t.Fatalf("callNode() error = %v", err)
+	}
+
+	// the first owner has the key: nothing is added, not even on the stale replica
+	resp := m.HandleRequest(CacheRequest{Command: "add", Keys: []string{"key"}, Values: []any{"added"}})
+	if resp.Status != "OK" || len(resp.Stored) != 0 || !slices.Equal(resp.Skipped, []string{"key"}) {
+		t.Errorf("add response was %v", resp)
+	}
+	if v := nodeValue(nodes[stale]); v != nil {
+		t.Errorf("the stale replica added the key on its own: %v", v)
+	}
+
+	// the replace is stored and reaches the stale replica too
+	resp = m.HandleRequest(CacheRequest{Command: "replace", Keys: []string{"key"}, Values: []any{"replaced"}})
+	if resp.Status != "OK" || !slices.Equal(resp.Stored, []string{"key"}) || len(resp.Skipped) != 0 {
+		t.Errorf("replace response was %v", resp)
+	}
+	for _, n := range nodes {
+		if v := nodeValue(n); v != "replaced" {
+			t.Errorf("a replica has %v after the replace", v)
+		}
+	}
+}
+
+func TestDateNodesManager_FirstOwnerDown(t *testing.T) {
+
+	m, nodes, stops := newReplicatedManager(t, 3, ManagerOptions{Replicas: 3, WriteQuorum: 2, ReadQuorum: 2, Timeout: 100 * time.Millisecond})
+	m.HandleRequest(CacheRequest{Command: "put", Keys: []string{"key"}, Values: []any{int64(1)}})
+
+	owners := m.partitioner.Owners("key", 3)
+	first, _ := strconv.Atoi(owners[0])
+	stops[first]()
+
+	// the writes needing the first owner fail, the other replicas keep the value
+	for _, rq := range []CacheRequest{
+		{Command: "incr", Keys: []string{"key"}, Values: []any{int64(1)}},
+		{Command: "replace", Keys: []string{"key"}, Values: []any{"replaced"}},
+	} {
+		resp := m.HandleRequest(rq)
+		if resp.Status != StatusError || resp.Kind != Unavailable || !strings.Contains(resp.Message, "first owners") {
+			t.Errorf("%s with the first owner down returned %+v", rq.Command, resp)
+		}
+	}
+	for _, id := range owners[1:] {
+		i, _ := strconv.Atoi(id)
+		resp, err := m.callNode(nodes[i].GetChannel(), DataNode.DNRequest{Command: "get", Keys: []string{"key"}})
+		if err != nil || len(resp.Values) != 1 || resp.Values[0] != int64(1) {
+			t.Errorf("node %s has %v %v", id, resp.Values, err)
+		}
+	}
+	// the plain writes go on with the quorum of the others
+	if resp := m.HandleRequest(CacheRequest{Command: "put", Keys: []string{"key"}, Values: []any{int64(2)}}); resp.Status != StatusOK {
+		t.Errorf("put with the first owner down returned %+v", resp)
+	}
+}
+
+// a replicating manager whose first node gets the puts late, the write quorum is made by the others first.
+// Returns the manager and a key the first node owns first
+func newLaggingManager(t *testing.T) (*DateNodesManager, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	var fail atomic.Bool
+	nodeChannels := []chan<- DataNode.DNRequest{
+		flakyNode(ctx, "000", &fail, 300*time.Millisecond),
+		(&DataNode.SingleDataNode{}).New(ctx, "001", 1000).GetChannel(),
+		(&DataNode.SingleDataNode{}).New(ctx, "002", 1000).GetChannel(),
+	}
+	m, err := (&DateNodesManager{}).NewWithOptions(ctx, nodeChannels, ManagerOptions{Replicas: 3, WriteQuorum: 2, ReadQuorum: 2, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	for i := 0; ; i++ {
+		if k := fmt.Sprintf("key%d", i); m.partitioner.Owners(k, 3)[0] == "000" {
+			return m, k
+		}
+	}
+}
+
+func TestDateNodesManager_LaggingFirstOwner(t *testing.T) {
+
+	m, key := newLaggingManager(t)
+
+	// the increment starts from the value acked
+	if resp := m.HandleRequest(CacheRequest{Command: "put", Keys: []string{key}, Values: []any{int64(100)}}); resp.Status != StatusOK {
+		t.Fatalf("put returned %+v", resp)
+	}
+	if resp := m.HandleRequest(CacheRequest{Command: "incr", Keys: []string{key}, Values: []any{int64(1)}}); resp.Status != StatusOK || resp.Result[key] != int64(101) {
+		t.Errorf("incr after the put returned %+v", resp)
+	}
+	if resp := m.HandleCacheRequest("get", []string{key}, nil); resp.Result[key] != int64(101) {
+		t.Errorf("expected the increment kept, got %v", resp.Result)
+	}
+}
+
+func TestDateNodesManager_CasLaggingFirstOwner(t *testing.T) {
+
+	m, key := newLaggingManager(t)
+	put := m.HandleRequest(CacheRequest{Command: "put", Keys: []string{key}, Values: []any{"v1"}})
+	version, err := strconv.ParseUint(put.Versions[key], 10, 64)
+	if put.Status != StatusOK || err != nil {
+		t.Fatalf("put returned %+v", put)
+	}
+
+	// the version acked wins, the one before it conflicts
+	if resp := m.HandleRequest(CacheRequest{Command: "cas", Keys: []string{key}, Values: []any{"stale"}, Versions: []uint64{0}}); resp.Kind != Conflict {
+		t.Errorf("cas with the version before the put returned %+v", resp)
+	}
+	if resp := m.HandleRequest(CacheRequest{Command: "cas", Keys: []string{key}, Values: []any{"v2"}, Versions: []uint64{version}}); resp.Status != StatusOK || !slices.Equal(resp.Stored, []string{key}) {
+		t.Errorf("cas with the version of the put returned %+v", resp)
+	}
+	if resp := m.HandleCacheRequest("get", []string{key}, nil); resp.Result[key] != "v2" {
+		t.Errorf("expected the value of the cas, got %v", resp.Result)
+	}
+}
+
+// a node which answers every request with an error while down is set, as if it was cut off
+func partitionedNode(ctx context.Context, id string, down *atomic.Bool) chan<- DataNode.DNRequest {
+	nodeCh := (&DataNode.SingleDataNode{}).New(ctx, id, 1000).GetChannel()
+	ch := make(chan DataNode.DNRequest)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case rq := <-ch:
+				if down.Load() {
+					rq.BackCh <- DataNode.DNResponse{Status: "Error", Message: "unreachable"}
+				} else {
+					nodeCh <- rq
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+func TestDateNodesManager_DeleteWithReplicaPartitioned(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var down atomic.Bool
+	nodeChannels := []chan<- DataNode.DNRequest{
+		partitionedNode(ctx, "000", &down),
+		(&DataNode.SingleDataNode{}).New(ctx, "001", 1000).GetChannel(),
+		(&DataNode.SingleDataNode{}).New(ctx, "002", 1000).GetChannel(),
+	}
+	m, err := (&DateNodesManager{}).NewWithOptions(ctx, nodeChannels, ManagerOptions{Replicas: 3, WriteQuorum: 2, ReadQuorum: 3})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	m.HandleCacheRequest("put", []string{"key"}, []string{"value"})
+
+	// the first node misses the delete
+	down.Store(true)
+	if resp := m.HandleCacheRequest("del", []string{"key"}, nil); resp.Status != StatusOK || !slices.Equal(resp.Deleted, []string{"key"}) {
+		t.Fatalf("del with a replica cut off returned %+v", resp)
+	}
+	down.Store(false)
+
+	// it still has the record, the reads find the delete newer and repair it
+	for i := 0; i < 10; i++ {
+		if resp := m.HandleCacheRequest("get", []string{"key"}, nil); resp.Status != StatusOK || len(resp.Result) != 0 {
+			t.Fatalf("the deleted key came back: %+v", resp)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := m.callNode(nodeChannels[0], DataNode.DNRequest{Command: "get", Keys: []string{"key"}})
+		if err == nil && len(resp.Keys) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the read repair did not delete the record on the first node: %v %v", resp.Values, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the key is new for the next writes
+	if resp := m.HandleRequest(CacheRequest{Command: "incr", Keys: []string{"key"}, Values: []any{int64(1)}}); resp.Status != StatusOK || resp.Result["key"] != int64(1) {
+		t.Errorf("incr of the deleted key returned %+v", resp)
+	}
+	if resp := m.HandleCacheRequest("get", []string{"key"}, nil); resp.Result["key"] != int64(1) {
+		t.Errorf("expected the key written again, got %v", resp.Result)
+	}
+}
+
+func TestDateNodesManager_Incr(t *testing.T) {
+
+	m, nodes, _ := newReplicatedManager(t, 4, ManagerOptions{Replicas: 3})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if resp := m.HandleRequest(CacheRequest{Command: "incr", Keys: []string{"counter"}, Values: []any{1}}); resp.Status != "OK" {
+					t.Errorf("incr failed: %v", resp)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp := m.HandleRequest(CacheRequest{Command: "incr", Keys: []string{"counter", "float"}, Values: []any{"-100", 0.5}})
+	if resp.Status != "OK" || resp.Result["counter"] != int64(100) || resp.Result["float"] != 0.5 {
+		t.Errorf("incr returned %v", resp)
+	}
+
+	// every replica has the last value
+	deadline := time.Now().Add(time.Second)
+	for {
+		copies := 0
+		for _, n := range nodes {
+			if r, _ := m.callNode(n.GetChannel(), DataNode.DNRequest{Command: "get", Keys: []string{"counter"}}); len(r.Values) == 1 && r.Values[0] == int64(100) {
+				copies++
+			}
+		}
+		if copies == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 copies of the counter, got %d", copies)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.HandleCacheRequest("put", []string{"name"}, []string{"Ann"})
+	if resp = m.HandleRequest(CacheRequest{Command: "incr", Keys: []string{"name"}, Values: []any{1}}); resp.Status != "Error" || resp.Kind != BadRequest {
+		t.Errorf("incr of a string must fail, got %v", resp)
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "incr", Keys: []string{"counter"}, Values: []any{"x"}}); resp.Kind != BadRequest {
+		t.Errorf("incr by a string must fail, got %v", resp)
+	}
+}
+
+func TestDateNodesManager_Cas(t *testing.T) {
+
+	m, _, _ := newReplicatedManager(t, 4, ManagerOptions{Replicas: 3})
+
+	// version zero creates a record once
+	resp := m.HandleRequest(CacheRequest{Command: "cas", Keys: []string{"counter"}, Values: []any{0}, Versions: []uint64{0}})
+	if resp.Status != "OK" || !slices.Equal(resp.Stored, []string{"counter"}) || resp.Versions["counter"] == "" {
+		t.Fatalf("cas of an absent key returned %v", resp)
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "cas", Keys: []string{"counter"}, Values: []any{1}, Versions: []uint64{0}}); resp.Kind != Conflict {
+		t.Errorf("cas of an existing key with version zero must conflict, got %v", resp)
+	}
+
+	// concurrent read-modify-write loops lose no update
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; {
+				got := m.HandleRequest(CacheRequest{Command: "get", Keys: []string{"counter"}})
+				version, err := strconv.ParseUint(got.Versions["counter"], 10, 64)
+				if err != nil {
+					t.Errorf("get returned no version: %v", got)
+					return
+				}
+				put := m.HandleRequest(CacheRequest{Command: "cas", Keys: []string{"counter"}, Values: []any{got.Result["counter"].(int) + 1}, Versions: []uint64{version}})
+				switch put.Kind {
+				case NoError:
+					j++
+				case Conflict: // somebody was faster, read again
+				default:
+					t.Errorf("cas failed: %v", put)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp = m.HandleRequest(CacheRequest{Command: "get", Keys: []string{"counter"}, WithMeta: true})
+	if resp.Result["counter"] != 200 || resp.Versions["counter"] != strconv.FormatUint(resp.Meta["counter"].Version, 10) {
+		t.Errorf("expected 200 after the concurrent updates, got %v", resp)
+	}
+
+	if resp = m.HandleRequest(CacheRequest{Command: "cas", Keys: []string{"counter"}, Values: []any{1}}); resp.Kind != BadRequest {
+		t.Errorf("cas without the versions must fail, got %v", resp)
+	}
+}
+
+func TestDateNodesManager_Op(t *testing.T) {
+
+	m, nodes, _ := newReplicatedManager(t, 4, ManagerOptions{Replicas: 3})
+
+	// concurrent pushes are serialized by the first owner, none is lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				op := DataNode.StructOp{Name: "rpush", Args: []string{strconv.Itoa(i*10 + j)}}
+				if resp := m.HandleRequest(CacheRequest{Command: "op", Keys: []string{"list"}, Op: op}); resp.Status != "OK" {
+					t.Errorf("rpush failed: %v", resp)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	resp := m.HandleRequest(CacheRequest{Command: "op", Keys: []string{"list", "none"}, Op: DataNode.StructOp{Name: "llen"}})
+	if resp.Status != "OK" || resp.Result["list"] != int64(100) || resp.Result["none"] != int64(0) || resp.Versions["none"] != "" {
+		t.Errorf("llen returned %v", resp)
+	}
+
+	// every replica has the last value
+	resp = m.HandleRequest(CacheRequest{Command: "op", Keys: []string{"zset"}, Op: DataNode.StructOp{Name: "zadd", Args: []string{"2", "b", "1", "a"}}})
+	if resp.Status != "OK" || resp.Result["zset"] != int64(2) || resp.Versions["zset"] == "" {
+		t.Errorf("zadd returned %v", resp)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		copies := 0
+		for _, n := range nodes {
+			if r, _ := m.callNode(n.GetChannel(), DataNode.DNRequest{Command: "get", Keys: []string{"zset"}}); len(r.Values) == 1 && reflect.DeepEqual(r.Values[0], DataNode.ZSet{{Member: "a", Score: 1}, {Member: "b", Score: 2}}) {
+				copies++
+			}
+		}
+		if copies == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 copies of the sorted set, got %d", copies)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp = m.HandleRequest(CacheRequest{Command: "op", Keys: []string{"zset"}, Op: DataNode.StructOp{Name: "zrange", Args: []string{"1.5", "+inf"}}})
+	if resp.Status != "OK" || !reflect.DeepEqual(resp.Result["zset"], DataNode.ZSet{{Member: "b", Score: 2}}) {
+		t.Errorf("zrange returned %v", resp)
+	}
+
+	// type mismatches and bad operations
+	m.HandleCacheRequest("put", []string{"name"}, []string{"Ann"})
+	for _, op := range []DataNode.StructOp{{Name: "lpush", Args: []string{"a"}}, {Name: "hget", Args: []string{"a"}}} {
+		if resp = m.HandleRequest(CacheRequest{Command: "op", Keys: []string{"name"}, Op: op}); resp.Kind != BadRequest || !strings.Contains(resp.Message, "WRONGTYPE") {
+			t.Errorf("%s on a string must fail, got %v", op.Name, resp)
+		}
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "op", Keys: []string{"list"}, Op: DataNode.StructOp{Name: "zadd", Args: []string{"x", "a"}}}); resp.Kind != BadRequest {
+		t.Errorf("zadd with a bad score must fail, got %v", resp)
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "incr", Keys: []string{"list"}, Values: []any{1}}); resp.Kind != BadRequest {
+		t.Errorf("incr of a list must fail, got %v", resp)
+	}
+}
+
+func TestDateNodesManager_OpStaleReplica(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the nodes count the puts they get
+	nodes := make([]*DataNode.SingleDataNode, 3)
+	puts := make([]atomic.Int32, 3)
+	nodeChannels := make([]chan<- DataNode.DNRequest, 3)
+	for i := range nodes {
+		nodes[i] = (&DataNode.SingleDataNode{}).New(ctx, fmt.Sprintf("%03d", i), 1000)
+		ch := make(chan DataNode.DNRequest)
+		go func(i int) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case rq := <-ch:
+					if rq.Command == "put" {
+						puts[i].Add(1)
+					}
+					nodes[i].GetChannel() <- rq
+				}
+			}
+		}(i)
+		nodeChannels[i] = ch
+	}
+	m, err := (&DateNodesManager{}).NewWithOptions(ctx, nodeChannels, ManagerOptions{Replicas: 3, WriteQuorum: 3, ReadQuorum: 3})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	push := func(v string) {
+		if resp := m.HandleRequest(CacheRequest{Command: "op", Keys: []string{"list"}, Op: DataNode.StructOp{Name: "rpush", Args: []string{v}}}); resp.Status != StatusOK {
+			t.Fatalf("rpush %s returned %+v", v, resp)
+		}
+	}
+	check := func(expected DataNode.List) {
+		for i, n := range nodes {
+			if r, _ := m.callNode(n.GetChannel(), DataNode.DNRequest{Command: "get", Keys: []string{"list"}}); len(r.Values) != 1 || !reflect.DeepEqual(r.Values[0], expected) {
+				t.Errorf("node %d has %v, expected %v", i, r.Values, expected)
+			}
+		}
+	}
+
+	push("a")
+	check(DataNode.List{"a"})
+
+	// the last owner loses the list, the next push brings it the whole list, the other replica gets the push only
+	owners := m.partitioner.Owners("list", 3)
+	stale, _ := strconv.Atoi(owners[2])
+	inSync, _ := strconv.Atoi(owners[1])
+	_, _ = m.callNode(nodes[stale].GetChannel(), DataNode.DNRequest{Command: "del", Keys: []string{"list"}})
+	puts[stale].Store(0)
+	puts[inSync].Store(0)
+	push("b")
+	check(DataNode.List{"a", "b"})
+	if puts[stale].Load() != 1 || puts[inSync].Load() != 0 {
+		t.Errorf("the stale replica got %d puts, the other one %d, expected 1 and 0", puts[stale].Load(), puts[inSync].Load())
+	}
+
+	// both are in step again
+	push("c")
+	check(DataNode.List{"a", "b", "c"})
+	if puts[stale].Load() != 1 || puts[inSync].Load() != 0 {
+		t.Errorf("the replicas got %d and %d puts, expected no more", puts[stale].Load(), puts[inSync].Load())
+	}
+}
+
+func TestDateNodesManager_InvalidateTags(t *testing.T) {
+
+	m, nodes, _ := newReplicatedManager(t, 4, ManagerOptions{Replicas: 2})
+
+	m.HandleRequest(CacheRequest{Command: "put", Keys: []string{"profile:42", "orders:42"}, Values: []any{"a", "b"}, Tags: []string{"user:42"}})
+	m.HandleRequest(CacheRequest{Command: "put", Keys: []string{"profile:7"}, Values: []any{"c"}, Tags: []string{"user:7", "user:42", "user:7"}})
+	m.HandleRequest(CacheRequest{Command: "put", Keys: []string{"profile:7"}, Values: []any{"c"}, Tags: []string{"user:7"}})
+	m.HandleRequest(CacheRequest{Command: "put", Namespace: "team", Keys: []string{"profile:42"}, Values: []any{"d"}, Tags: []string{"user:42"}})
+
+	// both replicas of every record are deleted, the keys are reported once
+	resp := m.HandleRequest(CacheRequest{Command: "invalidate", Tags: []string{"user:42"}})
+	if resp.Status != "OK" || !slices.Equal(resp.Deleted, []string{"orders:42", "profile:42"}) || resp.Message != "2 keys invalidated" {
+		t.Errorf("invalidate response was %v", resp)
+	}
+	total := 0
+	for _, n := range nodes {
+		total += n.Len()
+	}
+	if total != 4 {
+		t.Errorf("the nodes have %d records, expected 2 replicas of 2 keys", total)
+	}
+	if result := m.HandleCacheRequest("get", []string{"profile:7"}, nil).Result; result["profile:7"] != "c" {
+		t.Errorf("a record retagged by the update was invalidated: %v", result)
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "invalidate", Namespace: "team", Tags: []string{"user:42"}}); !slices.Equal(resp.Deleted, []string{"profile:42"}) {
+		t.Errorf("invalidate in the namespace response was %v", resp)
+	}
+
+	// the records moved to a new node keep their tags
+	newNode := (&DataNode.SingleDataNode{}).New(context.Background(), "new", 1000)
+	for i := 0; i < 20; i++ {
+		m.HandleRequest(CacheRequest{Command: "put", Keys: []string{fmt.Sprintf("key%d", i)}, Values: []any{i}, Tags: []string{"user:7"}})
+	}
+	if _, err := m.AddNode("new", newNode.GetChannel()); err != nil || newNode.Len() == 0 {
+		t.Fatalf("AddNode() error = %v, the new node has %d records", err, newNode.Len())
+	}
+	if resp = m.HandleRequest(CacheRequest{Command: "invalidate", Tags: []string{"user:7"}}); len(resp.Deleted) != 21 || newNode.Len() != 0 {
+		t.Errorf("invalidate after AddNode deleted %d keys, the new node has %d records", len(resp.Deleted), newNode.Len())
+	}
+
+	for _, rq := range []CacheRequest{
+		{Command: "invalidate"},
+		{Command: "invalidate", Tags: []string{""}},
+		{Command: "invalidate", Keys: []string{"k"}, Tags: []string{"t"}},
+		{Command: "put", Keys: []string{"k"}, Values: []any{"v"}, Tags: []string{""}},
+	} {
+		if resp = m.HandleRequest(rq); resp.Status != "Error" || resp.Kind != BadRequest {
+			t.Errorf("request %+v must be rejected, response was %v", rq, resp)
+		}
+	}
+}
+
+func TestDateNodesManager_Scan(t *testing.T) {
+
+	// the first owners list the keys, all the replicas confirm the writes so the scans see them
+	m, _, _ := newReplicatedManager(t, 4, ManagerOptions{Replicas: 3, WriteQuorum: 3})
+
+	keys := make([]string, 50)
+	values := make([]any, 50)
+	for i := range keys {
+		keys[i], values[i] = fmt.Sprintf("key%02d", i), i
+	}
+	m.HandleRequest(CacheRequest{Command: "put", Keys: keys, Values: values})
+	m.HandleRequest(CacheRequest{Command: "put", Namespace: "team", Keys: []string{"key00", "other"}, Values: []any{"t", "t"}})
+
+	// every key once though it has 3 replicas, the other namespaces are not listed
+	scanAll := func(rq CacheRequest) []string {
+		t.Helper()
+		var all []string
+		rq.Command = "scan"
+		count := rq.Count
+		if count == 0 {
+			count = DefaultScanCount
+		}
+		for pages := 0; ; pages++ {
+			resp := m.HandleRequest(rq)
+			if resp.Status != "OK" || len(resp.Keys) > count || pages > 100 {
+				t.Fatalf("scan of %+v returned %v", rq, resp)
+			}
+			all = append(all, resp.Keys...)
+			if resp.Cursor == ScanDone {
+				break
+			}
+			rq.Cursor = resp.Cursor
+		}
+		slices.Sort(all)
+		return all
+	}
+	if all := scanAll(CacheRequest{Count: 7}); !slices.Equal(all, keys) {
+		t.Errorf("scan listed %v", all)
+	}
+	if all := scanAll(CacheRequest{Count: 5, Prefix: "key1", Pattern: "*[05]"}); !slices.Equal(all, []string{"key10", "key15"}) {
+		t.Errorf("scan with a prefix and a pattern listed %v", all)
+	}
+	if all := scanAll(CacheRequest{Namespace: "team"}); !slices.Equal(all, []string{"key00", "other"}) {
+		t.Errorf("scan of a namespace listed %v", all)
+	}
+
+	for _, rq := range []CacheRequest{
+		{Command: "scan", Cursor: "x"},
+		{Command: "scan", Cursor: "MDAx.%%"},
+		{Command: "scan", Cursor: ".a2V5"},
+		{Command: "scan", Count: MaxScanCount + 1},
+		{Command: "scan", Pattern: "["},
+		{Command: "scan", Keys: []string{"k"}},
+	} {
+		if resp := m.HandleRequest(rq); resp.Status != "Error" || resp.Kind != BadRequest {
+			t.Errorf("request %+v must be rejected, response was %v", rq, resp)
+		}
+	}
+
+	// the cursor names its node: a node removed before it does not move it, a cursor of a removed node is rejected
+	cursor := encodeCursor("003", "")
+	before := m.HandleRequest(CacheRequest{Command: "scan", Cursor: cursor})
+	if _, err := m.RemoveNode("000"); err != nil {
+		t.Fatalf("RemoveNode() error = %v", err)
+	}
+	after := m.HandleRequest(CacheRequest{Command: "scan", Cursor: cursor})
+	if before.Status != "OK" || after.Status != "OK" || after.Cursor != ScanDone || len(after.Keys) < len(before.Keys) {
+		t.Errorf("the last node listed %v, after a removal %v", before, after)
+	}
+	for _, cursor := range []string{encodeCursor("000", "key10"), encodeCursor("none", "")} {
+		if resp := m.HandleRequest(CacheRequest{Command: "scan", Cursor: cursor}); resp.Kind != BadRequest || !strings.Contains(resp.Message, "start the scan again") {
+			t.Errorf("scan with the cursor of a missing node returned %v", resp)
+		}
+	}
+	if all := scanAll(CacheRequest{Count: 7}); !slices.Equal(all, keys) {
+		t.Errorf("scan after the removal listed %v", all)
+	}
+}
+
+func TestDateNodesManager_Range(t *testing.T) {
+
+	keys := make([]string, 50)
+	values := make([]any, 50)
+	for i := range keys {
+		keys[i], values[i] = fmt.Sprintf("key%02d", i), i
+	}
+
+	for name, partitioner := range map[string]Partitioner{
+		"hash ring": (&HashRing{}).New(DefaultVirtualNodes, 0),
+		"ranges":    (&RangePartitioner{}).New([]string{"key1", "key3", "x"}),
+	} {
+		// all the replicas confirm the writes so the first owners see them
+		m, _, _ := newReplicatedManager(t, 4, ManagerOptions{Partitioner: partitioner, Replicas: 3, WriteQuorum: 3})
+		m.HandleRequest(CacheRequest{Command: "put", Keys: keys, Values: values})
+		m.HandleRequest(CacheRequest{Command: "put", Namespace: "team", Keys: []string{"key00", "other"}, Values: []any{"t", "t"}})
+
+		// the pages follow each other in order, every key once
+		rangeAll := func(rq CacheRequest) []string {
+			t.Helper()
+			var all []string
+			rq.Command = "range"
+			for pages := 0; ; pages++ {
+				resp := m.HandleRequest(rq)
+				if resp.Status != "OK" || (rq.Count > 0 && len(resp.Keys) > rq.Count) || pages > 100 {
+					t.Fatalf("%s: range of %+v returned %v", name, rq, resp)
+				}
+				all = append(all, resp.Keys...)
+				if resp.Next == "" {
+					return all
+				}
+				rq.From = resp.Next
+			}
+		}
+		if all := rangeAll(CacheRequest{From: "key10", To: "key20", Count: 4}); !slices.Equal(all, keys[10:20]) {
+			t.Errorf("%s: range listed %v", name, all)
+		}
+		if all := rangeAll(CacheRequest{Count: 7}); !slices.Equal(all, keys) {
+			t.Errorf("%s: range of all the keys listed %v", name, all)
+		}
+		if resp := m.HandleRequest(CacheRequest{Command: "range", From: "key45", Count: 5}); !slices.Equal(resp.Keys, keys[45:]) || resp.Next != "" {
+			t.Errorf("%s: the last page was %v", name, resp)
+		}
+		if resp := m.HandleRequest(CacheRequest{Command: "range", From: "key45", Count: 2}); resp.Next != "key47" {
+			t.Errorf("%s: the next page must start from key47, the response was %v", name, resp)
+		}
+		if all := rangeAll(CacheRequest{Namespace: "team"}); !slices.Equal(all, []string{"key00", "other"}) {
+			t.Errorf("%s: range of a namespace listed %v", name, all)
+		}
+		if all := rangeAll(CacheRequest{Namespace: "team", From: "l", Count: 1}); !slices.Equal(all, []string{"other"}) {
+			t.Errorf("%s: range of a namespace listed %v", name, all)
+		}
+
+		for _, rq := range []CacheRequest{
+			{Command: "range", From: "b", To: "a"},
+			{Command: "range", Count: MaxScanCount + 1},
+			{Command: "range", Keys: []string{"k"}},
+			{Command: "range", From: "team\x1fkey00"},
+		} {
+			if resp := m.HandleRequest(rq); resp.Status != "Error" || resp.Kind != BadRequest {
+				t.Errorf("%s: request %+v must be rejected, response was %v", name, rq, resp)
+			}
+		}
+	}
+}
+
+func TestDateNodesManager_Inspect(t *testing.T) {
+
+	// all the replicas answer the writes and the reads, so their counters are known
+	m, _, _ := newReplicatedManager(t, 4, ManagerOptions{Replicas: 3, WriteQuorum: 3, ReadQuorum: 3})
+	m.HandleRequest(CacheRequest{Command: "put", Keys: []string{"k"}, Values: []any{"v"}})
+	m.HandleRequest(CacheRequest{Command: "put", Namespace: "team", Keys: []string{"k"}, Values: []any{"t"}, TTL: time.Minute})
+
+	resp := m.HandleRequest(CacheRequest{Command: "inspect", Keys: []string{"k", "missing"}})
+	if resp.Status != "OK" || len(resp.Owners["k"]) != 3 || len(resp.Owners["missing"]) != 3 || len(resp.Info["k"]) != 3 || len(resp.Info) != 1 {
+		t.Fatalf("inspect returned %+v", resp)
+	}
+	for i, info := range resp.Info["k"] {
+		if info.Node != resp.Owners["k"][i] || info.Writes != 1 || info.Reads != 0 || !info.ExpiresAt.IsZero() {
+			t.Errorf("replica %d: %+v, owners %v", i, info, resp.Owners["k"])
+		}
+	}
+
+	// the reads are counted, the inspections are not
+	m.HandleRequest(CacheRequest{Command: "get", Keys: []string{"k"}})
+	reads := func() (total int64) {
+		for _, info := range m.HandleRequest(CacheRequest{Command: "inspect", Keys: []string{"k"}}).Info["k"] {
+			total += info.Reads
+		}
+		return total
+	}
+	if r1, r2 := reads(), reads(); r1 != 3 || r2 != 3 {
+		t.Errorf("reads counted %d and %d, the get read 3 replicas", r1, r2)
+	}
+
+	// the ranks are given when asked for
+	for i, info := range resp.Info["k"] {
+		if info.Rank != 0 {
+			t.Errorf("replica %d has the rank %d, not asked for", i, info.Rank)
+		}
+	}
+	for i, info := range m.HandleRequest(CacheRequest{Command: "inspect", Keys: []string{"k"}, WithRank: true}).Info["k"] {
+		if info.Rank < 1 || info.Rank > info.Records {
+			t.Errorf("replica %d: rank %d of %d records", i, info.Rank, info.Records)
+		}
+	}
+
+	resp = m.HandleRequest(CacheRequest{Command: "inspect", Namespace: "team", Keys: []string{"k"}})
+	if infos := resp.Info["k"]; len(infos) != 3 || infos[0].ExpiresAt.IsZero() || len(resp.Owners["k"]) != 3 {
+		t.Errorf("inspect in a namespace returned %+v", resp)
+	}
+	if resp := m.HandleRequest(CacheRequest{Command: "inspect"}); resp.Status != "Error" || resp.Kind != BadRequest {
+		t.Errorf("inspect without keys must be rejected, response was %v", resp)
+	}
+}
@@ -0,0 +1,61 @@
+package CacheManager
+
+import (
+	"errors"
+
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// Response statuses
+const (
+	StatusOK    = "OK"
+	StatusError = "Error"
+)
+
+// ErrorKind tells why a request failed, the servers map it to their error codes
+type ErrorKind int
+
+const (
+	NoError     ErrorKind = iota // the request succeeded
+	BadRequest                   // the request is malformed, sending it again won't help
+	Unavailable                  // the nodes did not answer or the quorum was not reached
+	Conflict                     // a record did not have the version a "cas" expected
+)
+
+// Response is the answer of the cache manager to a request, the web server sends it to the clients as JSON
+type Response struct {
+	Status   string                          `json:"status"`             // StatusOK or StatusError
+	Message  string                          `json:"message,omitempty"`  // what was done or what went wrong
+	Result   map[string]any                  `json:"result,omitempty"`   // "get": the records found
+	Meta     map[string]DataNode.EntryMeta   `json:"meta,omitempty"`     // "get": metadata of the records found, if asked
+	Nodes    []string                        `json:"nodes,omitempty"`    // the status request: states of the nodes
+	Deleted  []string                        `json:"deleted,omitempty"`  // "del": the keys which existed, sorted
+	Stored   []string                        `json:"stored,omitempty"`   // "add", "replace" and "cas": the keys stored, sorted
+	Skipped  []string                        `json:"skipped,omitempty"`  // "add" and "replace": the keys not stored, the existing or the missing ones, sorted
+	Previous map[string]any                  `json:"previous,omitempty"` // "getset": the values the keys had, the keys which did not exist are missing
+	Versions map[string]string               `json:"versions,omitempty"` // versions of the records read or written, decimal as doubles can't hold them
+	Keys     []string                        `json:"keys,omitempty"`     // "scan" and "range": the keys of the page, sorted
+	Cursor   string                          `json:"cursor,omitempty"`   // "scan": the cursor of the next page, ScanDone after the last one
+	Next     string                          `json:"next,omitempty"`     // "range": the key the next page starts from, missing after the last one
+	Owners   map[string][]string             `json:"owners,omitempty"`   // "inspect": the nodes the keys belong to, the owner first
+	Info     map[string][]DataNode.EntryInfo `json:"info,omitempty"`     // "inspect": the records on the owners keeping them, in the order of Owners
+	Debug    []string                        `json:"debug,omitempty"`    // "put": messages of the nodes
+	Kind     ErrorKind                       `json:"-"`                  // why the request failed
+}
+
+// a failed request
+func errorResponse(kind ErrorKind, message string) Response {
+	return Response{
+		Status:  StatusError,
+		Message: message,
+		Kind:    kind,
+	}
+}
+
+// Err returns the message of a failed request as an error, nil if the request succeeded
+func (r Response) Err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+	return errors.New(r.Message)
+}
@@ -0,0 +1,153 @@
+package CacheManager
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// DefaultScanCount is the number of keys of a scan or a range page by default
+const DefaultScanCount = 100
+
+// MaxScanCount is the largest number of keys of a scan or a range page
+const MaxScanCount = 10000
+
+// ScanDone is the cursor of a finished scan, a scan starts with it too
+const ScanDone = "0"
+
+// errCursorNode is the error of a scan cursor whose node was removed, the scan must start again
+var errCursorNode = errors.New("the node of the cursor was removed, start the scan again")
+
+// the cursor of a scan position: the id of the node and the last key listed from it. The nodes are scanned
+// in the order of their ids, so the nodes added or removed elsewhere do not move the position
+func encodeCursor(node string, after string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(node)) + "." + base64.RawURLEncoding.EncodeToString([]byte(after))
+}
+
+// the scan position of a cursor, no node for "" and ScanDone: the scan starts with the first one
+func decodeCursor(cursor string) (node string, after string, err error) {
+	if cursor == "" || cursor == ScanDone {
+		return "", "", nil
+	}
+	encodedNode, encodedAfter, ok := strings.Cut(cursor, ".")
+	id, err := base64.RawURLEncoding.DecodeString(encodedNode)
+	if !ok || err != nil || len(id) == 0 {
+		return "", "", fmt.Errorf("bad cursor %q", cursor)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(encodedAfter)
+	if err != nil {
+		return "", "", fmt.Errorf("bad cursor %q", cursor)
+	}
+	return string(id), string(b), nil
+}
+
+// lists a page of the keys of the node at the position of a cursor, in lexical order, the first node if node is "".
+// Every key is listed by its first owner only, so the replicas do not repeat it. A page may have fewer keys than count,
+// even none, before the scan is done.
+// Returns the keys and the cursor of the next page, ScanDone after the last one, errCursorNode if the node was removed
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) scan(node string, after string, count int, prefix string, pattern string) ([]string, string, error) {
+
+	ids := m.partitioner.Nodes()
+	if len(ids) == 0 {
+		return nil, ScanDone, nil
+	}
+	i := 0 // position of the node in the sorted ids
+	if node != "" {
+		var found bool
+		if i, found = slices.BinarySearch(ids, node); !found {
+			return nil, "", errCursorNode
+		}
+	}
+	id := ids[i]
+	resp, err := m.callNode(m.nodeCh[id], DataNode.DNRequest{Command: "scan", After: after, Limit: count, Prefix: prefix, Pattern: pattern})
+	if err == nil && resp.Status != "OK" {
+		err = errors.New(resp.Message)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("node %s error: %w", id, err)
+	}
+
+	keys := make([]string, 0, len(resp.Keys))
+	for _, k := range resp.Keys {
+		if m.partitioner.Owners(k, 1)[0] == id {
+			keys = append(keys, k)
+		}
+	}
+	next := ScanDone
+	if resp.More {
+		next = encodeCursor(id, resp.Keys[len(resp.Keys)-1])
+	} else if i+1 < len(ids) {
+		next = encodeCursor(ids[i+1], "")
+	}
+	return keys, next, nil
+}
+
+// lists a node's keys from from to to, "" for no end, up to limit of them
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) rangeNode(id string, from string, to string, limit int) ([]string, error) {
+	resp, err := m.callNode(m.nodeCh[id], DataNode.DNRequest{Command: "range", From: from, To: to, Limit: limit})
+	if err == nil && resp.Status != "OK" {
+		err = errors.New(resp.Message)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("node %s error: %w", id, err)
+	}
+	return resp.Keys, nil
+}
+
+// lists up to limit keys from the key from, inclusive, to the key to, exclusive, "" for no end, in lexical order.
+// With a Ranger the owners of the ranges are read one after the other until the page is full, otherwise every node
+// gives its first keys and the pages are merged, the replicas repeating a key are listed once.
+// Returns the keys and the key the next page starts from, "" after the last page
+// warning: not protected by the mutex, the caller holds it
+func (m *DateNodesManager) rangeKeys(from string, to string, limit int) ([]string, string, error) {
+
+	// a key more than the page tells where the next page starts
+	if ranger, ok := m.partitioner.(Ranger); ok {
+		var keys []string
+		for _, kr := range ranger.Ranges(from, to) {
+			found, err := m.rangeNode(kr.Node, kr.From, kr.To, limit-len(keys)+1)
+			if err != nil {
+				return nil, "", err
+			}
+			if len(keys)+len(found) > limit {
+				return append(keys, found[:limit-len(keys)]...), found[limit-len(keys)], nil
+			}
+			keys = append(keys, found...)
+		}
+		return keys, "", nil
+	}
+
+	requests := make(map[string]DataNode.DNRequest, len(m.nodeCh))
+	for id := range m.nodeCh {
+		requests[id] = DataNode.DNRequest{Command: "range", From: from, To: to, Limit: limit + 1}
+	}
+	var keys []string
+	var errMessages []string
+	for r := range m.fanOut(requests) {
+		if r.err == nil && r.resp.Status != "OK" {
+			r.err = errors.New(r.resp.Message)
+		}
+		if r.err != nil {
+			errMessages = append(errMessages, fmt.Sprintf("node %s error: %s", r.id, r.err))
+			continue
+		}
+		keys = append(keys, r.resp.Keys...)
+	}
+	if len(errMessages) > 0 {
+		sort.Strings(errMessages)
+		return nil, "", fmt.Errorf("%v", errMessages)
+	}
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+	if len(keys) > limit {
+		return keys[:limit], keys[limit], nil
+	}
+	return keys, "", nil
+}
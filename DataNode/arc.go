@@ -0,0 +1,84 @@
+package DataNode
+
+// arcPolicy is the Adaptive Replacement Cache (Megiddo, Modha).
+// t1 holds records seen once recently, t2 records seen at least twice.
+// b1 and b2 are ghost lists remembering keys recently evicted from t1 and t2:
+// a miss found in b1 means t1 should be larger, a miss found in b2 means t2 should be larger,
+// p is the adaptive target size of t1.
+type arcPolicy struct {
+	capacity int
+	p        int // target size of t1
+	t1, t2   *keyList
+	b1, b2   *keyList
+}
+
+func (a *arcPolicy) New(capacity int) *arcPolicy {
+	a.capacity = capacity
+	a.p = 0
+	a.t1, a.t2 = newKeyList(), newKeyList()
+	a.b1, a.b2 = newKeyList(), newKeyList()
+	return a
+}
+
+func (a *arcPolicy) Insert(key string) {
+	switch {
+	case a.t1.contains(key) || a.t2.contains(key):
+		a.Access(key)
+		return
+	case a.b1.contains(key): // recency was undervalued
+		a.p = min(a.capacity, a.p+max(a.b2.Len()/max(a.b1.Len(), 1), 1))
+		a.b1.remove(key)
+		a.t2.pushFront(key)
+	case a.b2.contains(key): // frequency was undervalued
+		a.p = max(0, a.p-max(a.b1.Len()/max(a.b2.Len(), 1), 1))
+		a.b2.remove(key)
+		a.t2.pushFront(key)
+	default:
+		a.t1.pushFront(key)
+	}
+	a.trimGhosts()
+}
+
+// keeps |t1|+|b1| <= c and the whole directory <= 2c
+func (a *arcPolicy) trimGhosts() {
+	for a.t1.Len()+a.b1.Len() > a.capacity && a.b1.Len() > 0 {
+		a.b1.popBack()
+	}
+	for a.t1.Len()+a.t2.Len()+a.b1.Len()+a.b2.Len() > 2*a.capacity && a.b2.Len() > 0 {
+		a.b2.popBack()
+	}
+}
+
+func (a *arcPolicy) Access(key string) {
+	if a.t1.remove(key) || a.t2.contains(key) {
+		a.t2.pushFront(key)
+	}
+}
+
+func (a *arcPolicy) Remove(key string) {
+	if !a.t1.remove(key) {
+		a.t2.remove(key)
+	}
+}
+
+// the REPLACE step: evict from t1 if it's over its target, from t2 otherwise. The victim goes to a ghost list
+func (a *arcPolicy) Evict() (string, bool) {
+	if a.t1.Len() > 0 && (a.t1.Len() > a.p || a.t2.Len() == 0) {
+		key, _ := a.t1.popBack()
+		a.b1.pushFront(key)
+		a.trimGhosts()
+		return key, true
+	}
+	key, ok := a.t2.popBack()
+	if ok {
+		a.b2.pushFront(key)
+		a.trimGhosts()
+	}
+	return key, ok
+}
+
+func (a *arcPolicy) Keys() []string {
+	return a.t1.appendKeys(a.t2.appendKeys(make([]string, 0, a.Len())))
+}
+
+func (a *arcPolicy) Len() int { return a.t1.Len() + a.t2.Len() }
@@ -0,0 +1,166 @@
+package DataNode
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	errNotInteger = errors.New("value is not an integer")
+	errOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// adds the deltas to the records, a missing or expired record counts as zero and is created.
+// A delta is an int64 or a float64: an int64 needs an integer value, a float64 takes any number.
+// The records keep their type: strings stay strings, so the text protocols read the numbers back.
+// An existing record keeps its expiry, flags and tags, a new one gets meta. The new version is the larger one
+// of meta.Version and the next version of the record, so the increments always apply.
+// Returns the keys incremented with their new values and metadata, and the errors of the others
+func (n *SingleDataNode) incrementRecords(keys []string, deltas []any, meta []EntryMeta) (resKeys []string, resValues []any, resMeta []EntryMeta, err error) {
+
+	if len(deltas) != len(keys) || (meta != nil && len(meta) != len(keys)) {
+		return nil, nil, nil, fmt.Errorf("bad keys/deltas/meta array dimensions %d/%d/%d", len(keys), len(deltas), len(meta))
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	var errs []error
+	now := time.Now()
+	for i, k := range keys {
+		var m EntryMeta
+		if meta != nil {
+			m = meta[i]
+		}
+		var current any
+		if de, ok := n.dataMap[k]; ok {
+			if de.expired(now) {
+				n.removeRecord(de)
+			} else {
+				current = de.value
+				m.ExpiresAt, m.Flags, m.ContentType, m.Tags = de.expiresAt, de.flags, de.contentType, de.tags
+				m.Version = max(m.Version, de.version+1)
+			}
+		}
+		if current == nil { // a new record is newer than the delete of the key
+			m.Version = max(m.Version, n.tombstones[k].version+1)
+		}
+		value, e := addNumber(current, deltas[i])
+		if e != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k, e))
+			continue
+		}
+		if e = n.fits(k, n.recordSize(k, value)); e != nil {
+			errs = append(errs, e)
+			continue
+		}
+		n.storeSingleRecord(k, value, m)
+		resKeys = append(resKeys, k)
+		resValues = append(resValues, value)
+		resMeta = append(resMeta, n.dataMap[k].meta())
+	}
+	return resKeys, resValues, resMeta, errors.Join(errs...)
+}
+
+// adds a delta to a value of the cache. nil is zero of the delta type,
+// strings and byte slices holding numbers give strings and byte slices
+func addNumber(value any, delta any) (any, error) {
+	switch v := value.(type) {
+	case nil:
+		return delta, nil
+	case string:
+		sum, err := addText(v, delta)
+		if err != nil {
+			return nil, err
+		}
+		return sum, nil
+	case []byte:
+		sum, err := addText(string(v), delta)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(sum), nil
+	}
+
+	var i int64
+	switch v := value.(type) {
+	case float32:
+		return addFloat(float64(v), delta)
+	case float64:
+		return addFloat(v, delta)
+	case int:
+		i = int64(v)
+	case int8:
+		i = int64(v)
+	case int16:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint8:
+		i = int64(v)
+	case uint16:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	default:
+		return nil, fmt.Errorf("value of type %T is not a number", value)
+	}
+
+	switch d := delta.(type) {
+	case int64:
+		if (d > 0 && i > math.MaxInt64-d) || (d < 0 && i < math.MinInt64-d) {
+			return nil, errOverflow
+		}
+		return i + d, nil
+	case float64:
+		return addFloat(float64(i), d)
+	}
+	return nil, fmt.Errorf("delta of type %T is not a number", delta)
+}
+
+// adds a delta to a float, an integer delta needs an integer value
+func addFloat(f float64, delta any) (any, error) {
+	switch d := delta.(type) {
+	case int64:
+		if f != math.Trunc(f) {
+			return nil, errNotInteger
+		}
+		sum := f + float64(d)
+		if math.IsInf(sum, 0) {
+			return nil, errOverflow
+		}
+		return sum, nil
+	case float64:
+		sum := f + d
+		if math.IsInf(sum, 0) || math.IsNaN(sum) {
+			return nil, errOverflow
+		}
+		return sum, nil
+	}
+	return nil, fmt.Errorf("delta of type %T is not a number", delta)
+}
+
+// adds a delta to a number written as text, gives the text of the sum
+func addText(s string, delta any) (string, error) {
+	var sum any
+	var err error
+	if i, e := strconv.ParseInt(s, 10, 64); e == nil {
+		sum, err = addNumber(i, delta)
+	} else if f, e := strconv.ParseFloat(s, 64); e == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		sum, err = addFloat(f, delta)
+	} else {
+		return "", errors.New("value is not a number")
+	}
+	if err != nil {
+		return "", err
+	}
+	if f, ok := sum.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+	return strconv.FormatInt(sum.(int64), 10), nil
+}
@@ -0,0 +1,84 @@
+package DataNode
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_addNumber(t *testing.T) {
+
+	for _, tt := range []struct {
+		value    any
+		delta    any
+		expected any // nil if an error is expected
+	}{
+		{nil, int64(5), int64(5)},
+		{nil, 0.5, 0.5},
+		{10, int64(-3), int64(7)},
+		{int64(10), 0.5, 10.5},
+		{2.0, int64(1), 3.0},
+		{2.5, 0.25, 2.75},
+		{2.5, int64(1), nil},
+		{"41", int64(1), "42"},
+		{"1.5", 0.25, "1.75"},
+		{"1.5", int64(1), nil},
+		{[]byte("9"), int64(1), []byte("10")},
+		{"abc", int64(1), nil},
+		{true, int64(1), nil},
+		{map[string]any{}, 1.0, nil},
+		{int64(math.MaxInt64), int64(1), nil},
+		{int64(math.MinInt64), int64(-1), nil},
+		{math.MaxFloat64, math.MaxFloat64, nil},
+	} {
+		got, err := addNumber(tt.value, tt.delta)
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("addNumber(%v, %v) = %v, expected an error", tt.value, tt.delta, got)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("addNumber(%v, %v) = %v %v, expected %v", tt.value, tt.delta, got, err, tt.expected)
+		}
+	}
+}
+
+func TestSingleDataNode_incrementRecords(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 10)
+	expires := time.Now().Add(time.Hour)
+	_ = n.storeMultipleRecords([]string{"hits", "name"}, []any{"10", "Ann"}, 0, []EntryMeta{{ExpiresAt: expires, Flags: 3, Version: 5}, {}})
+
+	keys, values, meta, err := n.incrementRecords([]string{"hits", "name", "new", "new"}, []any{int64(5), int64(1), 1.5, 1.5}, []EntryMeta{{Version: 2}, {}, {Version: 9}, {Version: 9}})
+	if err == nil {
+		t.Errorf("incrementRecords() must fail for the name")
+	}
+	if !slices.Equal(keys, []string{"hits", "new", "new"}) || !reflect.DeepEqual(values, []any{"15", 1.5, 3.0}) {
+		t.Errorf("incrementRecords() returned %v %v", keys, values)
+	}
+	// the record keeps its expiry and flags, the versions always grow
+	if !meta[0].ExpiresAt.Equal(expires) || meta[0].Flags != 3 || meta[0].Version != 6 || meta[1].Version != 9 || meta[2].Version != 10 {
+		t.Errorf("incrementRecords() returned metadata %+v", meta)
+	}
+
+	// concurrent increments through the channel are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				backCh := make(chan DNResponse, 1)
+				n.GetChannel() <- DNRequest{Command: "incr", Keys: []string{"concurrent"}, Values: []any{int64(1)}, BackCh: backCh}
+				<-backCh
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _, _, _ := n.findSingleKey("concurrent"); v != int64(1000) {
+		t.Errorf("expected 1000 after the concurrent increments, got %v", v)
+	}
+}
@@ -1,66 +1,194 @@
 package DataNode
 
 import (
-	"container/list"
+	"container/heap"
 	"context"
 	"fmt"
 	"log"
+	"path"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 // internal store element
 type dataEntry struct {
-	key         string // element's key
-	value       any    // the data
-	useCounterR int64  // number of reads
-	useCounterW int64  // number of writes
+	key         string    // element's key
+	value       any       // the data
+	useCounterR int64     // number of reads
+	useCounterW int64     // number of writes
+	expiresAt   time.Time // when the record expires, zero if never
+	heapIndex   int       // position in the expiry heap, -1 if the record has no TTL
+	size        int       // bytes taken by the key and the value
+	version     uint64    // grows with every write, replicas compare versions to find the latest value
+	flags       uint32    // opaque client flags, memcached clients keep the value type there
+	contentType string    // media type of a raw value, empty if not known
+	tags        []string  // tags the record is invalidated by, sorted
+	createdAt   time.Time // when the node got the record
+	accessedAt  time.Time // the last read, zero if never read
+	writtenAt   time.Time // the last write
+	shared      bool      // the value was handed out or given by a caller, an operation changes a copy of it
+}
+
+// EntryMeta is the record metadata travelling with the records between the nodes and the manager
+type EntryMeta struct {
+	ExpiresAt   time.Time // when the record expires, zero if never
+	Version     uint64    // record version. Zero in a "put" lets the node count versions itself
+	Flags       uint32    // opaque client flags stored with the value
+	ContentType string    // media type of a raw value uploaded over HTTP, empty if not known
+	Tags        []string  // tags the record is invalidated by, sorted, see CheckTags
+	Deleted     bool      // a tombstone: the key was deleted with Version, there is no value
 }
 
 // DNRequest is a request struct sent from manager to the node
 type DNRequest struct {
-	Command string          // one of the "get" "put" "del"
-	Keys    []string        // array of keys
-	Values  []any           // array of values
-	BackCh  chan DNResponse // channel to reply
+	Command   string          // one of the "get" "put" "add" "replace" "cas" "getset" "incr" "op" "del" "invalidate" "scan" "range" "inspect" "dump" "quota"
+	Keys      []string        // array of keys
+	Values    []any           // array of values, the int64 or float64 deltas for "incr"
+	TTL       time.Duration   // time to live of the records for "put", "add", "replace", "cas" and "getset", zero means forever
+	Meta      []EntryMeta     // optional, metadata of the records to store, parallel to Keys. Overrides TTL, older versions are ignored. "del": the versions of the deletes, see tombstones.go
+	Versions  []uint64        // "cas": the versions the records must have to be stored, "op": to be changed, zero if a record must be absent
+	Ops       []StructOp      // "op": the operations on the typed values of the records, parallel to Keys
+	Prefix    string          // optional, "del" deletes and "scan" lists the keys starting with it
+	Pattern   string          // optional, "del" deletes and "scan" lists the keys matching this glob, path.Match syntax
+	After     string          // "scan": the keys listed are greater than this one, "" for the first page
+	From      string          // "range": the first key listed, inclusive
+	To        string          // "range": the keys listed are less than this one, "" for no end
+	Limit     int             // "scan" and "range": the most keys listed
+	Namespace string          // "quota" sets the quota of this namespace, "get" without keys gives its usage, "invalidate" deletes in it
+	Tags      []string        // "invalidate" deletes the records having any of these tags
+	Quota     Quota           // "quota": the quota, zero removes it
+	Deadline  time.Time       // optional, a RemoteNode fails the request when it waits for the response longer, zero means no limit
+	Deleted   bool            // "get": answer the keys deleted with a version too, with their tombstones in Meta
+	WithRank  bool            // "inspect": give the ranks of the records in the eviction order too, it reads the whole order
+	BackCh    chan DNResponse // channel to reply
 }
 
 // DNResponse response struct from a node to the cache manager
 type DNResponse struct {
-	Status  string   // "OK" or "Error" for good or bad cases
-	Message string   // text to read
-	Count   int      // generally a number of single ops (i.e. records saved or deleted)
-	Keys    []string // found records keys
-	Values  []any    // their values
+	Status   string      // "OK" or "Error" for good or bad cases
+	Message  string      // text to read
+	Count    int         // generally a number of single ops (i.e. records saved or deleted)
+	Keys     []string    // found records keys, the keys stored by "add", "replace" and "cas", the keys incremented by "incr", the keys "getset" replaced, the keys "op" applied to
+	Values   []any       // their values, the new values for "incr", the previous values for "getset"
+	Meta     []EntryMeta // metadata of the records for "get", "incr", "getset", "op" and "dump", parallel to Keys, the tombstones for "get" with Deleted
+	Results  []any       // "op": the results of the operations, parallel to Keys
+	Versions []uint64    // "op": the versions the records had before the operations, zero for the absent ones, parallel to Keys
+	Bytes    int64       // bytes used by the node or by the namespace, for the status request
+	Quota    Quota       // quota of the namespace, for the status request of a namespace
+	More     bool        // "scan" and "range": there are more keys after the ones listed
+	Info     []EntryInfo // "inspect": usage and eviction rank of the records, parallel to Keys
 }
 
 const queueSize = 100
 
+// NodeOptions are the node settings
+type NodeOptions struct {
+	MaxSize  int    // node capacity, number of records
+	MaxBytes int64  // node capacity, bytes taken by keys and values. Zero means no byte limit
+	Policy   string // eviction policy, one of the PolicyNames, "lru" if empty
+	Sizer    Sizer  // measures the values, DefaultSizer if nil
+
+	DataDir          string        // directory of the append-only log and the snapshots, no persistence if empty
+	Fsync            string        // log fsync policy, one of the FsyncPolicies, FsyncEverySec if empty
+	SnapshotInterval time.Duration // how often a snapshot is written, DefaultSnapshotInterval if not positive
+
+	Quotas map[string]Quota // quotas of the namespaces, they can be changed with the "quota" command
+
+	Ordered bool // keep the keys in lexical order too, so "range" and "scan" read only the keys they list
+}
+
 // SingleDataNode data node class
 type SingleDataNode struct {
-	sync.Mutex                          // lock for concurrent ops
-	ctx        context.Context          // exec context with cancel
-	dataCh     chan DNRequest           // channel to receive requests
-	data       *list.List               // data storage. Note: we will keep fresh data in the front, we will kill old data from the back
-	dataMap    map[string]*list.Element // map of the elements
-	maxSize    int                      // node capacity
-	nodeId     string                   // id for logging
+	sync.Mutex                               // lock for concurrent ops
+	ctx           context.Context            // exec context with cancel
+	dataCh        chan DNRequest             // channel to receive requests
+	dataMap       map[string]*dataEntry      // data storage
+	policy        EvictionPolicy             // decides which record is evicted when the node is full
+	policyName    string                     // to recreate the policy when the node is cleared
+	expiry        expiryHeap                 // records having a TTL, the one expiring first on top
+	maxSize       int                        // node capacity
+	maxBytes      int64                      // node capacity in bytes, zero if not limited
+	usedBytes     int64                      // bytes taken by the records
+	namespaces    map[string]*namespace      // usage and quotas of the namespaces
+	tags          map[string]map[string]bool // tag index: the keys of the records having the tag
+	tombstones    map[string]tombstone       // keys deleted with a version, kept for tombstoneTTL
+	tombstoneAges []tombstoneAge             // the tombstones in the order of the deletes
+	ordered       *orderedKeys               // keys in lexical order, nil if the node does not keep them
+	sizer         Sizer                      // measures the values
+	customSizer   bool                       // the sizer is not DefaultSizer, an operation measures the whole value then
+	persist       *persistence               // append-only log and snapshots, nil if the node is not persistent
+	nodeId        string                     // id for logging
 }
 
-// New  constructs a node
+// New  constructs a node with LRU eviction
 // --> Input:
 // ctx         context.Context     execution context
 // maxSize     int                 node max size
 // <-- Output:
 // 1) *SingleDataNode     initialized node
 func (n *SingleDataNode) New(ctx context.Context, id string, maxSize int) *SingleDataNode {
-	n.data = list.New()
-	n.dataMap = make(map[string]*list.Element)
+	n, _ = n.NewWithOptions(ctx, id, NodeOptions{MaxSize: maxSize})
+	return n
+}
+
+// NewWithOptions  constructs a node
+// --> Input:
+// ctx         context.Context     execution context
+// id          string              node id for logging
+// opts        NodeOptions         node settings
+// <-- Output:
+// 1) *SingleDataNode     initialized node
+// 2) error               if the options are bad, the node is not started then
+func (n *SingleDataNode) NewWithOptions(ctx context.Context, id string, opts NodeOptions) (*SingleDataNode, error) {
+	policy, err := NewEvictionPolicy(opts.Policy, opts.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	n.dataMap = make(map[string]*dataEntry)
+	n.policy = policy
+	n.policyName = opts.Policy
 	n.ctx = ctx
 	n.nodeId = id
-	n.maxSize = maxSize
+	n.maxSize = opts.MaxSize
+	n.maxBytes = opts.MaxBytes
+	n.usedBytes = 0
+	n.sizer = opts.Sizer
+	n.customSizer = opts.Sizer != nil
+	if n.sizer == nil {
+		n.sizer = DefaultSizer
+	}
+	n.expiry = nil
+	n.tags = make(map[string]map[string]bool)
+	n.tombstones = make(map[string]tombstone)
+	n.tombstoneAges = nil
+	n.ordered = nil
+	if opts.Ordered {
+		n.ordered = newOrderedKeys()
+	}
+	n.namespaces = make(map[string]*namespace)
+	for name, quota := range opts.Quotas {
+		if quota != (Quota{}) {
+			n.namespaces[name] = &namespace{quota: quota, policy: n.namespacePolicy(quota)}
+		}
+	}
+	n.persist = nil
+	if opts.DataDir != "" {
+		p, err := newPersistence(id, opts)
+		if err != nil {
+			return nil, err
+		}
+		if err = n.restore(p); err != nil {
+			return nil, err
+		}
+		n.persist = p
+		go n.persistLoop()
+	}
 	n.dataCh = make(chan DNRequest, queueSize)
 	go n.mainLoop()
-	return n
+	go n.sweepLoop()
+	return n, nil
 }
 
 // GetChannel gives request channel
@@ -74,97 +202,509 @@ func (n *SingleDataNode) findSingleKey(key string) (any, int64, int64, bool) {
 	n.Lock()
 	defer n.Unlock()
 
-	e, ok := n.dataMap[key]
+	de, ok := n.dataMap[key]
+	if ok && de.expired(time.Now()) {
+		n.removeRecord(de)
+		ok = false
+	}
 	if ok {
-		de := e.Value.(*dataEntry)
 		de.useCounterR += 1
-		n.data.MoveToFront(e)
+		de.accessedAt = time.Now()
+		n.access(key)
+		de.shared = true
 		return de.value, de.useCounterR, de.useCounterW, true
 	}
 	return nil, 0, 0, false
 }
 
-func (n *SingleDataNode) findMultipleKeys(keys []string) (resKeys []string, resValues []any) {
+// finds the records of the keys, and the tombstones of the keys deleted with a version if deleted is set
+func (n *SingleDataNode) findMultipleKeys(keys []string, deleted bool) (resKeys []string, resValues []any, resMeta []EntryMeta) {
 
 	n.Lock()
 	defer n.Unlock()
 
-	var needTouch []*list.Element // the records need to be refreshed
+	now := time.Now()
 	for _, key := range keys {
-		if e, ok := n.dataMap[key]; ok {
-			e.Value.(*dataEntry).useCounterR += 1
-			needTouch = append(needTouch, e)
-			resKeys = append(resKeys, e.Value.(*dataEntry).key)
-			resValues = append(resValues, e.Value.(*dataEntry).value)
+		de, ok := n.dataMap[key]
+		if ok && de.expired(now) { // lazy expiry
+			n.removeRecord(de)
+			ok = false
+		}
+		if ok {
+			de.useCounterR += 1
+			de.accessedAt = now
+			n.access(key)
+			resKeys = append(resKeys, de.key)
+			resValues = append(resValues, de.value)
+			resMeta = append(resMeta, de.meta())
+			de.shared = true
+		} else if t, found := n.tombstones[key]; found && deleted {
+			resKeys = append(resKeys, key)
+			resValues = append(resValues, nil)
+			resMeta = append(resMeta, EntryMeta{Version: t.version, Deleted: true})
 		}
 	}
+	return resKeys, resValues, resMeta
+}
 
-	for _, e := range needTouch {
-		n.data.MoveToFront(e)
+// metadata of a record
+func (de *dataEntry) meta() EntryMeta {
+	return EntryMeta{
+		ExpiresAt:   de.expiresAt,
+		Version:     de.version,
+		Flags:       de.flags,
+		ContentType: de.contentType,
+		Tags:        de.tags,
 	}
-	return resKeys, resValues
 }
 
-// puts a new record or updates if exists. returns true if it's new, false if updated
+// removes a record from the map, the eviction policy and the expiry heap
 // warning: not protected by a mutex
-func (n *SingleDataNode) storeSingleRecord(key string, value any) bool {
+func (n *SingleDataNode) removeRecord(de *dataEntry) {
+	n.setExpiry(de, time.Time{})
+	n.policy.Remove(de.key)
+	n.nsRemove(de)
+	n.tagRemove(de)
+	if n.ordered != nil {
+		n.ordered.remove(de.key)
+	}
+	n.usedBytes -= int64(de.size)
+	delete(n.dataMap, de.key)
+}
 
-	e, ok := n.dataMap[key]
+// evicts the record chosen by the policy
+// warning: not protected by a mutex
+func (n *SingleDataNode) evictRecord() bool {
+	key, ok := n.policy.Evict()
+	if !ok {
+		return false
+	}
+	if de, found := n.dataMap[key]; found {
+		n.setExpiry(de, time.Time{})
+		n.nsRemove(de)
+		n.tagRemove(de)
+		if n.ordered != nil {
+			n.ordered.remove(key)
+		}
+		n.usedBytes -= int64(de.size)
+		delete(n.dataMap, key)
+		n.logDel(key)
+	}
+	return true
+}
+
+// evicts records until a record of the given size fits under both limits.
+// The current version of the record, if any, is not counted, but it may be evicted itself
+// warning: not protected by a mutex
+func (n *SingleDataNode) makeRoom(key string, size int) {
+	for {
+		count, used := len(n.dataMap), n.usedBytes
+		if de, ok := n.dataMap[key]; ok {
+			count--
+			used -= int64(de.size)
+		}
+		if count < n.maxSize && (n.maxBytes <= 0 || used+int64(size) <= n.maxBytes) {
+			return
+		}
+		if !n.evictRecord() {
+			return
+		}
+	}
+}
+
+// puts a new record or updates if exists. returns false if the record has a newer version already
+// meta.ExpiresAt is zero if the record never expires, zero meta.Version means the next version
+// warning: not protected by a mutex
+func (n *SingleDataNode) storeSingleRecord(key string, value any, meta EntryMeta) bool {
+	return n.storeRecord(key, value, n.recordSize(key, value), true, meta)
+}
+
+// storeSingleRecord of a record of the size given. shared tells if the caller keeps the value, see dataEntry.shared
+// warning: not protected by a mutex
+func (n *SingleDataNode) storeRecord(key string, value any, size int, shared bool, meta EntryMeta) bool {
+
+	if de, ok := n.dataMap[key]; ok && meta.Version != 0 && meta.Version <= de.version {
+		return false // a stale or repeated write, e.g. a late replica update
+	}
+	deletedVersion := n.tombstones[key].version
+	if meta.Version != 0 && meta.Version <= deletedVersion {
+		return false // the key was deleted after this write
+	}
+
+	now := time.Now()
+	// check if there is space, the policy chooses whom to kill. A namespace over its quota loses its own records
+	n.makeNamespaceRoom(key, size)
+	n.makeRoom(key, size)
+
+	de, ok := n.dataMap[key]
 	if ok {
-		de := e.Value.(*dataEntry)
 		de.useCounterW++
+		de.writtenAt = now
 		de.value = value
-		n.data.MoveToFront(e)
-		return false // element exists already, update and make most recent
-	}
-	// check if there is space
-	if n.data.Len() >= n.maxSize {
-		// the list is full, we got to kill the back element.
-		// note: once this limit is reached we always kill, without calling Len(), do we save anything?
-		backEl := n.data.Back()
-		backKey := backEl.Value.(*dataEntry).key
-		n.data.Remove(n.data.Back())
-		delete(n.dataMap, backKey)
-	}
-	e = n.data.PushFront(&dataEntry{ // make a new pair and push it as the most recent
+		de.shared = shared
+		n.usedBytes += int64(size - de.size)
+		n.namespaceOf(key).bytes += int64(size - de.size)
+		de.size = size
+		de.version = max(meta.Version, de.version+1)
+		de.flags = meta.Flags
+		de.contentType = meta.ContentType
+		n.setTags(de, meta.Tags)
+		n.setExpiry(de, meta.ExpiresAt)
+		n.access(key)
+		n.logPut(de)
+		return true // element exists already, update and tell the policy
+	}
+	de = &dataEntry{ // make a new pair
 		key:         key,
 		value:       value,
 		useCounterW: 1,
-	})
-	n.dataMap[key] = e
+		heapIndex:   -1,
+		size:        size,
+		version:     max(meta.Version, deletedVersion+1),
+		flags:       meta.Flags,
+		contentType: meta.ContentType,
+		tags:        meta.Tags,
+		createdAt:   now,
+		writtenAt:   now,
+		shared:      shared,
+	}
+	n.usedBytes += int64(size)
+	n.setExpiry(de, meta.ExpiresAt)
+	delete(n.tombstones, key)
+	n.dataMap[key] = de
+	n.policy.Insert(key)
+	n.nsInsert(de)
+	n.tagInsert(de)
+	if n.ordered != nil {
+		n.ordered.insert(key)
+	}
+	n.logPut(de)
 	return true
 }
 
 // store records
-func (n *SingleDataNode) storeMultipleRecords(keys []string, values []any) error {
+// ttl is zero if the records never expire. meta is optional and overrides ttl
+func (n *SingleDataNode) storeMultipleRecords(keys []string, values []any, ttl time.Duration, meta []EntryMeta) error {
+	_, err := n.storeRecordsIf("put", keys, values, nil, ttl, meta)
+	return err
+}
+
+// stores the records depending on the command: "put" always, "add" only the absent keys,
+// "replace" only the existing ones, "cas" only the ones having the versions given, zero for the absent ones.
+// Returns the keys stored
+func (n *SingleDataNode) storeRecordsIf(command string, keys []string, values []any, versions []uint64, ttl time.Duration, meta []EntryMeta) (stored []string, err error) {
 
-	if len(values) != len(keys) {
-		return fmt.Errorf("bad keys/values/ndx array dimensions %d/%d", len(keys), len(values))
+	if command != "put" && command != "add" && command != "replace" && command != "cas" {
+		return nil, fmt.Errorf("unknown store command %q", command)
 	}
+	if len(values) != len(keys) || (meta != nil && len(meta) != len(keys)) {
+		return nil, fmt.Errorf("bad keys/values/meta array dimensions %d/%d/%d", len(keys), len(values), len(meta))
+	}
+	if command == "cas" && len(versions) != len(keys) {
+		return nil, fmt.Errorf("bad keys/versions array dimensions %d/%d", len(keys), len(versions))
+	}
+	if err = n.checkRecords(keys, values, ttl); err != nil {
+		return nil, err
+	}
+	var m EntryMeta
+	now := time.Now()
+	if ttl > 0 {
+		m.ExpiresAt = now.Add(ttl)
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	for i, k := range keys {
+		if meta != nil {
+			m = meta[i]
+		}
+		if command != "put" {
+			de, exists := n.dataMap[k]
+			if exists && de.expired(now) {
+				n.removeRecord(de)
+				exists = false
+			}
+			if command == "cas" {
+				var current uint64 // an absent record has version zero
+				if exists {
+					current = de.version
+				}
+				if current != versions[i] {
+					continue
+				}
+			} else if exists != (command == "replace") {
+				continue
+			}
+		}
+		if n.storeSingleRecord(k, values[i], m) {
+			stored = append(stored, k)
+		}
+	}
+	return stored, nil
+}
+
+// stores the records and returns the previous values of the ones which existed with their metadata.
+// Nothing is written between reading a previous value and storing the new one
+func (n *SingleDataNode) swapRecords(keys []string, values []any, ttl time.Duration, meta []EntryMeta) (prevKeys []string, prevValues []any, prevMeta []EntryMeta, err error) {
+
+	if len(values) != len(keys) || (meta != nil && len(meta) != len(keys)) {
+		return nil, nil, nil, fmt.Errorf("bad keys/values/meta array dimensions %d/%d/%d", len(keys), len(values), len(meta))
+	}
+	if err = n.checkRecords(keys, values, ttl); err != nil {
+		return nil, nil, nil, err
+	}
+	var m EntryMeta
+	now := time.Now()
+	if ttl > 0 {
+		m.ExpiresAt = now.Add(ttl)
+	}
+
 	n.Lock()
 	defer n.Unlock()
 
 	for i, k := range keys {
-		n.storeSingleRecord(k, values[i])
+		if meta != nil {
+			m = meta[i]
+		}
+		de, existed := n.dataMap[k]
+		if existed && de.expired(now) { // an expired record is absent, a new one takes its place
+			n.removeRecord(de)
+			existed = false
+		}
+		var prevValue any
+		var prevM EntryMeta
+		if existed {
+			prevValue, prevM = de.value, de.meta()
+			de.shared = true
+		}
+		if n.storeSingleRecord(k, values[i], m) && existed {
+			prevKeys = append(prevKeys, k)
+			prevValues = append(prevValues, prevValue)
+			prevMeta = append(prevMeta, prevM)
+		}
+	}
+	return prevKeys, prevValues, prevMeta, nil
+}
+
+// checks the ttl and that every record fits the node and the quota of its namespace
+func (n *SingleDataNode) checkRecords(keys []string, values []any, ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("bad ttl %v", ttl)
+	}
+	n.Lock()
+	defer n.Unlock()
+	for i, k := range keys {
+		if err := n.fits(k, n.recordSize(k, values[i])); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// tells if a record of the size can be stored: it's not bigger than the node or the byte quota of its namespace
+// warning: not protected by a mutex
+func (n *SingleDataNode) fits(key string, size int) error {
+	if n.maxBytes > 0 && int64(size) > n.maxBytes {
+		return fmt.Errorf("record %s takes %d bytes, more than the node capacity of %d bytes", key, size, n.maxBytes)
+	}
+	name, _ := SplitNamespace(key)
+	if ns := n.namespaces[name]; ns != nil && ns.quota.MaxBytes > 0 && int64(size) > ns.quota.MaxBytes {
+		return fmt.Errorf("record %s takes %d bytes, more than the quota of the namespace %s of %d bytes", key, size, name, ns.quota.MaxBytes)
+	}
+	return nil
+}
+
+// deletes the given keys, returns the keys which existed.
+// meta is optional: a delete with a version leaves a tombstone of the key and spares a record written after it
+func (n *SingleDataNode) deleteRecords(keys []string, meta []EntryMeta) (deleted []string, err error) {
+	if meta != nil && len(meta) != len(keys) {
+		return nil, fmt.Errorf("bad keys/meta array dimensions %d/%d", len(keys), len(meta))
+	}
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	for i, key := range keys {
+		var version uint64
+		if meta != nil {
+			version = meta[i].Version
+		}
+		if de, ok := n.dataMap[key]; ok {
+			if version != 0 && de.version > version {
+				continue // written after the delete
+			}
+			if !de.expired(now) {
+				deleted = append(deleted, key)
+			}
+			n.removeRecord(de)
+			n.logDel(key)
+		}
+		if version != 0 {
+			n.setTombstone(key, version, now)
+		}
+	}
+	return deleted, nil
+}
+
+// deletes the keys starting with the prefix and matching the glob pattern, empty ones match everything
+// in the namespace of the prefix. returns the keys which existed
+func (n *SingleDataNode) deleteMatchingRecords(prefix string, pattern string) (deleted []string, err error) {
+	if _, err = path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+	}
+	n.Lock()
+	defer n.Unlock()
+	var matched []string
+	ns, _ := SplitNamespace(prefix)
+	for key := range n.dataMap {
+		if keyMatches(key, ns, prefix, pattern) {
+			matched = append(matched, key)
+		}
+	}
+	now := time.Now()
+	for _, key := range matched {
+		de := n.dataMap[key]
+		if !de.expired(now) {
+			deleted = append(deleted, key)
+		}
+		n.removeRecord(de)
+		n.logDel(key)
+	}
+	return deleted, nil
+}
+
+// tells if the key is in the namespace, starts with the prefix and matches the pattern, the empty ones match everything
+func keyMatches(key string, ns string, prefix string, pattern string) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	if keyNs, _ := SplitNamespace(key); keyNs != ns {
+		return false
+	}
+	ok, _ := path.Match(pattern, key)
+	return pattern == "" || ok
+}
+
+// lists up to limit live keys greater than after in lexical order, starting with the prefix and matching the pattern
+// in the namespace of the prefix. Tells if there are more keys after them.
+// The ordered index reads the keys listed only, without it the node is locked for one pass over the keys
+// keeping the limit+1 smallest ones in a heap
+func (n *SingleDataNode) scanRecords(after string, prefix string, pattern string, limit int) (keys []string, more bool, err error) {
+	if _, err = path.Match(pattern, ""); err != nil {
+		return nil, false, fmt.Errorf("bad pattern %q: %w", pattern, err)
+	}
+	if limit <= 0 {
+		return nil, false, fmt.Errorf("bad limit %d", limit)
+	}
+	ns, _ := SplitNamespace(prefix)
+	now := time.Now()
+	n.Lock()
+	if n.ordered != nil {
+		defer n.Unlock()
+		keys, more = n.scanOrdered(after, ns, prefix, pattern, limit)
+		return keys, more, nil
+	}
+	smallest := make(keyHeap, 0, min(limit+1, len(n.dataMap)))
+	for key, de := range n.dataMap {
+		if key <= after || (len(smallest) > limit && key >= smallest[0]) {
+			continue
+		}
+		if !keyMatches(key, ns, prefix, pattern) || de.expired(now) {
+			continue
+		}
+		if len(smallest) <= limit {
+			heap.Push(&smallest, key)
+		} else { // the biggest one kept gives way
+			smallest[0] = key
+			heap.Fix(&smallest, 0)
+		}
+	}
+	n.Unlock()
+
+	keys = []string(smallest)
+	slices.Sort(keys)
+	if len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+// keyHeap is a max-heap of keys, the biggest one is on top
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyHeap) Push(x any)        { *h = append(*h, x.(string)) }
+func (h *keyHeap) Pop() any {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+// returns all live records, the most valuable for the eviction policy first, or the live records of the given keys.
+// Does not count as a read and does not change the order
+func (n *SingleDataNode) dumpRecords(only []string) (keys []string, values []any, meta []EntryMeta) {
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	order := only
+	if order == nil {
+		order = n.policy.Keys()
+	}
+	keys = make([]string, 0, len(order))
+	values = make([]any, 0, len(order))
+	meta = make([]EntryMeta, 0, len(order))
+	for _, key := range order {
+		de, ok := n.dataMap[key]
+		if !ok || de.expired(now) {
+			continue
+		}
+		keys = append(keys, de.key)
+		values = append(values, de.value)
+		meta = append(meta, de.meta())
+		de.shared = true
+	}
+	return keys, values, meta
+}
+
 // kills all data, returns number of records deleted
 func (n *SingleDataNode) deleteAllRecords() (count int) {
 	n.Lock()
 	defer n.Unlock()
-	count = n.data.Len()
-	n.data = list.New()
-	n.dataMap = make(map[string]*list.Element)
+	count = len(n.dataMap)
+	n.clearRecords()
+	n.logRecord(logRecord{Op: "flush"})
 	return
 }
 
+// drops all the records
+// warning: not protected by a mutex
+func (n *SingleDataNode) clearRecords() {
+	n.dataMap = make(map[string]*dataEntry)
+	n.usedBytes = 0
+	n.policy, _ = NewEvictionPolicy(n.policyName, n.maxSize) // the name was checked in New
+	n.expiry = nil
+	n.tags = make(map[string]map[string]bool)
+	if n.ordered != nil {
+		n.ordered = newOrderedKeys()
+	}
+	n.clearNamespaces()
+}
+
 // Len returns current data size
 func (n *SingleDataNode) Len() int {
 	n.Lock()
 	defer n.Unlock()
-	return n.data.Len()
+	return len(n.dataMap)
+}
+
+// Bytes returns bytes taken by the records
+func (n *SingleDataNode) Bytes() int64 {
+	n.Lock()
+	defer n.Unlock()
+	return n.usedBytes
 }
 
 // main loop receiving requests
@@ -175,17 +715,116 @@ func (n *SingleDataNode) mainLoop() {
 		case <-n.ctx.Done(): // user cancellation
 			return
 		case rq := <-n.dataCh:
-			if rq.Command == "del" { // request to clear the cache
-				count := n.deleteAllRecords()
+			// select picks a request and the cancellation at random when both are ready,
+			// a stopped node answers nothing
+			if n.ctx.Err() != nil {
+				return
+			}
+			if rq.Command == "del" { // request to clear the cache or to delete some keys
+				if rq.Prefix != "" || rq.Pattern != "" {
+					deleted, err := n.deleteMatchingRecords(rq.Prefix, rq.Pattern)
+					if err != nil {
+						rq.BackCh <- DNResponse{
+							Status:  "Error",
+							Message: err.Error(),
+						}
+					} else {
+						log.Printf("[%s] deleted %d records matching %q %q\n", n.nodeId, len(deleted), rq.Prefix, rq.Pattern)
+						rq.BackCh <- DNResponse{
+							Status:  "OK",
+							Count:   len(deleted),
+							Message: fmt.Sprintf("deleted %d records", len(deleted)),
+							Keys:    deleted,
+						}
+					}
+				} else if len(rq.Keys) == 0 {
+					count := n.deleteAllRecords()
+					rq.BackCh <- DNResponse{
+						Status:  "OK",
+						Count:   count,
+						Message: fmt.Sprintf("deleted %d records", count),
+					}
+				} else if deleted, err := n.deleteRecords(rq.Keys, rq.Meta); err != nil {
+					rq.BackCh <- DNResponse{
+						Status:  "Error",
+						Message: err.Error(),
+					}
+				} else {
+					rq.BackCh <- DNResponse{
+						Status:  "OK",
+						Count:   len(deleted),
+						Message: fmt.Sprintf("deleted %d records", len(deleted)),
+						Keys:    deleted,
+					}
+				}
+
+			} else if rq.Command == "invalidate" { // delete the records having the tags
+				deleted := n.invalidateTags(rq.Namespace, rq.Tags)
+				log.Printf("[%s] invalidated %d records tagged %v\n", n.nodeId, len(deleted), rq.Tags)
 				rq.BackCh <- DNResponse{
 					Status:  "OK",
-					Count:   count,
-					Message: fmt.Sprintf("deleted %d records", count),
+					Count:   len(deleted),
+					Message: fmt.Sprintf("invalidated %d records", len(deleted)),
+					Keys:    deleted,
+				}
+
+			} else if rq.Command == "scan" { // list the keys after a position in lexical order
+				keys, more, err := n.scanRecords(rq.After, rq.Prefix, rq.Pattern, rq.Limit)
+				if err != nil {
+					rq.BackCh <- DNResponse{
+						Status:  "Error",
+						Message: err.Error(),
+					}
+				} else {
+					log.Printf("[%s] scanned %d keys after %q\n", n.nodeId, len(keys), rq.After)
+					rq.BackCh <- DNResponse{
+						Status: "OK",
+						Count:  len(keys),
+						Keys:   keys,
+						More:   more,
+					}
+				}
+
+			} else if rq.Command == "range" { // list the keys of a range in lexical order
+				keys, more, err := n.rangeRecords(rq.From, rq.To, rq.Limit)
+				if err != nil {
+					rq.BackCh <- DNResponse{
+						Status:  "Error",
+						Message: err.Error(),
+					}
+				} else {
+					log.Printf("[%s] listed %d keys from %q to %q\n", n.nodeId, len(keys), rq.From, rq.To)
+					rq.BackCh <- DNResponse{
+						Status: "OK",
+						Count:  len(keys),
+						Keys:   keys,
+						More:   more,
+					}
+				}
+
+			} else if rq.Command == "inspect" { // usage of the records, not counted as reads
+				keys, infos := n.inspectRecords(rq.Keys, rq.WithRank)
+				rq.BackCh <- DNResponse{
+					Status: "OK",
+					Count:  len(keys),
+					Keys:   keys,
+					Info:   infos,
+				}
+
+			} else if rq.Command == "dump" { // all records or the records of the keys, used to move data between nodes
+				keys, values, meta := n.dumpRecords(rq.Keys)
+				log.Printf("[%s] dumping %d records\n", n.nodeId, len(keys))
+				rq.BackCh <- DNResponse{
+					Status: "OK",
+					Count:  len(keys),
+					Keys:   keys,
+					Values: values,
+					Meta:   meta,
 				}
 
 			} else if rq.Command == "put" { // store/update some records
 				log.Printf("[%s] putting %d records\n", n.nodeId, len(rq.Keys))
-				err := n.storeMultipleRecords(rq.Keys, rq.Values)
+				err := n.storeMultipleRecords(rq.Keys, rq.Values, rq.TTL, rq.Meta)
 				if err != nil {
 					log.Printf("[%s] error storeMultipleRecords: %s\n", n.nodeId, err.Error())
 					rq.BackCh <- DNResponse{
@@ -200,24 +839,115 @@ func (n *SingleDataNode) mainLoop() {
 						Count:   len(rq.Keys),
 					}
 				}
+			} else if rq.Command == "add" || rq.Command == "replace" || rq.Command == "cas" { // store the absent, the existing or the unchanged records only
+				stored, err := n.storeRecordsIf(rq.Command, rq.Keys, rq.Values, rq.Versions, rq.TTL, rq.Meta)
+				if err != nil {
+					log.Printf("[%s] error storeRecordsIf: %s\n", n.nodeId, err.Error())
+					rq.BackCh <- DNResponse{
+						Status:  "Error",
+						Message: err.Error(),
+					}
+				} else {
+					log.Printf("[%s] %s: stored %d of %d records\n", n.nodeId, rq.Command, len(stored), len(rq.Keys))
+					rq.BackCh <- DNResponse{
+						Status:  "OK",
+						Message: fmt.Sprintf("stored %d of %d records", len(stored), len(rq.Keys)),
+						Count:   len(stored),
+						Keys:    stored,
+					}
+				}
+			} else if rq.Command == "getset" { // store the records, return the previous values
+				keys, values, meta, err := n.swapRecords(rq.Keys, rq.Values, rq.TTL, rq.Meta)
+				if err != nil {
+					log.Printf("[%s] error swapRecords: %s\n", n.nodeId, err.Error())
+					rq.BackCh <- DNResponse{
+						Status:  "Error",
+						Message: err.Error(),
+					}
+				} else {
+					log.Printf("[%s] getset: stored %d records, %d replaced\n", n.nodeId, len(rq.Keys), len(keys))
+					rq.BackCh <- DNResponse{
+						Status:  "OK",
+						Message: fmt.Sprintf("stored %d records, %d replaced", len(rq.Keys), len(keys)),
+						Count:   len(rq.Keys),
+						Keys:    keys,
+						Values:  values,
+						Meta:    meta,
+					}
+				}
+			} else if rq.Command == "incr" { // add the deltas to the records atomically
+				keys, values, meta, err := n.incrementRecords(rq.Keys, rq.Values, rq.Meta)
+				resp := DNResponse{
+					Status:  "OK",
+					Message: fmt.Sprintf("incremented %d of %d records", len(keys), len(rq.Keys)),
+					Count:   len(keys),
+					Keys:    keys,
+					Values:  values,
+					Meta:    meta,
+				}
+				if err != nil {
+					log.Printf("[%s] error incrementRecords: %s\n", n.nodeId, err.Error())
+					resp.Status, resp.Message = "Error", err.Error()
+				}
+				rq.BackCh <- resp
+			} else if rq.Command == "op" { // apply the operations to the typed values atomically
+				keys, meta, results, bases, err := n.applyOps(rq.Keys, rq.Ops, rq.Meta, rq.Versions)
+				resp := DNResponse{
+					Status:   "OK",
+					Message:  fmt.Sprintf("applied %d of %d operations", len(keys), len(rq.Keys)),
+					Count:    len(keys),
+					Keys:     keys,
+					Meta:     meta,
+					Results:  results,
+					Versions: bases,
+				}
+				if err != nil {
+					log.Printf("[%s] error applyOps: %s\n", n.nodeId, err.Error())
+					resp.Status, resp.Message = "Error", err.Error()
+				}
+				rq.BackCh <- resp
+			} else if rq.Command == "quota" { // set the quota of a namespace
+				evicted := n.setQuota(rq.Namespace, rq.Quota)
+				log.Printf("[%s] namespace %s quota %+v, %d records evicted\n", n.nodeId, rq.Namespace, rq.Quota, evicted)
+				rq.BackCh <- DNResponse{
+					Status:  "OK",
+					Message: fmt.Sprintf("quota set, %d records evicted", evicted),
+					Count:   evicted,
+				}
 			} else if rq.Command == "get" { // find records
-				if len(rq.Keys) == 0 {
-					l := n.Len()
-					log.Printf("[%s] current length %d\n", n.nodeId, l)
+				if len(rq.Keys) == 0 && rq.Namespace != "" {
+					l, b, q := n.namespaceUsage(rq.Namespace)
+					log.Printf("[%s] namespace %s length %d, %d bytes\n", n.nodeId, rq.Namespace, l, b)
 					rq.BackCh <- DNResponse{
 						Status: "OK",
 						Count:  l,
+						Bytes:  b,
+						Quota:  q,
+					}
+				} else if len(rq.Keys) == 0 {
+					l, b := n.Len(), n.Bytes()
+					log.Printf("[%s] current length %d, %d bytes\n", n.nodeId, l, b)
+					rq.BackCh <- DNResponse{
+						Status: "OK",
+						Count:  l,
+						Bytes:  b,
 					}
 
 				} else {
 					log.Printf("[%s] getting %d records\n", n.nodeId, len(rq.Keys))
-					resKeys, resValues := n.findMultipleKeys(rq.Keys)
+					resKeys, resValues, resMeta := n.findMultipleKeys(rq.Keys, rq.Deleted)
 					rq.BackCh <- DNResponse{
 						Status: "OK",
 						Keys:   resKeys,
 						Values: resValues,
+						Meta:   resMeta,
 					}
 				}
+			} else {
+				rq.BackCh <- DNResponse{
+					Status:  "Error",
+					Message: "unknown command: " + rq.Command,
+				}
 			}
 		}
 	}
@@ -2,8 +2,11 @@ package DataNode
 
 import (
 	"context"
+	"fmt"
 	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestSingleDataNode_storeMultipleRecords(t *testing.T) {
@@ -24,21 +27,21 @@ func TestSingleDataNode_storeMultipleRecords(t *testing.T) {
 		"value3",
 	}
 
-	if err := n.storeMultipleRecords(keys, values); err != nil {
+	if err := n.storeMultipleRecords(keys, values, 0, nil); err != nil {
 		t.Errorf("storeMultipleRecords() error = %v", err)
 	}
 	if len(keys) != n.Len() {
 		t.Errorf("storeMultipleRecords() error, length must be %d, got %d", len(keys), n.Len())
 	}
 
-	n.storeMultipleRecords([]string{"key4"}, []any{"value4"})
+	n.storeMultipleRecords([]string{"key4"}, []any{"value4"}, 0, nil)
 
 	if size != n.Len() {
 		t.Errorf("storeMultipleRecords() error, length must be %d, got %d", size, n.Len())
 	}
 	// expect "key1" to be evicted, keys 2,3,4 still there
 	keys4 := append(keys, "key4")
-	kf, _ := n.findMultipleKeys(keys4)
+	kf, _, _ := n.findMultipleKeys(keys4, false)
 
 	if size != n.Len() {
 		t.Errorf("storeMultipleRecords() error, length must be %d, got %d", size, n.Len())
@@ -77,16 +80,16 @@ func TestSingleDataNode_findMultipleKeys(t *testing.T) {
 		"value3",
 	}
 
-	if err := n.storeMultipleRecords(keys, values); err != nil {
+	if err := n.storeMultipleRecords(keys, values, 0, nil); err != nil {
 		t.Errorf("storeMultipleRecords() error = %v", err)
 	}
 	if len(keys) != n.Len() {
 		t.Errorf("storeMultipleRecords() error, length must be %d, got %d", len(keys), n.Len())
 	}
 
-	n.storeMultipleRecords([]string{"key4"}, []any{"value4"})
+	n.storeMultipleRecords([]string{"key4"}, []any{"value4"}, 0, nil)
 	keys4 := append(keys, "key4")
-	kf, vf := n.findMultipleKeys(keys4)
+	kf, vf, _ := n.findMultipleKeys(keys4, false)
 
 	if size != n.Len() {
 		t.Errorf("storeMultipleRecords() error, length must be %d, got %d", size, n.Len())
@@ -132,15 +135,15 @@ func TestSingleDataNode_storeMultipleRecordsEviction(t *testing.T) {
 		"value3",
 	}
 
-	if err := n.storeMultipleRecords(keys, values); err != nil {
+	if err := n.storeMultipleRecords(keys, values, 0, nil); err != nil {
 		t.Errorf("storeMultipleRecords() error = %v", err)
 	}
 	if len(keys) != n.Len() {
 		t.Errorf("storeMultipleRecords() error, length must be %d, got %d", len(keys), n.Len())
 	}
 
-	_, _ = n.findMultipleKeys([]string{"key1"}) // touch key1, it should stay
-	n.storeMultipleRecords([]string{"key4"}, []any{"value4"})
+	_, _, _ = n.findMultipleKeys([]string{"key1"}, false) // touch key1, it should stay
+	n.storeMultipleRecords([]string{"key4"}, []any{"value4"}, 0, nil)
 
 	if size != n.Len() {
 		t.Errorf("storeMultipleRecords() error, length must be %d, got %d", size, n.Len())
@@ -148,7 +151,7 @@ func TestSingleDataNode_storeMultipleRecordsEviction(t *testing.T) {
 
 	// expect "key2" to be evicted, keys 1,3,4 still there
 	keys4 := append(keys, "key4")
-	kf, _ := n.findMultipleKeys(keys4)
+	kf, _, _ := n.findMultipleKeys(keys4, false)
 
 	if slices.Index(kf, "key2") > 0 {
 		t.Errorf("storeMultipleRecords() error, key2 expected to be evicted, got %v", kf)
@@ -164,3 +167,318 @@ func TestSingleDataNode_storeMultipleRecordsEviction(t *testing.T) {
 	}
 
 }
+
+func TestSingleDataNode_dumpAndDeleteRecords(t *testing.T) {
+
+	ctx := context.Background()
+	n := (&SingleDataNode{}).New(ctx, "000", 10)
+
+	if err := n.storeMultipleRecords([]string{"key1", "key2", "key3"}, []any{"value1", "value2", "value3"}, 0, nil); err != nil {
+		t.Errorf("storeMultipleRecords() error = %v", err)
+	}
+
+	// most recent first
+	keys, values, _ := n.dumpRecords(nil)
+	if !slices.Equal(keys, []string{"key3", "key2", "key1"}) || values[0] != "value3" {
+		t.Errorf("dumpRecords() error, got %v %v", keys, values)
+	}
+	if keys, _, _ = n.dumpRecords([]string{"key1", "key4"}); !slices.Equal(keys, []string{"key1"}) {
+		t.Errorf("dumpRecords() of some keys error, got %v", keys)
+	}
+
+	deleted, _ := n.deleteRecords([]string{"key2", "key4"}, nil)
+	if !slices.Equal(deleted, []string{"key2"}) {
+		t.Errorf("deleteRecords() error, expected only key2 deleted, got %v", deleted)
+	}
+	if n.Len() != 2 {
+		t.Errorf("deleteRecords() error, length must be 2, got %d", n.Len())
+	}
+	if kf, _, _ := n.findMultipleKeys([]string{"key2"}, false); len(kf) != 0 {
+		t.Errorf("deleteRecords() error, key2 expected to be deleted")
+	}
+}
+
+func TestSingleDataNode_deleteMatchingRecords(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 10)
+	_ = n.storeMultipleRecords([]string{"user:1", "user:2", "user:10", "session:1", "users"}, []any{1, 2, 10, "s", "u"}, 0, nil)
+	_ = n.storeMultipleRecords([]string{"user:3"}, []any{3}, 0, []EntryMeta{{ExpiresAt: time.Now().Add(-time.Second)}})
+
+	deleted, err := n.deleteMatchingRecords("", "user:?")
+	slices.Sort(deleted)
+	if err != nil || !slices.Equal(deleted, []string{"user:1", "user:2"}) {
+		t.Errorf("deleteMatchingRecords() by pattern deleted %v, error %v", deleted, err)
+	}
+	if n.Len() != 3 {
+		t.Errorf("deleteMatchingRecords() must remove the expired user:3 too, %d records left", n.Len())
+	}
+
+	deleted, _ = n.deleteMatchingRecords("user", "")
+	slices.Sort(deleted)
+	if !slices.Equal(deleted, []string{"user:10", "users"}) {
+		t.Errorf("deleteMatchingRecords() by prefix deleted %v", deleted)
+	}
+
+	if _, err = n.deleteMatchingRecords("", "[session"); err == nil {
+		t.Errorf("deleteMatchingRecords() must fail for a bad pattern")
+	}
+	if n.Len() != 1 {
+		t.Errorf("only session:1 must be left, have %d records", n.Len())
+	}
+}
+
+func TestSingleDataNode_scanRecords(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 20)
+	_ = n.storeMultipleRecords([]string{"user:1", "user:2", "user:10", "session:1", "b", "a", NamespaceKey("team", "user:1")}, []any{1, 2, 10, "s", "b", "a", "t"}, 0, nil)
+	_ = n.storeMultipleRecords([]string{"user:3"}, []any{3}, 0, []EntryMeta{{ExpiresAt: time.Now().Add(-time.Second)}})
+
+	// pages in lexical order, the expired user:3 and the other namespaces are skipped
+	var all []string
+	after, more := "", true
+	for more {
+		var keys []string
+		var err error
+		if keys, more, err = n.scanRecords(after, "", "", 2); err != nil || len(keys) > 2 {
+			t.Fatalf("scanRecords(%q) = %v %v %v", after, keys, more, err)
+		}
+		all = append(all, keys...)
+		if more {
+			after = keys[len(keys)-1]
+		}
+	}
+	if !slices.Equal(all, []string{"a", "b", "session:1", "user:1", "user:10", "user:2"}) {
+		t.Errorf("scanRecords() listed %v", all)
+	}
+
+	if keys, more, _ := n.scanRecords("", "user:", "*:?", 10); more || !slices.Equal(keys, []string{"user:1", "user:2"}) {
+		t.Errorf("scanRecords() with a prefix and a pattern = %v %v", keys, more)
+	}
+	if keys, _, _ := n.scanRecords("", NamespaceKey("team", ""), "", 10); !slices.Equal(keys, []string{NamespaceKey("team", "user:1")}) {
+		t.Errorf("scanRecords() of a namespace = %q", keys)
+	}
+	if _, _, err := n.scanRecords("", "", "[", 10); err == nil {
+		t.Errorf("scanRecords() must fail for a bad pattern")
+	}
+
+	// the pages of many keys are the smallest ones after the cursor, whatever the limit
+	n = (&SingleDataNode{}).New(context.Background(), "000", 1000)
+	var expected []string
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("k%d", i*7919%500)
+		_ = n.storeMultipleRecords([]string{key}, []any{i}, 0, nil)
+		expected = append(expected, key)
+	}
+	slices.Sort(expected)
+	for _, limit := range []int{1, 3, 64, 499, 500, 1000} {
+		keys, more, _ := n.scanRecords(expected[10], "", "", limit)
+		want := expected[11:min(11+limit, len(expected))]
+		if !slices.Equal(keys, want) || more != (11+limit < len(expected)) {
+			t.Errorf("scanRecords() of %d keys = %d keys, more %v", limit, len(keys), more)
+		}
+	}
+}
+
+func TestSingleDataNode_storeRecordsIf(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 10)
+	_ = n.storeMultipleRecords([]string{"key1", "old"}, []any{1, "old"}, 0, []EntryMeta{{Flags: 7}, {ExpiresAt: time.Now().Add(-time.Second)}})
+
+	// an expired record counts as absent
+	stored, err := n.storeRecordsIf("add", []string{"key1", "key2", "old"}, []any{10, 2, "new"}, nil, 0, nil)
+	if err != nil || !slices.Equal(stored, []string{"key2", "old"}) {
+		t.Errorf("storeRecordsIf(add) stored %v, error %v", stored, err)
+	}
+	stored, _ = n.storeRecordsIf("replace", []string{"key1", "key3"}, []any{11, 3}, nil, 0, []EntryMeta{{Flags: 9}, {}})
+	if !slices.Equal(stored, []string{"key1"}) {
+		t.Errorf("storeRecordsIf(replace) stored %v", stored)
+	}
+
+	_, values, meta := n.findMultipleKeys([]string{"key1", "key2", "key3", "old"}, false)
+	if !slices.Equal(values, []any{11, 2, "new"}) || meta[0].Flags != 9 || meta[1].Flags != 0 {
+		t.Errorf("expected values [11 2 new] and flags 9 0, got %v %+v", values, meta)
+	}
+
+	// key1 was written twice, key2 once, a version zero expects no record
+	stored, err = n.storeRecordsIf("cas", []string{"key1", "key2", "key4", "key5"}, []any{12, 20, 4, 5}, []uint64{2, 7, 0, 3}, 0, nil)
+	if err != nil || !slices.Equal(stored, []string{"key1", "key4"}) {
+		t.Errorf("storeRecordsIf(cas) stored %v, error %v", stored, err)
+	}
+	if v, _, _, _ := n.findSingleKey("key1"); v != 12 {
+		t.Errorf("expected key1 12 after cas, got %v", v)
+	}
+	if _, err = n.storeRecordsIf("cas", []string{"key1"}, []any{1}, nil, 0, nil); err == nil {
+		t.Errorf("storeRecordsIf(cas) must fail without the versions")
+	}
+
+	if _, err = n.storeRecordsIf("append", []string{"key1"}, []any{1}, nil, 0, nil); err == nil {
+		t.Errorf("storeRecordsIf() must fail for an unknown command")
+	}
+}
+
+func TestSingleDataNode_expiry(t *testing.T) {
+
+	ctx := context.Background()
+	n := (&SingleDataNode{}).New(ctx, "000", 10)
+
+	if err := n.storeMultipleRecords([]string{"short", "long"}, []any{"value1", "value2"}, 0, []EntryMeta{
+		{ExpiresAt: time.Now().Add(50 * time.Millisecond)},
+		{ExpiresAt: time.Now().Add(time.Hour)},
+	}); err != nil {
+		t.Errorf("storeMultipleRecords() error = %v", err)
+	}
+	// no ttl; then the same key again with a ttl, then without it: it must never expire
+	_ = n.storeMultipleRecords([]string{"forever"}, []any{"value3"}, 0, nil)
+	_ = n.storeMultipleRecords([]string{"forever"}, []any{"value3"}, time.Millisecond, nil)
+	_ = n.storeMultipleRecords([]string{"forever"}, []any{"value3"}, 0, nil)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// lazy expiry on read
+	kf, _, _ := n.findMultipleKeys([]string{"short", "long", "forever"}, false)
+	if slices.Index(kf, "short") >= 0 {
+		t.Errorf("findMultipleKeys() error, short expected to be expired, got %v", kf)
+	}
+	if len(kf) != 2 || n.Len() != 2 {
+		t.Errorf("findMultipleKeys() error, long and forever expected to be present, got %v, length %d", kf, n.Len())
+	}
+
+	// the sweeper removes expired records without reads
+	if count := n.sweepExpired(time.Now().Add(2 * time.Hour)); count != 1 {
+		t.Errorf("sweepExpired() error, expected 1 record removed, got %d", count)
+	}
+	if kf, _, _ = n.findMultipleKeys([]string{"long", "forever"}, false); !slices.Equal(kf, []string{"forever"}) {
+		t.Errorf("sweepExpired() error, only forever expected to be present, got %v", kf)
+	}
+	if len(n.expiry) != 0 {
+		t.Errorf("expiry heap expected to be empty, has %d records", len(n.expiry))
+	}
+}
+
+func TestSingleDataNode_expiryHeapOrder(t *testing.T) {
+
+	ctx := context.Background()
+	n := (&SingleDataNode{}).New(ctx, "000", 100)
+
+	// evictions, deletes and updates must keep the heap consistent
+	for i := 0; i < 100; i++ {
+		_ = n.storeMultipleRecords([]string{fmt.Sprintf("key%d", i%30)}, []any{i}, time.Duration(100-i)*time.Minute, nil)
+	}
+	n.deleteRecords([]string{"key3", "key7"}, nil)
+	for i, de := range n.expiry {
+		if de.heapIndex != i {
+			t.Fatalf("heap index of %s is %d, expected %d", de.key, de.heapIndex, i)
+		}
+		if i > 0 && de.expiresAt.Before(n.expiry[(i-1)/2].expiresAt) {
+			t.Fatalf("heap order broken at %d", i)
+		}
+	}
+	if len(n.expiry) != n.Len() {
+		t.Errorf("expected %d records in the heap, got %d", n.Len(), len(n.expiry))
+	}
+}
+
+func TestSingleDataNode_byteBudget(t *testing.T) {
+
+	ctx := context.Background()
+	n, _ := (&SingleDataNode{}).NewWithOptions(ctx, "000", NodeOptions{MaxSize: 100, MaxBytes: 100})
+
+	// each record is 4 bytes of key and 20 bytes of value, 4 of them fit
+	value := strings.Repeat("x", 20)
+	for i := 0; i < 4; i++ {
+		_ = n.storeMultipleRecords([]string{fmt.Sprintf("key%d", i)}, []any{value}, 0, nil)
+	}
+	if n.Len() != 4 || n.Bytes() != 96 {
+		t.Errorf("expected 4 records and 96 bytes, got %d and %d", n.Len(), n.Bytes())
+	}
+
+	// a big one pushes out the oldest records
+	_ = n.storeMultipleRecords([]string{"big0"}, []any{strings.Repeat("y", 50)}, 0, nil)
+	if n.Bytes() > 100 {
+		t.Errorf("node is over its budget: %d bytes", n.Bytes())
+	}
+	kf, _, _ := n.findMultipleKeys([]string{"key0", "key1", "key2", "key3", "big0"}, false)
+	if !slices.Equal(kf, []string{"key3", "big0"}) {
+		t.Errorf("expected key0, key1 and key2 evicted, have %v", kf)
+	}
+
+	// updates are accounted by the difference
+	_ = n.storeMultipleRecords([]string{"key3"}, []any{"z"}, 0, nil)
+	if n.Bytes() != 4+1+4+50 {
+		t.Errorf("expected %d bytes after update, got %d", 4+1+4+50, n.Bytes())
+	}
+
+	// a record bigger than the node is refused
+	if err := n.storeMultipleRecords([]string{"huge"}, []any{strings.Repeat("h", 200)}, 0, nil); err == nil {
+		t.Errorf("storeMultipleRecords() of a record bigger than the node must fail")
+	}
+
+	n.deleteRecords([]string{"key3"}, nil)
+	if n.Bytes() != 54 {
+		t.Errorf("expected 54 bytes after delete, got %d", n.Bytes())
+	}
+	n.deleteAllRecords()
+	if n.Bytes() != 0 {
+		t.Errorf("expected 0 bytes after delete all, got %d", n.Bytes())
+	}
+}
+
+func TestSingleDataNode_customSizer(t *testing.T) {
+
+	ctx := context.Background()
+	// every value weighs a kilobyte, two fit
+	n, _ := (&SingleDataNode{}).NewWithOptions(ctx, "000", NodeOptions{
+		MaxSize:  100,
+		MaxBytes: 2100,
+		Sizer:    func(any) int { return 1024 },
+	})
+	_ = n.storeMultipleRecords([]string{"a", "b", "c"}, []any{1, 2, 3}, 0, nil)
+	if n.Len() != 2 || n.Bytes() != 2*1025 {
+		t.Errorf("expected 2 records and %d bytes, got %d and %d", 2*1025, n.Len(), n.Bytes())
+	}
+}
+
+func TestSingleDataNode_swapRecords(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 10)
+	_ = n.storeMultipleRecords([]string{"key1", "old"}, []any{1, "old"}, 0, []EntryMeta{{Flags: 7}, {ExpiresAt: time.Now().Add(-time.Second)}})
+
+	// an expired record has no previous value, a repeated key gives the value it got before
+	keys, values, meta, err := n.swapRecords([]string{"key1", "key2", "old", "key1"}, []any{10, 2, "new", 100}, 0, nil)
+	if err != nil || !slices.Equal(keys, []string{"key1", "key1"}) || !slices.Equal(values, []any{1, 10}) || meta[0].Flags != 7 {
+		t.Errorf("swapRecords() returned %v %v %+v %v", keys, values, meta, err)
+	}
+	_, values, _ = n.findMultipleKeys([]string{"key1", "key2", "old"}, false)
+	if !slices.Equal(values, []any{100, 2, "new"}) {
+		t.Errorf("expected values [100 2 new] after swapRecords(), got %v", values)
+	}
+	if de := n.dataMap["old"]; de.useCounterW != 1 || de.useCounterR != 1 || de.version != 1 {
+		t.Errorf("the record replacing an expired one kept its counters: %+v", de)
+	}
+
+	// a stale write is not stored and does not give the previous value
+	if keys, _, _, _ = n.swapRecords([]string{"key2"}, []any{3}, 0, []EntryMeta{{Version: 1}}); len(keys) != 0 {
+		t.Errorf("a stale swapRecords() returned %v", keys)
+	}
+	if _, _, _, err = n.swapRecords([]string{"key1"}, []any{1, 2}, 0, nil); err == nil {
+		t.Errorf("swapRecords() must fail for bad dimensions")
+	}
+}
+
+func TestSingleDataNode_stopped(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := (&SingleDataNode{}).New(ctx, "000", 10)
+	cancel()
+
+	// the request and the cancellation are both ready, the node must not answer
+	for i := 0; i < 20; i++ {
+		backCh := make(chan DNResponse, 1)
+		n.GetChannel() <- DNRequest{Command: "get", BackCh: backCh}
+		select {
+		case resp := <-backCh:
+			t.Fatalf("a stopped node answered %+v", resp)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package DataNode
+
+import (
+	"container/heap"
+	"log"
+	"time"
+)
+
+// how often the sweeper looks for expired records
+const sweepInterval = time.Second
+
+// expiryHeap is a min-heap of the records having a TTL, the record expiring first is on top.
+// Every record keeps its position in the heap so it can be removed or moved in O(log n).
+type expiryHeap []*dataEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	de := x.(*dataEntry)
+	de.heapIndex = len(*h)
+	*h = append(*h, de)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	de := old[len(old)-1]
+	old[len(old)-1] = nil
+	de.heapIndex = -1
+	*h = old[:len(old)-1]
+	return de
+}
+
+// sets or clears the expiration time of a record and keeps the heap in order
+// warning: not protected by a mutex
+func (n *SingleDataNode) setExpiry(de *dataEntry, expiresAt time.Time) {
+	de.expiresAt = expiresAt
+	switch {
+	case expiresAt.IsZero() && de.heapIndex >= 0:
+		heap.Remove(&n.expiry, de.heapIndex)
+	case expiresAt.IsZero():
+	case de.heapIndex >= 0:
+		heap.Fix(&n.expiry, de.heapIndex)
+	default:
+		heap.Push(&n.expiry, de)
+	}
+}
+
+// true if the record has a TTL and it's over
+func (de *dataEntry) expired(now time.Time) bool {
+	return !de.expiresAt.IsZero() && !now.Before(de.expiresAt)
+}
+
+// removes all expired records, returns how many
+func (n *SingleDataNode) sweepExpired(now time.Time) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.removeExpired(now)
+}
+
+// sweepExpired
+// warning: not protected by a mutex
+func (n *SingleDataNode) removeExpired(now time.Time) int {
+	count := 0
+	for len(n.expiry) > 0 && n.expiry[0].expired(now) {
+		n.removeRecord(n.expiry[0])
+		count++
+	}
+	return count
+}
+
+// background loop freeing the capacity taken by expired records and dropping the old tombstones
+func (n *SingleDataNode) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if count := n.sweepExpired(now); count > 0 {
+				log.Printf("[%s] %d expired records removed\n", n.nodeId, count)
+			}
+			if count := n.sweepTombstones(now); count > 0 {
+				log.Printf("[%s] %d tombstones removed\n", n.nodeId, count)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package DataNode
+
+import (
+	"time"
+)
+
+// EntryInfo is what a node knows about a record: its usage, its age and its place in the eviction order
+type EntryInfo struct {
+	Node       string    // id of the node keeping the record
+	Reads      int64     // number of reads
+	Writes     int64     // number of writes
+	Size       int       // bytes taken by the key and the value
+	CreatedAt  time.Time // when the node got the record, the restored records are created at the restart
+	AccessedAt time.Time // the last read, zero if never read
+	WrittenAt  time.Time // the last write
+	ExpiresAt  time.Time // when the record expires, zero if never
+	Rank       int       // position in the eviction order, 1 is the most valuable, Records the next victim. Zero if not asked for
+	Records    int       // number of live records on the node
+}
+
+// describes the live records of the keys, the keys not found are skipped. The expired records are removed first,
+// so they are neither described nor counted. The ranks read the whole eviction order, they are given if withRank is set.
+// Neither counts as a read nor tells the eviction policy, so the records keep their places
+func (n *SingleDataNode) inspectRecords(keys []string, withRank bool) (resKeys []string, infos []EntryInfo) {
+
+	n.Lock()
+	defer n.Unlock()
+
+	now := time.Now()
+	n.removeExpired(now)
+	var found []*dataEntry
+	for _, key := range keys {
+		if de, ok := n.dataMap[key]; ok && !de.expired(now) {
+			found = append(found, de)
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	// the policy knows the order only, the rank is the position of the key in it
+	rank := make(map[string]int, len(found))
+	if withRank {
+		for _, de := range found {
+			rank[de.key] = 0
+		}
+		for i, key := range n.policy.Keys() {
+			if _, ok := rank[key]; ok {
+				rank[key] = i + 1
+			}
+		}
+	}
+	for _, de := range found {
+		resKeys = append(resKeys, de.key)
+		infos = append(infos, EntryInfo{
+			Node:       n.nodeId,
+			Reads:      de.useCounterR,
+			Writes:     de.useCounterW,
+			Size:       de.size,
+			CreatedAt:  de.createdAt,
+			AccessedAt: de.accessedAt,
+			WrittenAt:  de.writtenAt,
+			ExpiresAt:  de.expiresAt,
+			Rank:       rank[de.key],
+			Records:    len(n.dataMap),
+		})
+	}
+	return resKeys, infos
+}
@@ -0,0 +1,61 @@
+package DataNode
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSingleDataNode_inspectRecords(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 3)
+	start := time.Now()
+	_ = n.storeMultipleRecords([]string{"a", "b"}, []any{"1", "2"}, 0, nil)
+	_ = n.storeMultipleRecords([]string{"c"}, []any{"3"}, time.Minute, nil)
+	_ = n.storeMultipleRecords([]string{"c"}, []any{"4"}, time.Minute, nil)
+	n.findMultipleKeys([]string{"a", "a"}, false)
+
+	keys, infos := n.inspectRecords([]string{"a", "b", "c", "missing"}, true)
+	if !slices.Equal(keys, []string{"a", "b", "c"}) {
+		t.Fatalf("inspectRecords() found %v", keys)
+	}
+	a, b, c := infos[0], infos[1], infos[2]
+	if a.Node != "000" || a.Reads != 2 || a.Writes != 1 || a.Size != n.dataMap["a"].size || a.Records != 3 {
+		t.Errorf("inspectRecords() of a = %+v", a)
+	}
+	if c.Writes != 2 || c.CreatedAt.Before(start) || c.WrittenAt.Before(c.CreatedAt) || c.ExpiresAt.Sub(start) < time.Minute {
+		t.Errorf("inspectRecords() of c = %+v", c)
+	}
+	if !b.AccessedAt.IsZero() || a.AccessedAt.Before(a.CreatedAt) || !b.ExpiresAt.IsZero() {
+		t.Errorf("inspectRecords() of b = %+v, of a = %+v", b, a)
+	}
+	// the last read is the most valuable, the least recently used goes first
+	if a.Rank != 1 || c.Rank != 2 || b.Rank != 3 {
+		t.Errorf("ranks are a %d c %d b %d, expected 1 2 3", a.Rank, c.Rank, b.Rank)
+	}
+
+	// inspecting neither counts as a read nor saves the record from eviction
+	n.inspectRecords([]string{"b"}, true)
+	if _, infos = n.inspectRecords([]string{"b"}, true); infos[0].Reads != 0 || infos[0].Rank != 3 {
+		t.Errorf("inspectRecords() changed the record: %+v", infos[0])
+	}
+	_ = n.storeMultipleRecords([]string{"d"}, []any{"5"}, 0, nil)
+	if keys, _ = n.inspectRecords([]string{"b"}, true); len(keys) != 0 {
+		t.Errorf("b must have been evicted")
+	}
+
+	// the rank is given only if asked for
+	if _, infos = n.inspectRecords([]string{"a"}, false); infos[0].Rank != 0 || infos[0].Records != 3 {
+		t.Errorf("inspectRecords() without the rank = %+v", infos[0])
+	}
+
+	// the expired records are neither described nor counted nor ranked
+	n = (&SingleDataNode{}).New(context.Background(), "000", 10)
+	_ = n.storeMultipleRecords([]string{"old", "live"}, []any{"1", "2"}, 0, []EntryMeta{{ExpiresAt: time.Now().Add(time.Millisecond)}, {}})
+	n.findMultipleKeys([]string{"old"}, false)
+	time.Sleep(5 * time.Millisecond)
+	if keys, infos = n.inspectRecords([]string{"old", "live"}, true); !slices.Equal(keys, []string{"live"}) || infos[0].Records != 1 || infos[0].Rank != 1 {
+		t.Errorf("inspectRecords() with an expired record = %v %+v", keys, infos)
+	}
+}
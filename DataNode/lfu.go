@@ -0,0 +1,119 @@
+package DataNode
+
+import (
+	"container/list"
+	"slices"
+)
+
+// an lfu record
+type lfuItem struct {
+	key  string
+	freq int64         // number of accesses
+	elem *list.Element // position in the bucket of its frequency
+}
+
+// lfuPolicy evicts the least frequently used record, the least recent one among equals.
+// Records are kept in buckets by frequency so every operation is O(1)
+type lfuPolicy struct {
+	items   map[string]*lfuItem
+	buckets map[int64]*list.List // frequency -> records, most recent in the front
+	minFreq int64                // lowest frequency having records, may be lower after removals, Evict fixes it
+}
+
+func (p *lfuPolicy) New() *lfuPolicy {
+	p.items = make(map[string]*lfuItem)
+	p.buckets = make(map[int64]*list.List)
+	p.minFreq = 0
+	return p
+}
+
+// puts the item in the bucket of its frequency
+func (p *lfuPolicy) link(it *lfuItem) {
+	b, ok := p.buckets[it.freq]
+	if !ok {
+		b = list.New()
+		p.buckets[it.freq] = b
+	}
+	it.elem = b.PushFront(it)
+}
+
+// takes the item out of its bucket, drops empty buckets
+func (p *lfuPolicy) unlink(it *lfuItem) {
+	b := p.buckets[it.freq]
+	b.Remove(it.elem)
+	if b.Len() == 0 {
+		delete(p.buckets, it.freq)
+	}
+}
+
+func (p *lfuPolicy) Insert(key string) {
+	if _, ok := p.items[key]; ok {
+		p.Access(key)
+		return
+	}
+	it := &lfuItem{key: key, freq: 1}
+	p.items[key] = it
+	p.link(it)
+	p.minFreq = 1
+}
+
+func (p *lfuPolicy) Access(key string) {
+	it, ok := p.items[key]
+	if !ok {
+		return
+	}
+	p.unlink(it)
+	if it.freq == p.minFreq && p.buckets[it.freq] == nil {
+		p.minFreq++
+	}
+	it.freq++
+	p.link(it)
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	it, ok := p.items[key]
+	if !ok {
+		return
+	}
+	p.unlink(it)
+	delete(p.items, key)
+}
+
+// finds the lowest frequency, needed only when its bucket went away outside of Access
+func (p *lfuPolicy) recalcMinFreq() {
+	p.minFreq = 0
+	for f := range p.buckets {
+		if p.minFreq == 0 || f < p.minFreq {
+			p.minFreq = f
+		}
+	}
+}
+
+func (p *lfuPolicy) Evict() (string, bool) {
+	if len(p.items) == 0 {
+		return "", false
+	}
+	if p.buckets[p.minFreq] == nil {
+		p.recalcMinFreq()
+	}
+	it := p.buckets[p.minFreq].Back().Value.(*lfuItem)
+	p.Remove(it.key)
+	return it.key, true
+}
+
+func (p *lfuPolicy) Keys() []string {
+	freqs := make([]int64, 0, len(p.buckets))
+	for f := range p.buckets {
+		freqs = append(freqs, f)
+	}
+	slices.Sort(freqs)
+	keys := make([]string, 0, len(p.items))
+	for i := len(freqs) - 1; i >= 0; i-- {
+		for e := p.buckets[freqs[i]].Front(); e != nil; e = e.Next() {
+			keys = append(keys, e.Value.(*lfuItem).key)
+		}
+	}
+	return keys
+}
+
+func (p *lfuPolicy) Len() int { return len(p.items) }
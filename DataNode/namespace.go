@@ -0,0 +1,223 @@
+package DataNode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NamespaceSeparator joins a namespace and a key into the key a node keeps, "team\x1fuser:42".
+// The keys of the default namespace "" are kept as they are, so the keys can't contain it
+const NamespaceSeparator = "\x1f"
+
+// Quota limits the records of a namespace on every node. When a namespace is full its own records are evicted,
+// chosen by the eviction policy of the node, the other namespaces are not touched
+type Quota struct {
+	MaxSize  int   `json:"max_entries"` // records, zero if not limited
+	MaxBytes int64 `json:"max_bytes"`   // bytes taken by the keys and the values, zero if not limited
+}
+
+// a namespace on a node: its usage and, if it has a quota, the policy choosing the victims among its records
+type namespace struct {
+	count  int
+	bytes  int64
+	quota  Quota
+	policy EvictionPolicy // nil if there is no quota
+}
+
+// NamespaceKey gives the key a record of a namespace is kept under
+// --> Input:
+// ns      string     namespace, "" is the default one
+// key     string     key in the namespace
+// <-- Output:
+// 1) string     the key the nodes keep
+func NamespaceKey(ns string, key string) string {
+	if ns == "" {
+		return key
+	}
+	return ns + NamespaceSeparator + key
+}
+
+// SplitNamespace splits a key the nodes keep into its namespace and its key in the namespace
+// --> Input:
+// key     string     the key the nodes keep
+// <-- Output:
+// 1) string     namespace, "" for the default one
+// 2) string     key in the namespace
+func SplitNamespace(key string) (string, string) {
+	if ns, k, ok := strings.Cut(key, NamespaceSeparator); ok {
+		return ns, k
+	}
+	return "", key
+}
+
+// CheckNamespace tells if a namespace name is good: letters, digits, '-', '_' and '.', at most 64 of them
+func CheckNamespace(ns string) error {
+	if ns == "" || len(ns) > 64 {
+		return fmt.Errorf("bad namespace %q, it should have 1 to 64 characters", ns)
+	}
+	for _, c := range ns {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("bad namespace %q, it can have letters, digits, '-', '_' and '.' only", ns)
+		}
+	}
+	return nil
+}
+
+// the namespace of a key, created if there is none
+// warning: not protected by a mutex
+func (n *SingleDataNode) namespaceOf(key string) *namespace {
+	name, _ := SplitNamespace(key)
+	ns, ok := n.namespaces[name]
+	if !ok {
+		ns = &namespace{}
+		n.namespaces[name] = ns
+	}
+	return ns
+}
+
+// counts a new record in its namespace
+// warning: not protected by a mutex
+func (n *SingleDataNode) nsInsert(de *dataEntry) {
+	ns := n.namespaceOf(de.key)
+	ns.count++
+	ns.bytes += int64(de.size)
+	if ns.policy != nil {
+		ns.policy.Insert(de.key)
+	}
+}
+
+// forgets a removed or evicted record in its namespace, the namespace goes away with its last record if it has no quota
+// warning: not protected by a mutex
+func (n *SingleDataNode) nsRemove(de *dataEntry) {
+	name, _ := SplitNamespace(de.key)
+	ns := n.namespaces[name]
+	if ns == nil {
+		return
+	}
+	ns.count--
+	ns.bytes -= int64(de.size)
+	if ns.policy != nil {
+		ns.policy.Remove(de.key)
+	} else if ns.count == 0 {
+		delete(n.namespaces, name)
+	}
+}
+
+// tells the policies a record is read or updated
+// warning: not protected by a mutex
+func (n *SingleDataNode) access(key string) {
+	n.policy.Access(key)
+	name, _ := SplitNamespace(key)
+	if ns := n.namespaces[name]; ns != nil && ns.policy != nil {
+		ns.policy.Access(key)
+	}
+}
+
+// tells if the namespace is over its quota with the records and the bytes added
+func (ns *namespace) over(count int, bytes int64) bool {
+	return (ns.quota.MaxSize > 0 && ns.count+count > ns.quota.MaxSize) || (ns.quota.MaxBytes > 0 && ns.bytes+bytes > ns.quota.MaxBytes)
+}
+
+// evicts the record of the namespace its policy chooses
+// warning: not protected by a mutex
+func (n *SingleDataNode) evictFromNamespace(ns *namespace) bool {
+	key, ok := ns.policy.Evict()
+	if !ok {
+		return false
+	}
+	if de, found := n.dataMap[key]; found {
+		n.removeRecord(de)
+		n.logDel(key)
+	}
+	return true
+}
+
+// evicts the records of the namespace of the key until a record of the given size fits under its quota.
+// The current version of the record, if any, is not counted, but it may be evicted itself
+// warning: not protected by a mutex
+func (n *SingleDataNode) makeNamespaceRoom(key string, size int) {
+	name, _ := SplitNamespace(key)
+	ns := n.namespaces[name]
+	if ns == nil || ns.policy == nil {
+		return
+	}
+	for {
+		count, bytes := 1, int64(size)
+		if de, ok := n.dataMap[key]; ok {
+			count, bytes = 0, bytes-int64(de.size)
+		}
+		if !ns.over(count, bytes) || !n.evictFromNamespace(ns) {
+			return
+		}
+	}
+}
+
+// a policy for the records of a namespace having a quota
+// warning: not protected by a mutex
+func (n *SingleDataNode) namespacePolicy(quota Quota) EvictionPolicy {
+	capacity := quota.MaxSize
+	if capacity <= 0 {
+		capacity = n.maxSize
+	}
+	policy, _ := NewEvictionPolicy(n.policyName, capacity) // the name was checked in New
+	return policy
+}
+
+// sets the quota of a namespace, a zero one removes it. The records over the new quota are evicted.
+// Returns the number of records evicted
+func (n *SingleDataNode) setQuota(name string, quota Quota) int {
+	n.Lock()
+	defer n.Unlock()
+
+	ns := n.namespaces[name]
+	if quota == (Quota{}) {
+		if ns != nil {
+			ns.quota, ns.policy = Quota{}, nil
+			if ns.count == 0 {
+				delete(n.namespaces, name)
+			}
+		}
+		return 0
+	}
+	if ns == nil {
+		ns = &namespace{}
+		n.namespaces[name] = ns
+	}
+	if ns.policy == nil || ns.quota.MaxSize != quota.MaxSize { // adaptive policies are sized by the quota
+		ns.policy = n.namespacePolicy(quota)
+		keys := n.policy.Keys()
+		for i := len(keys) - 1; i >= 0; i-- { // the least valuable first, so the order is kept
+			if nsName, _ := SplitNamespace(keys[i]); nsName == name {
+				ns.policy.Insert(keys[i])
+			}
+		}
+	}
+	ns.quota = quota
+	evicted := 0
+	for ns.over(0, 0) && n.evictFromNamespace(ns) {
+		evicted++
+	}
+	return evicted
+}
+
+// records and bytes of a namespace and its quota
+func (n *SingleDataNode) namespaceUsage(name string) (count int, bytes int64, quota Quota) {
+	n.Lock()
+	defer n.Unlock()
+	if ns, ok := n.namespaces[name]; ok {
+		return ns.count, ns.bytes, ns.quota
+	}
+	return 0, 0, Quota{}
+}
+
+// the namespaces after all the records are dropped, the ones having quotas are kept with new policies
+// warning: not protected by a mutex
+func (n *SingleDataNode) clearNamespaces() {
+	old := n.namespaces
+	n.namespaces = make(map[string]*namespace)
+	for name, ns := range old {
+		if ns.policy != nil {
+			n.namespaces[name] = &namespace{quota: ns.quota, policy: n.namespacePolicy(ns.quota)}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package DataNode
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSplitNamespace(t *testing.T) {
+
+	for _, tt := range []struct{ ns, key string }{{"", "key1"}, {"team", "key1"}, {"team", ""}, {"team", "a\x1fb"}} {
+		if ns, key := SplitNamespace(NamespaceKey(tt.ns, tt.key)); ns != tt.ns || key != tt.key {
+			t.Errorf("SplitNamespace(NamespaceKey(%q, %q)) = %q %q", tt.ns, tt.key, ns, key)
+		}
+	}
+	for _, ns := range []string{"", "a/b", "a b", "a\x1fb", "a*"} {
+		if CheckNamespace(ns) == nil {
+			t.Errorf("CheckNamespace(%q) must fail", ns)
+		}
+	}
+	if err := CheckNamespace("team-1.prod_2"); err != nil {
+		t.Errorf("CheckNamespace() error = %v", err)
+	}
+}
+
+func TestSingleDataNode_namespaceQuotas(t *testing.T) {
+
+	n, _ := (&SingleDataNode{}).NewWithOptions(context.Background(), "000", NodeOptions{MaxSize: 10, Quotas: map[string]Quota{"noisy": {MaxSize: 3}}})
+	nsKey := NamespaceKey
+
+	_ = n.storeMultipleRecords([]string{"key1", "key2", nsKey("quiet", "key1")}, []any{"v", "v", "v"}, 0, nil)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		_ = n.storeMultipleRecords([]string{nsKey("noisy", k)}, []any{"v"}, 0, nil)
+		n.findSingleKey(nsKey("noisy", "a")) // read it, so LRU keeps it
+	}
+	// the noisy namespace evicts its own records only
+	if n.Len() != 6 || n.dataMap["key1"] == nil || n.dataMap[nsKey("quiet", "key1")] == nil || n.dataMap[nsKey("noisy", "a")] == nil {
+		t.Errorf("the node has %d records %v, expected 6 with the noisy a", n.Len(), n.policy.Keys())
+	}
+	if count, bytes, quota := n.namespaceUsage("noisy"); count != 3 || bytes != 3*int64(len(nsKey("noisy", "a"))+1) || quota.MaxSize != 3 {
+		t.Errorf("namespaceUsage() = %d %d %+v", count, bytes, quota)
+	}
+
+	// a byte quota evicts down to it, the quota stays after a flush
+	if evicted := n.setQuota("quiet", Quota{MaxBytes: 5}); evicted != 1 || n.Len() != 5 {
+		t.Errorf("setQuota() evicted %d records, the node has %d", evicted, n.Len())
+	}
+	n.deleteAllRecords()
+	if err := n.storeMultipleRecords([]string{nsKey("quiet", "k")}, []any{"abc"}, 0, nil); err == nil {
+		t.Errorf("a record larger than the byte quota must fail")
+	}
+	if count, _, quota := n.namespaceUsage("quiet"); count != 0 || quota.MaxBytes != 5 {
+		t.Errorf("after a flush the quiet namespace has %d records and the quota %+v", count, quota)
+	}
+	if n.setQuota("quiet", Quota{}); n.namespaces["quiet"] != nil {
+		t.Errorf("a zero quota must remove the namespace without records")
+	}
+
+	// the deletes by prefix and pattern stay in the namespace of the prefix
+	_ = n.storeMultipleRecords([]string{"key1", nsKey("noisy", "key1"), nsKey("noisy", "key2")}, []any{"v", "v", "v"}, 0, nil)
+	if deleted, _ := n.deleteMatchingRecords("", "key*"); len(deleted) != 1 {
+		t.Errorf("deleteMatchingRecords() in the default namespace deleted %v", deleted)
+	}
+	if deleted, _ := n.deleteMatchingRecords(nsKey("noisy", ""), ""); len(deleted) != 2 || n.Len() != 0 {
+		t.Errorf("deleteMatchingRecords() of the noisy namespace deleted %v, %d records left", deleted, n.Len())
+	}
+
+	// quotas and usage through the channel
+	backCh := make(chan DNResponse, 1)
+	n.GetChannel() <- DNRequest{Command: "quota", Namespace: "team", Quota: Quota{MaxSize: 1}, BackCh: backCh}
+	<-backCh
+	_ = n.storeMultipleRecords([]string{nsKey("team", "a"), nsKey("team", "b")}, []any{"v", "v"}, 0, nil)
+	n.GetChannel() <- DNRequest{Command: "get", Namespace: "team", BackCh: backCh}
+	if resp := <-backCh; resp.Count != 1 || resp.Quota.MaxSize != 1 || n.dataMap[nsKey("team", "b")] == nil {
+		t.Errorf("get of the namespace usage returned %+v", resp)
+	}
+}
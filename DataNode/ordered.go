@@ -0,0 +1,161 @@
+package DataNode
+
+import (
+	"fmt"
+	"math/bits"
+	"slices"
+	"strings"
+	"time"
+)
+
+// the most levels of the skip list, enough for 2^32 keys
+const maxSkipLevel = 32
+
+// a key in the skip list with its successors on every level it takes part in
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// orderedKeys is a skip list keeping the keys of a node in lexical order.
+// Finding, adding and removing a key take O(log n), the keys after a given one are read in order
+type orderedKeys struct {
+	head  skipNode // sentinel before the first key, it has all the levels
+	level int      // levels in use
+	rnd   uint64   // xorshift state choosing the levels
+}
+
+// a new empty skip list
+func newOrderedKeys() *orderedKeys {
+	return &orderedKeys{
+		head:  skipNode{next: make([]*skipNode, maxSkipLevel)},
+		level: 1,
+		rnd:   uint64(time.Now().UnixNano()) | 1,
+	}
+}
+
+// the level of a new key: every level above the first one is taken with the probability 1/4
+func (o *orderedKeys) randomLevel() int {
+	o.rnd ^= o.rnd << 13
+	o.rnd ^= o.rnd >> 7
+	o.rnd ^= o.rnd << 17
+	return min(1+bits.TrailingZeros64(o.rnd)/2, maxSkipLevel)
+}
+
+// the last node before the key on every level
+func (o *orderedKeys) predecessors(key string) (prev [maxSkipLevel]*skipNode) {
+	x := &o.head
+	for l := o.level - 1; l >= 0; l-- {
+		for x.next[l] != nil && x.next[l].key < key {
+			x = x.next[l]
+		}
+		prev[l] = x
+	}
+	return prev
+}
+
+// adds a key, no-op if it's there already
+func (o *orderedKeys) insert(key string) {
+	prev := o.predecessors(key)
+	if x := prev[0].next[0]; x != nil && x.key == key {
+		return
+	}
+	level := o.randomLevel()
+	for ; o.level < level; o.level++ {
+		prev[o.level] = &o.head
+	}
+	x := &skipNode{key: key, next: make([]*skipNode, level)}
+	for l := 0; l < level; l++ {
+		x.next[l] = prev[l].next[l]
+		prev[l].next[l] = x
+	}
+}
+
+// removes a key, no-op if it's not there
+func (o *orderedKeys) remove(key string) {
+	prev := o.predecessors(key)
+	x := prev[0].next[0]
+	if x == nil || x.key != key {
+		return
+	}
+	for l := 0; l < len(x.next); l++ {
+		prev[l].next[l] = x.next[l]
+	}
+	for o.level > 1 && o.head.next[o.level-1] == nil {
+		o.level--
+	}
+}
+
+// calls fn with the keys from the given one on, inclusive, in lexical order until fn returns false
+func (o *orderedKeys) ascend(from string, fn func(key string) bool) {
+	for x := o.predecessors(from)[0].next[0]; x != nil; x = x.next[0] {
+		if !fn(x.key) {
+			return
+		}
+	}
+}
+
+// lists up to limit live keys from the key from, inclusive, to the key to, exclusive, "" for no end, in lexical order.
+// Only the keys in the namespace of from are listed. Tells if there are more keys after them.
+// The ordered index reads just the keys listed, a node without it sorts the keys of the range
+func (n *SingleDataNode) rangeRecords(from string, to string, limit int) (keys []string, more bool, err error) {
+	if limit <= 0 {
+		return nil, false, fmt.Errorf("bad limit %d", limit)
+	}
+	ns, _ := SplitNamespace(from)
+	inRange := func(key string) bool {
+		return key >= from && (to == "" || key < to)
+	}
+	now := time.Now()
+	n.Lock()
+	if n.ordered != nil {
+		defer n.Unlock()
+		n.ordered.ascend(from, func(key string) bool {
+			if !inRange(key) {
+				return false
+			}
+			if keyNs, _ := SplitNamespace(key); keyNs == ns && !n.dataMap[key].expired(now) {
+				if len(keys) == limit {
+					more = true
+					return false
+				}
+				keys = append(keys, key)
+			}
+			return true
+		})
+		return keys, more, nil
+	}
+
+	for key, de := range n.dataMap {
+		if keyNs, _ := SplitNamespace(key); inRange(key) && keyNs == ns && !de.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	n.Unlock()
+
+	slices.Sort(keys)
+	if len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+// lists the keys of scanRecords with the ordered index, reading the keys after the position only
+// warning: not protected by a mutex
+func (n *SingleDataNode) scanOrdered(after string, ns string, prefix string, pattern string, limit int) (keys []string, more bool) {
+	now := time.Now()
+	n.ordered.ascend(max(after+"\x00", prefix), func(key string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		if keyMatches(key, ns, prefix, pattern) && !n.dataMap[key].expired(now) {
+			if len(keys) == limit {
+				more = true
+				return false
+			}
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, more
+}
@@ -0,0 +1,92 @@
+package DataNode
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOrderedKeys(t *testing.T) {
+
+	o := newOrderedKeys()
+	rnd := rand.New(rand.NewSource(1))
+	present := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%d", rnd.Intn(1000))
+		if rnd.Intn(3) == 0 {
+			o.remove(key)
+			delete(present, key)
+		} else {
+			o.insert(key)
+			present[key] = true
+		}
+	}
+	expected := make([]string, 0, len(present))
+	for k := range present {
+		expected = append(expected, k)
+	}
+	slices.Sort(expected)
+
+	var keys []string
+	o.ascend("", func(key string) bool { keys = append(keys, key); return true })
+	if !slices.Equal(keys, expected) {
+		t.Fatalf("ascend() listed %d keys, expected %d", len(keys), len(expected))
+	}
+	// from a key in the middle, inclusive, and stopping early
+	keys = nil
+	o.ascend(expected[10], func(key string) bool { keys = append(keys, key); return len(keys) < 3 })
+	if !slices.Equal(keys, expected[10:13]) {
+		t.Errorf("ascend(%q) listed %v", expected[10], keys)
+	}
+}
+
+func TestSingleDataNode_rangeRecords(t *testing.T) {
+
+	for _, ordered := range []bool{false, true} {
+		n, _ := (&SingleDataNode{}).NewWithOptions(context.Background(), "000", NodeOptions{MaxSize: 20, Ordered: ordered})
+		_ = n.storeMultipleRecords([]string{"b", "a", "c", "m", "ma", "z", NamespaceKey("team", "b")}, []any{1, 2, 3, 4, 5, 6, 7}, 0, nil)
+		_ = n.storeMultipleRecords([]string{"d"}, []any{3}, 0, []EntryMeta{{ExpiresAt: time.Now().Add(-time.Second)}})
+		n.deleteRecords([]string{"c"}, nil)
+
+		for _, tt := range []struct {
+			from, to string
+			limit    int
+			expKeys  []string
+			expMore  bool
+		}{
+			{"a", "m", 10, []string{"a", "b"}, false},
+			{"a", "ma", 2, []string{"a", "b"}, true},
+			{"b", "", 10, []string{"b", "m", "ma", "z"}, false},
+			{"", "", 10, []string{"a", "b", "m", "ma", "z"}, false},
+			{"n", "y", 10, nil, false},
+			{NamespaceKey("team", ""), "team\x20", 10, []string{NamespaceKey("team", "b")}, false},
+		} {
+			if keys, more, err := n.rangeRecords(tt.from, tt.to, tt.limit); err != nil || !slices.Equal(keys, tt.expKeys) || more != tt.expMore {
+				t.Errorf("ordered %v: rangeRecords(%q, %q, %d) = %q %v %v", ordered, tt.from, tt.to, tt.limit, keys, more, err)
+			}
+		}
+
+		// the scans list the same keys with the index
+		if keys, more, _ := n.scanRecords("a", "", "", 2); !slices.Equal(keys, []string{"b", "m"}) || !more {
+			t.Errorf("ordered %v: scanRecords() = %v %v", ordered, keys, more)
+		}
+		if keys, more, _ := n.scanRecords("", "m", "", 5); !slices.Equal(keys, []string{"m", "ma"}) || more {
+			t.Errorf("ordered %v: scanRecords() with a prefix = %v %v", ordered, keys, more)
+		}
+
+		// evicted and flushed keys leave the index
+		for i := 0; i < 20; i++ {
+			_ = n.storeMultipleRecords([]string{fmt.Sprintf("x%02d", i)}, []any{i}, 0, nil)
+		}
+		if keys, _, _ := n.rangeRecords("", "x", 100); len(keys) != 0 {
+			t.Errorf("ordered %v: the evicted keys are listed: %v", ordered, keys)
+		}
+		n.deleteAllRecords()
+		if keys, _, _ := n.rangeRecords("", "", 100); len(keys) != 0 {
+			t.Errorf("ordered %v: the flushed keys are listed: %v", ordered, keys)
+		}
+	}
+}
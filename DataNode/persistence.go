@@ -0,0 +1,318 @@
+package DataNode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// fsync policies of the append-only log
+const (
+	FsyncAlways   = "always"   // every logged operation is synced, the slowest and the safest
+	FsyncEverySec = "everysec" // the log is synced once a second, up to a second of writes can be lost
+	FsyncNever    = "never"    // the operating system decides
+)
+
+// FsyncPolicies are the known fsync policies, the first one is the default
+var FsyncPolicies = []string{FsyncEverySec, FsyncAlways, FsyncNever}
+
+// DefaultSnapshotInterval is how often a node writes a snapshot by default
+const DefaultSnapshotInterval = time.Minute
+
+// A node with persistence keeps two files in its data directory:
+//   <node id>.aof   the append-only log of puts and deletes since the last snapshot
+//   <node id>.snap  the snapshot, all the records when it was taken
+// Both are sequences of records: 4 byte big endian payload length, 4 byte crc32 of the payload, gob encoded payload.
+// The snapshot is written to a temporary file and renamed, then the log is truncated.
+// A torn record at the end of the log (a crash in the middle of a write) is dropped when the node starts.
+
+// an operation in the log or a record in the snapshot
+type logRecord struct {
+	Op    string    // "put", "del" or "flush"
+	Key   string    // the key, empty for "flush"
+	Value any       // the value for "put"
+	Meta  EntryMeta // expiry and version for "put"
+}
+
+// files and state of a persistent node
+type persistence struct {
+	aofPath  string        // append-only log
+	snapPath string        // snapshot
+	fsync    string        // one of the FsyncPolicies
+	interval time.Duration // snapshot interval
+	aof      *os.File      // the log opened for appending
+	dirty    bool          // there are writes not synced yet
+	logged   int           // records in the log since the last snapshot
+}
+
+// checks the options and gives the file names of a node, nothing is opened yet
+func newPersistence(id string, opts NodeOptions) (*persistence, error) {
+	p := &persistence{
+		aofPath:  filepath.Join(opts.DataDir, id+".aof"),
+		snapPath: filepath.Join(opts.DataDir, id+".snap"),
+		fsync:    opts.Fsync,
+		interval: opts.SnapshotInterval,
+	}
+	if p.fsync == "" {
+		p.fsync = FsyncPolicies[0]
+	}
+	if p.fsync != FsyncAlways && p.fsync != FsyncEverySec && p.fsync != FsyncNever {
+		return nil, fmt.Errorf("unknown fsync policy %s, use one of %v", opts.Fsync, FsyncPolicies)
+	}
+	if p.interval <= 0 {
+		p.interval = DefaultSnapshotInterval
+	}
+	if err := os.MkdirAll(opts.DataDir, 0o755); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// encodes a record with its length and checksum
+func encodeLogRecord(rec logRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 8)) // room for the length and the checksum
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(b)-8))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(b[8:]))
+	return b, nil
+}
+
+// reads a file of records and gives them to apply.
+// Returns the size of the good part of the file, a torn or corrupted record ends it
+func readLogRecords(path string, apply func(rec logRecord)) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64
+	var header [8]byte
+	for {
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return good, nil
+			}
+			return good, fmt.Errorf("torn record header at %d", good)
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		if size > maxFrameSize {
+			return good, fmt.Errorf("bad record size %d at %d", size, good)
+		}
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return good, fmt.Errorf("torn record at %d", good)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return good, fmt.Errorf("bad record checksum at %d", good)
+		}
+		var rec logRecord
+		if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			return good, fmt.Errorf("bad record at %d: %w", good, err)
+		}
+		apply(rec)
+		good += int64(len(header)) + int64(size)
+	}
+}
+
+// restores the records from the snapshot and the log and opens the log for appending.
+// A broken tail of the log is cut off so the new records follow the good ones
+// warning: called by the constructor before the node is started
+func (n *SingleDataNode) restore(p *persistence) error {
+
+	now := time.Now()
+	apply := func(rec logRecord) {
+		switch rec.Op {
+		case "put":
+			if !rec.Meta.ExpiresAt.IsZero() && !now.Before(rec.Meta.ExpiresAt) {
+				if de, ok := n.dataMap[rec.Key]; ok {
+					n.removeRecord(de) // expired while the node was down
+				}
+				return
+			}
+			n.storeSingleRecord(rec.Key, rec.Value, rec.Meta)
+		case "del":
+			if de, ok := n.dataMap[rec.Key]; ok {
+				n.removeRecord(de)
+			}
+		case "flush":
+			n.clearRecords()
+		}
+	}
+
+	if _, err := readLogRecords(p.snapPath, apply); err != nil {
+		log.Printf("[%s] snapshot %s is damaged, restored what was readable: %s\n", n.nodeId, p.snapPath, err)
+	}
+	good, err := readLogRecords(p.aofPath, apply)
+	if err != nil {
+		log.Printf("[%s] log %s is damaged, cut at %d bytes: %s\n", n.nodeId, p.aofPath, good, err)
+		if err = os.Truncate(p.aofPath, good); err != nil {
+			return err
+		}
+	}
+
+	p.aof, err = os.OpenFile(p.aofPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	log.Printf("[%s] restored %d records from %s\n", n.nodeId, len(n.dataMap), filepath.Dir(p.aofPath))
+	return nil
+}
+
+// appends an operation to the log
+// warning: not protected by a mutex
+func (n *SingleDataNode) logRecord(rec logRecord) {
+	p := n.persist
+	if p == nil {
+		return
+	}
+	b, err := encodeLogRecord(rec)
+	if err == nil {
+		_, err = p.aof.Write(b)
+	}
+	if err == nil && p.fsync == FsyncAlways {
+		err = p.aof.Sync()
+	}
+	if err != nil {
+		log.Printf("[%s] error writing the log: %s\n", n.nodeId, err)
+		return
+	}
+	p.dirty = p.fsync != FsyncAlways
+	p.logged++
+}
+
+// logs a stored record
+// warning: not protected by a mutex
+func (n *SingleDataNode) logPut(de *dataEntry) {
+	n.logRecord(logRecord{Op: "put", Key: de.key, Value: de.value, Meta: de.meta()})
+}
+
+// logs a deleted or evicted record
+// warning: not protected by a mutex
+func (n *SingleDataNode) logDel(key string) {
+	n.logRecord(logRecord{Op: "del", Key: key})
+}
+
+// writes all the records to a new snapshot and truncates the log.
+// The node is locked meanwhile so nothing is written between the snapshot and the truncation
+func (n *SingleDataNode) snapshot() error {
+	n.Lock()
+	defer n.Unlock()
+	p := n.persist
+	if p == nil {
+		return nil
+	}
+
+	tmp := p.snapPath + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	now := time.Now()
+	keys := n.policy.Keys()
+	count := 0
+	// the oldest first so the most recent stay most recent when restored
+	for i := len(keys) - 1; i >= 0; i-- {
+		de := n.dataMap[keys[i]]
+		if de.expired(now) {
+			continue
+		}
+		b, err := encodeLogRecord(logRecord{Op: "put", Key: de.key, Value: de.value, Meta: de.meta()})
+		if err != nil {
+			log.Printf("[%s] record %s is not saved in the snapshot: %s\n", n.nodeId, de.key, err)
+			continue
+		}
+		_, _ = w.Write(b)
+		count++
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p.snapPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// a crash before the truncation is fine, the log replayed over the snapshot gives the same records
+	if err = p.aof.Truncate(0); err != nil {
+		return err
+	}
+	p.dirty = false
+	p.logged = 0
+	log.Printf("[%s] snapshot of %d records written\n", n.nodeId, count)
+	return nil
+}
+
+// syncs the log if needed
+func (n *SingleDataNode) syncLog() {
+	n.Lock()
+	defer n.Unlock()
+	p := n.persist
+	if p == nil || !p.dirty {
+		return
+	}
+	if err := p.aof.Sync(); err != nil {
+		log.Printf("[%s] error syncing the log: %s\n", n.nodeId, err)
+		return
+	}
+	p.dirty = false
+}
+
+// background loop syncing the log once a second for FsyncEverySec and writing the snapshots.
+// The log is synced and closed when the node stops
+func (n *SingleDataNode) persistLoop() {
+	syncTicker := time.NewTicker(time.Second)
+	defer syncTicker.Stop()
+	snapTicker := time.NewTicker(n.persist.interval)
+	defer snapTicker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			n.Lock()
+			_ = n.persist.aof.Sync()
+			_ = n.persist.aof.Close()
+			n.persist = nil
+			n.Unlock()
+			return
+		case <-syncTicker.C:
+			if n.persist.fsync == FsyncEverySec {
+				n.syncLog()
+			}
+		case <-snapTicker.C:
+			n.Lock()
+			logged := n.persist.logged
+			n.Unlock()
+			if logged == 0 {
+				continue
+			}
+			if err := n.snapshot(); err != nil {
+				log.Printf("[%s] error writing the snapshot: %s\n", n.nodeId, err)
+			}
+		}
+	}
+}
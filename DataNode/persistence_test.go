@@ -0,0 +1,134 @@
+package DataNode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// opens a persistent node in the directory, it is stopped when the test ends
+func openPersistentNode(t *testing.T, dir string, fsync string) *SingleDataNode {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	n, err := (&SingleDataNode{}).NewWithOptions(ctx, "000", NodeOptions{MaxSize: 100, DataDir: dir, Fsync: fsync})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	return n
+}
+
+// all the records of a node as key -> value
+func nodeContents(n *SingleDataNode) map[string]any {
+	keys, values, _ := n.dumpRecords(nil)
+	res := make(map[string]any, len(keys))
+	for i, k := range keys {
+		res[k] = values[i]
+	}
+	return res
+}
+
+func TestSingleDataNode_persistenceRestart(t *testing.T) {
+
+	for _, fsync := range FsyncPolicies {
+		dir := t.TempDir()
+		n := openPersistentNode(t, dir, fsync)
+
+		_ = n.storeMultipleRecords([]string{"key1", "key2", "key3"}, []any{"value1", 2, []byte("three")}, 0, []EntryMeta{{}, {}, {ContentType: "image/png"}})
+		_ = n.storeMultipleRecords([]string{"key1"}, []any{"value1.1"}, 0, nil)
+		_ = n.storeMultipleRecords([]string{"ttl", "gone"}, []any{"expires", "soon"}, time.Hour, []EntryMeta{{ExpiresAt: time.Now().Add(time.Hour)}, {ExpiresAt: time.Now().Add(50 * time.Millisecond)}})
+		n.deleteRecords([]string{"key2"}, nil)
+		_, _, metaBefore := n.findMultipleKeys([]string{"key1", "ttl", "key3"}, false)
+		time.Sleep(60 * time.Millisecond)
+
+		// a new node on the same files
+		r := openPersistentNode(t, dir, fsync)
+		got := nodeContents(r)
+		if len(got) != 3 || got["key1"] != "value1.1" || string(got["key3"].([]byte)) != "three" || got["ttl"] != "expires" {
+			t.Errorf("%s: restored %v", fsync, got)
+		}
+		_, _, metaAfter := r.findMultipleKeys([]string{"key1", "ttl", "key3"}, false)
+		for i := range metaBefore {
+			if metaAfter[i].Version != metaBefore[i].Version || !metaAfter[i].ExpiresAt.Equal(metaBefore[i].ExpiresAt) || metaAfter[i].ContentType != metaBefore[i].ContentType {
+				t.Errorf("%s: metadata %+v restored as %+v", fsync, metaBefore[i], metaAfter[i])
+			}
+		}
+
+		// a flush is persisted too
+		r.deleteAllRecords()
+		_ = r.storeMultipleRecords([]string{"after"}, []any{"flush"}, 0, nil)
+		if got = nodeContents(openPersistentNode(t, dir, fsync)); len(got) != 1 || got["after"] != "flush" {
+			t.Errorf("%s: restored after a flush %v", fsync, got)
+		}
+	}
+
+	if _, err := (&SingleDataNode{}).NewWithOptions(context.Background(), "000", NodeOptions{MaxSize: 10, DataDir: t.TempDir(), Fsync: "sometimes"}); err == nil {
+		t.Errorf("NewWithOptions() must fail for an unknown fsync policy")
+	}
+}
+
+func TestSingleDataNode_persistenceSnapshot(t *testing.T) {
+
+	dir := t.TempDir()
+	n := openPersistentNode(t, dir, FsyncAlways)
+	for i := 0; i < 20; i++ {
+		_ = n.storeMultipleRecords([]string{fmt.Sprintf("key%d", i)}, []any{i}, 0, nil)
+	}
+	if err := n.snapshot(); err != nil {
+		t.Fatalf("snapshot() error = %v", err)
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "000.aof")); info.Size() != 0 {
+		t.Errorf("the log must be empty after a snapshot, it has %d bytes", info.Size())
+	}
+	_ = n.storeMultipleRecords([]string{"key0", "key20"}, []any{"new", 20}, 0, nil)
+	n.deleteRecords([]string{"key1"}, nil)
+
+	got := nodeContents(openPersistentNode(t, dir, FsyncAlways))
+	if len(got) != 20 || got["key0"] != "new" || got["key20"] != 20 || got["key1"] != nil {
+		t.Errorf("restored from the snapshot and the log %v", got)
+	}
+}
+
+func TestSingleDataNode_persistenceTruncatedLog(t *testing.T) {
+
+	dir := t.TempDir()
+	aof := filepath.Join(dir, "000.aof")
+	n := openPersistentNode(t, dir, FsyncAlways)
+	for i := 0; i < 10; i++ {
+		_ = n.storeMultipleRecords([]string{fmt.Sprintf("key%d", i)}, []any{fmt.Sprintf("value%d", i)}, 0, nil)
+	}
+	info, _ := os.Stat(aof)
+	size := info.Size()
+
+	// a crash in the middle of the last write: every cut inside the last record loses that record only
+	recordSize := size / 10
+	for _, cut := range []int64{1, 4, 8, recordSize - 1} {
+		if err := os.Truncate(aof, size-cut); err != nil {
+			t.Fatal(err)
+		}
+		r := openPersistentNode(t, dir, FsyncAlways)
+		got := nodeContents(r)
+		if len(got) != 9 || got["key9"] != nil || got["key8"] != "value8" {
+			t.Errorf("cut %d: restored %d records %v", cut, len(got), got)
+		}
+		// the torn tail is cut off, new writes follow the good records
+		_ = r.storeMultipleRecords([]string{"key9"}, []any{"value9"}, 0, nil)
+		if got = nodeContents(openPersistentNode(t, dir, FsyncAlways)); len(got) != 10 || got["key9"] != "value9" {
+			t.Errorf("cut %d: restored after a new write %d records", cut, len(got))
+		}
+		info, _ = os.Stat(aof)
+		size = info.Size()
+	}
+
+	// a corrupted record in the middle ends the log there
+	b, _ := os.ReadFile(aof)
+	b[recordSize*5+10] ^= 0xff
+	if err := os.WriteFile(aof, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := nodeContents(openPersistentNode(t, dir, FsyncAlways)); len(got) != 5 {
+		t.Errorf("restored %d records before the corrupted one, expected 5", len(got))
+	}
+}
@@ -0,0 +1,128 @@
+package DataNode
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+)
+
+// EvictionPolicy decides which record goes away when the node is full.
+// The node calls it under its mutex, so implementations need no locking.
+// The node evicts before storing a new record, so the record being stored is never the victim.
+type EvictionPolicy interface {
+	Insert(key string)     // a new record is stored
+	Access(key string)     // an existing record is read or updated
+	Remove(key string)     // a record is deleted or expired, not evicted
+	Evict() (string, bool) // picks a victim and forgets it, false if there are no records
+	Keys() []string        // all keys, from the most to the least valuable
+	Len() int              // number of keys
+}
+
+// PolicyNames lists the known eviction policies, the first one is the default
+var PolicyNames = []string{"lru", "lfu", "arc", "2q", "tinylfu"}
+
+// NewEvictionPolicy creates an eviction policy by name
+// --> Input:
+// name         string     one of the PolicyNames, case insensitive, empty means "lru"
+// capacity     int        max number of records, adaptive policies size their internal lists with it
+// <-- Output:
+// 1) EvictionPolicy     the policy
+// 2) error              if the name is unknown
+func NewEvictionPolicy(name string, capacity int) (EvictionPolicy, error) {
+	if capacity < 1 {
+		capacity = 1
+	}
+	switch strings.ToLower(name) {
+	case "", "lru":
+		return (&lruPolicy{}).New(), nil
+	case "lfu":
+		return (&lfuPolicy{}).New(), nil
+	case "arc":
+		return (&arcPolicy{}).New(capacity), nil
+	case "2q":
+		return (&twoQueuePolicy{}).New(capacity), nil
+	case "tinylfu", "w-tinylfu":
+		return (&tinyLFUPolicy{}).New(capacity), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q, known are %v", name, PolicyNames)
+}
+
+// keyList is a list of keys with O(1) lookup, the front is the most recent
+type keyList struct {
+	l *list.List
+	m map[string]*list.Element
+}
+
+func newKeyList() *keyList {
+	return &keyList{l: list.New(), m: make(map[string]*list.Element)}
+}
+
+func (kl *keyList) Len() int { return kl.l.Len() }
+
+func (kl *keyList) contains(key string) bool {
+	_, ok := kl.m[key]
+	return ok
+}
+
+// adds the key to the front, or moves it there
+func (kl *keyList) pushFront(key string) {
+	if e, ok := kl.m[key]; ok {
+		kl.l.MoveToFront(e)
+		return
+	}
+	kl.m[key] = kl.l.PushFront(key)
+}
+
+func (kl *keyList) remove(key string) bool {
+	e, ok := kl.m[key]
+	if ok {
+		kl.l.Remove(e)
+		delete(kl.m, key)
+	}
+	return ok
+}
+
+// removes and returns the back (least recent) key
+func (kl *keyList) popBack() (string, bool) {
+	e := kl.l.Back()
+	if e == nil {
+		return "", false
+	}
+	key := e.Value.(string)
+	kl.l.Remove(e)
+	delete(kl.m, key)
+	return key, true
+}
+
+func (kl *keyList) back() (string, bool) {
+	e := kl.l.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// appends the keys front to back
+func (kl *keyList) appendKeys(keys []string) []string {
+	for e := kl.l.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(string))
+	}
+	return keys
+}
+
+// lruPolicy evicts the least recently used record
+type lruPolicy struct {
+	keys *keyList // fresh keys in the front, old in the back
+}
+
+func (p *lruPolicy) New() *lruPolicy {
+	p.keys = newKeyList()
+	return p
+}
+
+func (p *lruPolicy) Insert(key string)     { p.keys.pushFront(key) }
+func (p *lruPolicy) Access(key string)     { p.keys.pushFront(key) }
+func (p *lruPolicy) Remove(key string)     { p.keys.remove(key) }
+func (p *lruPolicy) Evict() (string, bool) { return p.keys.popBack() }
+func (p *lruPolicy) Keys() []string        { return p.keys.appendKeys(nil) }
+func (p *lruPolicy) Len() int              { return p.keys.Len() }
@@ -0,0 +1,186 @@
+package DataNode
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// replays a trace of keys against a policy the way the node does, returns the hit ratio
+func simulatePolicy(p EvictionPolicy, capacity int, trace []string) float64 {
+	resident := make(map[string]bool)
+	hits := 0
+	for _, key := range trace {
+		if resident[key] {
+			hits++
+			p.Access(key)
+			continue
+		}
+		for len(resident) >= capacity {
+			victim, ok := p.Evict()
+			if !ok {
+				break
+			}
+			delete(resident, victim)
+		}
+		resident[key] = true
+		p.Insert(key)
+	}
+	return float64(hits) / float64(len(trace))
+}
+
+// synthetic Zipf distributed trace
+func zipfTrace(length int, keySpace uint64, s float64, seed int64) []string {
+	r := rand.New(rand.NewSource(seed))
+	z := rand.NewZipf(r, s, 1, keySpace-1)
+	trace := make([]string, length)
+	for i := range trace {
+		trace[i] = fmt.Sprintf("key%d", z.Uint64())
+	}
+	return trace
+}
+
+// a Zipf trace with a one-off scan of cold keys in the middle, LRU suffers from it
+func zipfTraceWithScan(length int, keySpace uint64, seed int64) []string {
+	trace := zipfTrace(length, keySpace, 1.1, seed)
+	var scan []string
+	for i := 0; i < length/4; i++ {
+		scan = append(scan, fmt.Sprintf("scan%d", i))
+	}
+	return append(append(append([]string{}, trace[:length/2]...), scan...), trace[length/2:]...)
+}
+
+func TestEvictionPolicies_Consistency(t *testing.T) {
+
+	capacity := 50
+	for _, name := range PolicyNames {
+		p, err := NewEvictionPolicy(name, capacity)
+		if err != nil {
+			t.Fatalf("NewEvictionPolicy(%s) error = %v", name, err)
+		}
+
+		// random inserts, accesses, removals and evictions against a reference set
+		r := rand.New(rand.NewSource(1))
+		resident := make(map[string]bool)
+		for i := 0; i < 20000; i++ {
+			key := fmt.Sprintf("key%d", r.Intn(200))
+			switch {
+			case resident[key] && r.Intn(10) == 0:
+				p.Remove(key)
+				delete(resident, key)
+			case resident[key]:
+				p.Access(key)
+			default:
+				for len(resident) >= capacity {
+					victim, ok := p.Evict()
+					if !ok || !resident[victim] {
+						t.Fatalf("%s: bad victim %q, ok %v", name, victim, ok)
+					}
+					delete(resident, victim)
+				}
+				resident[key] = true
+				p.Insert(key)
+			}
+			if p.Len() != len(resident) {
+				t.Fatalf("%s: policy has %d keys, expected %d", name, p.Len(), len(resident))
+			}
+		}
+		keys := p.Keys()
+		if len(keys) != len(resident) {
+			t.Fatalf("%s: Keys() returned %d keys, expected %d", name, len(keys), len(resident))
+		}
+		for _, k := range keys {
+			if !resident[k] {
+				t.Fatalf("%s: Keys() returned %s which is not resident", name, k)
+			}
+		}
+		// drain
+		for len(resident) > 0 {
+			victim, ok := p.Evict()
+			if !ok || !resident[victim] {
+				t.Fatalf("%s: bad victim %q while draining", name, victim)
+			}
+			delete(resident, victim)
+		}
+		if _, ok := p.Evict(); ok {
+			t.Errorf("%s: Evict() on an empty policy must fail", name)
+		}
+	}
+
+	if _, err := NewEvictionPolicy("fifo", capacity); err == nil {
+		t.Errorf("NewEvictionPolicy() must fail for an unknown name")
+	}
+}
+
+func TestEvictionPolicies_HitRatio(t *testing.T) {
+
+	capacity := 100
+	trace := zipfTraceWithScan(100000, 5000, 1)
+
+	ratios := make(map[string]float64)
+	for _, name := range PolicyNames {
+		p, _ := NewEvictionPolicy(name, capacity)
+		ratios[name] = simulatePolicy(p, capacity, trace)
+		t.Logf("%-8s hit ratio %.2f%%", name, ratios[name]*100)
+	}
+	// frequency aware policies must beat plain LRU on a skewed trace with a scan
+	for _, name := range []string{"lfu", "arc", "2q", "tinylfu"} {
+		if ratios[name] <= ratios["lru"] {
+			t.Errorf("%s hit ratio %.2f%% is not better than lru %.2f%%", name, ratios[name]*100, ratios["lru"]*100)
+		}
+	}
+}
+
+func TestSingleDataNode_evictionPolicy(t *testing.T) {
+
+	ctx := context.Background()
+	n, err := (&SingleDataNode{}).NewWithOptions(ctx, "000", NodeOptions{MaxSize: 3, Policy: "lfu"})
+	if err != nil {
+		t.Fatalf("NewWithOptions() error = %v", err)
+	}
+	_ = n.storeMultipleRecords([]string{"key1", "key2", "key3"}, []any{"value1", "value2", "value3"}, 0, nil)
+
+	// key1 is the least recent but the most frequent, key2 is the least frequent
+	n.findMultipleKeys([]string{"key1", "key1", "key3"}, false)
+	_ = n.storeMultipleRecords([]string{"key4"}, []any{"value4"}, 0, nil)
+
+	kf, _, _ := n.findMultipleKeys([]string{"key1", "key2", "key3", "key4"}, false)
+	if !slices.Equal(kf, []string{"key1", "key3", "key4"}) {
+		t.Errorf("lfu node expected to evict key2, has %v", kf)
+	}
+
+	if _, err = (&SingleDataNode{}).NewWithOptions(ctx, "001", NodeOptions{MaxSize: 3, Policy: "random"}); err == nil {
+		t.Errorf("NewWithOptions() must fail for an unknown policy")
+	}
+}
+
+// hit ratios on synthetic Zipf traces, compare the policies with
+//
+//	go test -bench=EvictionPolicies -run=^$ ./DataNode/
+func BenchmarkEvictionPolicies(b *testing.B) {
+
+	traces := []struct {
+		name  string
+		trace []string
+	}{
+		{"zipf1.01", zipfTrace(200000, 10000, 1.01, 1)}, // rand.Zipf needs s > 1, 1.01 is close to flat
+		{"zipf1.2", zipfTrace(200000, 10000, 1.2, 1)},
+		{"zipf+scan", zipfTraceWithScan(200000, 10000, 1)},
+	}
+	for _, tr := range traces {
+		for _, capacity := range []int{100, 1000} {
+			for _, name := range PolicyNames {
+				b.Run(fmt.Sprintf("%s/cap%d/%s", tr.name, capacity, name), func(b *testing.B) {
+					var ratio float64
+					for i := 0; i < b.N; i++ {
+						p, _ := NewEvictionPolicy(name, capacity)
+						ratio = simulatePolicy(p, capacity, tr.trace)
+					}
+					b.ReportMetric(ratio*100, "hit%")
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package DataNode
+
+import (
+	"fmt"
+)
+
+// Sizer returns the number of bytes a value takes, used for the byte budget of a node
+type Sizer func(value any) int
+
+// DefaultSizer knows the sizes of strings, byte slices, numbers and the typed structures.
+// Other values are measured by their printed form, good enough for an estimate
+func DefaultSizer(value any) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, int64, uint, uint64, float64:
+		return 8
+	}
+	if size, ok := structSize(value); ok {
+		return size
+	}
+	return len(fmt.Sprint(value))
+}
+
+// size of a record: its key plus its value
+func (n *SingleDataNode) recordSize(key string, value any) int {
+	return len(key) + n.sizer(value)
+}
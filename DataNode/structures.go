@@ -0,0 +1,511 @@
+package DataNode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The typed values the nodes change on behalf of the clients: lists, hashes, sets and sorted sets.
+// Their elements are strings, the way Redis has them. A write changes the value in place, so an operation
+// costs the size of its arguments and not the size of the value. The node owns the values it changes:
+// one handed out or given by a caller is copied by the first operation changing it, see dataEntry.shared.
+
+// List is a list of strings
+type List []string
+
+// Hash maps the fields to their values
+type Hash map[string]string
+
+// Set is a set of strings, every member maps to true
+type Set map[string]bool
+
+// ZMember is a member of a sorted set with its score
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// ZSet is a sorted set, the members ordered by their scores, the ones of equal scores by the members
+type ZSet []ZMember
+
+// MarshalJSON gives the members of a set as a sorted array
+func (s Set) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.members())
+}
+
+// ErrArgCount is the error of an operation given too few or too many arguments
+var ErrArgCount = errors.New("wrong number of arguments")
+
+// ErrWrongType is the error of an operation on a value of another type, the text is the one Redis has
+var ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// StructOp is an operation on a typed value with its arguments, the ones of the Redis command of the same name
+type StructOp struct {
+	Name string   // one of the StructOpNames
+	Args []string // the arguments after the key, e.g. the values of "lpush" or the start and the stop of "lrange"
+}
+
+// an operation: the type it works on, whether it writes and how many arguments it takes
+type opSpec struct {
+	kind    string
+	writes  bool
+	minArgs int
+	maxArgs int // -1 if any number
+	pairs   bool
+}
+
+var opSpecs = map[string]opSpec{
+	"lpush":     {kind: "list", writes: true, minArgs: 1, maxArgs: -1},
+	"rpush":     {kind: "list", writes: true, minArgs: 1, maxArgs: -1},
+	"lpop":      {kind: "list", writes: true},
+	"rpop":      {kind: "list", writes: true},
+	"lrange":    {kind: "list", minArgs: 2, maxArgs: 2},
+	"llen":      {kind: "list"},
+	"hset":      {kind: "hash", writes: true, minArgs: 2, maxArgs: -1, pairs: true},
+	"hget":      {kind: "hash", minArgs: 1, maxArgs: 1},
+	"hdel":      {kind: "hash", writes: true, minArgs: 1, maxArgs: -1},
+	"hgetall":   {kind: "hash"},
+	"sadd":      {kind: "set", writes: true, minArgs: 1, maxArgs: -1},
+	"srem":      {kind: "set", writes: true, minArgs: 1, maxArgs: -1},
+	"smembers":  {kind: "set"},
+	"sismember": {kind: "set", minArgs: 1, maxArgs: 1},
+	"zadd":      {kind: "zset", writes: true, minArgs: 2, maxArgs: -1, pairs: true},
+	"zrem":      {kind: "zset", writes: true, minArgs: 1, maxArgs: -1},
+	"zrange":    {kind: "zset", minArgs: 2, maxArgs: 2},
+	"zscore":    {kind: "zset", minArgs: 1, maxArgs: 1},
+}
+
+// StructOpNames lists the known operations
+var StructOpNames = []string{"lpush", "rpush", "lpop", "rpop", "lrange", "llen", "hset", "hget", "hdel", "hgetall",
+	"sadd", "srem", "smembers", "sismember", "zadd", "zrem", "zrange", "zscore"}
+
+// Check tells if the operation is known and its arguments are good
+func (op StructOp) Check() error {
+	spec, ok := opSpecs[op.Name]
+	if !ok {
+		return fmt.Errorf("unknown operation %q, expected one of %v", op.Name, StructOpNames)
+	}
+	n := len(op.Args)
+	if n < spec.minArgs || (spec.maxArgs >= 0 && n > spec.maxArgs) || (spec.pairs && n%2 != 0) {
+		return fmt.Errorf("%w for %s", ErrArgCount, op.Name)
+	}
+	switch op.Name {
+	case "lrange":
+		for _, a := range op.Args {
+			if _, err := strconv.Atoi(a); err != nil {
+				return fmt.Errorf("lrange: index %q is not an integer", a)
+			}
+		}
+	case "zadd":
+		for i := 0; i < n; i += 2 {
+			if _, err := parseScore(op.Args[i]); err != nil {
+				return fmt.Errorf("zadd: %w", err)
+			}
+		}
+	case "zrange":
+		for _, a := range op.Args {
+			if _, err := parseScore(a); err != nil {
+				return fmt.Errorf("zrange: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Writes tells if the operation changes the value
+func (op StructOp) Writes() bool {
+	return opSpecs[op.Name].writes
+}
+
+// a score of a sorted set, -inf and +inf are the bounds of the ranges
+func parseScore(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, fmt.Errorf("score %q is not a number", s)
+	}
+	return f, nil
+}
+
+// ApplyOp applies an operation to a value, nil if there is no record.
+// A write changes the value in place, the caller must own it, see cloneValue
+// --> Input:
+// value     any          the value, a List, a Hash, a Set, a ZSet or nil
+// op        StructOp     the operation, checked with Check
+// <-- Output:
+// 1) any       the new value, the value itself if the operation does not write
+// 2) any       the result: an int64 count or length, a string element, a List, a Hash, a ZSet, a bool, a float64 score, or nil
+// 3) error     ErrWrongType if the value is of another type
+func ApplyOp(value any, op StructOp) (newValue any, result any, err error) {
+	newValue, result, _, err = applyOp(value, op)
+	return newValue, result, err
+}
+
+// ApplyOp, also giving how many bytes the operation added to the value, negative if it removed some,
+// the way DefaultSizer counts them
+func applyOp(value any, op StructOp) (newValue any, result any, grown int, err error) {
+	if err = op.Check(); err != nil {
+		return nil, nil, 0, err
+	}
+	switch opSpecs[op.Name].kind {
+	case "list":
+		l, ok := value.(List)
+		if !ok && value != nil {
+			return nil, nil, 0, ErrWrongType
+		}
+		return l.apply(op)
+	case "hash":
+		h, ok := value.(Hash)
+		if !ok && value != nil {
+			return nil, nil, 0, ErrWrongType
+		}
+		return h.apply(op)
+	case "set":
+		s, ok := value.(Set)
+		if !ok && value != nil {
+			return nil, nil, 0, ErrWrongType
+		}
+		return s.apply(op)
+	}
+	z, ok := value.(ZSet)
+	if !ok && value != nil {
+		return nil, nil, 0, ErrWrongType
+	}
+	return z.apply(op)
+}
+
+// the most bytes an operation can add to a value, it is checked before the value is changed in place
+func (op StructOp) maxGrowth() int {
+	if !op.Writes() {
+		return 0
+	}
+	grown := 0
+	for _, a := range op.Args {
+		grown += len(a) + 8 // a score takes 8
+	}
+	return grown
+}
+
+// a copy of a typed value an operation may change, other values are returned as they are
+func cloneValue(value any) any {
+	switch v := value.(type) {
+	case List:
+		return slices.Clone(v)
+	case Hash:
+		return maps.Clone(v)
+	case Set:
+		return maps.Clone(v)
+	case ZSet:
+		return slices.Clone(v)
+	}
+	return value
+}
+
+// applies a list operation
+func (l List) apply(op StructOp) (any, any, int, error) {
+	switch op.Name {
+	case "lpush", "rpush":
+		grown := 0
+		for _, a := range op.Args {
+			grown += len(a)
+		}
+		if op.Name == "rpush" {
+			l = append(l, op.Args...)
+			return l, int64(len(l)), grown, nil
+		}
+		head := make(List, len(op.Args)) // every value goes to the head in turn, so the last one is the first
+		for i, a := range op.Args {
+			head[len(op.Args)-1-i] = a
+		}
+		l = slices.Insert(l, 0, head...)
+		return l, int64(len(l)), grown, nil
+	case "lpop", "rpop":
+		if len(l) == 0 {
+			return l, nil, 0, nil
+		}
+		i := 0
+		if op.Name == "rpop" {
+			i = len(l) - 1
+		}
+		e := l[i]
+		l[i] = "" // the array may outlive the element
+		if i == 0 {
+			l = l[1:]
+		} else {
+			l = l[:i]
+		}
+		return l, e, -len(e), nil
+	case "lrange":
+		start, _ := strconv.Atoi(op.Args[0])
+		stop, _ := strconv.Atoi(op.Args[1])
+		if start < 0 {
+			start = max(len(l)+start, 0)
+		}
+		if stop < 0 {
+			stop = len(l) + stop
+		}
+		stop = min(stop, len(l)-1)
+		if start > stop {
+			return l, List{}, 0, nil
+		}
+		return l, slices.Clone(l[start : stop+1]), 0, nil
+	}
+	return l, int64(len(l)), 0, nil // llen
+}
+
+// applies a hash operation
+func (h Hash) apply(op StructOp) (any, any, int, error) {
+	switch op.Name {
+	case "hset":
+		if h == nil {
+			h = make(Hash, len(op.Args)/2)
+		}
+		added, grown := int64(0), 0
+		for i := 0; i < len(op.Args); i += 2 {
+			f, v := op.Args[i], op.Args[i+1]
+			if old, ok := h[f]; ok {
+				grown += len(v) - len(old)
+			} else {
+				added++
+				grown += len(f) + len(v)
+			}
+			h[f] = v
+		}
+		return h, added, grown, nil
+	case "hget":
+		if v, ok := h[op.Args[0]]; ok {
+			return h, v, 0, nil
+		}
+		return h, nil, 0, nil
+	case "hdel":
+		removed, grown := int64(0), 0
+		for _, f := range op.Args {
+			if v, ok := h[f]; ok {
+				delete(h, f)
+				removed++
+				grown -= len(f) + len(v)
+			}
+		}
+		return h, removed, grown, nil
+	}
+	return h, maps.Clone(h), 0, nil // hgetall
+}
+
+// applies a set operation
+func (s Set) apply(op StructOp) (any, any, int, error) {
+	switch op.Name {
+	case "sadd", "srem":
+		adds := op.Name == "sadd"
+		if s == nil && adds {
+			s = make(Set, len(op.Args))
+		}
+		changed, grown := int64(0), 0
+		for _, m := range op.Args {
+			if s[m] == adds {
+				continue
+			}
+			changed++
+			if adds {
+				s[m] = true
+				grown += len(m)
+			} else {
+				delete(s, m)
+				grown -= len(m)
+			}
+		}
+		return s, changed, grown, nil
+	case "sismember":
+		return s, s[op.Args[0]], 0, nil
+	}
+	return s, s.members(), 0, nil // smembers
+}
+
+// the members of a set, sorted
+func (s Set) members() List {
+	l := make(List, 0, len(s))
+	for m := range s {
+		l = append(l, m)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// applies a sorted set operation
+func (z ZSet) apply(op StructOp) (any, any, int, error) {
+	switch op.Name {
+	case "zadd":
+		added, grown := int64(0), 0
+		for i := 0; i < len(op.Args); i += 2 {
+			score, _ := parseScore(op.Args[i])
+			member := op.Args[i+1]
+			if j := z.index(member); j >= 0 {
+				z = slices.Delete(z, j, j+1)
+			} else {
+				added++
+				grown += len(member) + 8
+			}
+			z = z.insert(ZMember{Member: member, Score: score})
+		}
+		return z, added, grown, nil
+	case "zrem":
+		removed, grown := int64(0), 0
+		for _, member := range op.Args {
+			if j := z.index(member); j >= 0 {
+				z = slices.Delete(z, j, j+1)
+				removed++
+				grown -= len(member) + 8
+			}
+		}
+		return z, removed, grown, nil
+	case "zrange": // by score, both bounds included
+		lo, _ := parseScore(op.Args[0])
+		hi, _ := parseScore(op.Args[1])
+		from := sort.Search(len(z), func(i int) bool { return z[i].Score >= lo })
+		to := sort.Search(len(z), func(i int) bool { return z[i].Score > hi })
+		if from >= to {
+			return z, ZSet{}, 0, nil
+		}
+		return z, slices.Clone(z[from:to]), 0, nil
+	}
+	if j := z.index(op.Args[0]); j >= 0 { // zscore
+		return z, z[j].Score, 0, nil
+	}
+	return z, nil, 0, nil
+}
+
+// position of a member, -1 if it is not there
+func (z ZSet) index(member string) int {
+	return slices.IndexFunc(z, func(m ZMember) bool { return m.Member == member })
+}
+
+// inserts a member keeping the order, the set must not have it
+func (z ZSet) insert(m ZMember) ZSet {
+	i := sort.Search(len(z), func(i int) bool {
+		return z[i].Score > m.Score || (z[i].Score == m.Score && z[i].Member >= m.Member)
+	})
+	return slices.Insert(z, i, m)
+}
+
+// applies the operations to the records, a missing or expired record is an empty value of the type of its operation.
+// An existing record keeps its expiry, flags and tags, a new one gets meta. The new version is the larger one
+// of meta.Version and the next version of the record, so the operations always apply.
+// versions is optional: a replica applies an operation only to a record having the version the first owner had before it,
+// zero if there was none, and skips the others without an error.
+// A structure emptied by the operations is kept, an operation leaving an absent one empty does not create it,
+// its metadata is zero then.
+// Returns the keys changed with their metadata, the results of the operations and the versions the records had before them,
+// and the errors of the others
+func (n *SingleDataNode) applyOps(keys []string, ops []StructOp, meta []EntryMeta, versions []uint64) (resKeys []string, resMeta []EntryMeta, results []any, bases []uint64, err error) {
+
+	if len(ops) != len(keys) || (meta != nil && len(meta) != len(keys)) || (versions != nil && len(versions) != len(keys)) {
+		return nil, nil, nil, nil, fmt.Errorf("bad keys/ops/meta/versions array dimensions %d/%d/%d/%d", len(keys), len(ops), len(meta), len(versions))
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	var errs []error
+	now := time.Now()
+	for i, k := range keys {
+		var m EntryMeta
+		if meta != nil {
+			m = meta[i]
+		}
+		var current any
+		var base uint64
+		size, shared := len(k), false // the size of the record before the operation, the key alone if there is none
+		if de, ok := n.dataMap[k]; ok {
+			if de.expired(now) {
+				n.removeRecord(de)
+			} else {
+				current, base, size, shared = de.value, de.version, de.size, de.shared
+				m.ExpiresAt, m.Flags, m.ContentType, m.Tags = de.expiresAt, de.flags, de.contentType, de.tags
+				m.Version = max(m.Version, de.version+1)
+			}
+		}
+		if versions != nil && versions[i] != base {
+			continue // the replica missed a write or has a newer one
+		}
+		if current == nil { // a new record is newer than the delete of the key
+			m.Version = max(m.Version, n.tombstones[k].version+1)
+		}
+		op := ops[i]
+		// a value handed out must stay as it was, and one which could outgrow the node must be left untouched on failure.
+		// A custom sizer measures the whole value, which must be kept too
+		if op.Writes() && (shared || n.customSizer || n.fits(k, size+op.maxGrowth()) != nil) {
+			current = cloneValue(current)
+		}
+		value, result, grown, e := applyOp(current, op)
+		if e != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", k, e))
+			continue
+		}
+		if op.Writes() && (current != nil || structLen(value) > 0) { // nothing to store for a pop from an absent key
+			size += grown
+			if n.customSizer {
+				size = n.recordSize(k, value)
+			}
+			if e = n.fits(k, size); e != nil {
+				errs = append(errs, e)
+				continue
+			}
+			n.storeRecord(k, value, size, false, m)
+		}
+		resKeys = append(resKeys, k)
+		if de, ok := n.dataMap[k]; ok {
+			resMeta = append(resMeta, de.meta())
+		} else {
+			resMeta = append(resMeta, EntryMeta{})
+		}
+		results = append(results, result)
+		bases = append(bases, base)
+	}
+	return resKeys, resMeta, results, bases, errors.Join(errs...)
+}
+
+// number of elements of a typed value
+func structLen(value any) int {
+	switch v := value.(type) {
+	case List:
+		return len(v)
+	case Hash:
+		return len(v)
+	case Set:
+		return len(v)
+	case ZSet:
+		return len(v)
+	}
+	return 0
+}
+
+// sizes of the typed values: the bytes of their elements, a score takes 8
+func structSize(value any) (int, bool) {
+	size := 0
+	switch v := value.(type) {
+	case List:
+		for _, e := range v {
+			size += len(e)
+		}
+	case Hash:
+		for f, e := range v {
+			size += len(f) + len(e)
+		}
+	case Set:
+		for m := range v {
+			size += len(m)
+		}
+	case ZSet:
+		for _, m := range v {
+			size += len(m.Member) + 8
+		}
+	default:
+		return 0, false
+	}
+	return size, true
+}
@@ -0,0 +1,174 @@
+package DataNode
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyOp(t *testing.T) {
+
+	// a write changes the value in place, every case gets its own
+	list := func() List { return List{"b", "c"} }
+	hash := func() Hash { return Hash{"name": "Ann"} }
+	set := func() Set { return Set{"x": true} }
+	zset := func() ZSet { return ZSet{{"a", 1}, {"c", 2}} }
+	for _, tt := range []struct {
+		value    any
+		op       StructOp
+		expValue any
+		expRes   any
+	}{
+		{nil, StructOp{"lpush", []string{"a", "b"}}, List{"b", "a"}, int64(2)},
+		{list(), StructOp{"lpush", []string{"a"}}, List{"a", "b", "c"}, int64(3)},
+		{list(), StructOp{"rpush", []string{"d"}}, List{"b", "c", "d"}, int64(3)},
+		{list(), StructOp{"lpop", nil}, List{"c"}, "b"},
+		{list(), StructOp{"rpop", nil}, List{"b"}, "c"},
+		{nil, StructOp{"lpop", nil}, List(nil), nil},
+		{List{"a", "b", "c", "d"}, StructOp{"lrange", []string{"1", "-2"}}, List{"a", "b", "c", "d"}, List{"b", "c"}},
+		{list(), StructOp{"lrange", []string{"0", "-1"}}, list(), List{"b", "c"}},
+		{list(), StructOp{"lrange", []string{"5", "9"}}, list(), List{}},
+		{list(), StructOp{"llen", nil}, list(), int64(2)},
+		{hash(), StructOp{"hset", []string{"name", "Bob", "age", "7"}}, Hash{"name": "Bob", "age": "7"}, int64(1)},
+		{hash(), StructOp{"hget", []string{"name"}}, hash(), "Ann"},
+		{hash(), StructOp{"hget", []string{"age"}}, hash(), nil},
+		{hash(), StructOp{"hdel", []string{"name", "age"}}, Hash{}, int64(1)},
+		{hash(), StructOp{"hgetall", nil}, hash(), Hash{"name": "Ann"}},
+		{set(), StructOp{"sadd", []string{"x", "y"}}, Set{"x": true, "y": true}, int64(1)},
+		{set(), StructOp{"srem", []string{"x", "z"}}, Set{}, int64(1)},
+		{Set{"b": true, "a": true}, StructOp{"smembers", nil}, Set{"b": true, "a": true}, List{"a", "b"}},
+		{set(), StructOp{"sismember", []string{"x"}}, set(), true},
+		{zset(), StructOp{"zadd", []string{"1.5", "b", "0", "c"}}, ZSet{{"c", 0}, {"a", 1}, {"b", 1.5}}, int64(1)},
+		{zset(), StructOp{"zrem", []string{"a", "z"}}, ZSet{{"c", 2}}, int64(1)},
+		{zset(), StructOp{"zrange", []string{"-inf", "1"}}, zset(), ZSet{{"a", 1}}},
+		{zset(), StructOp{"zrange", []string{"3", "+inf"}}, zset(), ZSet{}},
+		{zset(), StructOp{"zscore", []string{"c"}}, zset(), 2.0},
+	} {
+		value, res, err := ApplyOp(tt.value, tt.op)
+		if err != nil || !reflect.DeepEqual(value, tt.expValue) || !reflect.DeepEqual(res, tt.expRes) {
+			t.Errorf("ApplyOp(%v) = %#v %#v %v, expected %#v %#v", tt.op, value, res, err, tt.expValue, tt.expRes)
+		}
+	}
+
+	// a write changes the value given, a read does not
+	h := hash()
+	if _, _, _ = ApplyOp(h, StructOp{"hset", []string{"age", "7"}}); !reflect.DeepEqual(h, Hash{"name": "Ann", "age": "7"}) {
+		t.Errorf("hset changed the hash to %v", h)
+	}
+	if _, all, _ := ApplyOp(h, StructOp{"hgetall", nil}); reflect.ValueOf(all).Pointer() == reflect.ValueOf(h).Pointer() {
+		t.Errorf("hgetall returned the hash itself")
+	}
+
+	// the bytes added or removed are the ones DefaultSizer counts
+	for _, tt := range []struct {
+		value any
+		op    StructOp
+	}{
+		{list(), StructOp{"lpush", []string{"a", "bb"}}},
+		{list(), StructOp{"rpop", nil}},
+		{hash(), StructOp{"hset", []string{"name", "Bobby", "age", "7"}}},
+		{hash(), StructOp{"hdel", []string{"name"}}},
+		{set(), StructOp{"sadd", []string{"x", "yy"}}},
+		{set(), StructOp{"srem", []string{"x"}}},
+		{zset(), StructOp{"zadd", []string{"3", "a", "1", "bb"}}},
+		{zset(), StructOp{"zrem", []string{"c", "d"}}},
+	} {
+		before := DefaultSizer(tt.value)
+		value, _, grown, err := applyOp(tt.value, tt.op)
+		if err != nil || DefaultSizer(value)-before != grown || grown > tt.op.maxGrowth() {
+			t.Errorf("applyOp(%v) grew the value by %d bytes, expected %d, at most %d", tt.op, grown, DefaultSizer(value)-before, tt.op.maxGrowth())
+		}
+	}
+
+	for _, tt := range []struct {
+		value any
+		op    StructOp
+		err   error // nil for any error
+	}{
+		{"text", StructOp{"lpush", []string{"a"}}, ErrWrongType},
+		{list(), StructOp{"hget", []string{"a"}}, ErrWrongType},
+		{hash(), StructOp{"zscore", []string{"a"}}, ErrWrongType},
+		{nil, StructOp{"lpush", nil}, ErrArgCount},
+		{nil, StructOp{"hset", []string{"a"}}, ErrArgCount},
+		{nil, StructOp{"zadd", []string{"x", "a"}}, nil},
+		{nil, StructOp{"lrange", []string{"0", "x"}}, nil},
+		{nil, StructOp{"push", []string{"a"}}, nil},
+	} {
+		if _, _, err := ApplyOp(tt.value, tt.op); err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+			t.Errorf("ApplyOp(%v, %v) error = %v, expected %v", tt.value, tt.op, err, tt.err)
+		}
+	}
+}
+
+func TestSingleDataNode_applyOps(t *testing.T) {
+
+	n, _ := (&SingleDataNode{}).NewWithOptions(context.Background(), "000", NodeOptions{MaxSize: 10, MaxBytes: 30})
+	expires := time.Now().Add(time.Hour)
+	_ = n.storeMultipleRecords([]string{"list", "text"}, []any{List{"a"}, "abc"}, 0, []EntryMeta{{ExpiresAt: expires, Version: 5}, {}})
+
+	keys, meta, results, bases, err := n.applyOps(
+		[]string{"list", "text", "set", "empty"},
+		[]StructOp{{"rpush", []string{"b", "c"}}, {"lpush", []string{"x"}}, {"sadd", []string{"m"}}, {"rpop", nil}},
+		[]EntryMeta{{Version: 2}, {Version: 2}, {Version: 9}, {Version: 9}}, nil)
+	if !errors.Is(err, ErrWrongType) {
+		t.Errorf("applyOps() error = %v, expected %v for the text", err, ErrWrongType)
+	}
+	if !reflect.DeepEqual(keys, []string{"list", "set", "empty"}) || !reflect.DeepEqual(results, []any{int64(3), int64(1), nil}) ||
+		!reflect.DeepEqual(bases, []uint64{5, 0, 0}) {
+		t.Errorf("applyOps() returned %v %v %v", keys, results, bases)
+	}
+	if _, values, _ := n.findMultipleKeys([]string{"list", "set"}, false); !reflect.DeepEqual(values, []any{List{"a", "b", "c"}, Set{"m": true}}) {
+		t.Errorf("the node has %v", values)
+	}
+	// the record keeps its expiry, the versions grow, a pop from nothing stores nothing
+	if !meta[0].ExpiresAt.Equal(expires) || meta[0].Version != 6 || meta[1].Version != 9 || meta[2].Version != 0 || n.Len() != 3 {
+		t.Errorf("applyOps() returned metadata %+v, the node has %d records", meta, n.Len())
+	}
+
+	// the sizes are the bytes of the elements: list 4+3, text 4+3, set 3+1
+	if n.Bytes() != 18 {
+		t.Errorf("the node takes %d bytes, expected 18", n.Bytes())
+	}
+	// a growing list evicts the least recently used records
+	if _, _, _, _, err = n.applyOps([]string{"list"}, []StructOp{{"rpush", []string{"0123456789abc"}}}, nil, nil); err != nil {
+		t.Errorf("applyOps() error = %v", err)
+	}
+	if n.Bytes() != 24 || n.Len() != 2 || n.dataMap["text"] != nil {
+		t.Errorf("after the push the node has %d records of %d bytes, expected the list and the set of 24", n.Len(), n.Bytes())
+	}
+	if _, _, _, _, err = n.applyOps([]string{"list"}, []StructOp{{"rpush", []string{"0123456789abc"}}}, nil, nil); err == nil {
+		t.Errorf("applyOps() must fail for a list larger than the node")
+	}
+	if _, values, _ := n.findMultipleKeys([]string{"list"}, false); len(values[0].(List)) != 4 || n.Bytes() != 24 {
+		t.Errorf("a failed push changed the list to %v, the node takes %d bytes", values[0], n.Bytes())
+	}
+}
+
+func TestSingleDataNode_applyOpsInPlace(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 10)
+	_ = n.storeMultipleRecords([]string{"list"}, []any{List{"a"}}, 0, nil)
+	_, values, _ := n.findMultipleKeys([]string{"list"}, false)
+	given := values[0].(List)
+
+	// a value handed out stays as it was, the operation changes a copy, the next one changes that in place
+	_, meta, _, _, _ := n.applyOps([]string{"list", "list"}, []StructOp{{"rpush", []string{"b"}}, {"rpush", []string{"c"}}}, nil, nil)
+	if !reflect.DeepEqual(given, List{"a"}) || n.dataMap["list"].shared {
+		t.Errorf("the list handed out became %v", given)
+	}
+	if !reflect.DeepEqual(n.dataMap["list"].value, List{"a", "b", "c"}) || meta[1].Version != 3 {
+		t.Errorf("the node has %v of version %d", n.dataMap["list"].value, meta[1].Version)
+	}
+
+	// a replica applies an operation to the version the first owner had before it only
+	keys, meta, _, _, err := n.applyOps([]string{"list", "list", "other"}, []StructOp{{"lpop", nil}, {"lpop", nil}, {"sadd", []string{"m"}}},
+		[]EntryMeta{{Version: 10}, {Version: 11}, {Version: 10}}, []uint64{3, 5, 0})
+	if err != nil || !reflect.DeepEqual(keys, []string{"list", "other"}) || meta[0].Version != 10 || meta[1].Version != 10 {
+		t.Errorf("applyOps() = %v %+v %v, expected the first pop and the add", keys, meta, err)
+	}
+	if !reflect.DeepEqual(n.dataMap["list"].value, List{"b", "c"}) {
+		t.Errorf("the node has %v, expected one pop", n.dataMap["list"].value)
+	}
+}
@@ -0,0 +1,85 @@
+package DataNode
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// CheckTags tells if the tags of a record are good and gives them sorted, without repeats
+// --> Input:
+// tags     []string     tags of a record, nil if none
+// <-- Output:
+// 1) []string     the tags sorted, nil if none
+// 2) error        if a tag is empty or too long
+func CheckTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	res := make([]string, 0, len(tags))
+	for _, t := range tags {
+		if t == "" || len(t) > 256 {
+			return nil, fmt.Errorf("bad tag %q, it should have 1 to 256 bytes", t)
+		}
+		res = append(res, t)
+	}
+	sort.Strings(res)
+	return slices.Compact(res), nil
+}
+
+// adds a record to the index of its tags
+// warning: not protected by a mutex
+func (n *SingleDataNode) tagInsert(de *dataEntry) {
+	for _, t := range de.tags {
+		keys, ok := n.tags[t]
+		if !ok {
+			keys = make(map[string]bool)
+			n.tags[t] = keys
+		}
+		keys[de.key] = true
+	}
+}
+
+// removes a record from the index of its tags, a tag goes away with its last record
+// warning: not protected by a mutex
+func (n *SingleDataNode) tagRemove(de *dataEntry) {
+	for _, t := range de.tags {
+		delete(n.tags[t], de.key)
+		if len(n.tags[t]) == 0 {
+			delete(n.tags, t)
+		}
+	}
+}
+
+// gives a record new tags
+// warning: not protected by a mutex
+func (n *SingleDataNode) setTags(de *dataEntry, tags []string) {
+	if slices.Equal(de.tags, tags) {
+		return
+	}
+	n.tagRemove(de)
+	de.tags = tags
+	n.tagInsert(de)
+}
+
+// deletes the records of the namespace having any of the tags, returns the keys which existed
+func (n *SingleDataNode) invalidateTags(ns string, tags []string) (deleted []string) {
+	n.Lock()
+	defer n.Unlock()
+	now := time.Now()
+	for _, t := range tags {
+		for key := range n.tags[t] {
+			if keyNs, _ := SplitNamespace(key); keyNs != ns {
+				continue
+			}
+			de := n.dataMap[key]
+			if !de.expired(now) {
+				deleted = append(deleted, key)
+			}
+			n.removeRecord(de)
+			n.logDel(key)
+		}
+	}
+	return deleted
+}
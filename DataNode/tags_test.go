@@ -0,0 +1,73 @@
+package DataNode
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestCheckTags(t *testing.T) {
+
+	if tags, err := CheckTags([]string{"user:42", "all", "user:42"}); err != nil || !reflect.DeepEqual(tags, []string{"all", "user:42"}) {
+		t.Errorf("CheckTags() = %v %v", tags, err)
+	}
+	if tags, err := CheckTags(nil); err != nil || tags != nil {
+		t.Errorf("CheckTags(nil) = %v %v", tags, err)
+	}
+	if _, err := CheckTags([]string{"a", ""}); err == nil {
+		t.Errorf("CheckTags() must fail for an empty tag")
+	}
+}
+
+func TestSingleDataNode_tags(t *testing.T) {
+
+	n, _ := (&SingleDataNode{}).NewWithOptions(context.Background(), "000", NodeOptions{MaxSize: 4})
+	tagged := func(tags ...string) []EntryMeta { return []EntryMeta{{Tags: tags}} }
+
+	_ = n.storeMultipleRecords([]string{"profile"}, []any{"v"}, 0, tagged("user:42"))
+	_ = n.storeMultipleRecords([]string{"orders"}, []any{"v"}, 0, tagged("orders", "user:42"))
+	_ = n.storeMultipleRecords([]string{"other"}, []any{"v"}, 0, tagged("user:7"))
+	_ = n.storeMultipleRecords([]string{NamespaceKey("team", "profile")}, []any{"v"}, 0, tagged("user:42"))
+
+	// an update replaces the tags, an increment keeps them
+	_ = n.storeMultipleRecords([]string{"other"}, []any{"v"}, 0, tagged("user:42"))
+	if n.tags["user:7"] != nil || !n.tags["user:42"]["other"] {
+		t.Errorf("after the update the tag index is %v", n.tags)
+	}
+	_ = n.storeMultipleRecords([]string{"other"}, []any{int64(1)}, 0, tagged("user:7"))
+	if _, _, meta, err := n.incrementRecords([]string{"other"}, []any{int64(1)}, nil); err != nil || !slices.Equal(meta[0].Tags, []string{"user:7"}) {
+		t.Errorf("incrementRecords() returned the metadata %+v, error %v", meta, err)
+	}
+
+	// the invalidation stays in the namespace
+	if deleted := n.invalidateTags("", []string{"user:42", "nosuchtag"}); len(deleted) != 2 || n.Len() != 2 {
+		t.Errorf("invalidateTags() deleted %v, %d records left", deleted, n.Len())
+	}
+	if n.tags["orders"] != nil || len(n.tags["user:42"]) != 1 {
+		t.Errorf("after the invalidation the tag index is %v", n.tags)
+	}
+	if deleted := n.invalidateTags("team", []string{"user:42"}); len(deleted) != 1 || len(n.tags["user:42"]) != 0 {
+		t.Errorf("invalidateTags() in the namespace deleted %v, the tag index is %v", deleted, n.tags)
+	}
+
+	// the evicted records leave the index
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		_ = n.storeMultipleRecords([]string{k}, []any{"v"}, 0, tagged("letters"))
+	}
+	if len(n.tags["letters"]) != 4 || n.tags["user:7"] != nil {
+		t.Errorf("after the evictions the tag index is %v", n.tags)
+	}
+	n.deleteAllRecords()
+	if len(n.tags) != 0 {
+		t.Errorf("after a flush the tag index is %v", n.tags)
+	}
+
+	// through the channel
+	_ = n.storeMultipleRecords([]string{"a", "b"}, []any{"v", "v"}, 0, []EntryMeta{{Tags: []string{"x"}}, {}})
+	backCh := make(chan DNResponse, 1)
+	n.GetChannel() <- DNRequest{Command: "invalidate", Tags: []string{"x"}, BackCh: backCh}
+	if resp := <-backCh; resp.Count != 1 || !slices.Equal(resp.Keys, []string{"a"}) {
+		t.Errorf("invalidate returned %+v", resp)
+	}
+}
@@ -0,0 +1,171 @@
+package DataNode
+
+import (
+	"hash/fnv"
+)
+
+// countMinSketch estimates key frequencies in little memory: 4 rows of 4 bit counters.
+// After sampleSize increments all counters are halved so old popularity fades away.
+type countMinSketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 16
+	for width < capacity*2 {
+		width *= 2
+	}
+	s := &countMinSketch{
+		mask:       uint64(width - 1),
+		sampleSize: 10 * max(capacity, 16),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// counter positions of the key, one per row
+func (s *countMinSketch) indexes(key string) [4]uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(key))
+	h := f.Sum64()
+	h ^= h >> 33 // fnv's high bits are weak for short keys, mix them
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	lo, hi := h, h>>32|h<<32
+	var ndx [4]uint64
+	for i := range ndx {
+		ndx[i] = (lo + uint64(i)*hi) & s.mask
+	}
+	return ndx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, ndx := range s.indexes(key) {
+		if s.rows[i][ndx] < 15 {
+			s.rows[i][ndx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.additions /= 2
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] /= 2
+			}
+		}
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	est := uint8(15)
+	for i, ndx := range s.indexes(key) {
+		est = min(est, s.rows[i][ndx])
+	}
+	return est
+}
+
+// tinyLFUPolicy is W-TinyLFU (Einziger, Friedman, Manes).
+// New records enter a small LRU window. When the window is full its victim competes with
+// the victim of the main segmented LRU, the one with the higher estimated frequency stays.
+// The main area has a probation part for records seen once there and a protected part for records seen again.
+type tinyLFUPolicy struct {
+	windowCap    int // 1% of the capacity
+	mainCap      int // the rest
+	protectedCap int // 80% of the main area
+	sketch       *countMinSketch
+	window       *keyList
+	probation    *keyList
+	protected    *keyList
+}
+
+func (w *tinyLFUPolicy) New(capacity int) *tinyLFUPolicy {
+	w.windowCap = max(capacity/100, 1)
+	w.mainCap = max(capacity-w.windowCap, 1)
+	w.protectedCap = max(w.mainCap*8/10, 1)
+	w.sketch = newCountMinSketch(capacity)
+	w.window, w.probation, w.protected = newKeyList(), newKeyList(), newKeyList()
+	return w
+}
+
+func (w *tinyLFUPolicy) Insert(key string) {
+	if w.window.contains(key) || w.probation.contains(key) || w.protected.contains(key) {
+		w.Access(key)
+		return
+	}
+	w.sketch.increment(key)
+	w.window.pushFront(key)
+}
+
+func (w *tinyLFUPolicy) Access(key string) {
+	w.sketch.increment(key)
+	switch {
+	case w.window.contains(key):
+		w.window.pushFront(key)
+	case w.probation.remove(key): // promoted, the protected overflow goes back to probation
+		w.protected.pushFront(key)
+		for w.protected.Len() > w.protectedCap {
+			demoted, _ := w.protected.popBack()
+			w.probation.pushFront(demoted)
+		}
+	case w.protected.contains(key):
+		w.protected.pushFront(key)
+	}
+}
+
+func (w *tinyLFUPolicy) Remove(key string) {
+	if !w.window.remove(key) && !w.probation.remove(key) {
+		w.protected.remove(key)
+	}
+}
+
+// main area victim: probation first, protected if probation is empty
+func (w *tinyLFUPolicy) mainVictim() (*keyList, string, bool) {
+	if key, ok := w.probation.back(); ok {
+		return w.probation, key, true
+	}
+	key, ok := w.protected.back()
+	return w.protected, key, ok
+}
+
+func (w *tinyLFUPolicy) Evict() (string, bool) {
+	// while the main area has room the window overflow simply moves there
+	for w.window.Len() > w.windowCap && w.probation.Len()+w.protected.Len() < w.mainCap {
+		key, _ := w.window.popBack()
+		w.probation.pushFront(key)
+	}
+
+	if w.window.Len() < w.windowCap || w.window.Len() == 0 {
+		// the window has room, the main area gives the victim
+		list, key, ok := w.mainVictim()
+		if ok {
+			list.remove(key)
+			return key, true
+		}
+		return w.window.popBack()
+	}
+
+	// the window is full: its victim is a candidate for the main area
+	candidate, _ := w.window.popBack()
+	list, victim, ok := w.mainVictim()
+	if !ok {
+		return candidate, true
+	}
+	if w.sketch.estimate(candidate) > w.sketch.estimate(victim) {
+		list.remove(victim)
+		w.probation.pushFront(candidate)
+		return victim, true
+	}
+	return candidate, true
+}
+
+func (w *tinyLFUPolicy) Keys() []string {
+	keys := make([]string, 0, w.Len())
+	return w.probation.appendKeys(w.window.appendKeys(w.protected.appendKeys(keys)))
+}
+
+func (w *tinyLFUPolicy) Len() int { return w.window.Len() + w.probation.Len() + w.protected.Len() }
@@ -0,0 +1,52 @@
+package DataNode
+
+import (
+	"time"
+)
+
+// how long a key deleted with a version keeps its tombstone. A replica which missed the delete
+// and is read only after that may bring the record back
+const tombstoneTTL = 10 * time.Minute
+
+// a key deleted with a version: the writes of older versions arriving late are ignored.
+// The tombstones are not persisted, a node restored from its log forgets them
+type tombstone struct {
+	version   uint64    // version of the delete
+	deletedAt time.Time // when the node deleted the key
+}
+
+// a tombstone in the order of the deletes, for the sweeper
+type tombstoneAge struct {
+	key       string
+	deletedAt time.Time
+}
+
+// sets the tombstone of a deleted key unless it has a newer one
+// warning: not protected by a mutex
+func (n *SingleDataNode) setTombstone(key string, version uint64, now time.Time) {
+	if t, ok := n.tombstones[key]; ok && t.version >= version {
+		return
+	}
+	n.tombstones[key] = tombstone{version: version, deletedAt: now}
+	n.tombstoneAges = append(n.tombstoneAges, tombstoneAge{key: key, deletedAt: now})
+}
+
+// removes the tombstones older than tombstoneTTL, returns how many
+func (n *SingleDataNode) sweepTombstones(now time.Time) int {
+	n.Lock()
+	defer n.Unlock()
+
+	count := 0
+	horizon := now.Add(-tombstoneTTL)
+	i := 0
+	for ; i < len(n.tombstoneAges) && !n.tombstoneAges[i].deletedAt.After(horizon); i++ {
+		age := n.tombstoneAges[i]
+		// the key may have been written or deleted again since
+		if t, ok := n.tombstones[age.key]; ok && t.deletedAt.Equal(age.deletedAt) {
+			delete(n.tombstones, age.key)
+			count++
+		}
+	}
+	n.tombstoneAges = n.tombstoneAges[i:]
+	return count
+}
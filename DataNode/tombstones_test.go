@@ -0,0 +1,59 @@
+package DataNode
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSingleDataNode_Tombstones(t *testing.T) {
+
+	n := (&SingleDataNode{}).New(context.Background(), "000", 10)
+	put := func(key string, value any, version uint64) {
+		if err := n.storeMultipleRecords([]string{key}, []any{value}, 0, []EntryMeta{{Version: version}}); err != nil {
+			t.Fatalf("storeMultipleRecords() error = %v", err)
+		}
+	}
+	put("key1", "v1", 10)
+	put("key2", "v2", 30)
+
+	// a delete spares a record written after it
+	deleted, err := n.deleteRecords([]string{"key1", "key2", "key3"}, []EntryMeta{{Version: 20}, {Version: 20}, {Version: 20}})
+	if err != nil || !slices.Equal(deleted, []string{"key1"}) {
+		t.Errorf("deleteRecords() returned %v %v", deleted, err)
+	}
+
+	// the tombstones are found on request only
+	if kf, _, _ := n.findMultipleKeys([]string{"key1", "key3"}, false); len(kf) != 0 {
+		t.Errorf("findMultipleKeys() found deleted keys %v", kf)
+	}
+	kf, vf, mf := n.findMultipleKeys([]string{"key1", "key2"}, true)
+	if !slices.Equal(kf, []string{"key1", "key2"}) || vf[0] != nil || mf[0].Version != 20 || !mf[0].Deleted || vf[1] != "v2" || mf[1].Deleted {
+		t.Errorf("findMultipleKeys() with the tombstones returned %v %v %+v", kf, vf, mf)
+	}
+
+	// a late write older than the delete is ignored, a newer one or one without version is stored
+	put("key1", "late", 15)
+	if kf, _, _ := n.findMultipleKeys([]string{"key1"}, false); len(kf) != 0 {
+		t.Errorf("a write older than the delete brought key1 back")
+	}
+	put("key1", "new", 0)
+	put("key3", "new", 25)
+	if _, _, mf = n.findMultipleKeys([]string{"key1", "key3"}, true); len(mf) != 2 || mf[0].Version != 21 || mf[1].Version != 25 || mf[0].Deleted || mf[1].Deleted {
+		t.Errorf("expected the new records after the deletes, got %+v", mf)
+	}
+
+	// the sweeper drops the old tombstones only
+	n.deleteRecords([]string{"key1"}, []EntryMeta{{Version: 40}})
+	if count := n.sweepTombstones(time.Now()); count != 0 {
+		t.Errorf("sweepTombstones() removed %d fresh tombstones", count)
+	}
+	if count := n.sweepTombstones(time.Now().Add(tombstoneTTL)); count != 1 {
+		t.Errorf("sweepTombstones() removed %d tombstones, expected 1", count)
+	}
+	put("key1", "late", 15)
+	if _, vf, _ = n.findMultipleKeys([]string{"key1"}, true); len(vf) != 1 || vf[0] != "late" {
+		t.Errorf("expected the write after the tombstone expired, got %v", vf)
+	}
+}
@@ -0,0 +1,420 @@
+package DataNode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transport carries requests to a node and its responses back.
+// The node may live in the same process (SingleDataNode) or behind the network (RemoteNode),
+// the callers send DNRequest to the channel and read DNResponse from the BackCh either way
+type Transport interface {
+	GetChannel() chan DNRequest
+}
+
+var (
+	_ Transport = (*SingleDataNode)(nil)
+	_ Transport = (*RemoteNode)(nil)
+)
+
+// The wire protocol: every message is a frame of a 4 byte big endian payload length followed by
+// the gob encoded payload. Requests and responses carry ids so many requests can be in flight on one connection.
+
+const maxFrameSize = 64 << 20 // bigger frames are a protocol error
+
+// dialTimeout is how long RemoteNode waits for a connection
+const dialTimeout = 5 * time.Second
+
+// writeTimeout is how long writing a frame may take. A peer which does not read for so long is lost,
+// RemoteNode drops the connection and dials again
+const writeTimeout = 5 * time.Second
+
+// RemoteNode dials a lost connection again after minRedialDelay, doubling the delay after every failure up to maxRedialDelay
+const (
+	minRedialDelay = 100 * time.Millisecond
+	maxRedialDelay = 5 * time.Second
+)
+
+// pendingCheckPeriod is how often RemoteNode fails the requests waiting past their deadlines
+const pendingCheckPeriod = 100 * time.Millisecond
+
+// values decoded from JSON are maps and slices of any, the wire and the log carry them as interfaces,
+// and so the typed structures
+func init() {
+	gob.Register(map[string]any{})
+	gob.Register([]any{})
+	gob.Register(List{})
+	gob.Register(Hash{})
+	gob.Register(Set{})
+	gob.Register(ZSet{})
+}
+
+// a request on the wire, the BackCh is not sent
+type wireRequest struct {
+	Id      uint64
+	Request DNRequest
+}
+
+// a response on the wire
+type wireResponse struct {
+	Id       uint64
+	Response DNResponse
+}
+
+// encodes v into a frame
+func encodeFrame(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4)) // room for the length
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	frame := buf.Bytes()
+	if len(frame)-4 > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes is too big", len(frame)-4)
+	}
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	return frame, nil
+}
+
+// reads a frame and decodes it into v
+func readFrame(r io.Reader, v any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes is too big", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
+
+// ServeTCP  serves a node over the network until the context is cancelled or the listener fails
+// --> Input:
+// ctx        context.Context     execution context, cancelling it closes the listener and the connections
+// ln         net.Listener        listener accepting the managers
+// nodeCh     chan<- DNRequest    channel of the served node
+// <-- Output:
+// 1) error     why the server stopped
+func ServeTCP(ctx context.Context, ln net.Listener, nodeCh chan<- DNRequest) error {
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	log.Printf("[TCP] serving a node on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go serveConn(ctx, conn, nodeCh)
+	}
+}
+
+// passes the requests from a connection to the node, the responses go back in the order they are ready
+func serveConn(ctx context.Context, conn net.Conn, nodeCh chan<- DNRequest) {
+	log.Printf("[TCP] %s connected", conn.RemoteAddr())
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		_ = conn.Close()
+	}()
+
+	var writeLock sync.Mutex // responses are written by many goroutines
+	reader := bufio.NewReader(conn)
+	for {
+		var wr wireRequest
+		if err := readFrame(reader, &wr); err != nil {
+			if !errors.Is(err, io.EOF) && connCtx.Err() == nil {
+				log.Printf("[TCP] %s error: %s", conn.RemoteAddr(), err)
+			}
+			log.Printf("[TCP] %s disconnected", conn.RemoteAddr())
+			return
+		}
+		go func(wr wireRequest) {
+			rq := wr.Request
+			rq.BackCh = make(chan DNResponse, 1)
+			var resp DNResponse
+			select {
+			case nodeCh <- rq:
+				select {
+				case resp = <-rq.BackCh:
+				case <-connCtx.Done():
+					return
+				}
+			case <-connCtx.Done():
+				return
+			}
+			frame, err := encodeFrame(wireResponse{Id: wr.Id, Response: resp})
+			if err != nil { // e.g. a value of a type gob does not know
+				frame, _ = encodeFrame(wireResponse{Id: wr.Id, Response: DNResponse{Status: "Error", Message: err.Error()}})
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if _, err = conn.Write(frame); err != nil {
+				log.Printf("[TCP] %s error: %s", conn.RemoteAddr(), err)
+				cancel()
+			}
+		}(wr)
+	}
+}
+
+// RemoteNode is a node served by ServeTCP in another process.
+// It looks like a local node: requests go to its channel, responses come back on their BackCh.
+// A lost connection fails the requests in flight and is dialed again in the background, backing off
+// while the node is unreachable. The requests sent meanwhile fail at once. A request which can't be written
+// within writeTimeout loses the connection the same way.
+// A request waiting for its response past its Deadline fails as well
+type RemoteNode struct {
+	sync.Mutex                             // protects conn, dialing, dialErr, pending and lastId
+	ctx          context.Context           // exec context with cancel
+	addr         string                    // node address
+	dataCh       chan DNRequest            // channel to receive requests
+	conn         net.Conn                  // current connection, nil if there is none
+	dialing      bool                      // the connection is being dialed in the background
+	dialErr      error                     // why the last dial failed
+	pending      map[uint64]pendingRequest // request id -> the request waiting for its response
+	lastId       uint64                    // id of the last request sent
+	writeTimeout time.Duration             // how long writing a request may take, writeTimeout if zero
+}
+
+// a request sent over the connection waiting for its response
+type pendingRequest struct {
+	backCh   chan DNResponse // channel to reply
+	deadline time.Time       // when the request fails, zero if never
+}
+
+// Dial  connects to a node served by ServeTCP
+// --> Input:
+// ctx      context.Context     execution context, cancelling it closes the connection
+// addr     string              node address, host:port
+// <-- Output:
+// 1) *RemoteNode     connected node
+// 2) error           if the node can't be reached
+func (r *RemoteNode) Dial(ctx context.Context, addr string) (*RemoteNode, error) {
+	r.ctx = ctx
+	r.addr = addr
+	r.pending = make(map[uint64]pendingRequest)
+	r.dataCh = make(chan DNRequest, queueSize)
+	if r.writeTimeout <= 0 {
+		r.writeTimeout = writeTimeout
+	}
+	conn, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+	go r.readLoop(conn)
+	go r.mainLoop()
+	return r, nil
+}
+
+// GetChannel gives request channel
+func (r *RemoteNode) GetChannel() chan DNRequest {
+	return r.dataCh
+}
+
+// Addr gives the node address
+func (r *RemoteNode) Addr() string {
+	return r.addr
+}
+
+// dials the node once
+func (r *RemoteNode) dial() (net.Conn, error) {
+	return (&net.Dialer{Timeout: dialTimeout}).DialContext(r.ctx, "tcp", r.addr)
+}
+
+// starts dialing the node in the background unless it's dialed already
+// warning: not protected by the mutex, the caller holds it
+func (r *RemoteNode) redial() {
+	if r.dialing || r.ctx.Err() != nil {
+		return
+	}
+	r.dialing = true
+	go r.dialLoop()
+}
+
+// dials the node until it answers or the context is cancelled, waiting longer after every failure
+func (r *RemoteNode) dialLoop() {
+	backoff := minRedialDelay
+	for {
+		conn, err := r.dial()
+		r.Lock()
+		if err == nil && r.ctx.Err() == nil {
+			r.conn, r.dialing, r.dialErr = conn, false, nil
+			r.Unlock()
+			log.Printf("[TCP] connected to %s again", r.addr)
+			go r.readLoop(conn)
+			return
+		}
+		if err == nil { // connected too late, the node is closed
+			_ = conn.Close()
+		}
+		r.dialErr = err
+		if r.ctx.Err() != nil {
+			r.dialing = false
+			r.Unlock()
+			return
+		}
+		r.Unlock()
+
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+		}
+		backoff = min(2*backoff, maxRedialDelay)
+	}
+}
+
+// closes the connection, fails the requests waiting for it and dials again
+func (r *RemoteNode) disconnect(conn net.Conn, err error) {
+	r.Lock()
+	if r.conn != conn {
+		r.Unlock()
+		return // dropped already
+	}
+	_ = conn.Close()
+	r.conn = nil
+	if r.ctx.Err() == nil {
+		log.Printf("[TCP] connection to %s lost: %s", r.addr, err)
+	}
+	failed := r.pending
+	r.pending = make(map[uint64]pendingRequest)
+	r.redial()
+	r.Unlock()
+
+	for _, p := range failed {
+		reply(p.backCh, DNResponse{
+			Status:  "Error",
+			Message: fmt.Sprintf("connection to %s lost: %s", r.addr, err),
+		})
+	}
+}
+
+// fails the requests waiting past their deadlines
+func (r *RemoteNode) expirePending(now time.Time) {
+	var expired []chan DNResponse
+	r.Lock()
+	for id, p := range r.pending {
+		if !p.deadline.IsZero() && now.After(p.deadline) {
+			expired = append(expired, p.backCh)
+			delete(r.pending, id)
+		}
+	}
+	r.Unlock()
+
+	for _, backCh := range expired {
+		reply(backCh, DNResponse{
+			Status:  "Error",
+			Message: fmt.Sprintf("node %s did not answer in time", r.addr),
+		})
+	}
+}
+
+// sends a response unless nobody waits for it: the BackCh of the callers have room for one
+func reply(backCh chan DNResponse, resp DNResponse) {
+	select {
+	case backCh <- resp:
+	default:
+	}
+}
+
+// main loop sending the requests
+func (r *RemoteNode) mainLoop() {
+	ticker := time.NewTicker(pendingCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done(): // user cancellation
+			r.Lock()
+			conn := r.conn
+			r.Unlock()
+			if conn != nil {
+				r.disconnect(conn, r.ctx.Err())
+			}
+			return
+		case now := <-ticker.C:
+			r.expirePending(now)
+		case rq := <-r.dataCh:
+			r.Lock()
+			conn := r.conn
+			if conn == nil {
+				r.redial()
+				dialErr := r.dialErr
+				r.Unlock()
+				reply(rq.BackCh, DNResponse{
+					Status:  "Error",
+					Message: fmt.Sprintf("node %s unreachable: %v", r.addr, dialErr),
+				})
+				continue
+			}
+			r.lastId++
+			id := r.lastId
+			r.Unlock()
+			frame, err := encodeFrame(wireRequest{Id: id, Request: rq})
+			if err != nil {
+				reply(rq.BackCh, DNResponse{
+					Status:  "Error",
+					Message: err.Error(),
+				})
+				continue
+			}
+			r.Lock()
+			r.pending[id] = pendingRequest{backCh: rq.BackCh, deadline: rq.Deadline}
+			r.Unlock()
+			// a node which stops reading must not block the requests behind this one, a timeout loses the connection
+			_ = conn.SetWriteDeadline(time.Now().Add(r.writeTimeout))
+			if _, err = conn.Write(frame); err != nil {
+				r.disconnect(conn, err)
+				r.Lock()
+				_, ok := r.pending[id] // the connection was replaced before the request was sent
+				delete(r.pending, id)
+				r.Unlock()
+				if ok {
+					reply(rq.BackCh, DNResponse{
+						Status:  "Error",
+						Message: fmt.Sprintf("connection to %s lost: %s", r.addr, err),
+					})
+				}
+			}
+		}
+	}
+}
+
+// reads the responses of a connection and passes them to the waiting requests
+func (r *RemoteNode) readLoop(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	for {
+		var wr wireResponse
+		if err := readFrame(reader, &wr); err != nil {
+			r.disconnect(conn, err)
+			return
+		}
+		r.Lock()
+		p, ok := r.pending[wr.Id]
+		delete(r.pending, wr.Id)
+		r.Unlock()
+		if ok {
+			reply(p.backCh, wr.Response)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package DataNode
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// starts a node served on a localhost port, returns its address
+func serveTestNode(t *testing.T, ctx context.Context, maxSize int) (*SingleDataNode, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	n := (&SingleDataNode{}).New(ctx, "000", maxSize)
+	go func() { _ = ServeTCP(ctx, ln, n.GetChannel()) }()
+	return n, ln.Addr().String()
+}
+
+// sends a request and waits for the response
+func callTransport(t *testing.T, tr Transport, rq DNRequest) DNResponse {
+	rq.BackCh = make(chan DNResponse, 1)
+	tr.GetChannel() <- rq
+	select {
+	case resp := <-rq.BackCh:
+		return resp
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no response to %s", rq.Command)
+	}
+	return DNResponse{}
+}
+
+func TestRemoteNode_Requests(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n, addr := serveTestNode(t, ctx, 100)
+
+	r, err := (&RemoteNode{}).Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	expires := time.Now().Add(time.Hour).Round(0)
+	resp := callTransport(t, r, DNRequest{
+		Command: "put",
+		Keys:    []string{"key1", "key2", "key3", "json"},
+		Values:  []any{"value1", 42, []byte{0, 1, 2}, map[string]any{"name": "Ann", "tags": []any{"a", 1.5}}},
+		Meta:    []EntryMeta{{}, {ExpiresAt: expires}, {Version: 7, ContentType: "application/octet-stream"}, {}},
+	})
+	if resp.Status != "OK" || n.Len() != 4 {
+		t.Fatalf("put over the network failed: %+v, node has %d records", resp, n.Len())
+	}
+
+	resp = callTransport(t, r, DNRequest{Command: "get", Keys: []string{"key1", "key2", "key3", "json", "nokey"}})
+	got := make(map[string]any)
+	for i, k := range resp.Keys {
+		got[k] = resp.Values[i]
+	}
+	if len(got) != 4 || got["key1"] != "value1" || got["key2"] != 42 || fmt.Sprint(got["key3"]) != "[0 1 2]" || fmt.Sprint(got["json"]) != "map[name:Ann tags:[a 1.5]]" {
+		t.Errorf("get over the network returned %v", got)
+	}
+	if !resp.Meta[1].ExpiresAt.Equal(expires) || resp.Meta[2].Version != 7 || resp.Meta[2].ContentType != "application/octet-stream" {
+		t.Errorf("metadata did not survive the network: %+v", resp.Meta)
+	}
+
+	// many requests in flight on one connection, every response finds its request
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", i)
+			callTransport(t, r, DNRequest{Command: "put", Keys: []string{key}, Values: []any{i}})
+			resp := callTransport(t, r, DNRequest{Command: "get", Keys: []string{key}})
+			if len(resp.Keys) != 1 || resp.Keys[0] != key || resp.Values[0] != i {
+				t.Errorf("for %s got %v %v", key, resp.Keys, resp.Values)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// the typed structures and the results of the operations travel as they are
+	resp = callTransport(t, r, DNRequest{Command: "op", Keys: []string{"zset"}, Ops: []StructOp{{"zadd", []string{"2", "b", "1", "a"}}}})
+	if resp.Status != "OK" || !reflect.DeepEqual(resp.Results, []any{int64(2)}) || !reflect.DeepEqual(resp.Versions, []uint64{0}) {
+		t.Errorf("op over the network returned %+v", resp)
+	}
+	if resp = callTransport(t, r, DNRequest{Command: "get", Keys: []string{"zset"}}); !reflect.DeepEqual(resp.Values, []any{ZSet{{"a", 1}, {"b", 2}}}) {
+		t.Errorf("get over the network returned %+v", resp)
+	}
+
+	if resp = callTransport(t, r, DNRequest{Command: "del"}); resp.Count != 55 {
+		t.Errorf("del over the network deleted %d records, expected 55", resp.Count)
+	}
+}
+
+func TestRemoteNode_ServerGone(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverCtx, stopServer := context.WithCancel(ctx)
+	_, addr := serveTestNode(t, serverCtx, 100)
+
+	r, err := (&RemoteNode{}).Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if resp := callTransport(t, r, DNRequest{Command: "get"}); resp.Status != "OK" {
+		t.Fatalf("status request failed: %+v", resp)
+	}
+
+	stopServer()
+	// the requests fail instead of hanging
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		resp := callTransport(t, r, DNRequest{Command: "get"})
+		if resp.Status == "Error" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("requests still succeed after the server is gone")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err = (&RemoteNode{}).Dial(ctx, addr); err == nil {
+		t.Errorf("Dial() must fail when nothing listens")
+	}
+}
+
+func TestRemoteNode_Deadline(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a server reading the requests and never answering
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+
+	r, err := (&RemoteNode{}).Dial(ctx, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if resp := callTransport(t, r, DNRequest{Command: "get", Deadline: time.Now().Add(50 * time.Millisecond)}); resp.Status != "Error" {
+		t.Errorf("a request past its deadline returned %+v", resp)
+	}
+	r.Lock()
+	pending := len(r.pending)
+	r.Unlock()
+	if pending != 0 {
+		t.Errorf("%d requests are still pending after their deadlines", pending)
+	}
+}
+
+func TestRemoteNode_WriteTimeout(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// a server accepting the connections and never reading them
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer ln.Close()
+	var conns sync.Map
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns.Store(conn, true)
+		}
+	}()
+	defer conns.Range(func(conn, _ any) bool {
+		_ = conn.(net.Conn).Close()
+		return true
+	})
+
+	r, err := (&RemoteNode{writeTimeout: 100 * time.Millisecond}).Dial(ctx, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	r.Lock()
+	first := r.conn
+	r.Unlock()
+
+	// the request fills the socket buffers, the write times out instead of blocking the node
+	rq := DNRequest{Command: "put", Keys: []string{"big"}, Values: []any{make([]byte, 32<<20)}, BackCh: make(chan DNResponse, 1)}
+	r.GetChannel() <- rq
+	select {
+	case resp := <-rq.BackCh:
+		if resp.Status != "Error" {
+			t.Errorf("a request the node does not read returned %+v", resp)
+		}
+	case <-time.After(10 * time.Second): // encoding the frame takes a while with the race detector
+		t.Fatalf("the write to a node which does not read did not time out")
+	}
+
+	// the connection is dialed again
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		r.Lock()
+		conn := r.conn
+		r.Unlock()
+		if conn != nil && conn != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the connection was not dialed again after the write timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteNode_Redial(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	addr := ln.Addr().String()
+	n := (&SingleDataNode{}).New(ctx, "000", 100)
+	serverCtx, stopServer := context.WithCancel(ctx)
+	go func() { _ = ServeTCP(serverCtx, ln, n.GetChannel()) }()
+
+	r, err := (&RemoteNode{}).Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	callTransport(t, r, DNRequest{Command: "put", Keys: []string{"key"}, Values: []any{1}})
+	stopServer()
+
+	// the requests fail at once while the node is away, the connection comes back by itself
+	start := time.Now()
+	for resp := callTransport(t, r, DNRequest{Command: "get"}); resp.Status != "Error"; resp = callTransport(t, r, DNRequest{Command: "get"}) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("requests to a node away took %v to fail", elapsed)
+	}
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("can't listen on %s again: %v", addr, err)
+	}
+	go func() { _ = ServeTCP(ctx, ln, n.GetChannel()) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp := callTransport(t, r, DNRequest{Command: "get", Keys: []string{"key"}})
+		if resp.Status == "OK" && len(resp.Values) == 1 && resp.Values[0] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the connection did not come back: %+v", resp)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,62 @@
+package DataNode
+
+// twoQueuePolicy is the full 2Q algorithm (Johnson, Shasha).
+// New records go to a1in, a FIFO which filters out records used only once.
+// Records evicted from a1in are remembered in the a1out ghost list,
+// a record coming back while still remembered goes straight to am, the main LRU.
+type twoQueuePolicy struct {
+	kin   int      // a1in size target, 1/4 of the capacity
+	kout  int      // a1out ghost list size, 1/2 of the capacity
+	a1in  *keyList // FIFO of records seen once
+	a1out *keyList // ghost keys evicted from a1in
+	am    *keyList // LRU of records seen again
+}
+
+func (q *twoQueuePolicy) New(capacity int) *twoQueuePolicy {
+	q.kin = max(capacity/4, 1)
+	q.kout = max(capacity/2, 1)
+	q.a1in, q.a1out, q.am = newKeyList(), newKeyList(), newKeyList()
+	return q
+}
+
+func (q *twoQueuePolicy) Insert(key string) {
+	switch {
+	case q.am.contains(key) || q.a1in.contains(key):
+		q.Access(key)
+	case q.a1out.remove(key):
+		q.am.pushFront(key)
+	default:
+		q.a1in.pushFront(key)
+	}
+}
+
+// records in a1in are not moved: a second hit while still in the FIFO is considered correlated
+func (q *twoQueuePolicy) Access(key string) {
+	if q.am.contains(key) {
+		q.am.pushFront(key)
+	}
+}
+
+func (q *twoQueuePolicy) Remove(key string) {
+	if !q.a1in.remove(key) {
+		q.am.remove(key)
+	}
+}
+
+func (q *twoQueuePolicy) Evict() (string, bool) {
+	if q.a1in.Len() > q.kin || (q.a1in.Len() > 0 && q.am.Len() == 0) {
+		key, _ := q.a1in.popBack()
+		q.a1out.pushFront(key)
+		for q.a1out.Len() > q.kout {
+			q.a1out.popBack()
+		}
+		return key, true
+	}
+	return q.am.popBack()
+}
+
+func (q *twoQueuePolicy) Keys() []string {
+	return q.a1in.appendKeys(q.am.appendKeys(make([]string, 0, q.Len())))
+}
+
+func (q *twoQueuePolicy) Len() int { return q.a1in.Len() + q.am.Len() }
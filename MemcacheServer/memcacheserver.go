@@ -0,0 +1,752 @@
+package MemcacheServer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewelkin/discap/CacheManager"
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// limits protecting the server from broken clients, the same as memcached has by default
+const (
+	maxLineSize  = 8 << 10 // longest command line
+	maxKeySize   = 250     // longest key
+	maxValueSize = 1 << 20 // biggest value, the memcached item size
+)
+
+// exptime values bigger than this are unix timestamps, smaller are seconds from now
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// version reported to the clients, some of them check it for the meta commands support
+const serverVersion = "1.6.21"
+
+// errClient is a request the server can't parse, the connection is closed after it
+var errClient = errors.New("bad command line format")
+
+// MemcacheServer speaks the memcached text protocol: get, gets, set, add, replace, cas, delete, flush_all, stats
+// and the meta commands mg, ms, md, mn. It passes them to the cache manager,
+// so the memcached clients can talk to the cache. The client flags and exptime are kept with the records
+type MemcacheServer struct {
+	cacheManager *CacheManager.DateNodesManager
+	started      time.Time
+
+	currConnections  atomic.Int64
+	totalConnections atomic.Int64
+	cmdGet           atomic.Int64
+	cmdSet           atomic.Int64
+	cmdFlush         atomic.Int64
+	getHits          atomic.Int64
+	getMisses        atomic.Int64
+	deleteHits       atomic.Int64
+	deleteMisses     atomic.Int64
+}
+
+// a client connection
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// StartAndServe starts a memcached protocol server. it passes requests to the cache manager
+// --> Input:
+// port             int                                port to listen, 11211 is the usual one
+// cacheManager     *CacheManager.DateNodesManager     points to cache manager
+func (s *MemcacheServer) StartAndServe(port int, cacheManager *CacheManager.DateNodesManager) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err == nil {
+		err = s.Serve(context.Background(), ln, cacheManager)
+	}
+	if err != nil {
+		fmt.Printf("error starting memcached protocol server: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Serve  accepts the clients until the context is cancelled or the listener fails
+// --> Input:
+// ctx              context.Context                    execution context, cancelling it closes the listener and the connections
+// ln               net.Listener                       listener accepting the clients
+// cacheManager     *CacheManager.DateNodesManager     points to cache manager
+// <-- Output:
+// 1) error     why the server stopped
+func (s *MemcacheServer) Serve(ctx context.Context, ln net.Listener, cacheManager *CacheManager.DateNodesManager) error {
+	s.cacheManager = cacheManager
+	s.started = time.Now()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	log.Printf("[MC] listening on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// reads the commands of a client and answers them, pipelined answers are flushed together
+func (s *MemcacheServer) serveConn(ctx context.Context, conn net.Conn) {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		_ = conn.Close()
+	}()
+	s.currConnections.Add(1)
+	s.totalConnections.Add(1)
+	defer s.currConnections.Add(-1)
+
+	c := &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			if errors.Is(err, errClient) {
+				c.line("CLIENT_ERROR " + err.Error())
+				_ = c.w.Flush()
+			}
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			c.line("ERROR")
+			continue
+		}
+		quit, err := s.execute(c, args)
+		if err != nil { // the data block is broken, the rest of the stream can't be trusted
+			c.line("CLIENT_ERROR " + err.Error())
+			quit = true
+		}
+		if c.r.Buffered() == 0 || quit {
+			if err = c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// reads a line without the \r\n
+func (c *client) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// the reader buffer is smaller than maxLineSize, collect the rest
+		buf := append([]byte(nil), line...)
+		for errors.Is(err, bufio.ErrBufferFull) && len(buf) <= maxLineSize {
+			line, err = c.r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		if len(buf) > maxLineSize {
+			return "", fmt.Errorf("%w: line too long", errClient)
+		}
+		line = buf
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// reads a data block of the given size and its \r\n
+func (c *client) readData(size int) (string, error) {
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, buf); err != nil {
+		return "", err
+	}
+	if buf[size] != '\r' || buf[size+1] != '\n' {
+		return "", errors.New("bad data chunk")
+	}
+	return string(buf[:size]), nil
+}
+
+// skips a data block the server does not take
+func (c *client) skipData(size int) error {
+	_, err := c.r.Discard(size + 2)
+	return err
+}
+
+func (c *client) line(s string) {
+	_, _ = c.w.WriteString(s + "\r\n")
+}
+
+// a value from the cache as bytes
+func valueBytes(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// keys are up to 250 bytes without spaces and control characters
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) > maxKeySize {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// converts the memcached exptime to a TTL: zero never expires, up to 30 days are seconds from now,
+// bigger numbers are unix timestamps. A negative or past exptime gives a TTL expiring at once
+func exptimeToTTL(exptime int64) time.Duration {
+	var ttl time.Duration
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime > maxRelativeExptime:
+		ttl = time.Until(time.Unix(exptime, 0))
+	default:
+		ttl = time.Duration(exptime) * time.Second
+	}
+	if ttl <= 0 {
+		return time.Nanosecond
+	}
+	return ttl
+}
+
+// executes a command. Returns true if the connection should be closed,
+// an error if the data block of a storage command is broken
+func (s *MemcacheServer) execute(c *client, args []string) (bool, error) {
+
+	switch args[0] {
+
+	case "get", "gets":
+		if len(args) < 2 {
+			c.line("ERROR")
+			break
+		}
+		s.retrieve(c, args[1:], args[0] == "gets")
+
+	case "set", "add", "replace", "cas":
+		return false, s.store(c, args)
+
+	case "delete": // delete <key> [0] [noreply]
+		noreply := args[len(args)-1] == "noreply"
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "0") || !validKey(args[1]) {
+			c.line("CLIENT_ERROR bad command line format")
+			break
+		}
+		deleted, err := s.delete(args[1])
+		switch {
+		case noreply:
+		case err != nil:
+			c.line("SERVER_ERROR " + err.Error())
+		case deleted:
+			c.line("DELETED")
+		default:
+			c.line("NOT_FOUND")
+		}
+
+	case "flush_all": // flush_all [delay] [noreply]
+		noreply := args[len(args)-1] == "noreply"
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		delay := int64(0)
+		if len(args) > 2 {
+			c.line("ERROR")
+			break
+		}
+		if len(args) == 2 {
+			var err error
+			if delay, err = strconv.ParseInt(args[1], 10, 64); err != nil || delay < 0 {
+				c.line("CLIENT_ERROR bad command line format")
+				break
+			}
+		}
+		err := s.flush(time.Duration(delay) * time.Second)
+		switch {
+		case noreply:
+		case err != nil:
+			c.line("SERVER_ERROR " + err.Error())
+		default:
+			c.line("OK")
+		}
+
+	case "stats":
+		if len(args) > 1 {
+			c.line("ERROR")
+			break
+		}
+		s.stats(c)
+
+	case "version":
+		c.line("VERSION " + serverVersion)
+
+	case "verbosity": // nothing to change, the logging is always on
+		if args[len(args)-1] != "noreply" {
+			c.line("OK")
+		}
+
+	case "quit":
+		return true, nil
+
+	case "mg":
+		s.metaGet(c, args[1:])
+
+	case "ms":
+		return false, s.metaSet(c, args[1:])
+
+	case "md":
+		s.metaDelete(c, args[1:])
+
+	case "mn":
+		c.line("MN")
+
+	default:
+		c.line("ERROR")
+	}
+	return false, nil
+}
+
+// finds the keys in the cache with their metadata
+func (s *MemcacheServer) get(keys []string) (map[string]any, map[string]DataNode.EntryMeta, error) {
+	s.cmdGet.Add(int64(len(keys)))
+	r := s.cacheManager.HandleRequest(CacheManager.CacheRequest{
+		Command:  "get",
+		Keys:     keys,
+		WithMeta: true,
+	})
+	if err := r.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, k := range keys {
+		if _, ok := r.Result[k]; ok {
+			s.getHits.Add(1)
+		} else {
+			s.getMisses.Add(1)
+		}
+	}
+	return r.Result, r.Meta, nil
+}
+
+// get <key>*, gets <key>* answers the found records with their cas unique
+func (s *MemcacheServer) retrieve(c *client, keys []string, withCas bool) {
+	for _, k := range keys {
+		if !validKey(k) {
+			c.line("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+	result, meta, err := s.get(keys)
+	if err != nil {
+		c.line("SERVER_ERROR " + err.Error())
+		return
+	}
+	for _, k := range keys {
+		v, ok := result[k]
+		if !ok {
+			continue
+		}
+		data := valueBytes(v)
+		if withCas {
+			c.line(fmt.Sprintf("VALUE %s %d %d %d", k, meta[k].Flags, len(data), meta[k].Version))
+		} else {
+			c.line(fmt.Sprintf("VALUE %s %d %d", k, meta[k].Flags, len(data)))
+		}
+		c.line(data)
+	}
+	c.line("END")
+}
+
+// stores a record with the cache manager command "put", "add", "replace" or "cas", the last one if the record
+// has the version casUnique. Returns true if it was stored
+func (s *MemcacheServer) put(command string, key string, value string, flags uint32, exptime int64, casUnique uint64) (bool, error) {
+	s.cmdSet.Add(1)
+	rq := CacheManager.CacheRequest{
+		Command: command,
+		Keys:    []string{key},
+		Values:  []any{value},
+		TTL:     exptimeToTTL(exptime),
+		Flags:   flags,
+	}
+	if command == "cas" {
+		rq.Versions = []uint64{casUnique}
+	}
+	r := s.cacheManager.HandleRequest(rq)
+	if r.Kind == CacheManager.Conflict {
+		return false, nil
+	}
+	if err := r.Err(); err != nil {
+		return false, err
+	}
+	return command == "put" || len(r.Stored) == 1, nil
+}
+
+// tells if a record exists, to tell a cas of a missing record from a cas of a changed one
+func (s *MemcacheServer) exists(key string) (bool, error) {
+	r := s.cacheManager.HandleCacheRequest("get", []string{key}, nil)
+	if err := r.Err(); err != nil {
+		return false, err
+	}
+	_, ok := r.Result[key]
+	return ok, nil
+}
+
+// set|add|replace <key> <flags> <exptime> <bytes> [noreply],
+// cas <key> <flags> <exptime> <bytes> <cas unique> [noreply], the data block follows
+func (s *MemcacheServer) store(c *client, args []string) error {
+	fields := 5
+	if args[0] == "cas" {
+		fields = 6
+	}
+	noreply := len(args) == fields+1 && args[fields] == "noreply"
+	if len(args) != fields && !noreply {
+		c.line("ERROR")
+		return nil
+	}
+	flags, err1 := strconv.ParseUint(args[2], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[3], 10, 64)
+	size, err3 := strconv.Atoi(args[4])
+	var casUnique uint64
+	var err4 error
+	if args[0] == "cas" {
+		casUnique, err4 = strconv.ParseUint(args[5], 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 || !validKey(args[1]) {
+		c.line("CLIENT_ERROR bad command line format")
+		return nil
+	}
+	if size > maxValueSize {
+		c.line("SERVER_ERROR object too large for cache")
+		return c.skipData(size)
+	}
+	data, err := c.readData(size)
+	if err != nil {
+		return err
+	}
+
+	command := args[0]
+	if command == "set" {
+		command = "put"
+	}
+	stored, err := s.put(command, args[1], data, uint32(flags), exptime, casUnique)
+	switch {
+	case noreply:
+	case err != nil:
+		c.line("SERVER_ERROR " + err.Error())
+	case stored:
+		c.line("STORED")
+	case command == "cas":
+		if found, err := s.exists(args[1]); err != nil {
+			c.line("SERVER_ERROR " + err.Error())
+		} else if found {
+			c.line("EXISTS")
+		} else {
+			c.line("NOT_FOUND")
+		}
+	default:
+		c.line("NOT_STORED")
+	}
+	return nil
+}
+
+// deletes a key, returns true if it existed
+func (s *MemcacheServer) delete(key string) (bool, error) {
+	r := s.cacheManager.HandleCacheRequest("del", []string{key}, nil)
+	if err := r.Err(); err != nil {
+		return false, err
+	}
+	if len(r.Deleted) == 1 {
+		s.deleteHits.Add(1)
+		return true, nil
+	}
+	s.deleteMisses.Add(1)
+	return false, nil
+}
+
+// clears the cache now or after the delay
+func (s *MemcacheServer) flush(delay time.Duration) error {
+	s.cmdFlush.Add(1)
+	flush := func() error {
+		return s.cacheManager.HandleCacheRequest("del", nil, nil).Err()
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, func() {
+			if err := flush(); err != nil {
+				log.Printf("[MC] delayed flush_all failed: %s", err)
+			}
+		})
+		return nil
+	}
+	return flush()
+}
+
+// the general purpose statistics
+func (s *MemcacheServer) stats(c *client) {
+	items, bytes := 0, int64(0)
+	for _, st := range s.cacheManager.Stats() {
+		items += st.Length
+		bytes += st.Bytes
+	}
+	stat := func(name string, value any) {
+		c.line(fmt.Sprintf("STAT %s %v", name, value))
+	}
+	stat("pid", os.Getpid())
+	stat("uptime", int64(time.Since(s.started).Seconds()))
+	stat("time", time.Now().Unix())
+	stat("version", serverVersion)
+	stat("curr_connections", s.currConnections.Load())
+	stat("total_connections", s.totalConnections.Load())
+	stat("cmd_get", s.cmdGet.Load())
+	stat("cmd_set", s.cmdSet.Load())
+	stat("cmd_flush", s.cmdFlush.Load())
+	stat("get_hits", s.getHits.Load())
+	stat("get_misses", s.getMisses.Load())
+	stat("delete_hits", s.deleteHits.Load())
+	stat("delete_misses", s.deleteMisses.Load())
+	stat("curr_items", items/s.cacheManager.Replicas())
+	stat("bytes", bytes)
+	stat("replicas", s.cacheManager.Replicas())
+	c.line("END")
+}
+
+// flags of a meta command, a letter and an optional token each. Returns false if a flag is repeated
+func parseMetaFlags(args []string) (map[byte]string, bool) {
+	flags := make(map[byte]string, len(args))
+	for _, a := range args {
+		if _, ok := flags[a[0]]; ok {
+			return nil, false
+		}
+		flags[a[0]] = a[1:]
+	}
+	return flags, true
+}
+
+// the flags returned as they were asked: k the key, O the opaque token
+func metaEcho(args []string, key string) []string {
+	var ret []string
+	for _, a := range args {
+		switch a[0] {
+		case 'k':
+			ret = append(ret, "k"+key)
+		case 'O':
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
+
+// writes a meta response code with the returned flags
+func (c *client) meta(code string, ret []string) {
+	if len(ret) == 0 {
+		c.line(code)
+	} else {
+		c.line(code + " " + strings.Join(ret, " "))
+	}
+}
+
+// mg <key> <flags>*: v the value, f the client flags, t the TTL left, c the cas unique, s the size,
+// k the key, O an opaque token, q no EN on a miss
+func (s *MemcacheServer) metaGet(c *client, args []string) {
+	if len(args) == 0 || !validKey(args[0]) {
+		c.line("CLIENT_ERROR bad command line format")
+		return
+	}
+	key, args := args[0], args[1:]
+	flags, ok := parseMetaFlags(args)
+	if !ok {
+		c.line("CLIENT_ERROR duplicate flag")
+		return
+	}
+	for f := range flags {
+		if !strings.ContainsRune("vftcskOq", rune(f)) {
+			c.line("CLIENT_ERROR invalid flag")
+			return
+		}
+	}
+
+	result, meta, err := s.get([]string{key})
+	if err != nil {
+		c.line("SERVER_ERROR " + err.Error())
+		return
+	}
+	v, found := result[key]
+	if !found {
+		if _, quiet := flags['q']; !quiet {
+			c.line("EN")
+		}
+		return
+	}
+
+	data := valueBytes(v)
+	var ret []string
+	for _, a := range args {
+		switch a[0] {
+		case 'f':
+			ret = append(ret, fmt.Sprintf("f%d", meta[key].Flags))
+		case 't':
+			ttl := int64(-1)
+			if exp := meta[key].ExpiresAt; !exp.IsZero() {
+				ttl = max(int64(time.Until(exp).Round(time.Second).Seconds()), 0)
+			}
+			ret = append(ret, fmt.Sprintf("t%d", ttl))
+		case 'c':
+			ret = append(ret, fmt.Sprintf("c%d", meta[key].Version))
+		case 's':
+			ret = append(ret, fmt.Sprintf("s%d", len(data)))
+		}
+	}
+	ret = append(ret, metaEcho(args, key)...)
+	if _, withValue := flags['v']; withValue {
+		c.meta(fmt.Sprintf("VA %d", len(data)), ret)
+		c.line(data)
+	} else {
+		c.meta("HD", ret)
+	}
+}
+
+// ms <key> <datalen> <flags>*: F the client flags, T the exptime, ME add, MR replace, MS set,
+// C the cas unique the record must have, k the key, O an opaque token, q no HD on success. The data block follows
+func (s *MemcacheServer) metaSet(c *client, args []string) error {
+	if len(args) < 2 {
+		c.line("CLIENT_ERROR bad command line format")
+		return nil
+	}
+	key := args[0]
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size < 0 || !validKey(key) {
+		c.line("CLIENT_ERROR bad command line format")
+		return nil
+	}
+	args = args[2:]
+	flags, ok := parseMetaFlags(args)
+	command := "put"
+	var clientFlags, casUnique uint64
+	var exptime int64
+	var badFlag string
+	for f, token := range flags {
+		switch f {
+		case 'F':
+			if clientFlags, err = strconv.ParseUint(token, 10, 32); err != nil {
+				badFlag = "bad token in command line format"
+			}
+		case 'T':
+			if exptime, err = strconv.ParseInt(token, 10, 64); err != nil {
+				badFlag = "bad token in command line format"
+			}
+		case 'M':
+			switch strings.ToUpper(token) {
+			case "E":
+				command = "add"
+			case "R":
+				command = "replace"
+			case "S", "":
+				command = "put"
+			default: // append and prepend are not supported
+				badFlag = "invalid mode for ms"
+			}
+		case 'C':
+			if casUnique, err = strconv.ParseUint(token, 10, 64); err != nil {
+				badFlag = "bad token in command line format"
+			}
+		case 'k', 'O', 'q':
+		default:
+			badFlag = "invalid flag"
+		}
+	}
+	if !ok {
+		badFlag = "duplicate flag"
+	}
+	if _, compare := flags['C']; compare {
+		if command != "put" {
+			badFlag = "invalid mode for ms"
+		}
+		command = "cas"
+	}
+	if size > maxValueSize {
+		badFlag = "object too large for cache"
+	}
+	if badFlag != "" {
+		if size > maxValueSize {
+			c.line("SERVER_ERROR " + badFlag)
+		} else {
+			c.line("CLIENT_ERROR " + badFlag)
+		}
+		return c.skipData(size)
+	}
+	data, err := c.readData(size)
+	if err != nil {
+		return err
+	}
+
+	stored, err := s.put(command, key, data, uint32(clientFlags), exptime, casUnique)
+	_, quiet := flags['q']
+	switch {
+	case err != nil:
+		c.line("SERVER_ERROR " + err.Error())
+	case !stored && command == "cas":
+		if found, err := s.exists(key); err != nil {
+			c.line("SERVER_ERROR " + err.Error())
+		} else if found {
+			c.meta("EX", metaEcho(args, key))
+		} else {
+			c.meta("NF", metaEcho(args, key))
+		}
+	case !stored:
+		c.meta("NS", metaEcho(args, key))
+	case !quiet:
+		c.meta("HD", metaEcho(args, key))
+	}
+	return nil
+}
+
+// md <key> <flags>*: k the key, O an opaque token, q no HD and NF
+func (s *MemcacheServer) metaDelete(c *client, args []string) {
+	if len(args) == 0 || !validKey(args[0]) {
+		c.line("CLIENT_ERROR bad command line format")
+		return
+	}
+	key, args := args[0], args[1:]
+	flags, ok := parseMetaFlags(args)
+	if !ok {
+		c.line("CLIENT_ERROR duplicate flag")
+		return
+	}
+	for f := range flags {
+		if !strings.ContainsRune("kOq", rune(f)) {
+			c.line("CLIENT_ERROR invalid flag")
+			return
+		}
+	}
+	deleted, err := s.delete(key)
+	_, quiet := flags['q']
+	switch {
+	case err != nil:
+		c.line("SERVER_ERROR " + err.Error())
+	case quiet:
+	case deleted:
+		c.meta("HD", metaEcho(args, key))
+	default:
+		c.meta("NF", metaEcho(args, key))
+	}
+}
@@ -0,0 +1,212 @@
+package MemcacheServer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewelkin/discap/CacheManager"
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// starts a cache with a memcached protocol server on a localhost port, returns a raw connection to it
+func startTestServer(t *testing.T) (net.Conn, *bufio.Reader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	nodeChannels := make([]chan<- DataNode.DNRequest, 3)
+	for i := range nodeChannels {
+		nodeChannels[i] = (&DataNode.SingleDataNode{}).New(ctx, fmt.Sprintf("%03d", i), 100).GetChannel()
+	}
+	m := (&CacheManager.DateNodesManager{}).New(ctx, nodeChannels)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go func() { _ = (&MemcacheServer{}).Serve(ctx, ln, m) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// sends the requests at once, the way a pipelining client does, and checks the reply lines.
+// An expected line starting with ~ is a regular expression
+func expectLines(t *testing.T, conn net.Conn, r *bufio.Reader, requests string, lines ...string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	for _, expected := range lines {
+		got, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading a reply to %q: %v", requests, err)
+		}
+		got = strings.TrimSuffix(got, "\r\n")
+		if strings.HasPrefix(expected, "~") {
+			if !regexp.MustCompile("^" + expected[1:] + "$").MatchString(got) {
+				t.Errorf("requests %q: expected a line matching %q, got %q", requests, expected[1:], got)
+			}
+		} else if got != expected {
+			t.Errorf("requests %q: expected %q, got %q", requests, expected, got)
+		}
+	}
+}
+
+// the cas unique of a record, read with mg
+func casUnique(t *testing.T, conn net.Conn, r *bufio.Reader, key string) string {
+	t.Helper()
+	_, _ = conn.Write([]byte("mg " + key + " c\r\n"))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "HD c") {
+		t.Fatalf("mg %s c returned %q %v", key, line, err)
+	}
+	return strings.TrimSpace(line[len("HD c"):])
+}
+
+func TestMemcacheServer_TextProtocol(t *testing.T) {
+
+	conn, r := startTestServer(t)
+
+	expectLines(t, conn, r,
+		"set key1 5 0 6\r\nvalue1\r\n"+
+			"set key2 0 0 7 noreply\r\nbin\x00ary\r\n"+
+			"get key1 nokey key2\r\n",
+		"STORED",
+		"VALUE key1 5 6", "value1",
+		"VALUE key2 0 7", "bin\x00ary",
+		"END")
+
+	expectLines(t, conn, r,
+		"add key1 0 0 1\r\nx\r\n"+
+			"add key3 7 0 1\r\nx\r\n"+
+			"replace nokey 0 0 1\r\nx\r\n"+
+			"replace key1 9 0 2\r\nv2\r\n"+
+			"gets key1\r\n",
+		"NOT_STORED",
+		"STORED",
+		"NOT_STORED",
+		"STORED",
+		`~VALUE key1 9 2 \d+`, "v2", "END")
+
+	// cas stores a record which has not changed since it was read
+	cas := casUnique(t, conn, r, "key1")
+	expectLines(t, conn, r,
+		"cas key1 0 0 2 "+cas+"\r\nv3\r\n"+
+			"cas key1 0 0 2 "+cas+"\r\nv4\r\n"+
+			"cas nokey 0 0 1 "+cas+"\r\nx\r\n"+
+			"cas key1 0 0 1 x\r\n"+
+			"get key1\r\n",
+		"STORED",
+		"EXISTS",
+		"NOT_FOUND",
+		"CLIENT_ERROR bad command line format",
+		"VALUE key1 0 2", "v3", "END")
+
+	expectLines(t, conn, r,
+		"delete key1\r\ndelete key1\r\nget key1\r\n",
+		"DELETED", "NOT_FOUND", "END")
+
+	// a past exptime expires at once, a negative one too
+	expectLines(t, conn, r,
+		"set gone 0 1000000000 1\r\nx\r\nset key3 0 -1 1\r\nx\r\nget gone key3\r\n",
+		"STORED", "STORED", "END")
+	expectLines(t, conn, r,
+		"set short 0 1 1\r\nx\r\nget short\r\n",
+		"STORED", "VALUE short 0 1", "x", "END")
+
+	_, _ = conn.Write([]byte("stats\r\n"))
+	stats := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stats: %v", err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		if f := strings.Fields(line); len(f) == 3 && f[0] == "STAT" {
+			stats[f[1]] = f[2]
+		}
+	}
+	if stats["version"] != serverVersion || stats["curr_connections"] != "1" || stats["curr_items"] != "2" || stats["get_hits"] != "6" {
+		t.Errorf("stats returned %v", stats)
+	}
+
+	// errors keep the connection open
+	expectLines(t, conn, r,
+		"bogus\r\nset k x 0 1\r\nset k 0 0 2000000\r\n"+strings.Repeat("x", 2000000)+"\r\nget\r\nversion\r\n",
+		"ERROR",
+		"CLIENT_ERROR bad command line format",
+		"SERVER_ERROR object too large for cache",
+		"ERROR",
+		"VERSION "+serverVersion)
+
+	expectLines(t, conn, r,
+		"flush_all\r\nget key2 short\r\n",
+		"OK", "END")
+
+	// a broken data block closes the connection
+	expectLines(t, conn, r,
+		"set k 0 0 1\r\nxyz\r\n",
+		"CLIENT_ERROR bad data chunk")
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("the connection must be closed after a bad data chunk")
+	}
+}
+
+func TestMemcacheServer_MetaProtocol(t *testing.T) {
+
+	conn, r := startTestServer(t)
+
+	expectLines(t, conn, r,
+		"ms key1 6 F3 T100 k Oabc\r\nvalue1\r\n"+
+			"mg key1 v f t k\r\n"+
+			"mg key1 s c\r\n"+
+			"mg nokey v\r\n"+
+			"mg nokey v q\r\n"+
+			"mn\r\n",
+		"HD kkey1 Oabc",
+		"VA 6 f3 t100 kkey1", "value1",
+		`~HD s6 c\d+`,
+		"EN",
+		"MN")
+
+	expectLines(t, conn, r,
+		"ms key1 1 ME\r\nx\r\n"+
+			"ms key2 1 MR\r\nx\r\n"+
+			"ms key2 1 ME q\r\nx\r\n"+
+			"ms key2 1 MA\r\nx\r\n"+
+			"mg key2 v\r\n",
+		"NS",
+		"NS",
+		"CLIENT_ERROR invalid mode for ms",
+		"VA 1", "x")
+
+	cas := casUnique(t, conn, r, "key2")
+	expectLines(t, conn, r,
+		"ms key2 1 C"+cas+" k\r\ny\r\n"+
+			"ms key2 1 C"+cas+" k\r\nz\r\n"+
+			"ms nokey 1 C"+cas+"\r\nz\r\n"+
+			"ms key2 1 C"+cas+" ME\r\nz\r\n"+
+			"mg key2 v\r\n",
+		"HD kkey2",
+		"EX kkey2",
+		"NF",
+		"CLIENT_ERROR invalid mode for ms",
+		"VA 1", "y")
+
+	expectLines(t, conn, r,
+		"md key2 q\r\nmd key2 Oxy\r\nmd key1\r\nmn\r\n",
+		"NF Oxy", "HD", "MN")
+}
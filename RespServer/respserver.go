@@ -0,0 +1,771 @@
+package RespServer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewelkin/discap/CacheManager"
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// limits protecting the server from broken clients
+const (
+	maxInlineSize = 64 << 10 // longest inline command or header line
+	bulkChunk     = 64 << 10 // a bulk string is read in chunks of this size, a client gets no more memory than it sends
+	argsPrealloc  = 1024     // most arguments preallocated for a command, the ones announced are not trusted
+)
+
+// DefaultMaxBulkLen is the biggest bulk string a client may send, the proto-max-bulk-len of redis
+const DefaultMaxBulkLen = 512 << 20
+
+// DefaultMaxMultiBulkLen is the most arguments of a command
+const DefaultMaxMultiBulkLen = 1 << 20
+
+// errProtocol is a request the server can't parse, the connection is closed after it
+var errProtocol = errors.New("Protocol error")
+
+// RespServer speaks the Redis protocol, RESP2 and RESP3 after HELLO 3.
+// It passes GET, SET, SETNX, GETSET, MGET, MSET, DEL, FLUSHALL, DBSIZE and INFO to the cache manager,
+// so redis-cli and the usual Redis clients can talk to the cache
+type RespServer struct {
+	cacheManager *CacheManager.DateNodesManager
+
+	MaxBulkLen      int // biggest bulk string a client may send, DefaultMaxBulkLen if not positive
+	MaxMultiBulkLen int // most arguments of a command, DefaultMaxMultiBulkLen if not positive
+}
+
+// a client connection
+type client struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	proto        int // 2 or 3
+	maxBulk      int // biggest bulk string
+	maxMultiBulk int // most arguments of a command
+}
+
+// StartAndServe starts a Redis protocol server. it passes requests to the cache manager
+// --> Input:
+// port             int                                port to listen, 6379 is the usual one
+// cacheManager     *CacheManager.DateNodesManager     points to cache manager
+func (s *RespServer) StartAndServe(port int, cacheManager *CacheManager.DateNodesManager) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err == nil {
+		err = s.Serve(context.Background(), ln, cacheManager)
+	}
+	if err != nil {
+		fmt.Printf("error starting redis protocol server: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Serve  accepts the clients until the context is cancelled or the listener fails
+// --> Input:
+// ctx              context.Context                    execution context, cancelling it closes the listener and the connections
+// ln               net.Listener                       listener accepting the clients
+// cacheManager     *CacheManager.DateNodesManager     points to cache manager
+// <-- Output:
+// 1) error     why the server stopped
+func (s *RespServer) Serve(ctx context.Context, ln net.Listener, cacheManager *CacheManager.DateNodesManager) error {
+	s.cacheManager = cacheManager
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	log.Printf("[RESP] listening on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// reads the commands of a client and answers them, pipelined answers are flushed together
+func (s *RespServer) serveConn(ctx context.Context, conn net.Conn) {
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-connCtx.Done()
+		_ = conn.Close()
+	}()
+
+	c := &client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), proto: 2, maxBulk: s.MaxBulkLen, maxMultiBulk: s.MaxMultiBulkLen}
+	if c.maxBulk <= 0 {
+		c.maxBulk = DefaultMaxBulkLen
+	}
+	if c.maxMultiBulk <= 0 {
+		c.maxMultiBulk = DefaultMaxMultiBulkLen
+	}
+	for {
+		args, err := c.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.error("ERR " + err.Error())
+				_ = c.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.execute(c, args)
+		if c.r.Buffered() == 0 || quit {
+			if err = c.w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// reads a line without the \r\n
+func (c *client) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// the reader buffer is smaller than maxInlineSize, collect the rest
+		buf := append([]byte(nil), line...)
+		for errors.Is(err, bufio.ErrBufferFull) && len(buf) <= maxInlineSize {
+			line, err = c.r.ReadSlice('\n')
+			buf = append(buf, line...)
+		}
+		if len(buf) > maxInlineSize {
+			return "", fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		line = buf
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// reads a command: an array of bulk strings or an inline command line
+func (c *client) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") { // inline command, e.g. typed in telnet
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > c.maxMultiBulk {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, min(max(n, 0), argsPrealloc))
+	for i := 0; i < n; i++ {
+		line, err = c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > c.maxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		arg, err := c.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// reads a bulk string of the size given and its \r\n. The string grows with the bytes received,
+// not with the size the client announced
+func (c *client) readBulk(size int) (string, error) {
+	var b strings.Builder
+	b.Grow(min(size, bulkChunk))
+	if _, err := io.CopyN(&b, c.r, int64(size)); err != nil {
+		return "", err
+	}
+	var end [2]byte
+	if _, err := io.ReadFull(c.r, end[:]); err != nil {
+		return "", err
+	}
+	if end != [2]byte{'\r', '\n'} {
+		return "", fmt.Errorf("%w: bulk string is not terminated", errProtocol)
+	}
+	return b.String(), nil
+}
+
+func (c *client) simple(s string) {
+	_, _ = c.w.WriteString("+" + s + "\r\n")
+}
+
+// msg starts with the error code, e.g. "ERR syntax error"
+func (c *client) error(msg string) {
+	_, _ = c.w.WriteString("-" + strings.ReplaceAll(msg, "\r\n", " ") + "\r\n")
+}
+
+func (c *client) integer(n int) {
+	_, _ = c.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (c *client) bulk(s string) {
+	_, _ = c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *client) null() {
+	if c.proto == 3 {
+		_, _ = c.w.WriteString("_\r\n")
+	} else {
+		_, _ = c.w.WriteString("$-1\r\n")
+	}
+}
+
+func (c *client) array(n int) {
+	_, _ = c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// a map of n pairs, a flat array of 2n elements in RESP2
+func (c *client) mapHeader(n int) {
+	if c.proto == 3 {
+		_, _ = c.w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+	} else {
+		c.array(2 * n)
+	}
+}
+
+// a value from the cache as a bulk string
+func (c *client) value(v any) {
+	switch v := v.(type) {
+	case string:
+		c.bulk(v)
+	case []byte:
+		c.bulk(string(v))
+	default:
+		c.bulk(fmt.Sprint(v))
+	}
+}
+
+// number of arguments error, the same text as redis gives
+func (c *client) wrongArgs(command string) {
+	c.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+// executes a command, returns true if the connection should be closed
+func (s *RespServer) execute(c *client, args []string) bool {
+
+	command := strings.ToUpper(args[0])
+	switch command {
+
+	case "PING":
+		if len(args) > 2 {
+			c.wrongArgs(command)
+		} else if len(args) == 2 {
+			c.bulk(args[1])
+		} else {
+			c.simple("PONG")
+		}
+
+	case "ECHO":
+		if len(args) != 2 {
+			c.wrongArgs(command)
+			break
+		}
+		c.bulk(args[1])
+
+	case "QUIT":
+		c.simple("OK")
+		return true
+
+	case "HELLO":
+		s.hello(c, args[1:])
+
+	case "SELECT":
+		if len(args) != 2 {
+			c.wrongArgs(command)
+		} else if args[1] != "0" {
+			c.error("ERR DB index is out of range")
+		} else {
+			c.simple("OK")
+		}
+
+	case "CLIENT": // SETNAME, SETINFO and the like, nothing to keep
+		c.simple("OK")
+
+	case "COMMAND": // redis-cli asks for the command docs, none here
+		c.array(0)
+
+	case "GET":
+		if len(args) != 2 {
+			c.wrongArgs(command)
+			break
+		}
+		result, err := s.get(args[1:])
+		if err != nil {
+			c.error("ERR " + err.Error())
+		} else if v, ok := result[args[1]]; ok {
+			c.value(v)
+		} else {
+			c.null()
+		}
+
+	case "MGET":
+		if len(args) < 2 {
+			c.wrongArgs(command)
+			break
+		}
+		result, err := s.get(args[1:])
+		if err != nil {
+			c.error("ERR " + err.Error())
+			break
+		}
+		c.array(len(args) - 1)
+		for _, k := range args[1:] {
+			if v, ok := result[k]; ok {
+				c.value(v)
+			} else {
+				c.null()
+			}
+		}
+
+	case "SET":
+		if len(args) < 3 {
+			c.wrongArgs(command)
+			break
+		}
+		ttl, mode, get, err := parseSetOptions(args[3:])
+		if err != nil {
+			c.error(err.Error())
+			break
+		}
+		switch {
+		case get:
+			s.getSet(c, args[1], args[2], ttl)
+		case mode != "put":
+			if stored, err := s.putIf(mode, args[1], args[2], ttl); err != nil {
+				c.error("ERR " + err.Error())
+			} else if stored {
+				c.simple("OK")
+			} else {
+				c.null()
+			}
+		default:
+			s.put(c, args[1:2], args[2:3], ttl)
+		}
+
+	case "SETNX":
+		if len(args) != 3 {
+			c.wrongArgs(command)
+			break
+		}
+		if stored, err := s.putIf("add", args[1], args[2], 0); err != nil {
+			c.error("ERR " + err.Error())
+		} else if stored {
+			c.integer(1)
+		} else {
+			c.integer(0)
+		}
+
+	case "GETSET":
+		if len(args) != 3 {
+			c.wrongArgs(command)
+			break
+		}
+		s.getSet(c, args[1], args[2], 0)
+
+	case "MSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			c.wrongArgs(command)
+			break
+		}
+		var keys, values []string
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+			values = append(values, args[i+1])
+		}
+		s.put(c, keys, values, 0)
+
+	case "INCR", "DECR":
+		if len(args) != 2 {
+			c.wrongArgs(command)
+			break
+		}
+		s.incr(c, command, args[1], "1")
+
+	case "INCRBY", "DECRBY", "INCRBYFLOAT":
+		if len(args) != 3 {
+			c.wrongArgs(command)
+			break
+		}
+		s.incr(c, command, args[1], args[2])
+
+	case "LPUSH", "RPUSH", "LPOP", "RPOP", "LRANGE", "LLEN", "HSET", "HGET", "HDEL", "HGETALL",
+		"SADD", "SREM", "SMEMBERS", "SISMEMBER", "ZADD", "ZREM", "ZRANGE", "ZRANGEBYSCORE", "ZSCORE":
+		if len(args) < 2 {
+			c.wrongArgs(command)
+			break
+		}
+		s.structCommand(c, command, args[1], args[2:])
+
+	case "DEL":
+		if len(args) < 2 {
+			c.wrongArgs(command)
+			break
+		}
+		r := s.cacheManager.HandleCacheRequest("del", args[1:], nil)
+		if err := r.Err(); err != nil {
+			c.error("ERR " + err.Error())
+			break
+		}
+		c.integer(len(r.Deleted))
+
+	case "FLUSHALL", "FLUSHDB": // ASYNC and SYNC are the same here
+		if err := s.cacheManager.HandleCacheRequest("del", nil, nil).Err(); err != nil {
+			c.error("ERR " + err.Error())
+			break
+		}
+		c.simple("OK")
+
+	case "DBSIZE":
+		c.integer(s.dbSize())
+
+	case "INFO":
+		c.bulk(s.info())
+
+	default:
+		c.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+	return false
+}
+
+// adds the delta to the number of the key, a missing key is created.
+// INCRBYFLOAT takes a float and answers the new value as a bulk string, the others take and answer integers
+func (s *RespServer) incr(c *client, command string, key string, delta string) {
+	notNumber := "ERR value is not an integer or out of range"
+	var d any
+	if command == "INCRBYFLOAT" {
+		notNumber = "ERR value is not a valid float"
+		f, err := strconv.ParseFloat(delta, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			c.error(notNumber)
+			return
+		}
+		d = f
+	} else {
+		i, err := strconv.ParseInt(delta, 10, 64)
+		if err != nil || (strings.HasPrefix(command, "DECR") && i == math.MinInt64) {
+			c.error(notNumber)
+			return
+		}
+		if strings.HasPrefix(command, "DECR") {
+			i = -i
+		}
+		d = i
+	}
+
+	r := s.cacheManager.HandleRequest(CacheManager.CacheRequest{
+		Command: "incr",
+		Keys:    []string{key},
+		Values:  []any{d},
+	})
+	if err := r.Err(); err != nil {
+		if r.Kind == CacheManager.BadRequest {
+			c.error(notNumber)
+		} else {
+			c.error("ERR " + err.Error())
+		}
+		return
+	}
+
+	text := fmt.Sprint(r.Result[key])
+	switch v := r.Result[key].(type) {
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	case float64:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	if command == "INCRBYFLOAT" {
+		c.bulk(text)
+	} else if n, err := strconv.Atoi(text); err == nil {
+		c.integer(n)
+	} else {
+		c.error(notNumber)
+	}
+}
+
+// applies a list, hash, set or sorted set command to the value of a key and answers its result.
+// ZRANGE takes scores only, with BYSCORE, the same as ZRANGEBYSCORE; both take WITHSCORES
+func (s *RespServer) structCommand(c *client, command string, key string, args []string) {
+	op := DataNode.StructOp{Name: strings.ToLower(command), Args: args}
+	withScores := false
+	if command == "ZRANGE" || command == "ZRANGEBYSCORE" {
+		byScore := command == "ZRANGEBYSCORE"
+		op = DataNode.StructOp{Name: "zrange"}
+		for _, a := range args {
+			switch strings.ToUpper(a) {
+			case "WITHSCORES":
+				withScores = true
+			case "BYSCORE":
+				byScore = true
+			default:
+				op.Args = append(op.Args, a)
+			}
+		}
+		if !byScore {
+			c.error("ERR only the ranges by score are supported, use ZRANGE key min max BYSCORE")
+			return
+		}
+	}
+	if err := op.Check(); err != nil {
+		if errors.Is(err, DataNode.ErrArgCount) {
+			c.wrongArgs(command)
+		} else {
+			c.error("ERR " + err.Error())
+		}
+		return
+	}
+
+	r := s.cacheManager.HandleRequest(CacheManager.CacheRequest{
+		Command: "op",
+		Keys:    []string{key},
+		Op:      op,
+	})
+	if err := r.Err(); err != nil {
+		if r.Kind == CacheManager.BadRequest && strings.Contains(r.Message, "WRONGTYPE") {
+			c.error(DataNode.ErrWrongType.Error())
+		} else {
+			c.error("ERR " + err.Error())
+		}
+		return
+	}
+
+	switch v := r.Result[key].(type) {
+	case nil:
+		c.null()
+	case int64:
+		c.integer(int(v))
+	case bool:
+		if v {
+			c.integer(1)
+		} else {
+			c.integer(0)
+		}
+	case float64:
+		c.bulk(strconv.FormatFloat(v, 'f', -1, 64))
+	case DataNode.List:
+		c.array(len(v))
+		for _, e := range v {
+			c.bulk(e)
+		}
+	case DataNode.Hash:
+		fields := make([]string, 0, len(v))
+		for f := range v {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		c.mapHeader(len(fields))
+		for _, f := range fields {
+			c.bulk(f)
+			c.bulk(v[f])
+		}
+	case DataNode.ZSet:
+		if withScores {
+			c.array(2 * len(v))
+		} else {
+			c.array(len(v))
+		}
+		for _, m := range v {
+			c.bulk(m.Member)
+			if withScores {
+				c.bulk(strconv.FormatFloat(m.Score, 'f', -1, 64))
+			}
+		}
+	default:
+		c.value(v)
+	}
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (s *RespServer) hello(c *client, args []string) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(args[0])
+		if err != nil || proto < 2 || proto > 3 {
+			c.error("NOPROTO unsupported protocol version")
+			return
+		}
+		c.proto = proto
+	}
+	c.mapHeader(7)
+	c.bulk("server")
+	c.bulk("discap")
+	c.bulk("version")
+	c.bulk("7.0.0")
+	c.bulk("proto")
+	c.integer(c.proto)
+	c.bulk("id")
+	c.integer(0)
+	c.bulk("mode")
+	c.bulk("standalone")
+	c.bulk("role")
+	c.bulk("master")
+	c.bulk("modules")
+	c.array(0)
+}
+
+// parses [NX | XX] [GET] [EX seconds | PX milliseconds] of SET.
+// Returns the ttl, the cache manager command of NX and XX, "put" without them, and whether GET is given.
+// GET does not go with NX and XX, the way it was before Redis 7
+func parseSetOptions(args []string) (ttl time.Duration, command string, get bool, err error) {
+	errSyntax := errors.New("ERR syntax error")
+	command = "put"
+	for i := 0; i < len(args); i++ {
+		unit := time.Duration(0)
+		switch option := strings.ToUpper(args[i]); option {
+		case "NX", "XX", "GET":
+			if command != "put" || get {
+				return 0, "", false, errSyntax
+			}
+			switch option {
+			case "NX":
+				command = "add"
+			case "XX":
+				command = "replace"
+			default:
+				get = true
+			}
+			continue
+		case "EX":
+			unit = time.Second
+		case "PX":
+			unit = time.Millisecond
+		default:
+			return 0, "", false, errSyntax
+		}
+		if ttl != 0 || i+1 == len(args) {
+			return 0, "", false, errSyntax
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return 0, "", false, errors.New("ERR value is not an integer or out of range")
+		}
+		if n <= 0 {
+			return 0, "", false, errors.New("ERR invalid expire time in 'set' command")
+		}
+		ttl = time.Duration(n) * unit
+		i++
+	}
+	return ttl, command, get, nil
+}
+
+// finds the keys in the cache
+func (s *RespServer) get(keys []string) (map[string]any, error) {
+	r := s.cacheManager.HandleCacheRequest("get", keys, nil)
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return r.Result, nil
+}
+
+// stores the records, answers OK or the error
+func (s *RespServer) put(c *client, keys []string, values []string, ttl time.Duration) {
+	rq := CacheManager.CacheRequest{
+		Command: "put",
+		Keys:    keys,
+		TTL:     ttl,
+	}
+	for _, v := range values {
+		rq.Values = append(rq.Values, v)
+	}
+	if err := s.cacheManager.HandleRequest(rq).Err(); err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	c.simple("OK")
+}
+
+// stores a record with the cache manager command "add" or "replace", returns true if it was stored
+func (s *RespServer) putIf(command string, key string, value string, ttl time.Duration) (bool, error) {
+	r := s.cacheManager.HandleRequest(CacheManager.CacheRequest{
+		Command: command,
+		Keys:    []string{key},
+		Values:  []any{value},
+		TTL:     ttl,
+	})
+	if err := r.Err(); err != nil {
+		return false, err
+	}
+	return len(r.Stored) == 1, nil
+}
+
+// stores a record, answers its previous value or null
+func (s *RespServer) getSet(c *client, key string, value string, ttl time.Duration) {
+	r := s.cacheManager.HandleRequest(CacheManager.CacheRequest{
+		Command: "getset",
+		Keys:    []string{key},
+		Values:  []any{value},
+		TTL:     ttl,
+	})
+	if err := r.Err(); err != nil {
+		c.error("ERR " + err.Error())
+	} else if prev, ok := r.Previous[key]; ok {
+		c.value(prev)
+	} else {
+		c.null()
+	}
+}
+
+// number of keys: the records on all the nodes divided by the replication factor
+func (s *RespServer) dbSize() int {
+	total := 0
+	for _, st := range s.cacheManager.Stats() {
+		total += st.Length
+	}
+	return total / s.cacheManager.Replicas()
+}
+
+// the INFO text, the sections redis clients usually look at and the nodes
+func (s *RespServer) info() string {
+	var b strings.Builder
+	stats := s.cacheManager.Stats()
+	total, bytes := 0, int64(0)
+	for _, st := range stats {
+		total += st.Length
+		bytes += st.Bytes
+	}
+	b.WriteString("# Server\r\n")
+	b.WriteString("redis_version:7.0.0\r\n")
+	b.WriteString("redis_mode:standalone\r\n")
+	b.WriteString("server_name:discap\r\n")
+	b.WriteString("\r\n# Memory\r\n")
+	fmt.Fprintf(&b, "used_memory:%d\r\n", bytes)
+	b.WriteString("\r\n# Replication\r\n")
+	b.WriteString("role:master\r\n")
+	fmt.Fprintf(&b, "discap_replicas:%d\r\n", s.cacheManager.Replicas())
+	b.WriteString("\r\n# Nodes\r\n")
+	for _, st := range stats {
+		if st.Err != nil {
+			fmt.Fprintf(&b, "node_%s:status=unavailable\r\n", st.Id)
+		} else {
+			fmt.Fprintf(&b, "node_%s:status=ok,keys=%d,bytes=%d\r\n", st.Id, st.Length, st.Bytes)
+		}
+	}
+	b.WriteString("\r\n# Keyspace\r\n")
+	fmt.Fprintf(&b, "db0:keys=%d,expires=0,avg_ttl=0\r\n", total/s.cacheManager.Replicas())
+	return b.String()
+}
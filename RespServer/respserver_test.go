@@ -0,0 +1,363 @@
+package RespServer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewelkin/discap/CacheManager"
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// starts a cache with a redis protocol server on a localhost port, returns a raw connection to it
+func startTestServer(t *testing.T) (net.Conn, *bufio.Reader) {
+	return startLimitedServer(t, &RespServer{})
+}
+
+// startTestServer with the limits of the server given
+func startLimitedServer(t *testing.T, s *RespServer) (net.Conn, *bufio.Reader) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	nodeChannels := make([]chan<- DataNode.DNRequest, 3)
+	for i := range nodeChannels {
+		nodeChannels[i] = (&DataNode.SingleDataNode{}).New(ctx, fmt.Sprintf("%03d", i), 100).GetChannel()
+	}
+	m := (&CacheManager.DateNodesManager{}).New(ctx, nodeChannels)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go func() { _ = s.Serve(ctx, ln, m) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// encodes a command the way the clients do
+func command(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return b.String()
+}
+
+// reads one reply, nested replies are read whole
+func readReply(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading a reply: %v", err)
+	}
+	reply := line
+	switch line[0] {
+	case '$':
+		var size int
+		fmt.Sscanf(line[1:], "%d", &size)
+		if size >= 0 {
+			buf := make([]byte, size+2)
+			if _, err = io.ReadFull(r, buf); err != nil {
+				t.Fatalf("reading a bulk string: %v", err)
+			}
+			reply += string(buf)
+		}
+	case '*', '%':
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		if line[0] == '%' {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			reply += readReply(t, r)
+		}
+	}
+	return reply
+}
+
+// sends the commands at once, the way a pipelining client does, and checks the replies
+func expectReplies(t *testing.T, conn net.Conn, r *bufio.Reader, commands []string, replies []string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(strings.Join(commands, ""))); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	for i, expected := range replies {
+		if got := readReply(t, r); got != expected {
+			t.Errorf("command %q: expected reply %q, got %q", commands[i], expected, got)
+		}
+	}
+}
+
+func TestRespServer_Commands(t *testing.T) {
+
+	conn, r := startTestServer(t)
+
+	expectReplies(t, conn, r,
+		[]string{
+			command("PING"),
+			command("SET", "key1", "value1"),
+			command("GET", "key1"),
+			command("GET", "nokey"),
+			command("MSET", "key2", "value2", "key3", "binary\r\n\x00value"),
+			command("MGET", "key1", "nokey", "key3"),
+			command("DBSIZE"),
+			command("DEL", "key1", "key2", "nokey"),
+			command("DBSIZE"),
+			command("FLUSHALL"),
+			command("DBSIZE"),
+		},
+		[]string{
+			"+PONG\r\n",
+			"+OK\r\n",
+			"$6\r\nvalue1\r\n",
+			"$-1\r\n",
+			"+OK\r\n",
+			"*3\r\n$6\r\nvalue1\r\n$-1\r\n$14\r\nbinary\r\n\x00value\r\n",
+			":3\r\n",
+			":2\r\n",
+			":1\r\n",
+			"+OK\r\n",
+			":0\r\n",
+		})
+
+	// errors keep the connection open
+	expectReplies(t, conn, r,
+		[]string{
+			command("GET"),
+			command("MSET", "key1"),
+			command("SET", "key1", "value1", "EX", "0"),
+			command("SET", "key1", "value1", "XY", "1"),
+			command("NOSUCH", "x"),
+			command("PING", "still here"),
+		},
+		[]string{
+			"-ERR wrong number of arguments for 'get' command\r\n",
+			"-ERR wrong number of arguments for 'mset' command\r\n",
+			"-ERR invalid expire time in 'set' command\r\n",
+			"-ERR syntax error\r\n",
+			"-ERR unknown command 'NOSUCH'\r\n",
+			"$10\r\nstill here\r\n",
+		})
+
+	// conditional writes
+	expectReplies(t, conn, r,
+		[]string{
+			command("SET", "cond", "v1", "XX"),
+			command("SET", "cond", "v1", "NX", "EX", "100"),
+			command("SET", "cond", "v2", "nx"),
+			command("SETNX", "cond", "v2"),
+			command("SET", "cond", "v2", "XX"),
+			command("SET", "cond", "v3", "GET"),
+			command("GETSET", "cond", "v4"),
+			command("GETSET", "new", "v1"),
+			command("GET", "cond"),
+			command("SET", "cond", "v5", "NX", "XX"),
+			command("SET", "cond", "v5", "NX", "GET"),
+			command("DEL", "cond", "new"),
+		},
+		[]string{
+			"$-1\r\n",
+			"+OK\r\n",
+			"$-1\r\n",
+			":0\r\n",
+			"+OK\r\n",
+			"$2\r\nv2\r\n",
+			"$2\r\nv3\r\n",
+			"$-1\r\n",
+			"$2\r\nv4\r\n",
+			"-ERR syntax error\r\n",
+			"-ERR syntax error\r\n",
+			":2\r\n",
+		})
+
+	// inline commands, as typed in telnet
+	expectReplies(t, conn, r,
+		[]string{"set inline yes\r\n", "get inline\r\n"},
+		[]string{"+OK\r\n", "$3\r\nyes\r\n"})
+
+	// expiry
+	expectReplies(t, conn, r,
+		[]string{command("SET", "ttl", "v", "PX", "50")},
+		[]string{"+OK\r\n"})
+	time.Sleep(100 * time.Millisecond)
+	expectReplies(t, conn, r,
+		[]string{command("GET", "ttl")},
+		[]string{"$-1\r\n"})
+
+	_, _ = conn.Write([]byte(command("INFO")))
+	if info := readReply(t, r); !strings.Contains(info, "db0:keys=1,") || !strings.Contains(info, "node_000:status=ok") {
+		t.Errorf("INFO returned %q", info)
+	}
+}
+
+func TestRespServer_Counters(t *testing.T) {
+
+	conn, r := startTestServer(t)
+
+	expectReplies(t, conn, r,
+		[]string{
+			command("INCR", "counter"),
+			command("INCRBY", "counter", "10"),
+			command("DECR", "counter"),
+			command("DECRBY", "counter", "-5"),
+			command("GET", "counter"),
+			command("SET", "float", "1.5"),
+			command("INCRBYFLOAT", "float", "0.25"),
+			command("INCR", "float"),
+			command("SET", "text", "abc"),
+			command("INCR", "text"),
+			command("INCRBY", "counter", "x"),
+			command("INCRBYFLOAT", "text", "1"),
+		},
+		[]string{
+			":1\r\n",
+			":11\r\n",
+			":10\r\n",
+			":15\r\n",
+			"$2\r\n15\r\n",
+			"+OK\r\n",
+			"$4\r\n1.75\r\n",
+			"-ERR value is not an integer or out of range\r\n",
+			"+OK\r\n",
+			"-ERR value is not an integer or out of range\r\n",
+			"-ERR value is not an integer or out of range\r\n",
+			"-ERR value is not a valid float\r\n",
+		})
+}
+
+func TestRespServer_Structures(t *testing.T) {
+
+	conn, r := startTestServer(t)
+
+	wrongType := "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	expectReplies(t, conn, r,
+		[]string{
+			command("RPUSH", "list", "a", "b"),
+			command("LPUSH", "list", "z"),
+			command("LRANGE", "list", "0", "-1"),
+			command("LPOP", "list"),
+			command("LLEN", "list"),
+			command("LPOP", "nolist"),
+			command("HSET", "hash", "name", "Ann", "age", "7"),
+			command("HGET", "hash", "name"),
+			command("HDEL", "hash", "age", "none"),
+			command("HGETALL", "hash"),
+			command("SADD", "set", "x", "y", "x"),
+			command("SISMEMBER", "set", "y"),
+			command("SREM", "set", "y"),
+			command("SMEMBERS", "set"),
+			command("ZADD", "zset", "2", "b", "1", "a"),
+			command("ZRANGEBYSCORE", "zset", "-inf", "+inf", "WITHSCORES"),
+			command("ZRANGE", "zset", "1.5", "3", "BYSCORE"),
+			command("ZSCORE", "zset", "a"),
+			command("ZREM", "zset", "a"),
+			command("SET", "text", "abc"),
+			command("LPUSH", "text", "a"),
+			command("HGET", "list", "a"),
+			command("HSET", "hash", "a"),
+			command("ZADD", "zset", "x", "a"),
+			command("ZRANGE", "zset", "0", "1"),
+			command("DEL", "list", "hash", "set", "zset", "text"),
+		},
+		[]string{
+			":2\r\n",
+			":3\r\n",
+			"*3\r\n$1\r\nz\r\n$1\r\na\r\n$1\r\nb\r\n",
+			"$1\r\nz\r\n",
+			":2\r\n",
+			"$-1\r\n",
+			":2\r\n",
+			"$3\r\nAnn\r\n",
+			":1\r\n",
+			"*2\r\n$4\r\nname\r\n$3\r\nAnn\r\n",
+			":2\r\n",
+			":1\r\n",
+			":1\r\n",
+			"*1\r\n$1\r\nx\r\n",
+			":2\r\n",
+			"*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n",
+			"*1\r\n$1\r\nb\r\n",
+			"$1\r\n1\r\n",
+			":1\r\n",
+			"+OK\r\n",
+			wrongType,
+			wrongType,
+			"-ERR wrong number of arguments for 'hset' command\r\n",
+			"-ERR zadd: score \"x\" is not a number\r\n",
+			"-ERR only the ranges by score are supported, use ZRANGE key min max BYSCORE\r\n",
+			":5\r\n",
+		})
+}
+
+func TestRespServer_Resp3(t *testing.T) {
+
+	conn, r := startTestServer(t)
+
+	_, _ = conn.Write([]byte(command("HELLO", "3")))
+	if hello := readReply(t, r); !strings.HasPrefix(hello, "%7\r\n") || !strings.Contains(hello, "$5\r\nproto\r\n:3\r\n") {
+		t.Errorf("HELLO 3 returned %q", hello)
+	}
+	expectReplies(t, conn, r,
+		[]string{command("GET", "nokey"), command("MGET", "nokey")},
+		[]string{"_\r\n", "*1\r\n_\r\n"})
+
+	expectReplies(t, conn, r,
+		[]string{command("HELLO", "4"), command("QUIT")},
+		[]string{"-NOPROTO unsupported protocol version\r\n", "+OK\r\n"})
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("the connection must be closed after QUIT")
+	}
+}
+
+func TestRespServer_ProtocolError(t *testing.T) {
+
+	conn, r := startTestServer(t)
+
+	_, _ = conn.Write([]byte("*1\r\n+PING\r\n"))
+	if reply := readReply(t, r); !strings.HasPrefix(reply, "-ERR Protocol error") {
+		t.Errorf("expected a protocol error, got %q", reply)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("the connection must be closed after a protocol error")
+	}
+}
+
+func TestRespServer_Limits(t *testing.T) {
+
+	for _, tt := range []struct {
+		request string
+		reply   string
+	}{
+		{"*3\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+		{"*1\r\n$11\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*1\r\n$-1\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"*1\r\n$4\r\nPINGxx", "-ERR Protocol error: bulk string is not terminated\r\n"},
+	} {
+		conn, r := startLimitedServer(t, &RespServer{MaxBulkLen: 10, MaxMultiBulkLen: 2})
+		_, _ = conn.Write([]byte(tt.request))
+		if reply := readReply(t, r); reply != tt.reply {
+			t.Errorf("%q: expected %q, got %q", tt.request, tt.reply, reply)
+		}
+		if _, err := r.ReadByte(); err == nil {
+			t.Errorf("%q: the connection must be closed after a protocol error", tt.request)
+		}
+	}
+
+	// a big value is read in chunks
+	conn, r := startTestServer(t)
+	value := strings.Repeat("0123456789", 30000)
+	expectReplies(t, conn, r,
+		[]string{command("SET", "big", value), command("GET", "big")},
+		[]string{"+OK\r\n", "$300000\r\n" + value + "\r\n"})
+}
@@ -0,0 +1,292 @@
+package SimpleWeb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CBOR, RFC 8949
+
+// CBOR major types
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+)
+
+// encodes a tree of toTree in CBOR
+func encodeCBOR(tree any) ([]byte, error) {
+	return appendCBOR(nil, tree)
+}
+
+// appends a CBOR value
+func appendCBOR(b []byte, v any) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		b = append(b, cborSimple|22)
+	case bool:
+		if v {
+			b = append(b, cborSimple|21)
+		} else {
+			b = append(b, cborSimple|20)
+		}
+	case json.Number:
+		return appendCBOR(b, numberValue(v))
+	case int:
+		return appendCBOR(b, int64(v))
+	case int64:
+		if v >= 0 {
+			b = appendCBORHeader(b, cborUint, uint64(v))
+		} else {
+			b = appendCBORHeader(b, cborNegInt, uint64(-1-v))
+		}
+	case uint64:
+		b = appendCBORHeader(b, cborUint, v)
+	case float64:
+		b = binary.BigEndian.AppendUint64(append(b, cborSimple|27), math.Float64bits(v))
+	case string:
+		b = append(appendCBORHeader(b, cborText, uint64(len(v))), v...)
+	case []byte:
+		b = append(appendCBORHeader(b, cborBytes, uint64(len(v))), v...)
+	case []any:
+		b = appendCBORHeader(b, cborArray, uint64(len(v)))
+		for _, e := range v {
+			if b, err = appendCBOR(b, e); err != nil {
+				return nil, err
+			}
+		}
+	case map[string]any:
+		b = appendCBORHeader(b, cborMap, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			b = append(appendCBORHeader(b, cborText, uint64(len(k))), k...)
+			if b, err = appendCBOR(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return b, nil
+}
+
+// appends the shortest head of a major type with the argument n
+func appendCBORHeader(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, major|27), n)
+}
+
+// decodes a CBOR value for fromTree
+func decodeCBOR(data []byte) (any, error) {
+	d := cborDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("cbor: %d bytes after the value", len(d.data)-d.pos)
+	}
+	return v, nil
+}
+
+// cborDecoder reads the values of a buffer one after another
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+var (
+	errCBORShort = errors.New("cbor: unexpected end of data")
+	errCBORBreak = errors.New("cbor: unexpected break")
+)
+
+// the next n bytes
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errCBORShort
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// the head of the next item: its major type, additional info and argument.
+// The argument of the indefinite length items (info 31) is 0
+func (d *cborDecoder) head() (major byte, info byte, arg uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]&0xe0, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		if b, err = d.next(1 << (info - 24)); err != nil {
+			return 0, 0, 0, err
+		}
+		for _, c := range b {
+			arg = arg<<8 | uint64(c)
+		}
+		return major, info, arg, nil
+	case info == 31 && major != cborUint && major != cborNegInt && major != cborTag:
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("cbor: bad additional info %d", info)
+}
+
+// the next value
+func (d *cborDecoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("cbor: values nested too deep")
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if arg > math.MaxInt64 {
+			return arg, nil
+		}
+		return int64(arg), nil
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return -1 - float64(arg), nil
+		}
+		return -1 - int64(arg), nil
+	case cborBytes, cborText:
+		b, err := d.chunks(major, info, arg)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(b), nil
+		}
+		return b, nil
+	case cborArray:
+		if info != 31 && arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORShort
+		}
+		var a []any
+		for i := uint64(0); info == 31 || i < arg; i++ {
+			v, err := d.value(depth + 1)
+			if err == errCBORBreak && info == 31 {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		if a == nil {
+			a = []any{}
+		}
+		return a, nil
+	case cborMap:
+		if info != 31 && arg > uint64(len(d.data)-d.pos) {
+			return nil, errCBORShort
+		}
+		m := map[string]any{}
+		for i := uint64(0); info == 31 || i < arg; i++ {
+			k, err := d.value(depth + 1)
+			if err == errCBORBreak && info == 31 {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("cbor: map key %v is not a string", k)
+			}
+			if m[key], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case cborTag: // the tags are ignored, the tagged value is returned
+		return d.value(depth + 1)
+	}
+
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null and undefined
+		return nil, nil
+	case 25:
+		return halfToFloat(uint16(arg)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	case 31:
+		return nil, errCBORBreak
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+}
+
+// the bytes of a byte or text string, joining the chunks of an indefinite length one
+func (d *cborDecoder) chunks(major byte, info byte, arg uint64) ([]byte, error) {
+	if info != 31 {
+		b, err := d.next(arg)
+		return append([]byte(nil), b...), err
+	}
+	b := []byte{}
+	for {
+		m, i, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m == cborSimple && i == 31 {
+			return b, nil
+		}
+		if m != major || i == 31 {
+			return nil, errors.New("cbor: bad chunk of an indefinite length string")
+		}
+		chunk, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+}
+
+// converts an IEEE 754 half precision float
+func halfToFloat(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp, frac := int(h>>10)&0x1f, float64(h&0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
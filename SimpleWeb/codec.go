@@ -0,0 +1,203 @@
+package SimpleWeb
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Codec encodes the responses and decodes the request bodies of a media type
+type Codec interface {
+	ContentType() string                // the media type sent in the Content-Type header
+	Marshal(v any) ([]byte, error)      // encodes a response
+	Unmarshal(data []byte, v any) error // decodes a request body into v
+}
+
+// the registered codecs by their media types and aliases, in the order of registration
+var codecs = struct {
+	sync.RWMutex
+	byType map[string]Codec
+	order  []Codec
+}{byType: map[string]Codec{}}
+
+// RegisterCodec adds a codec, or replaces the one of the same media type.
+// The clients choose it with the Accept header and send bodies in it with the Content-Type header
+// --> Input:
+// codec        Codec       the codec
+// aliases      ...string   other media types of the same format, like application/x-msgpack
+func RegisterCodec(codec Codec, aliases ...string) {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	if _, ok := codecs.byType[codec.ContentType()]; !ok {
+		codecs.order = append(codecs.order, codec)
+	} else {
+		for i, c := range codecs.order {
+			if c.ContentType() == codec.ContentType() {
+				codecs.order[i] = codec
+			}
+		}
+	}
+	codecs.byType[codec.ContentType()] = codec
+	for _, alias := range aliases {
+		codecs.byType[alias] = codec
+	}
+}
+
+func init() {
+	RegisterCodec(jsonCodec{}, "text/json")
+	RegisterCodec(treeCodec{contentType: "application/msgpack", encode: encodeMsgpack, decode: decodeMsgpack},
+		"application/x-msgpack", "application/vnd.msgpack")
+	RegisterCodec(treeCodec{contentType: "application/cbor", encode: encodeCBOR, decode: decodeCBOR})
+	RegisterCodec(treeCodec{contentType: "application/x-protobuf", encode: encodeProtobuf, decode: decodeProtobuf},
+		"application/protobuf", "application/vnd.google.protobuf")
+}
+
+// the codec of a media type, nil if none
+func codecByType(mediaType string) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.byType[strings.ToLower(mediaType)]
+}
+
+// the codec of the request body. No Content-Type or the one curl sends by default mean JSON
+func requestCodec(r *http.Request) (Codec, error) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return jsonCodec{}, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Type %q: %w", contentType, err)
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		return jsonCodec{}, nil
+	}
+	if c := codecByType(mediaType); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Type %q, supported are %s", mediaType, strings.Join(ContentTypes(), ", "))
+}
+
+// the codec the client accepts with the highest q, JSON if the client has no preference.
+// Returns false if no codec is acceptable
+func responseCodec(r *http.Request) (Codec, bool) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return jsonCodec{}, true
+	}
+
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	var best Codec
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		var c Codec
+		switch {
+		case mediaType == "*/*":
+			c = codecs.order[0]
+		case strings.HasSuffix(mediaType, "/*"):
+			for _, o := range codecs.order {
+				if strings.HasPrefix(o.ContentType(), mediaType[:len(mediaType)-1]) {
+					c = o
+					break
+				}
+			}
+		default:
+			c = codecs.byType[mediaType]
+		}
+		if c != nil {
+			best, bestQ = c, q
+		}
+	}
+	return best, best != nil
+}
+
+// ContentTypes lists the media types of the registered codecs
+func ContentTypes() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	types := make([]string, len(codecs.order))
+	for i, c := range codecs.order {
+		types[i] = c.ContentType()
+	}
+	return types
+}
+
+// jsonCodec is the default codec
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return "application/json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// treeCodec is a codec of a format encoding the values of a tree, see toTree.
+// The json tags of the structures apply to all the formats
+type treeCodec struct {
+	contentType string
+	encode      func(tree any) ([]byte, error) // encodes a tree of toTree
+	decode      func(data []byte) (any, error) // decodes a value for fromTree
+}
+
+func (c treeCodec) ContentType() string { return c.contentType }
+
+func (c treeCodec) Marshal(v any) ([]byte, error) {
+	tree, err := toTree(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.encode(tree)
+}
+
+func (c treeCodec) Unmarshal(data []byte, v any) error {
+	tree, err := c.decode(data)
+	if err != nil {
+		return err
+	}
+	return fromTree(tree, v)
+}
+
+// the keys of a map in the order they are encoded
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// maxDepth limits the nesting of the decoded values
+const maxDepth = 1000
+
+// numberValue gives a number of a tree as an int64, an uint64 or a float64
+func numberValue(n json.Number) any {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return u
+	}
+	f, _ := strconv.ParseFloat(string(n), 64)
+	return f
+}
@@ -0,0 +1,158 @@
+package SimpleWeb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/andrewelkin/discap/CacheManager"
+)
+
+func TestCodecs_Encoding(t *testing.T) {
+
+	value := map[string]any{"a": 1, "b": []any{"x", -2, 1.5, true, nil}}
+	for _, tt := range []struct {
+		contentType string
+		expected    string // hex
+	}{
+		{"application/msgpack", "82" + "a161" + "01" + "a162" + "95" + "a178" + "fe" + "cb3ff8000000000000" + "c3" + "c0"},
+		{"application/cbor", "a2" + "6161" + "01" + "6162" + "85" + "6178" + "21" + "fb3ff8000000000000" + "f5" + "f6"},
+		// fields { key: "a" value { number_value: 1 } } fields { key: "b" value { list_value { ... } } }
+		{"application/x-protobuf", "0a0e" + "0a0161" + "1209" + "11000000000000f03f" +
+			"0a2a" + "0a0162" + "1225" + "3223" + "0a03" + "1a0178" + "0a09" + "1100000000000000c0" +
+			"0a09" + "11000000000000f83f" + "0a02" + "2001" + "0a02" + "0800"},
+	} {
+		codec := codecByType(tt.contentType)
+		b, err := codec.Marshal(value)
+		if err != nil {
+			t.Fatalf("%s Marshal() error = %v", tt.contentType, err)
+		}
+		if got := hex.EncodeToString(b); got != tt.expected {
+			t.Errorf("%s Marshal() = %s, expected %s", tt.contentType, got, tt.expected)
+		}
+	}
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+
+	resp := CacheManager.Response{
+		Status:  CacheManager.StatusOK,
+		Message: "a message",
+		Result: map[string]any{
+			"string": "value",
+			"long":   string(bytes.Repeat([]byte("x"), 70000)),
+			"number": 42.0,
+			"big":    float64(math.MaxInt64),
+			"neg":    -1e6,
+			"float":  0.25,
+			"object": map[string]any{"list": []any{"a", 1.0, false, nil, []any{}}},
+			"empty":  map[string]any{},
+		},
+		Deleted: []string{"key1", "key2"},
+	}
+	for _, contentType := range ContentTypes() {
+		codec := codecByType(contentType)
+		b, err := codec.Marshal(resp)
+		if err != nil {
+			t.Fatalf("%s Marshal() error = %v", contentType, err)
+		}
+		var got CacheManager.Response
+		if err = codec.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s Unmarshal() error = %v", contentType, err)
+		}
+		if !reflect.DeepEqual(got, resp) {
+			t.Errorf("%s round trip returned %+v", contentType, got)
+		}
+
+		// broken data is an error, not a panic
+		for i := 0; i < len(b) && i < 200; i++ {
+			_ = codec.Unmarshal(b[:i], &got)
+		}
+	}
+
+	// the values other encoders produce
+	for _, tt := range []struct {
+		contentType string
+		data        string // hex
+		expected    any
+	}{
+		{"application/msgpack", "93" + "ccff" + "d1fc18" + "ca3fc00000", []any{int64(255), int64(-1000), 1.5}},
+		{"application/msgpack", "81" + "d90161" + "c40278ff", map[string]any{"a": []byte("x\xff")}},
+		{"application/cbor", "9f" + "1903e8" + "3903e7" + "f93e00" + "c11a514b67b0" + "ff", []any{int64(1000), int64(-1000), 1.5, int64(1363896240)}},
+		{"application/cbor", "bf" + "6161" + "7f657374726561646d696e67ff" + "ff", map[string]any{"a": "streaming"}},
+	} {
+		data, _ := hex.DecodeString(tt.data)
+		var got any
+		if err := codecByType(tt.contentType).Unmarshal(data, &got); err != nil {
+			t.Errorf("%s Unmarshal(%s) error = %v", tt.contentType, tt.data, err)
+		} else if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s Unmarshal(%s) = %v, expected %v", tt.contentType, tt.data, got, tt.expected)
+		}
+	}
+}
+
+func TestCodecs_Integers(t *testing.T) {
+
+	type record struct {
+		ID    int64  `json:"id"`
+		Count uint64 `json:"count"`
+		Data  []byte `json:"data"`
+		Value any    `json:"value"`
+	}
+	in := record{ID: math.MaxInt64 - 1, Count: math.MaxUint64, Data: []byte{0, 1, 0xfe, 0xff}, Value: map[string]any{"n": int64(1<<53 + 1), "b": []byte("raw")}}
+	for _, tt := range []struct {
+		contentType string
+		value       any // the value decoded into an any
+	}{
+		{"application/msgpack", map[string]any{"n": int64(1<<53 + 1), "b": []byte("raw")}},
+		{"application/cbor", map[string]any{"n": int64(1<<53 + 1), "b": []byte("raw")}},
+		// protobuf has doubles only, the integers a double can't hold are decimal strings, the bytes are base64
+		{"application/x-protobuf", map[string]any{"n": "9007199254740993", "b": "cmF3"}},
+	} {
+		codec := codecByType(tt.contentType)
+		b, err := codec.Marshal(in)
+		if err != nil {
+			t.Fatalf("%s Marshal() error = %v", tt.contentType, err)
+		}
+		var got record
+		if err = codec.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s Unmarshal() error = %v", tt.contentType, err)
+		}
+		if got.ID != in.ID || got.Count != in.Count || !bytes.Equal(got.Data, in.Data) {
+			t.Errorf("%s round trip returned %+v", tt.contentType, got)
+		}
+		if !reflect.DeepEqual(got.Value, tt.value) {
+			t.Errorf("%s round trip returned the value %#v, expected %#v", tt.contentType, got.Value, tt.value)
+		}
+	}
+}
+
+func TestCodecs_Negotiation(t *testing.T) {
+
+	for _, tt := range []struct {
+		accept   string
+		expected string // empty if not acceptable
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/x-msgpack", "application/msgpack"},
+		{"application/json;q=0.5, application/cbor", "application/cbor"},
+		{"text/html, application/protobuf;q=0.1", "application/x-protobuf"},
+		{"application/*;q=0.2, application/cbor;q=0.9, application/msgpack;q=0", "application/cbor"},
+		{"text/html", ""},
+		{"application/msgpack;q=0", ""},
+	} {
+		rq, _ := http.NewRequest(http.MethodGet, "/", nil)
+		rq.Header.Set("Accept", tt.accept)
+		got := ""
+		if codec, ok := responseCodec(rq); ok {
+			got = codec.ContentType()
+		}
+		if got != tt.expected {
+			t.Errorf("Accept %q chose %q, expected %q", tt.accept, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package SimpleWeb
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Protobuf has no schema for the values of the cache, so the responses and the request bodies
+// are the well-known google.protobuf.Struct message, the one of google/protobuf/struct.proto:
+//
+//	message Struct    { map<string, Value> fields = 1; }
+//	message ListValue { repeated Value values = 1; }
+//	message Value {
+//	  oneof kind {
+//	    NullValue null_value = 1; double number_value = 2; string string_value = 3;
+//	    bool bool_value = 4; Struct struct_value = 5; ListValue list_value = 6;
+//	  }
+//	}
+//
+// The numbers are doubles, the way JSON has them. The integers a double can't hold exactly are sent
+// as decimal strings and the bytes as base64 strings, the way the JSON mapping of protobuf sends int64 and bytes.
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// a double holds every integer up to 2^53 exactly
+const maxExactInt = 1 << 53
+
+// encodes a tree of toTree, which must be an object, as a google.protobuf.Struct
+func encodeProtobuf(tree any) ([]byte, error) {
+	m, ok := tree.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: a %T is not a Struct", tree)
+	}
+	return appendProtoStruct(nil, m)
+}
+
+// appends the fields of a Struct
+func appendProtoStruct(b []byte, m map[string]any) ([]byte, error) {
+	for _, k := range sortedKeys(m) {
+		entry := appendProtoBytes(nil, 1, []byte(k))
+		value, err := appendProtoValue(nil, m[k])
+		if err != nil {
+			return nil, err
+		}
+		entry = appendProtoBytes(entry, 2, value)
+		b = appendProtoBytes(b, 1, entry)
+	}
+	return b, nil
+}
+
+// appends the fields of a Value
+func appendProtoValue(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		b = append(appendProtoTag(b, 1, wireVarint), 0)
+	case bool:
+		b = appendProtoTag(b, 4, wireVarint)
+		if v {
+			b = append(b, 1)
+		} else {
+			b = append(b, 0)
+		}
+	case json.Number:
+		return appendProtoValue(b, numberValue(v))
+	case int:
+		return appendProtoValue(b, int64(v))
+	case int64:
+		if v < -maxExactInt || v > maxExactInt {
+			return appendProtoValue(b, strconv.FormatInt(v, 10))
+		}
+		return appendProtoValue(b, float64(v))
+	case uint64:
+		if v > maxExactInt {
+			return appendProtoValue(b, strconv.FormatUint(v, 10))
+		}
+		return appendProtoValue(b, float64(v))
+	case float64:
+		b = binary.LittleEndian.AppendUint64(appendProtoTag(b, 2, wireFixed64), math.Float64bits(v))
+	case string:
+		b = appendProtoBytes(b, 3, []byte(v))
+	case []byte:
+		return appendProtoValue(b, base64.StdEncoding.EncodeToString(v))
+	case map[string]any:
+		s, err := appendProtoStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = appendProtoBytes(b, 5, s)
+	case []any:
+		var list []byte
+		for _, e := range v {
+			value, err := appendProtoValue(nil, e)
+			if err != nil {
+				return nil, err
+			}
+			list = appendProtoBytes(list, 1, value)
+		}
+		b = appendProtoBytes(b, 6, list)
+	default:
+		return nil, fmt.Errorf("protobuf: unsupported type %T", v)
+	}
+	return b, nil
+}
+
+// appends the tag of a field
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+// appends a length delimited field
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(appendProtoTag(b, field, wireBytes), uint64(len(data)))
+	return append(b, data...)
+}
+
+// decodes a google.protobuf.Struct for fromTree
+func decodeProtobuf(data []byte) (any, error) {
+	return decodeProtoStruct(data, 0)
+}
+
+var errProtoShort = errors.New("protobuf: unexpected end of data")
+
+// protoField is a field of a message: a varint, a fixed64 or fixed32 number or a length delimited field
+type protoField struct {
+	number   int
+	wireType int
+	num      uint64
+	data     []byte
+}
+
+// calls f for the fields of a message one after another
+func protoFields(data []byte, f func(field protoField) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtoShort
+		}
+		data = data[n:]
+		field := protoField{number: int(tag >> 3), wireType: int(tag & 7)}
+		switch field.wireType {
+		case wireVarint:
+			if field.num, n = binary.Uvarint(data); n <= 0 {
+				return errProtoShort
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errProtoShort
+			}
+			field.num, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errProtoShort
+			}
+			field.num, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errProtoShort
+			}
+			field.data, data = data[n:n+int(length)], data[n+int(length):]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d", field.wireType)
+		}
+		if err := f(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodes a Struct, the unknown fields are skipped
+func decodeProtoStruct(data []byte, depth int) (map[string]any, error) {
+	m := map[string]any{}
+	err := protoFields(data, func(field protoField) error {
+		if field.number != 1 || field.wireType != wireBytes {
+			return nil
+		}
+		var key string
+		var value any
+		err := protoFields(field.data, func(entry protoField) error {
+			var err error
+			switch {
+			case entry.number == 1 && entry.wireType == wireBytes:
+				key = string(entry.data)
+			case entry.number == 2 && entry.wireType == wireBytes:
+				value, err = decodeProtoValue(entry.data, depth+1)
+			}
+			return err
+		})
+		m[key] = value
+		return err
+	})
+	return m, err
+}
+
+// decodes a Value, a Value without a kind is null
+func decodeProtoValue(data []byte, depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("protobuf: values nested too deep")
+	}
+	var value any
+	err := protoFields(data, func(field protoField) error {
+		var err error
+		switch {
+		case field.number == 1 && field.wireType == wireVarint:
+			value = nil
+		case field.number == 2 && field.wireType == wireFixed64:
+			value = math.Float64frombits(field.num)
+		case field.number == 3 && field.wireType == wireBytes:
+			value = string(field.data)
+		case field.number == 4 && field.wireType == wireVarint:
+			value = field.num != 0
+		case field.number == 5 && field.wireType == wireBytes:
+			value, err = decodeProtoStruct(field.data, depth+1)
+		case field.number == 6 && field.wireType == wireBytes:
+			list := []any{}
+			err = protoFields(field.data, func(e protoField) error {
+				if e.number != 1 || e.wireType != wireBytes {
+					return nil
+				}
+				v, err := decodeProtoValue(e.data, depth+1)
+				list = append(list, v)
+				return err
+			})
+			value = list
+		}
+		return err
+	})
+	return value, err
+}
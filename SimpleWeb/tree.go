@@ -0,0 +1,467 @@
+package SimpleWeb
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The binary codecs encode trees: map[string]any, []any, string, []byte, int64, uint64, float64, bool and nil.
+// The values are converted to and from the trees the way encoding/json converts them to and from JSON,
+// with the json tags of the structures and the json and text marshalers of the types,
+// but the integers stay integers and the byte slices stay bytes, JSON has neither
+
+var (
+	jsonMarshaler   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshaler   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshaler = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	numberType      = reflect.TypeOf(json.Number(""))
+)
+
+// converts a value to a tree
+func toTree(v any) (any, error) {
+	return valueTree(reflect.ValueOf(v), 0)
+}
+
+// the tree of a value
+func valueTree(v reflect.Value, depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, errors.New("values nested too deep")
+	}
+	if !v.IsValid() {
+		return nil, nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+	}
+
+	switch {
+	case v.Type() == numberType:
+		return numberValue(json.Number(v.String())), nil
+	case v.Type().Implements(jsonMarshaler):
+		b, err := v.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		var tree any
+		if err = d.Decode(&tree); err != nil {
+			return nil, err
+		}
+		return numberTree(tree), nil
+	case v.Type().Implements(textMarshaler):
+		b, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(b), err
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Pointer, reflect.Interface:
+		return valueTree(v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		a := make([]any, v.Len())
+		for i := range a {
+			e, err := valueTree(v.Index(i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			a[i] = e
+		}
+		return a, nil
+	case reflect.Map:
+		m := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			k, err := mapKeyString(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			if m[k], err = valueTree(iter.Value(), depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case reflect.Struct:
+		m := map[string]any{}
+		for _, f := range fieldsOf(v.Type()) {
+			fv, err := v.FieldByIndexErr(f.index)
+			if err != nil || (f.omitEmpty && isEmptyValue(fv)) {
+				continue // a field of a nil embedded pointer
+			}
+			if m[f.name], err = valueTree(fv, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// the numbers of a decoded JSON tree as int64, uint64 or float64
+func numberTree(tree any) any {
+	switch t := tree.(type) {
+	case json.Number:
+		return numberValue(t)
+	case []any:
+		for i, e := range t {
+			t[i] = numberTree(e)
+		}
+	case map[string]any:
+		for k, e := range t {
+			t[k] = numberTree(e)
+		}
+	}
+	return tree
+}
+
+// a map key as a string: a string, a text marshaler or an integer
+func mapKeyString(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if k.Type().Implements(textMarshaler) {
+		if k.Kind() == reflect.Pointer && k.IsNil() {
+			return "", nil
+		}
+		b, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(b), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", k.Type())
+}
+
+// tells if a field with omitempty is left out, the way encoding/json does it
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// treeField is a field of a structure in its tree
+type treeField struct {
+	name      string // the json tag name or the name of the field
+	index     []int  // for reflect.Value.FieldByIndex, the fields of the embedded structures have longer ones
+	omitEmpty bool
+}
+
+// the fields of the structure types
+var structFields sync.Map // reflect.Type -> []treeField
+
+// the fields of a structure type: the exported ones without the "-" tag and the fields of the embedded structures
+// without a tag name. Of the fields having the same name the least nested one is kept
+func fieldsOf(t reflect.Type) []treeField {
+	if fields, ok := structFields.Load(t); ok {
+		return fields.([]treeField)
+	}
+	var fields []treeField
+	depths := map[string]int{}
+	var collect func(t reflect.Type, index []int)
+	collect = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			tag := sf.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			idx := append(append([]int(nil), index...), i)
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+				collect(ft, idx)
+				continue
+			}
+			if !sf.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			if d, ok := depths[name]; ok {
+				if d <= len(idx) {
+					continue
+				}
+				for j := range fields {
+					if fields[j].name == name {
+						fields = append(fields[:j], fields[j+1:]...)
+						break
+					}
+				}
+			}
+			depths[name] = len(idx)
+			fields = append(fields, treeField{name: name, index: idx, omitEmpty: strings.Contains(","+opts+",", ",omitempty,")})
+		}
+	}
+	collect(t, nil)
+	structFields.Store(t, fields)
+	return fields
+}
+
+// stores a tree into v the way json.Unmarshal stores JSON
+func fromTree(tree any, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("can't decode into a non pointer %T", v)
+	}
+	return setTree(tree, rv.Elem(), 0)
+}
+
+// stores a tree into a settable value
+func setTree(tree any, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return errors.New("values nested too deep")
+	}
+	if v.Kind() != reflect.Pointer && v.CanAddr() {
+		switch p := v.Addr(); {
+		case p.Type().Implements(jsonUnmarshaler):
+			b, err := json.Marshal(tree)
+			if err != nil {
+				return err
+			}
+			return p.Interface().(json.Unmarshaler).UnmarshalJSON(b)
+		case p.Type().Implements(textUnmarshaler):
+			if s, ok := tree.(string); ok {
+				return p.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+			}
+		}
+	}
+	if tree == nil {
+		switch v.Kind() {
+		case reflect.Pointer, reflect.Interface, reflect.Map, reflect.Slice:
+			v.SetZero()
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return setTree(tree, v.Elem(), depth+1)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			break
+		}
+		v.Set(reflect.ValueOf(tree))
+		return nil
+	case reflect.Bool:
+		if b, ok := tree.(bool); ok {
+			v.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := treeInt(tree); ok && !v.OverflowInt(n) {
+			v.SetInt(n)
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := treeUint(tree); ok && !v.OverflowUint(n) {
+			v.SetUint(n)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := tree.(type) {
+		case int64:
+			v.SetFloat(float64(n))
+			return nil
+		case uint64:
+			v.SetFloat(float64(n))
+			return nil
+		case float64:
+			v.SetFloat(n)
+			return nil
+		}
+	case reflect.String:
+		switch s := tree.(type) {
+		case string:
+			v.SetString(s)
+			return nil
+		case []byte:
+			v.SetString(string(s))
+			return nil
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			switch b := tree.(type) {
+			case []byte:
+				v.SetBytes(append([]byte(nil), b...))
+				return nil
+			case string: // base64, the way JSON has the bytes
+				data, err := base64.StdEncoding.DecodeString(b)
+				if err != nil {
+					return err
+				}
+				v.SetBytes(data)
+				return nil
+			}
+		}
+		a, ok := tree.([]any)
+		if !ok {
+			break
+		}
+		s := reflect.MakeSlice(v.Type(), len(a), len(a))
+		for i, e := range a {
+			if err := setTree(e, s.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case reflect.Array:
+		a, ok := tree.([]any)
+		if !ok {
+			break
+		}
+		v.SetZero()
+		for i := 0; i < len(a) && i < v.Len(); i++ {
+			if err := setTree(a[i], v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		m, ok := tree.(map[string]any)
+		if !ok {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), len(m)))
+		}
+		for k, e := range m {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := setTree(k, key, depth+1); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := setTree(e, value, depth+1); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+		return nil
+	case reflect.Struct:
+		m, ok := tree.(map[string]any)
+		if !ok {
+			break
+		}
+		fields := fieldsOf(v.Type())
+		for k, e := range m {
+			f := fieldByName(fields, k)
+			if f == nil {
+				continue // unknown fields are skipped
+			}
+			if err := setTree(e, fieldByIndex(v, f.index), depth+1); err != nil {
+				return fmt.Errorf("field %s: %w", f.name, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("can't decode %T into %s", tree, v.Type())
+}
+
+// an integer of a tree. Decimal strings are integers too, protobuf sends the ones a double can't hold as strings
+func treeInt(tree any) (int64, bool) {
+	switch n := tree.(type) {
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case float64:
+		return int64(n), n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64
+	case string:
+		i, err := strconv.ParseInt(n, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// an unsigned integer of a tree, see treeInt
+func treeUint(tree any) (uint64, bool) {
+	switch n := tree.(type) {
+	case int64:
+		return uint64(n), n >= 0
+	case uint64:
+		return n, true
+	case float64:
+		return uint64(n), n == math.Trunc(n) && n >= 0 && n < math.MaxUint64
+	case string:
+		u, err := strconv.ParseUint(n, 10, 64)
+		return u, err == nil
+	}
+	return 0, false
+}
+
+// the field of a key: the one of the same name, else the one of the same name ignoring the case
+func fieldByName(fields []treeField, key string) *treeField {
+	var folded *treeField
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+		if folded == nil && strings.EqualFold(fields[i].name, key) {
+			folded = &fields[i]
+		}
+	}
+	return folded
+}
+
+// a field of a structure, the nil embedded pointers on the way are allocated
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
@@ -1,39 +1,1015 @@
 package SimpleWeb
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/andrewelkin/discap/CacheManager"
+	"github.com/andrewelkin/discap/DataNode"
 	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// maxBodySize limits the request bodies
+const maxBodySize = 32 << 20
+
+// NodeFactory creates and starts a data node.
+// It returns the channel to send requests to the node and a function stopping the node
+type NodeFactory func(id string, maxSize int) (chan<- DataNode.DNRequest, context.CancelFunc)
+
 // JustWebServer is a primitive web server. it keeps a pointer to the cache manager and passes requests
 type JustWebServer struct {
 	cacheManager *CacheManager.DateNodesManager
+	nodeFactory  NodeFactory                   // creates nodes for the admin requests, nil if not supported
+	stopNode     map[string]context.CancelFunc // stop functions of the nodes created by the admin requests
+	stopLock     sync.Mutex                    // protects stopNode
+}
+
+// SetNodeFactory enables adding nodes at runtime with the admin requests
+func (s *JustWebServer) SetNodeFactory(f NodeFactory) *JustWebServer {
+	s.nodeFactory = f
+	return s
+}
+
+// parses ttl= parameter: a duration like "1m30s" or a number of seconds. Empty means no expiry
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseFloat(ttl, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, fmt.Errorf("bad ttl %q, expected a number of seconds or a duration like 1m30s", ttl)
+	}
+	return d, nil
+}
+
+// parses a ttl of a body: a number of seconds or a string parseTTL takes. Null means no expiry
+func parseJSONTTL(ttl any) (time.Duration, error) {
+	switch v := ttl.(type) {
+	case nil:
+		return 0, nil
+	case float64:
+		return parseTTL(strconv.FormatFloat(v, 'f', -1, 64))
+	case int64: // the binary formats keep the integers
+		return parseTTL(strconv.FormatInt(v, 10))
+	case uint64:
+		return parseTTL(strconv.FormatUint(v, 10))
+	case string:
+		return parseTTL(v)
+	}
+	return 0, fmt.Errorf("bad ttl %v, expected a number of seconds or a duration like \"1m30s\"", ttl)
+}
+
+// reads a request body up to maxBodySize.
+// Writes the error response and returns false if the body can't be read
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("The body is larger than %d bytes", maxBodySize))
+		} else {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("bad body: %s", err))
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+// decodes a request body of the Content-Type into v.
+// Writes the error response and returns false if the body can't be decoded
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	codec, err := requestCodec(r)
+	if err != nil {
+		writeError(w, r, http.StatusUnsupportedMediaType, err.Error())
+		return false
+	}
+	data, ok := readBody(w, r)
+	if !ok {
+		return false
+	}
+	if err = codec.Unmarshal(data, v); err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("bad %s body: %s", codec.ContentType(), err))
+		return false
+	}
+	return true
+}
+
+// tells if a request to /keys/{key} reads or writes the value itself rather than a body of a codec:
+// raw= is given, or a PUT body has a Content-Type none of the codecs decodes
+func isRaw(r *http.Request) bool {
+	if r.URL.Query().Has("raw") {
+		return true
+	}
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.URL.Path, "/keys/") {
+		return false
+	}
+	_, err := requestCodec(r)
+	return err != nil
+}
+
+// writes a value as it is with its content type, a value without one is written as
+// application/octet-stream bytes, text or JSON
+func writeRaw(w http.ResponseWriter, value any, contentType string) {
+	var data []byte
+	switch v := value.(type) {
+	case []byte:
+		data = v
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	case string:
+		data = []byte(v)
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+	default:
+		data, _ = json.Marshal(v)
+		if contentType == "" {
+			contentType = "application/json"
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+// writes a response to the client with the HTTP status code, in the format the client accepts
+func writeResponse(w http.ResponseWriter, r *http.Request, code int, resp any) {
+	codec, ok := responseCodec(r)
+	if !ok {
+		codec = jsonCodec{}
+	}
+	b, err := codec.Marshal(resp)
+	if err != nil {
+		codec, code = jsonCodec{}, http.StatusInternalServerError
+		b, _ = codec.Marshal(CacheManager.Response{Status: CacheManager.StatusError, Message: err.Error()})
+	}
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// answers 406 to the clients accepting none of the registered formats, unless they ask for a raw value
+func negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := responseCodec(r); !ok && !isRaw(r) {
+			writeError(w, r, http.StatusNotAcceptable, fmt.Sprintf("Not acceptable %q, supported are %s",
+				r.Header.Get("Accept"), strings.Join(ContentTypes(), ", ")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// the HTTP status code of a cache manager response
+func httpStatus(resp CacheManager.Response) int {
+	switch {
+	case resp.Status == CacheManager.StatusOK:
+		return http.StatusOK
+	case resp.Kind == CacheManager.Unavailable:
+		return http.StatusServiceUnavailable
+	case resp.Kind == CacheManager.Conflict:
+		return http.StatusConflict
+	}
+	return http.StatusBadRequest
+}
+
+// writes a cache manager response with its HTTP status code
+func writeCacheResponse(w http.ResponseWriter, r *http.Request, resp CacheManager.Response) {
+	writeResponse(w, r, httpStatus(resp), resp)
+}
+
+// writes an error response
+func writeError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	writeResponse(w, r, code, CacheManager.Response{
+		Status:  CacheManager.StatusError,
+		Message: message,
+	})
+}
+
+// writes 405 for a method the route does not support
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("Unknown request type, we support only %s!", strings.Join(allowed, " ")))
+}
+
+// the HTTP status code of a get response, a single key which is not found is 404
+func getResponse(keys []string, resp CacheManager.Response) (int, CacheManager.Response) {
+	if resp.Status == CacheManager.StatusOK && len(keys) == 1 {
+		if _, ok := resp.Result[keys[0]]; !ok {
+			return http.StatusNotFound, CacheManager.Response{
+				Status:  CacheManager.StatusError,
+				Message: fmt.Sprintf("Key %s is not found", keys[0]),
+			}
+		}
+	}
+	return httpStatus(resp), resp
+}
+
+// writes the response of a get
+func writeGetResponse(w http.ResponseWriter, r *http.Request, keys []string, resp CacheManager.Response) {
+	code, resp := getResponse(keys, resp)
+	writeResponse(w, r, code, resp)
+}
+
+// passes a request to the cache manager in the namespace of the ns= parameter, unless the request has one
+func (s *JustWebServer) handle(r *http.Request, rq CacheManager.CacheRequest) CacheManager.Response {
+	if rq.Namespace == "" {
+		rq.Namespace = r.URL.Query().Get("ns")
+	}
+	return s.cacheManager.HandleRequest(rq)
 }
 
 func (s *JustWebServer) justHandler(w http.ResponseWriter, r *http.Request) {
 
 	values := r.URL.Query()
-	var resp any
 
 	switch r.Method {
 	case http.MethodPost:
-		resp = s.cacheManager.HandleCacheRequest("put", values["key"], values["value"])
+		ttl, err := parseTTL(values.Get("ttl"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		command, err := modeCommand(values.Get("mode"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		rq := CacheManager.CacheRequest{
+			Command: command,
+			Keys:    values["key"],
+			TTL:     ttl,
+			Tags:    values["tag"],
+		}
+		for _, v := range values["value"] {
+			rq.Values = append(rq.Values, v)
+		}
+		writeCacheResponse(w, r, s.handle(r, rq))
+	case http.MethodGet:
+		writeGetResponse(w, r, values["key"], s.handle(r, CacheManager.CacheRequest{Command: "get", Keys: values["key"]}))
+	case http.MethodDelete: // no parameters clear the cache, or the namespace of ns=
+		writeCacheResponse(w, r, s.handle(r, CacheManager.CacheRequest{
+			Command: "del",
+			Keys:    values["key"],
+			Prefix:  values.Get("prefix"),
+			Pattern: values.Get("pattern"),
+		}))
+	default:
+		writeMethodNotAllowed(w, r, http.MethodPost, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// keyBody is the body of PUT /keys/{key}
+type keyBody struct {
+	Value any      `json:"value"` // any JSON value
+	TTL   any      `json:"ttl"`   // optional, seconds or a duration like "1m30s". The ttl= parameter is used if missing
+	Tags  []string `json:"tags"`  // optional, the tags the record is invalidated by. The tag= parameters are used if missing
+}
+
+// requests to a single record: GET, PUT and DELETE /keys/{key}.
+// PUT takes a body {"value": ..., "ttl": ..., "tags": [...]} in any of the registered formats,
+// or the value itself as a raw body, see isRaw. GET with raw= returns the value itself.
+// The ETag of GET and PUT is the version of the record, PUT takes the mode= and the conditions of putCondition
+func (s *JustWebServer) keysHandler(w http.ResponseWriter, r *http.Request) {
+
+	key, op, err := keyPath(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if op == "incr" || op == "decr" {
+		s.counterHandler(w, r, key, op)
+		return
+	}
+	if op == "meta" {
+		s.metaHandler(w, r, key)
+		return
+	}
+	if op != "" {
+		s.structHandler(w, r, key, op)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !isRaw(r) {
+			resp := s.handle(r, CacheManager.CacheRequest{Command: "get", Keys: []string{key}})
+			setETag(w, resp, key)
+			writeGetResponse(w, r, []string{key}, resp)
+			return
+		}
+		resp := s.handle(r, CacheManager.CacheRequest{Command: "get", Keys: []string{key}, WithMeta: true})
+		if code, errResp := getResponse([]string{key}, resp); code != http.StatusOK {
+			writeResponse(w, r, code, errResp)
+			return
+		}
+		setETag(w, resp, key)
+		writeRaw(w, resp.Result[key], resp.Meta[key].ContentType)
+	case http.MethodPut:
+		if isRaw(r) {
+			s.putRaw(w, r, key)
+			return
+		}
+		var body keyBody
+		if !decodeBody(w, r, &body) {
+			return
+		}
+		if body.Value == nil {
+			writeError(w, r, http.StatusBadRequest, "The body should have a value: {\"value\": ...}")
+			return
+		}
+		if body.TTL == nil {
+			body.TTL = r.URL.Query().Get("ttl")
+		}
+		ttl, err := parseJSONTTL(body.TTL)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		if body.Tags == nil {
+			body.Tags = r.URL.Query()["tag"]
+		}
+		s.put(w, r, key, CacheManager.CacheRequest{
+			Values: []any{body.Value},
+			TTL:    ttl,
+			Tags:   body.Tags,
+		})
+	case http.MethodDelete:
+		writeCacheResponse(w, r, s.handle(r, CacheManager.CacheRequest{Command: "del", Keys: []string{key}}))
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// the key of a /keys/{key} path and the operation after it: "incr", "decr", "meta", one of the DataNode.StructOpNames or none.
+// A key ending with one of them has its slash escaped: /keys/a%2Fincr is the key "a/incr"
+func keyPath(r *http.Request) (key string, op string, err error) {
+	p := strings.TrimPrefix(r.URL.EscapedPath(), "/keys/")
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		if name := p[i+1:]; name == "incr" || name == "decr" || name == "meta" || slices.Contains(DataNode.StructOpNames, name) {
+			p, op = p[:i], name
+		}
+	}
+	if key, err = url.PathUnescape(p); err != nil {
+		return "", "", fmt.Errorf("bad key %q: %w", p, err)
+	}
+	if key == "" {
+		return "", "", errors.New("Key is required: /keys/{key}")
+	}
+	return key, op, nil
+}
+
+// MetaResponse is the response of GET /keys/{key}/meta
+type MetaResponse struct {
+	CacheManager.Response
+	Key      string        `json:"key"`      // the key asked for
+	Owner    string        `json:"owner"`    // the node the key belongs to
+	Replicas []ReplicaInfo `json:"replicas"` // the record on the nodes keeping it, the owner first
+}
+
+// ReplicaInfo describes a record on a node keeping it, the times are RFC 3339
+type ReplicaInfo struct {
+	Node       string   `json:"node"`                  // id of the node
+	Reads      int64    `json:"reads"`                 // number of reads
+	Writes     int64    `json:"writes"`                // number of writes
+	Size       int      `json:"size"`                  // bytes taken by the key and the value
+	Created    string   `json:"created"`               // when the node got the record
+	LastWrite  string   `json:"last_write"`            // the last write
+	LastAccess string   `json:"last_access,omitempty"` // the last read, missing if never read
+	TTL        *float64 `json:"ttl,omitempty"`         // the seconds the record has to live, missing if it never expires
+	Rank       int      `json:"rank,omitempty"`        // position in the eviction order of the node, 1 is the last to go, missing if not asked for
+	Records    int      `json:"records"`               // number of live records on the node
+}
+
+// GET /keys/{key}/meta describes the record on every node keeping it: the reads and the writes, the size, when it was
+// created, last read and last written, the seconds it has to live and with ?rank its rank in the eviction order of the node,
+// 1 being the last to go. The owner is the node the key belongs to. Neither counts as a read nor promotes the record
+func (s *JustWebServer) metaHandler(w http.ResponseWriter, r *http.Request, key string) {
+
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	resp := s.handle(r, CacheManager.CacheRequest{Command: "inspect", Keys: []string{key}, WithRank: r.URL.Query().Has("rank")})
+	if resp.Status != CacheManager.StatusOK {
+		writeResponse(w, r, httpStatus(resp), resp)
+		return
+	}
+	infos, ok := resp.Info[key]
+	if !ok {
+		writeError(w, r, http.StatusNotFound, fmt.Sprintf("Key %s is not found", key))
+		return
+	}
+
+	now := time.Now()
+	meta := MetaResponse{
+		Response: CacheManager.Response{Status: CacheManager.StatusOK},
+		Key:      key,
+		Owner:    resp.Owners[key][0],
+		Replicas: make([]ReplicaInfo, 0, len(infos)),
+	}
+	for _, info := range infos {
+		replica := ReplicaInfo{
+			Node:      info.Node,
+			Reads:     info.Reads,
+			Writes:    info.Writes,
+			Size:      info.Size,
+			Created:   info.CreatedAt.Format(time.RFC3339Nano),
+			LastWrite: info.WrittenAt.Format(time.RFC3339Nano),
+			Rank:      info.Rank,
+			Records:   info.Records,
+		}
+		if !info.AccessedAt.IsZero() {
+			replica.LastAccess = info.AccessedAt.Format(time.RFC3339Nano)
+		}
+		if !info.ExpiresAt.IsZero() {
+			ttl := max(info.ExpiresAt.Sub(now), 0).Seconds()
+			replica.TTL = &ttl
+		}
+		meta.Replicas = append(meta.Replicas, replica)
+	}
+	writeResponse(w, r, http.StatusOK, meta)
+}
+
+// POST /keys/{key}/incr and /keys/{key}/decr add or subtract by= (1 if not given) atomically
+// and return the new value. A missing key is created, ttl= sets its time to live
+func (s *JustWebServer) counterHandler(w http.ResponseWriter, r *http.Request, key string, op string) {
+
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	values := r.URL.Query()
+	by := values.Get("by")
+	if by == "" {
+		by = "1"
+	}
+	if op == "decr" {
+		if strings.HasPrefix(by, "-") {
+			by = by[1:]
+		} else {
+			by = "-" + by
+		}
+	}
+	ttl, err := parseTTL(values.Get("ttl"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := s.handle(r, CacheManager.CacheRequest{
+		Command: "incr",
+		Keys:    []string{key},
+		Values:  []any{by},
+		TTL:     ttl,
+	})
+	setETag(w, resp, key)
+	writeCacheResponse(w, r, resp)
+}
+
+// structBody is the body of POST /keys/{key}/{op} changing a list, a hash, a set or a sorted set
+type structBody struct {
+	Args []string `json:"args"` // the arguments of the operation, e.g. the values of an lpush or the score/member pairs of a zadd
+	TTL  any      `json:"ttl"`  // optional, seconds or a duration like "1m30s", sets the time to live of a new record
+}
+
+// requests to the typed values: GET /keys/{key}/{op} reads, e.g. lrange, hget or zrange, with the arguments in arg= parameters,
+// POST /keys/{key}/{op} changes the value, e.g. lpush, hset or zadd, with the arguments in arg= parameters
+// or a body {"args": [...], "ttl": ...}. The result of the operation is the value of the key.
+// A key holding another type is 400
+func (s *JustWebServer) structHandler(w http.ResponseWriter, r *http.Request, key string, name string) {
+
+	op := DataNode.StructOp{Name: name, Args: r.URL.Query()["arg"]}
+	ttlParam := any(r.URL.Query().Get("ttl"))
+	if op.Writes() {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		if len(op.Args) == 0 {
+			var body structBody
+			if !decodeBody(w, r, &body) {
+				return
+			}
+			op.Args = body.Args
+			if body.TTL != nil {
+				ttlParam = body.TTL
+			}
+		}
+	} else if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	ttl, err := parseJSONTTL(ttlParam)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := s.handle(r, CacheManager.CacheRequest{
+		Command: "op",
+		Keys:    []string{key},
+		Op:      op,
+		TTL:     ttl,
+	})
+	setETag(w, resp, key)
+	writeCacheResponse(w, r, resp)
+}
+
+// stores the body of PUT /keys/{key} as a []byte value with the Content-Type of the request,
+// application/octet-stream if none. The ttl= parameter sets the time to live
+func (s *JustWebServer) putRaw(w http.ResponseWriter, r *http.Request, key string) {
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	} else if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("bad Content-Type %q: %s", contentType, err))
+		return
+	}
+	ttl, err := parseTTL(r.URL.Query().Get("ttl"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	s.put(w, r, key, CacheManager.CacheRequest{
+		Values:      []any{data},
+		TTL:         ttl,
+		ContentType: contentType,
+		Tags:        r.URL.Query()["tag"],
+	})
+}
+
+// stores the value of PUT /keys/{key} with the mode or under the condition of the request, if any.
+// A key mode=nx finds is 409, a key mode=xx does not find is 404,
+// a failed condition is 409 for if-version= and 412 for the headers
+func (s *JustWebServer) put(w http.ResponseWriter, r *http.Request, key string, rq CacheManager.CacheRequest) {
+
+	rq.Keys = []string{key}
+	header, err := putCondition(r, &rq)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp := s.handle(r, rq)
+	code := httpStatus(resp)
+	switch {
+	case header && resp.Kind == CacheManager.Conflict:
+		code = http.StatusPreconditionFailed
+	case (rq.Command == "add" || rq.Command == "replace") && resp.Status == CacheManager.StatusOK && len(resp.Stored) == 0:
+		message := fmt.Sprintf("Key %s exists", key)
+		code = http.StatusConflict
+		if rq.Command == "replace" {
+			message, code = fmt.Sprintf("Key %s is not found", key), http.StatusNotFound
+		}
+		if header { // If-Match: * or If-None-Match: *
+			message, code = fmt.Sprintf("Precondition failed, key %s is not stored", key), http.StatusPreconditionFailed
+		}
+		resp = CacheManager.Response{
+			Status:  CacheManager.StatusError,
+			Message: message,
+			Skipped: resp.Skipped,
+		}
+	}
+	setETag(w, resp, key)
+	writeResponse(w, r, code, resp)
+}
+
+// the command of a mode= parameter: "nx" stores the absent keys only, "xx" the existing ones,
+// "getset" returns the previous values too, none stores always
+func modeCommand(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "":
+		return "put", nil
+	case "nx":
+		return "add", nil
+	case "xx":
+		return "replace", nil
+	case "getset":
+		return "getset", nil
+	}
+	return "", fmt.Errorf("bad mode %q, expected nx, xx or getset", mode)
+}
+
+// sets the command of a PUT request by its mode= or its condition: if-version= or If-Match: "<version>" store the value
+// if the record has the version given, zero if it must be absent, If-Match: * if there is a record
+// and If-None-Match: * if there is none. Tells if the condition is a header
+func putCondition(r *http.Request, rq *CacheManager.CacheRequest) (header bool, err error) {
+
+	mode := r.URL.Query().Get("mode")
+	if rq.Command, err = modeCommand(mode); err != nil {
+		return false, err
+	}
+	ifVersion, ifMatch, ifNoneMatch := r.URL.Query().Get("if-version"), r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	conditions := 0
+	for _, c := range []string{mode, ifVersion, ifMatch, ifNoneMatch} {
+		if c != "" {
+			conditions++
+		}
+	}
+	if conditions > 1 {
+		return false, errors.New("only one of mode=, if-version=, If-Match and If-None-Match can be given")
+	}
+
+	var version string
+	switch {
+	case mode != "":
+		return false, nil
+	case ifVersion != "":
+		version = ifVersion
+	case ifMatch == "*":
+		rq.Command = "replace"
+		return true, nil
+	case ifMatch != "":
+		if len(ifMatch) < 2 || ifMatch[0] != '"' || ifMatch[len(ifMatch)-1] != '"' {
+			return false, fmt.Errorf("bad If-Match %q, expected a version in quotes as the ETag has it", ifMatch)
+		}
+		version, header = ifMatch[1:len(ifMatch)-1], true
+	case ifNoneMatch == "*":
+		rq.Command = "add"
+		return true, nil
+	case ifNoneMatch != "":
+		return false, fmt.Errorf("bad If-None-Match %q, only * is supported", ifNoneMatch)
+	default:
+		return false, nil
+	}
+	v, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("bad version %q, expected a number", version)
+	}
+	rq.Command, rq.Versions = "cas", []uint64{v}
+	return header, nil
+}
+
+// sets the ETag of a response to a single record, its version in quotes
+func setETag(w http.ResponseWriter, resp CacheManager.Response, key string) {
+	if v, ok := resp.Versions[key]; ok {
+		w.Header().Set("ETag", `"`+v+`"`)
+	}
+}
+
+// batchOp is an operation of POST /batch
+type batchOp struct {
+	Op      string   `json:"op"`      // "put" "add" "replace" "getset" "get" "del" or "invalidate"
+	Key     string   `json:"key"`     // a key, added to the keys
+	Keys    []string `json:"keys"`    // keys
+	Value   any      `json:"value"`   // a value of the key
+	Values  []any    `json:"values"`  // values of the keys
+	TTL     any      `json:"ttl"`     // optional, seconds or a duration like "1m30s"
+	Prefix  string   `json:"prefix"`  // "del" deletes the keys starting with it
+	Pattern string   `json:"pattern"` // "del" deletes the keys matching this glob
+	NS      string   `json:"ns"`      // optional, the namespace of the keys, the ns= parameter is used if missing
+	Tags    []string `json:"tags"`    // tags of the records a put stores, or the tags to invalidate
+}
+
+// batchBody is the body of POST /batch
+type batchBody struct {
+	Operations []batchOp `json:"operations"`
+}
+
+// batchResult is the response to an operation of POST /batch with its HTTP status code
+type batchResult struct {
+	Code int `json:"code"`
+	CacheManager.Response
+}
+
+// batchResponse is the response of POST /batch
+type batchResponse struct {
+	CacheManager.Response
+	Results []batchResult `json:"results"` // the responses to the operations, in their order
+}
+
+// makes the cache manager request of an operation
+func (op batchOp) cacheRequest() (CacheManager.CacheRequest, error) {
+	switch op.Op {
+	case "put", "add", "replace", "getset", "get", "del", "invalidate":
+	default:
+		return CacheManager.CacheRequest{}, fmt.Errorf("unknown operation %q, expected put, add, replace, getset, get, del or invalidate", op.Op)
+	}
+	ttl, err := parseJSONTTL(op.TTL)
+	if err != nil {
+		return CacheManager.CacheRequest{}, err
+	}
+	rq := CacheManager.CacheRequest{
+		Command:   op.Op,
+		Keys:      op.Keys,
+		Values:    op.Values,
+		TTL:       ttl,
+		Prefix:    op.Prefix,
+		Pattern:   op.Pattern,
+		Namespace: op.NS,
+		Tags:      op.Tags,
+	}
+	if op.Key != "" {
+		rq.Keys = append(rq.Keys, op.Key)
+	}
+	if op.Value != nil {
+		rq.Values = append(rq.Values, op.Value)
+	}
+	return rq, nil
+}
+
+// POST /batch runs the operations of a body {"operations": [{"op": "put", "key": ..., "value": ...}, ...]}
+// one after another and returns their responses in the same order, each with its own status code.
+// The batch itself is 200 when its body is good
+func (s *JustWebServer) batchHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+	var body batchBody
+	if !decodeBody(w, r, &body) {
+		return
+	}
+	if len(body.Operations) == 0 {
+		writeError(w, r, http.StatusBadRequest, "The body should have operations: {\"operations\": [...]}")
+		return
+	}
+
+	results := make([]batchResult, len(body.Operations))
+	failed := 0
+	for i, op := range body.Operations {
+		var resp CacheManager.Response
+		code := http.StatusBadRequest
+		if rq, err := op.cacheRequest(); err != nil {
+			resp = CacheManager.Response{Status: CacheManager.StatusError, Message: err.Error(), Kind: CacheManager.BadRequest}
+		} else if resp = s.handle(r, rq); rq.Command == "get" {
+			code, resp = getResponse(rq.Keys, resp)
+		} else {
+			code = httpStatus(resp)
+		}
+		// a key which is not found is an answer, not a failure
+		if resp.Status != CacheManager.StatusOK && code != http.StatusNotFound {
+			failed++
+		}
+		results[i] = batchResult{Code: code, Response: resp}
+	}
+
+	status, message := CacheManager.StatusOK, fmt.Sprintf("%d operations done", len(results))
+	if failed > 0 {
+		status, message = CacheManager.StatusError, fmt.Sprintf("%d of %d operations failed", failed, len(results))
+	}
+	writeResponse(w, r, http.StatusOK, batchResponse{
+		Response: CacheManager.Response{Status: status, Message: message},
+		Results:  results,
+	})
+}
+
+// GET /scan lists the keys of all the nodes a page at a time: cursor= of the previous page, "0" or none for the first one,
+// count= keys at most, prefix= and pattern= filters. The response has the keys and the cursor of the next page,
+// "0" after the last one
+func (s *JustWebServer) scanHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	values := r.URL.Query()
+	count := 0
+	if c := values.Get("count"); c != "" {
+		var err error
+		if count, err = strconv.Atoi(c); err != nil || count <= 0 {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Bad count %q, it should be a positive number", c))
+			return
+		}
+	}
+	writeCacheResponse(w, r, s.handle(r, CacheManager.CacheRequest{
+		Command: "scan",
+		Cursor:  values.Get("cursor"),
+		Count:   count,
+		Prefix:  values.Get("prefix"),
+		Pattern: values.Get("pattern"),
+	}))
+}
+
+// GET /range lists the keys of all the nodes from from=, inclusive, to to=, exclusive, none for no end, in lexical order:
+// limit= keys at most. The response has the keys and the key the next page starts from, none after the last page
+func (s *JustWebServer) rangeHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+	values := r.URL.Query()
+	limit := 0
+	if l := values.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("Bad limit %q, it should be a positive number", l))
+			return
+		}
+	}
+	writeCacheResponse(w, r, s.handle(r, CacheManager.CacheRequest{
+		Command: "range",
+		From:    values.Get("from"),
+		To:      values.Get("to"),
+		Count:   limit,
+	}))
+}
+
+// DELETE /tags/{tag} deletes the records having the tag on all the nodes
+func (s *JustWebServer) tagsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, r, http.MethodDelete)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.EscapedPath(), "/tags/")
+	tag, err := url.PathUnescape(p)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("bad tag %q: %s", p, err))
+		return
+	}
+	if tag == "" {
+		writeError(w, r, http.StatusBadRequest, "Tag is required: /tags/{tag}")
+		return
+	}
+	writeCacheResponse(w, r, s.handle(r, CacheManager.CacheRequest{Command: "invalidate", Tags: []string{tag}}))
+}
+
+// admin requests to manage the nodes:
+// GET lists the nodes, POST with id= (and optional size=) adds a node, DELETE with id= removes a node
+func (s *JustWebServer) adminNodesHandler(w http.ResponseWriter, r *http.Request) {
+
+	values := r.URL.Query()
+	id := values.Get("id")
+
+	switch r.Method {
 	case http.MethodGet:
-		resp = s.cacheManager.HandleCacheRequest("get", values["key"], nil)
+		writeResponse(w, r, http.StatusOK, CacheManager.Response{
+			Status: CacheManager.StatusOK,
+			Nodes:  s.cacheManager.NodeIds(),
+		})
+	case http.MethodPost:
+		if s.nodeFactory == nil {
+			writeError(w, r, http.StatusNotImplemented, "Adding nodes is not supported")
+			return
+		}
+		if id == "" {
+			writeError(w, r, http.StatusBadRequest, "Node id= is required")
+			return
+		}
+		size, _ := strconv.Atoi(values.Get("size"))
+		nodeCh, stop := s.nodeFactory(id, size)
+		moved, err := s.cacheManager.AddNode(id, nodeCh)
+		if err != nil {
+			stop()
+			writeError(w, r, http.StatusConflict, err.Error())
+			return
+		}
+		s.stopLock.Lock()
+		s.stopNode[id] = stop
+		s.stopLock.Unlock()
+		writeResponse(w, r, http.StatusOK, CacheManager.Response{
+			Status:  CacheManager.StatusOK,
+			Message: fmt.Sprintf("node %s added, %d records moved to it", id, moved),
+		})
 	case http.MethodDelete:
-		resp = s.cacheManager.HandleCacheRequest("del", nil, nil)
+		moved, err := s.cacheManager.RemoveNode(id)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.stopLock.Lock()
+		if stop, ok := s.stopNode[id]; ok {
+			stop()
+			delete(s.stopNode, id)
+		}
+		s.stopLock.Unlock()
+		writeResponse(w, r, http.StatusOK, CacheManager.Response{
+			Status:  CacheManager.StatusOK,
+			Message: fmt.Sprintf("node %s removed, %d records moved from it", id, moved),
+		})
 	default:
-		resp = map[string]any{
-			"status":  "Error",
-			"message": "Unknown request type, we support only POST GET and DELETE!",
+		writeMethodNotAllowed(w, r, http.MethodPost, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// quotasResponse is the response of GET /ns
+type quotasResponse struct {
+	CacheManager.Response
+	Quotas map[string]DataNode.Quota `json:"quotas"` // the quotas of the namespaces
+}
+
+// requests to the namespaces: GET /ns lists the quotas, GET /ns/{name} gives the usage of a namespace on the nodes,
+// PUT /ns/{name} sets its quota with a body {"max_entries": ..., "max_bytes": ...} or the same parameters, zero meaning
+// no limit, DELETE /ns/{name} deletes its records. The other routes under /ns/{name}/ are the routes of the cache
+// in the namespace: /ns/{name}/keys/{key} is /keys/{key}?ns={name}
+func (s *JustWebServer) nsHandler(w http.ResponseWriter, r *http.Request, mux http.Handler) {
+
+	p := strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/ns"), "/")
+	if p == "" {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, http.MethodGet)
+			return
+		}
+		writeResponse(w, r, http.StatusOK, quotasResponse{
+			Response: CacheManager.Response{Status: CacheManager.StatusOK},
+			Quotas:   s.cacheManager.Quotas(),
+		})
+		return
+	}
+	name, rest, _ := strings.Cut(p, "/")
+	if err := DataNode.CheckNamespace(name); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rest != "" { // a route of the cache, in the namespace
+		rq := r.Clone(r.Context())
+		rq.URL.Path = strings.TrimPrefix(rq.URL.Path, "/ns/"+name)
+		rq.URL.RawPath = ""
+		if r.URL.RawPath != "" {
+			rq.URL.RawPath = "/" + rest
 		}
+		query := rq.URL.Query()
+		query.Set("ns", name)
+		rq.URL.RawQuery = query.Encode()
+		mux.ServeHTTP(w, rq)
+		return
 	}
-	b, _ := json.Marshal(&resp)
-	_, _ = io.WriteString(w, string(b))
+
+	switch r.Method {
+	case http.MethodGet:
+		writeCacheResponse(w, r, s.cacheManager.HandleRequest(CacheManager.CacheRequest{Command: "get", Namespace: name}))
+	case http.MethodPut:
+		var quota DataNode.Quota
+		values := r.URL.Query()
+		if values.Has("max_entries") || values.Has("max_bytes") {
+			var err error
+			if quota.MaxSize, err = strconv.Atoi(values.Get("max_entries")); err != nil && values.Has("max_entries") {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("bad max_entries: %s", err))
+				return
+			}
+			if quota.MaxBytes, err = strconv.ParseInt(values.Get("max_bytes"), 10, 64); err != nil && values.Has("max_bytes") {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("bad max_bytes: %s", err))
+				return
+			}
+		} else if !decodeBody(w, r, &quota) {
+			return
+		}
+		if quota.MaxSize < 0 || quota.MaxBytes < 0 {
+			writeError(w, r, http.StatusBadRequest, "The quota can't be negative")
+			return
+		}
+		evicted, err := s.cacheManager.SetQuota(name, quota)
+		if err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		writeResponse(w, r, http.StatusOK, CacheManager.Response{
+			Status:  CacheManager.StatusOK,
+			Message: fmt.Sprintf("namespace %s quota set, %d records evicted", name, evicted),
+		})
+	case http.MethodDelete:
+		writeCacheResponse(w, r, s.cacheManager.HandleRequest(CacheManager.CacheRequest{Command: "del", Namespace: name}))
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// Handler gives the routes of the web server:
+// "/" the query string requests, "/keys/{key}" single records and their metadata, "/batch" operations, "/tags/{tag}" tag invalidation,
+// "/scan" the keys page by page, "/range" the keys between two keys in order, "/admin/nodes" the nodes,
+// "/ns/{name}" the namespaces and the routes in them. The ns= parameter puts the keys of a request in a namespace.
+// The request bodies and the responses are in the formats of the registered codecs, JSON by default
+// --> Input:
+// cacheManager     *CacheManager.DateNodesManager     points to cache manager
+// <-- Output:
+// 1) http.Handler     handler passing requests to the cache manager
+func (s *JustWebServer) Handler(cacheManager *CacheManager.DateNodesManager) http.Handler {
+
+	s.cacheManager = cacheManager
+	s.stopNode = make(map[string]context.CancelFunc)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.justHandler)
+	mux.HandleFunc("/keys/", s.keysHandler)
+	mux.HandleFunc("/batch", s.batchHandler)
+	mux.HandleFunc("/tags/", s.tagsHandler)
+	mux.HandleFunc("/scan", s.scanHandler)
+	mux.HandleFunc("/range", s.rangeHandler)
+	mux.HandleFunc("/admin/nodes", s.adminNodesHandler)
+	mux.HandleFunc("/ns", func(w http.ResponseWriter, r *http.Request) { s.nsHandler(w, r, mux) })
+	mux.HandleFunc("/ns/", func(w http.ResponseWriter, r *http.Request) { s.nsHandler(w, r, mux) })
+	return negotiate(mux)
 }
 
 // StartAndServe starts a simple web server. it passes requests to the cache manager
@@ -42,9 +1018,7 @@ func (s *JustWebServer) justHandler(w http.ResponseWriter, r *http.Request) {
 // cacheManager     *CacheManager.DateNodesManager     points to cache manager
 func (s *JustWebServer) StartAndServe(port int, cacheManager *CacheManager.DateNodesManager) {
 
-	s.cacheManager = cacheManager
-	http.HandleFunc("/", s.justHandler)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), s.Handler(cacheManager))
 	if err != nil {
 		fmt.Printf("error starting server: %s\n", err)
 		os.Exit(1)
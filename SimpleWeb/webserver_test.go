@@ -0,0 +1,642 @@
+package SimpleWeb
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewelkin/discap/CacheManager"
+	"github.com/andrewelkin/discap/DataNode"
+)
+
+// starts a cache with 3 nodes behind a test web server
+func startTestServer(t *testing.T) *httptest.Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	nodeChannels := make([]chan<- DataNode.DNRequest, 3)
+	for i := range nodeChannels {
+		nodeChannels[i] = (&DataNode.SingleDataNode{}).New(ctx, fmt.Sprintf("%03d", i), 100).GetChannel()
+	}
+	m := (&CacheManager.DateNodesManager{}).New(ctx, nodeChannels)
+	ts := httptest.NewServer((&JustWebServer{}).Handler(m))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// sends a request, checks the status code and decodes the JSON response
+func call(t *testing.T, method string, url string, body string, code int) map[string]any {
+	t.Helper()
+	rq, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatalf("%s %s error = %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != code {
+		t.Errorf("%s %s returned %d %s, expected %d", method, url, resp.StatusCode, b, code)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s %s returned Content-Type %q", method, url, ct)
+	}
+	var res map[string]any
+	if err = json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("%s %s returned %q: %v", method, url, b, err)
+	}
+	return res
+}
+
+func TestJustWebServer_Keys(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	if resp := call(t, http.MethodPut, ts.URL+"/keys/user:1", `{"value": {"name": "Ann", "tags": ["a", "b"]}, "ttl": "1h"}`, http.StatusOK); resp["status"] != "OK" {
+		t.Errorf("PUT /keys/user:1 returned %v", resp)
+	}
+	if resp := call(t, http.MethodPut, ts.URL+"/keys/a%2Fb?ttl=60", `{"value": "slash"}`, http.StatusOK); resp["status"] != "OK" {
+		t.Errorf("PUT /keys/a%%2Fb returned %v", resp)
+	}
+
+	resp := call(t, http.MethodGet, ts.URL+"/keys/user:1", "", http.StatusOK)
+	user, _ := resp["result"].(map[string]any)["user:1"].(map[string]any)
+	if user["name"] != "Ann" || len(user["tags"].([]any)) != 2 {
+		t.Errorf("GET /keys/user:1 returned %v", resp)
+	}
+	// the legacy query string form sees the same records
+	if resp = call(t, http.MethodGet, ts.URL+"/?key=a/b", "", http.StatusOK); resp["result"].(map[string]any)["a/b"] != "slash" {
+		t.Errorf("GET /?key=a/b returned %v", resp)
+	}
+
+	if resp = call(t, http.MethodDelete, ts.URL+"/keys/user:1", "", http.StatusOK); fmt.Sprint(resp["deleted"]) != "[user:1]" {
+		t.Errorf("DELETE /keys/user:1 returned %v", resp)
+	}
+	if resp = call(t, http.MethodGet, ts.URL+"/keys/user:1", "", http.StatusNotFound); resp["status"] != "Error" || resp["result"] != nil {
+		t.Errorf("GET of a deleted key returned %v", resp)
+	}
+
+	for _, body := range []string{`{"value": "x", "ttl": "soon"}`, `{"ttl": 1}`, `{"value": `} {
+		if resp = call(t, http.MethodPut, ts.URL+"/keys/bad", body, http.StatusBadRequest); resp["status"] != "Error" {
+			t.Errorf("PUT with %s must fail, returned %v", body, resp)
+		}
+	}
+	if resp = call(t, http.MethodPost, ts.URL+"/keys/user:1", "", http.StatusMethodNotAllowed); resp["status"] != "Error" {
+		t.Errorf("POST /keys/user:1 must fail, returned %v", resp)
+	}
+}
+
+func TestJustWebServer_Batch(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	resp := call(t, http.MethodPost, ts.URL+"/batch", `{"operations": [
+		{"op": "put", "keys": ["key1", "key2"], "values": ["value1", 2]},
+		{"op": "add", "key": "key1", "value": "not stored"},
+		{"op": "get", "keys": ["key1", "key2", "nokey"]},
+		{"op": "del", "key": "key2"},
+		{"op": "get", "key": "key2"}
+	]}`, http.StatusOK)
+	if resp["status"] != "OK" {
+		t.Fatalf("POST /batch returned %v", resp)
+	}
+	results := resp["results"].([]any)
+	if len(results) != 5 {
+		t.Fatalf("expected 5 results, got %v", results)
+	}
+	if got := results[2].(map[string]any)["result"]; fmt.Sprint(got) != "map[key1:value1 key2:2]" {
+		t.Errorf("get in a batch returned %v", got)
+	}
+	if got := results[4].(map[string]any); got["code"] != 404.0 || got["result"] != nil {
+		t.Errorf("get of a deleted key in a batch returned %v", got)
+	}
+
+	// a failed operation does not stop the others
+	resp = call(t, http.MethodPost, ts.URL+"/batch", `{"operations": [{"op": "incr", "key": "key1"}, {"op": "put", "key": "key3", "value": 3}]}`, http.StatusOK)
+	if resp["status"] != "Error" || resp["message"] != "1 of 2 operations failed" {
+		t.Errorf("POST /batch with a bad operation returned %v", resp)
+	}
+	if got := resp["results"].([]any)[0].(map[string]any)["code"]; got != 400.0 {
+		t.Errorf("a bad operation in a batch returned code %v", got)
+	}
+	if resp = call(t, http.MethodGet, ts.URL+"/keys/key3", "", http.StatusOK); resp["result"].(map[string]any)["key3"] != 3.0 {
+		t.Errorf("GET /keys/key3 returned %v", resp)
+	}
+
+	if resp = call(t, http.MethodPost, ts.URL+"/batch", `{}`, http.StatusBadRequest); resp["status"] != "Error" {
+		t.Errorf("POST /batch without operations must fail, returned %v", resp)
+	}
+}
+
+func TestJustWebServer_StatusCodes(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	call(t, http.MethodPost, ts.URL+"/?key=key1&value=value1", "", http.StatusOK)
+	call(t, http.MethodGet, ts.URL+"/?key=key1", "", http.StatusOK)
+	call(t, http.MethodGet, ts.URL+"/?key=nokey", "", http.StatusNotFound)
+	call(t, http.MethodGet, ts.URL+"/?key=key1&key=nokey", "", http.StatusOK)
+	call(t, http.MethodPost, ts.URL+"/?key=key1&value=value1&ttl=-1", "", http.StatusBadRequest)
+	call(t, http.MethodDelete, ts.URL+"/?pattern=[", "", http.StatusBadRequest)
+	call(t, http.MethodPatch, ts.URL+"/?key=key1", "", http.StatusMethodNotAllowed)
+
+	rq, _ := http.NewRequest(http.MethodPatch, ts.URL+"/keys/key1", nil)
+	resp, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if allow := resp.Header.Get("Allow"); allow != "GET, PUT, DELETE" {
+		t.Errorf("405 returned Allow %q", allow)
+	}
+
+	// nodes which never answer
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m, err := (&CacheManager.DateNodesManager{}).NewWithOptions(ctx, []chan<- DataNode.DNRequest{make(chan DataNode.DNRequest, 10)},
+		CacheManager.ManagerOptions{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := httptest.NewServer((&JustWebServer{}).Handler(m))
+	defer dead.Close()
+	call(t, http.MethodGet, dead.URL+"/keys/key1", "", http.StatusServiceUnavailable)
+	call(t, http.MethodPut, dead.URL+"/keys/key1", `{"value": 1}`, http.StatusServiceUnavailable)
+}
+
+func TestJustWebServer_ContentNegotiation(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	// sends a body in a format and decodes the response of the accepted format
+	send := func(method string, url string, contentType string, body any, accept string, code int) CacheManager.Response {
+		t.Helper()
+		var data []byte
+		if body != nil {
+			data, _ = codecByType(contentType).Marshal(body)
+		}
+		rq, _ := http.NewRequest(method, url, bytes.NewReader(data))
+		rq.Header.Set("Content-Type", contentType)
+		rq.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatalf("%s %s error = %v", method, url, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != code {
+			t.Errorf("%s %s returned %d, expected %d", method, url, resp.StatusCode, code)
+		}
+		var res CacheManager.Response
+		codec := codecByType(resp.Header.Get("Content-Type"))
+		if codec == nil {
+			t.Fatalf("%s %s returned Content-Type %q", method, url, resp.Header.Get("Content-Type"))
+		}
+		if err = codec.Unmarshal(b, &res); err != nil {
+			t.Fatalf("%s %s returned %x: %v", method, url, b, err)
+		}
+		return res
+	}
+
+	value := map[string]any{"name": "Ann", "age": 42.0, "tags": []any{"a", "b"}}
+	for _, format := range ContentTypes() {
+		key := ts.URL + "/keys/" + strings.ReplaceAll(format, "/", "_")
+		send(http.MethodPut, key, format, map[string]any{"value": value, "ttl": 60}, format, http.StatusOK)
+		for _, accept := range ContentTypes() {
+			resp := send(http.MethodGet, key, "", nil, accept, http.StatusOK)
+			if got := resp.Result[strings.TrimPrefix(key, ts.URL+"/keys/")]; !reflect.DeepEqual(got, value) {
+				t.Errorf("PUT in %s, GET in %s returned %v", format, accept, got)
+			}
+		}
+	}
+
+	resp := send(http.MethodPost, ts.URL+"/batch", "application/msgpack", map[string]any{"operations": []any{
+		map[string]any{"op": "put", "key": "key1", "value": 1},
+		map[string]any{"op": "get", "keys": []any{"key1"}},
+	}}, "application/cbor", http.StatusOK)
+	if resp.Status != "OK" {
+		t.Errorf("a msgpack batch returned %+v", resp)
+	}
+
+	send(http.MethodGet, ts.URL+"/?key=key1", "", nil, "text/html", http.StatusNotAcceptable)
+	send(http.MethodPost, ts.URL+"/batch", "application/xml", nil, "", http.StatusUnsupportedMediaType)
+	send(http.MethodPut, ts.URL+"/keys/key1", "application/cbor", nil, "application/cbor", http.StatusBadRequest)
+}
+
+func TestJustWebServer_RawValues(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	// sends a raw body, returns the response and its body
+	do := func(method string, url string, contentType string, accept string, body []byte, code int) (*http.Response, []byte) {
+		t.Helper()
+		rq, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		if contentType != "" {
+			rq.Header.Set("Content-Type", contentType)
+		}
+		if accept != "" {
+			rq.Header.Set("Accept", accept)
+		}
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatalf("%s %s error = %v", method, url, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != code {
+			t.Errorf("%s %s returned %d %s, expected %d", method, url, resp.StatusCode, b, code)
+		}
+		return resp, b
+	}
+
+	image := make([]byte, 1024)
+	for i := range image {
+		image[i] = byte(i * 7)
+	}
+	do(http.MethodPut, ts.URL+"/keys/image?ttl=1h", "image/png", "", image, http.StatusOK)
+	resp, b := do(http.MethodGet, ts.URL+"/keys/image?raw", "", "image/png", nil, http.StatusOK)
+	if !bytes.Equal(b, image) || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("GET ?raw returned %d bytes of %s", len(b), resp.Header.Get("Content-Type"))
+	}
+	// the JSON response has the bytes in base64
+	if res := call(t, http.MethodGet, ts.URL+"/keys/image", "", http.StatusOK); res["result"].(map[string]any)["image"] != base64.StdEncoding.EncodeToString(image) {
+		t.Errorf("GET of a raw value returned %v", res)
+	}
+
+	// raw= stores a body of a codec as it is, and the value of a JSON body is returned as text
+	do(http.MethodPut, ts.URL+"/keys/doc?raw=1", "application/json; charset=utf-8", "", []byte(`{"a": 1}`), http.StatusOK)
+	if resp, b = do(http.MethodGet, ts.URL+"/keys/doc?raw", "", "", nil, http.StatusOK); string(b) != `{"a": 1}` || resp.Header.Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Errorf("GET ?raw of a raw JSON document returned %q of %s", b, resp.Header.Get("Content-Type"))
+	}
+	do(http.MethodPut, ts.URL+"/keys/text", "application/json", "", []byte(`{"value": "plain text"}`), http.StatusOK)
+	if resp, b = do(http.MethodGet, ts.URL+"/keys/text?raw", "", "", nil, http.StatusOK); string(b) != "plain text" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("GET ?raw of a string returned %q of %s", b, resp.Header.Get("Content-Type"))
+	}
+
+	do(http.MethodGet, ts.URL+"/keys/nokey?raw", "", "", nil, http.StatusNotFound)
+	do(http.MethodPut, ts.URL+"/keys/bad?raw", "image/png; =", "", image, http.StatusBadRequest)
+	do(http.MethodPut, ts.URL+"/keys/bad?raw&ttl=soon", "", "", image, http.StatusBadRequest)
+}
+
+func TestJustWebServer_Counters(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	if resp := call(t, http.MethodPost, ts.URL+"/keys/hits/incr?by=5&ttl=1h", "", http.StatusOK); resp["result"].(map[string]any)["hits"] != 5.0 {
+		t.Errorf("POST /keys/hits/incr returned %v", resp)
+	}
+	if resp := call(t, http.MethodPost, ts.URL+"/keys/hits/decr", "", http.StatusOK); resp["result"].(map[string]any)["hits"] != 4.0 {
+		t.Errorf("POST /keys/hits/decr returned %v", resp)
+	}
+	if resp := call(t, http.MethodPost, ts.URL+"/keys/hits/incr?by=0.5", "", http.StatusOK); resp["result"].(map[string]any)["hits"] != 4.5 {
+		t.Errorf("POST /keys/hits/incr?by=0.5 returned %v", resp)
+	}
+
+	// a key ending with /incr has its slash escaped
+	call(t, http.MethodPut, ts.URL+"/keys/a%2Fincr", `{"value": 1}`, http.StatusOK)
+	if resp := call(t, http.MethodPost, ts.URL+"/keys/a%2Fincr/incr", "", http.StatusOK); resp["result"].(map[string]any)["a/incr"] != 2.0 {
+		t.Errorf("POST /keys/a%%2Fincr/incr returned %v", resp)
+	}
+
+	call(t, http.MethodPut, ts.URL+"/keys/name", `{"value": "Ann"}`, http.StatusOK)
+	call(t, http.MethodPost, ts.URL+"/keys/name/incr", "", http.StatusBadRequest)
+	call(t, http.MethodPost, ts.URL+"/keys/hits/incr?by=x", "", http.StatusBadRequest)
+	call(t, http.MethodGet, ts.URL+"/keys/hits/incr", "", http.StatusMethodNotAllowed)
+}
+
+func TestJustWebServer_Structures(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	if resp := call(t, http.MethodPost, ts.URL+"/keys/list/rpush?arg=a&arg=b", "", http.StatusOK); resp["result"].(map[string]any)["list"] != 2.0 {
+		t.Errorf("POST /keys/list/rpush returned %v", resp)
+	}
+	if resp := call(t, http.MethodPost, ts.URL+"/keys/list/lpush", `{"args": ["z"], "ttl": "1h"}`, http.StatusOK); resp["result"].(map[string]any)["list"] != 3.0 {
+		t.Errorf("POST /keys/list/lpush returned %v", resp)
+	}
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/list/lrange?arg=0&arg=-1", "", http.StatusOK); fmt.Sprint(resp["result"]) != "map[list:[z a b]]" {
+		t.Errorf("GET /keys/list/lrange returned %v", resp)
+	}
+	call(t, http.MethodPost, ts.URL+"/keys/hash/hset?arg=name&arg=Ann", "", http.StatusOK)
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/hash/hget?arg=name", "", http.StatusOK); resp["result"].(map[string]any)["hash"] != "Ann" {
+		t.Errorf("GET /keys/hash/hget returned %v", resp)
+	}
+	call(t, http.MethodPost, ts.URL+"/keys/set/sadd?arg=y&arg=x&arg=y", "", http.StatusOK)
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/set", "", http.StatusOK); fmt.Sprint(resp["result"]) != "map[set:[x y]]" {
+		t.Errorf("GET /keys/set returned %v", resp)
+	}
+	call(t, http.MethodPost, ts.URL+"/keys/zset/zadd?arg=2&arg=b&arg=1&arg=a", "", http.StatusOK)
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/zset/zrange?arg=-inf&arg=%2Binf", "", http.StatusOK); fmt.Sprint(resp["result"]) != "map[zset:[map[member:a score:1] map[member:b score:2]]]" {
+		t.Errorf("GET /keys/zset/zrange returned %v", resp)
+	}
+
+	call(t, http.MethodGet, ts.URL+"/keys/hash/lrange?arg=0&arg=1", "", http.StatusBadRequest)
+	call(t, http.MethodPost, ts.URL+"/keys/list/hset?arg=a", "", http.StatusBadRequest)
+	call(t, http.MethodPost, ts.URL+"/keys/list/lrange?arg=0&arg=1", "", http.StatusMethodNotAllowed)
+	call(t, http.MethodGet, ts.URL+"/keys/list/lpush?arg=a", "", http.StatusMethodNotAllowed)
+}
+
+func TestJustWebServer_Versions(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	// sends a request with a header, returns the ETag of the response
+	do := func(method string, url string, body string, header string, value string, code int) string {
+		t.Helper()
+		rq, _ := http.NewRequest(method, url, strings.NewReader(body))
+		if header != "" {
+			rq.Header.Set(header, value)
+		}
+		resp, err := http.DefaultClient.Do(rq)
+		if err != nil {
+			t.Fatalf("%s %s error = %v", method, url, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != code {
+			t.Errorf("%s %s %s: %s returned %d %s, expected %d", method, url, header, value, resp.StatusCode, b, code)
+		}
+		return resp.Header.Get("ETag")
+	}
+
+	etag := do(http.MethodPut, ts.URL+"/keys/doc", `{"value": 1}`, "", "", http.StatusOK)
+	res := call(t, http.MethodGet, ts.URL+"/keys/doc", "", http.StatusOK)
+	version := res["versions"].(map[string]any)["doc"].(string)
+	if etag != `"`+version+`"` || do(http.MethodGet, ts.URL+"/keys/doc", "", "", "", http.StatusOK) != etag {
+		t.Fatalf("PUT returned ETag %s, GET returned version %s", etag, version)
+	}
+
+	// if-version= conflicts are 409, If-Match ones 412
+	newTag := do(http.MethodPut, ts.URL+"/keys/doc?if-version="+version, `{"value": 2}`, "", "", http.StatusOK)
+	if newTag == "" || newTag == etag {
+		t.Errorf("a conditional PUT returned ETag %q after %q", newTag, etag)
+	}
+	do(http.MethodPut, ts.URL+"/keys/doc?if-version="+version, `{"value": 3}`, "", "", http.StatusConflict)
+	do(http.MethodPut, ts.URL+"/keys/doc", `{"value": 3}`, "If-Match", etag, http.StatusPreconditionFailed)
+	do(http.MethodPut, ts.URL+"/keys/doc?raw", `3`, "If-Match", newTag, http.StatusOK)
+	if res = call(t, http.MethodGet, ts.URL+"/keys/doc", "", http.StatusOK); res["result"].(map[string]any)["doc"] != "Mw==" {
+		t.Errorf("expected the raw value 3 after the conditional PUTs, got %v", res)
+	}
+
+	// version zero and the wildcards check for the record
+	do(http.MethodPut, ts.URL+"/keys/new?if-version=0", `{"value": 1}`, "", "", http.StatusOK)
+	do(http.MethodPut, ts.URL+"/keys/new?if-version=0", `{"value": 1}`, "", "", http.StatusConflict)
+	do(http.MethodPut, ts.URL+"/keys/new", `{"value": 1}`, "If-None-Match", "*", http.StatusPreconditionFailed)
+	do(http.MethodPut, ts.URL+"/keys/other", `{"value": 1}`, "If-Match", "*", http.StatusPreconditionFailed)
+	do(http.MethodPut, ts.URL+"/keys/other", `{"value": 1}`, "If-None-Match", "*", http.StatusOK)
+	do(http.MethodPut, ts.URL+"/keys/other", `{"value": 2}`, "If-Match", "*", http.StatusOK)
+
+	do(http.MethodPut, ts.URL+"/keys/doc?if-version=x", `{"value": 1}`, "", "", http.StatusBadRequest)
+	do(http.MethodPut, ts.URL+"/keys/doc", `{"value": 1}`, "If-Match", strings.Trim(newTag, `"`), http.StatusBadRequest)
+	do(http.MethodPut, ts.URL+"/keys/doc?if-version=1", `{"value": 1}`, "If-Match", newTag, http.StatusBadRequest)
+}
+
+func TestJustWebServer_Modes(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	call(t, http.MethodPut, ts.URL+"/keys/k?mode=nx", `{"value": 1}`, http.StatusOK)
+	if resp := call(t, http.MethodPut, ts.URL+"/keys/k?mode=nx", `{"value": 2}`, http.StatusConflict); !reflect.DeepEqual(resp["skipped"], []any{"k"}) {
+		t.Errorf("PUT mode=nx of an existing key returned %v", resp)
+	}
+	call(t, http.MethodPut, ts.URL+"/keys/missing?mode=xx", `{"value": 2}`, http.StatusNotFound)
+	call(t, http.MethodPut, ts.URL+"/keys/k?mode=XX", `{"value": 2}`, http.StatusOK)
+
+	if resp := call(t, http.MethodPut, ts.URL+"/keys/k?mode=getset", `{"value": 3}`, http.StatusOK); !reflect.DeepEqual(resp["previous"], map[string]any{"k": 2.0}) {
+		t.Errorf("PUT mode=getset returned %v", resp)
+	}
+	if resp := call(t, http.MethodPut, ts.URL+"/keys/new?mode=getset", `{"value": 1}`, http.StatusOK); resp["previous"] != nil {
+		t.Errorf("PUT mode=getset of a new key returned %v", resp)
+	}
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/k", "", http.StatusOK); resp["result"].(map[string]any)["k"] != 3.0 {
+		t.Errorf("expected the value of getset, got %v", resp)
+	}
+
+	// the query string requests and the batches take the modes too
+	if resp := call(t, http.MethodPost, ts.URL+"?key=k&value=4&key=k2&value=5&mode=nx", "", http.StatusOK); !reflect.DeepEqual(resp["stored"], []any{"k2"}) ||
+		!reflect.DeepEqual(resp["skipped"], []any{"k"}) {
+		t.Errorf("POST mode=nx returned %v", resp)
+	}
+	resp := call(t, http.MethodPost, ts.URL+"/batch", `{"operations": [{"op": "getset", "key": "k2", "value": 6}]}`, http.StatusOK)
+	if result := resp["results"].([]any)[0].(map[string]any); !reflect.DeepEqual(result["previous"], map[string]any{"k2": "5"}) {
+		t.Errorf("batch getset returned %v", result)
+	}
+
+	call(t, http.MethodPut, ts.URL+"/keys/k?mode=upsert", `{"value": 1}`, http.StatusBadRequest)
+	call(t, http.MethodPut, ts.URL+"/keys/k?mode=nx&if-version=1", `{"value": 1}`, http.StatusBadRequest)
+	call(t, http.MethodPost, ts.URL+"?key=k&value=4&mode=upsert", "", http.StatusBadRequest)
+}
+
+func TestJustWebServer_Namespaces(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	call(t, http.MethodPut, ts.URL+"/keys/k1", `{"value": "default"}`, http.StatusOK)
+	call(t, http.MethodPut, ts.URL+"/ns/team/keys/k1", `{"value": "team"}`, http.StatusOK)
+	call(t, http.MethodPost, ts.URL+"/?key=k2&value=v2&ns=team", "", http.StatusOK)
+	if resp := call(t, http.MethodGet, ts.URL+"/ns/team/keys/k1", "", http.StatusOK); resp["result"].(map[string]any)["k1"] != "team" {
+		t.Errorf("GET /ns/team/keys/k1 returned %v", resp)
+	}
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/k1?ns=team", "", http.StatusOK); resp["result"].(map[string]any)["k1"] != "team" {
+		t.Errorf("GET /keys/k1?ns=team returned %v", resp)
+	}
+	if resp := call(t, http.MethodPost, ts.URL+"/batch", `{"operations": [{"op": "get", "key": "k2", "ns": "team"}, {"op": "get", "key": "k2"}]}`, http.StatusOK); resp["results"].([]any)[0].(map[string]any)["code"] != 200.0 || resp["results"].([]any)[1].(map[string]any)["code"] != 404.0 {
+		t.Errorf("POST /batch returned %v", resp)
+	}
+
+	// quotas
+	call(t, http.MethodPut, ts.URL+"/ns/team?max_entries=5", "", http.StatusOK)
+	call(t, http.MethodPut, ts.URL+"/ns/other", `{"max_bytes": 1000}`, http.StatusOK)
+	if resp := call(t, http.MethodGet, ts.URL+"/ns", "", http.StatusOK); fmt.Sprint(resp["quotas"]) != "map[other:map[max_bytes:1000 max_entries:0] team:map[max_bytes:0 max_entries:5]]" {
+		t.Errorf("GET /ns returned %v", resp)
+	}
+	if resp := call(t, http.MethodGet, ts.URL+"/ns/team", "", http.StatusOK); !strings.Contains(fmt.Sprint(resp["nodes"]), "namespace team length 1 bytes 11 quota 5 entries") {
+		t.Errorf("GET /ns/team returned %v", resp)
+	}
+	call(t, http.MethodPut, ts.URL+"/ns/team?max_entries=-1", "", http.StatusBadRequest)
+	call(t, http.MethodPut, ts.URL+"/ns/team?max_entries=x", "", http.StatusBadRequest)
+
+	// a flush of the namespace keeps the other keys
+	if resp := call(t, http.MethodDelete, ts.URL+"/ns/team", "", http.StatusOK); fmt.Sprint(resp["deleted"]) != "[k1 k2]" {
+		t.Errorf("DELETE /ns/team returned %v", resp)
+	}
+	call(t, http.MethodGet, ts.URL+"/ns/team/keys/k1", "", http.StatusNotFound)
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/k1", "", http.StatusOK); resp["result"].(map[string]any)["k1"] != "default" {
+		t.Errorf("GET /keys/k1 returned %v", resp)
+	}
+
+	call(t, http.MethodGet, ts.URL+"/ns/a*b/keys/k1", "", http.StatusBadRequest)
+	call(t, http.MethodGet, ts.URL+"/keys/k1?ns=a%2Fb", "", http.StatusBadRequest)
+	call(t, http.MethodPut, ts.URL+"/keys/a%1Fb", `{"value": "v"}`, http.StatusBadRequest)
+	call(t, http.MethodPost, ts.URL+"/ns/team", "", http.StatusMethodNotAllowed)
+}
+
+func TestJustWebServer_Tags(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	call(t, http.MethodPut, ts.URL+"/keys/profile:42", `{"value": "Ann", "tags": ["user:42"]}`, http.StatusOK)
+	call(t, http.MethodPut, ts.URL+"/keys/orders:42?tag=user:42&tag=orders", `{"value": [1, 2]}`, http.StatusOK)
+	call(t, http.MethodPost, ts.URL+"/?key=visits:42&value=7&tag=user:42", "", http.StatusOK)
+	call(t, http.MethodPut, ts.URL+"/ns/team/keys/profile:42", `{"value": "Bob", "tags": ["user:42"]}`, http.StatusOK)
+	call(t, http.MethodPost, ts.URL+"/batch", `{"operations": [{"op": "put", "key": "profile:7", "value": "Cid", "tags": ["user:7"]}]}`, http.StatusOK)
+
+	if resp := call(t, http.MethodDelete, ts.URL+"/tags/user:42", "", http.StatusOK); fmt.Sprint(resp["deleted"]) != "[orders:42 profile:42 visits:42]" {
+		t.Errorf("DELETE /tags/user:42 returned %v", resp)
+	}
+	call(t, http.MethodGet, ts.URL+"/keys/profile:42", "", http.StatusNotFound)
+	call(t, http.MethodGet, ts.URL+"/ns/team/keys/profile:42", "", http.StatusOK)
+	if resp := call(t, http.MethodDelete, ts.URL+"/ns/team/tags/user:42", "", http.StatusOK); fmt.Sprint(resp["deleted"]) != "[profile:42]" {
+		t.Errorf("DELETE /ns/team/tags/user:42 returned %v", resp)
+	}
+	resp := call(t, http.MethodPost, ts.URL+"/batch", `{"operations": [{"op": "invalidate", "tags": ["user:7"]}, {"op": "get", "key": "profile:7"}]}`, http.StatusOK)
+	if results := resp["results"].([]any); fmt.Sprint(results[0].(map[string]any)["deleted"]) != "[profile:7]" || results[1].(map[string]any)["code"] != 404.0 {
+		t.Errorf("invalidate in a batch returned %v", resp)
+	}
+
+	call(t, http.MethodDelete, ts.URL+"/tags/", "", http.StatusBadRequest)
+	call(t, http.MethodPut, ts.URL+"/keys/k", `{"value": 1, "tags": [""]}`, http.StatusBadRequest)
+	call(t, http.MethodGet, ts.URL+"/tags/user:42", "", http.StatusMethodNotAllowed)
+}
+
+func TestJustWebServer_Scan(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	call(t, http.MethodPost, ts.URL+"/?key=user:1&value=a&key=user:2&value=b&key=session:1&value=c&key=user:10&value=d", "", http.StatusOK)
+	call(t, http.MethodPut, ts.URL+"/ns/team/keys/user:1", `{"value": "t"}`, http.StatusOK)
+
+	var all []string
+	for cursor, pages := "0", 0; pages == 0 || cursor != "0"; pages++ {
+		resp := call(t, http.MethodGet, ts.URL+"/scan?count=1&prefix=user:&cursor="+url.QueryEscape(cursor), "", http.StatusOK)
+		keys, _ := resp["keys"].([]any)
+		if len(keys) > 1 || pages > 10 {
+			t.Fatalf("GET /scan returned %v", resp)
+		}
+		for _, k := range keys {
+			all = append(all, k.(string))
+		}
+		cursor = resp["cursor"].(string)
+	}
+	slices.Sort(all)
+	if !slices.Equal(all, []string{"user:1", "user:10", "user:2"}) {
+		t.Errorf("GET /scan listed %v", all)
+	}
+
+	if resp := call(t, http.MethodGet, ts.URL+"/scan?pattern=user:?&count=100", "", http.StatusOK); resp["status"] != "OK" || resp["cursor"] != "MDAx." {
+		t.Errorf("GET /scan returned %v", resp)
+	}
+	if resp := call(t, http.MethodGet, ts.URL+"/ns/team/scan?cursor=MDAy.", "", http.StatusOK); resp["cursor"] != "0" {
+		t.Errorf("GET /ns/team/scan returned %v", resp)
+	}
+	call(t, http.MethodGet, ts.URL+"/scan?count=x", "", http.StatusBadRequest)
+	call(t, http.MethodGet, ts.URL+"/scan?cursor=bad", "", http.StatusBadRequest)
+	call(t, http.MethodGet, ts.URL+"/scan?cursor=OTk5.", "", http.StatusBadRequest) // node 999 is not there
+	call(t, http.MethodGet, ts.URL+"/scan?pattern=[", "", http.StatusBadRequest)
+	call(t, http.MethodPost, ts.URL+"/scan", "", http.StatusMethodNotAllowed)
+}
+
+func TestJustWebServer_Range(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	call(t, http.MethodPost, ts.URL+"/?key=user:1&value=a&key=user:2&value=b&key=session:1&value=c&key=user:10&value=d", "", http.StatusOK)
+	call(t, http.MethodPut, ts.URL+"/ns/team/keys/user:1", `{"value": "t"}`, http.StatusOK)
+
+	var all []string
+	for from, pages := "a", 0; ; pages++ {
+		resp := call(t, http.MethodGet, ts.URL+"/range?limit=2&to=user:3&from="+url.QueryEscape(from), "", http.StatusOK)
+		keys, _ := resp["keys"].([]any)
+		if len(keys) > 2 || pages > 10 {
+			t.Fatalf("GET /range returned %v", resp)
+		}
+		for _, k := range keys {
+			all = append(all, k.(string))
+		}
+		next, _ := resp["next"].(string)
+		if next == "" {
+			break
+		}
+		from = next
+	}
+	if !slices.Equal(all, []string{"session:1", "user:1", "user:10", "user:2"}) {
+		t.Errorf("GET /range listed %v", all)
+	}
+
+	if resp := call(t, http.MethodGet, ts.URL+"/range?from=user:10", "", http.StatusOK); !reflect.DeepEqual(resp["keys"], []any{"user:10", "user:2"}) || resp["next"] != nil {
+		t.Errorf("GET /range returned %v", resp)
+	}
+	if resp := call(t, http.MethodGet, ts.URL+"/ns/team/range", "", http.StatusOK); !reflect.DeepEqual(resp["keys"], []any{"user:1"}) {
+		t.Errorf("GET /ns/team/range returned %v", resp)
+	}
+	call(t, http.MethodGet, ts.URL+"/range?limit=0", "", http.StatusBadRequest)
+	call(t, http.MethodGet, ts.URL+"/range?from=b&to=a", "", http.StatusBadRequest)
+	call(t, http.MethodPost, ts.URL+"/range", "", http.StatusMethodNotAllowed)
+}
+
+func TestJustWebServer_Meta(t *testing.T) {
+
+	ts := startTestServer(t)
+
+	call(t, http.MethodPut, ts.URL+"/keys/k", `{"value": "v", "ttl": 60}`, http.StatusOK)
+	call(t, http.MethodGet, ts.URL+"/keys/k", "", http.StatusOK)
+
+	resp := call(t, http.MethodGet, ts.URL+"/keys/k/meta?rank", "", http.StatusOK)
+	replicas, _ := resp["replicas"].([]any)
+	if resp["key"] != "k" || len(replicas) != 1 {
+		t.Fatalf("GET /keys/k/meta returned %v", resp)
+	}
+	replica := replicas[0].(map[string]any)
+	if replica["node"] != resp["owner"] || replica["reads"] != 1.0 || replica["writes"] != 1.0 || replica["rank"] != 1.0 || replica["records"] != 1.0 {
+		t.Errorf("GET /keys/k/meta returned %v", replica)
+	}
+	if ttl, _ := replica["ttl"].(float64); ttl <= 0 || ttl > 60 {
+		t.Errorf("GET /keys/k/meta returned the ttl %v", replica["ttl"])
+	}
+	for _, field := range []string{"created", "last_access", "last_write"} {
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(replica[field])); err != nil {
+			t.Errorf("GET /keys/k/meta returned the %s %v", field, replica[field])
+		}
+	}
+	// inspecting is not a read, the rank is given if asked for
+	if resp := call(t, http.MethodGet, ts.URL+"/keys/k/meta", "", http.StatusOK); resp["replicas"].([]any)[0].(map[string]any)["reads"] != 1.0 ||
+		resp["replicas"].([]any)[0].(map[string]any)["rank"] != nil {
+		t.Errorf("GET /keys/k/meta counted a read or gave the rank: %v", resp)
+	}
+	// the typed response, in a binary format
+	rq, _ := http.NewRequest(http.MethodGet, ts.URL+"/keys/k/meta", nil)
+	rq.Header.Set("Accept", "application/msgpack")
+	if r, err := http.DefaultClient.Do(rq); err != nil {
+		t.Errorf("GET /keys/k/meta error = %v", err)
+	} else {
+		b, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		var meta MetaResponse
+		if err = codecByType("application/msgpack").Unmarshal(b, &meta); err != nil || meta.Status != "OK" || meta.Key != "k" ||
+			len(meta.Replicas) != 1 || meta.Replicas[0].Node != meta.Owner || meta.Replicas[0].Reads != 1 || meta.Replicas[0].TTL == nil {
+			t.Errorf("GET /keys/k/meta in msgpack returned %+v %v", meta, err)
+		}
+	}
+
+	call(t, http.MethodPut, ts.URL+"/ns/team/keys/k", `{"value": "t"}`, http.StatusOK)
+	if resp := call(t, http.MethodGet, ts.URL+"/ns/team/keys/k/meta", "", http.StatusOK); resp["key"] != "k" || resp["replicas"].([]any)[0].(map[string]any)["ttl"] != nil {
+		t.Errorf("GET /ns/team/keys/k/meta returned %v", resp)
+	}
+	call(t, http.MethodPut, ts.URL+"/keys/a%2Fmeta", `{"value": "slash"}`, http.StatusOK)
+	call(t, http.MethodGet, ts.URL+"/keys/a%2Fmeta/meta", "", http.StatusOK)
+	call(t, http.MethodGet, ts.URL+"/keys/missing/meta", "", http.StatusNotFound)
+	call(t, http.MethodPost, ts.URL+"/keys/k/meta", "", http.StatusMethodNotAllowed)
+}
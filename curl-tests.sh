@@ -25,11 +25,170 @@ curl -X 'GET' \
   'http://localhost:8089?key=key1&key=key2&key=key3&key=key4' \
   -H 'accept: application/json' | jq
 
+echo 'Storing a record with 1 second ttl:'
+curl -X 'POST' \
+  'http://localhost:8089?key=key5&value=value5&ttl=1' \
+  -H 'accept: application/json' | jq
+
+sleep 2
+
+echo 'Getting expired key:'
+curl -X 'GET' \
+  'http://localhost:8089?key=key5' \
+  -H 'accept: application/json' | jq
+
 echo 'Getting legit key and abracadabra:'
 curl -X 'GET' \
   'http://localhost:8089?key=key3&key=abra&key=cadabra' \
   -H 'accept: application/json' | jq
 
+echo 'Adding a node:'
+curl -X 'POST' \
+  'http://localhost:8089/admin/nodes?id=extra' \
+  -H 'accept: application/json' | jq
+
+echo 'Check nodes len:'
+curl -X 'GET' \
+  'http://localhost:8089' \
+  -H 'accept: application/json' | jq
+
+echo 'Removing the node:'
+curl -X 'DELETE' \
+  'http://localhost:8089/admin/nodes?id=extra' \
+  -H 'accept: application/json' | jq
+
+echo 'Getting 4 keys:'
+curl -X 'GET' \
+  'http://localhost:8089?key=key1&key=key2&key=key3&key=key4' \
+  -H 'accept: application/json' | jq
+
+echo 'Deleting key1 and abra, only key1 existed:'
+curl -X 'DELETE' \
+  'http://localhost:8089?key=key1&key=abra' \
+  -H 'accept: application/json' | jq
+
+echo 'Deleting keys matching key?:'
+curl -X 'DELETE' \
+  'http://localhost:8089?pattern=key%3F' \
+  -H 'accept: application/json' | jq
+
+echo 'Storing a JSON record:'
+curl -X 'PUT' \
+  'http://localhost:8089/keys/user:42' \
+  -H 'accept: application/json' \
+  -d '{"value": {"name": "Ann", "roles": ["admin"]}, "ttl": "1h"}' | jq
+
+echo 'Getting it back:'
+curl -X 'GET' \
+  'http://localhost:8089/keys/user:42' \
+  -H 'accept: application/json' | jq
+
+echo 'Storing raw bytes with their content type:'
+printf 'GIF89a\x01\x00\x01\x00' | curl -X 'PUT' \
+  'http://localhost:8089/keys/pixel' \
+  -H 'Content-Type: image/gif' \
+  --data-binary @- | jq
+
+echo 'Getting the raw bytes back:'
+curl -s -D - -o /dev/null -X 'GET' \
+  'http://localhost:8089/keys/pixel?raw'
+
+echo 'Counting:'
+curl -X 'POST' \
+  'http://localhost:8089/keys/hits/incr?by=5' \
+  -H 'accept: application/json' | jq
+curl -X 'POST' \
+  'http://localhost:8089/keys/hits/decr' \
+  -H 'accept: application/json' | jq
+
+echo 'What the nodes know about a record:'
+curl -X 'GET' \
+  'http://localhost:8089/keys/hits/meta' \
+  -H 'accept: application/json' | jq
+
+echo 'Lists and sorted sets:'
+curl -X 'POST' \
+  'http://localhost:8089/keys/queue/rpush?arg=job1&arg=job2' \
+  -H 'accept: application/json' | jq
+curl -X 'GET' \
+  'http://localhost:8089/keys/queue/lrange?arg=0&arg=-1' \
+  -H 'accept: application/json' | jq
+curl -X 'POST' \
+  'http://localhost:8089/keys/board/zadd' \
+  -H 'accept: application/json' \
+  -H 'Content-Type: application/json' \
+  -d '{"args": ["100", "ann", "250", "bob"]}' | jq
+curl -X 'GET' \
+  'http://localhost:8089/keys/board/zrange?arg=200&arg=%2Binf' \
+  -H 'accept: application/json' | jq
+
+echo 'Storing only the absent keys, then swapping a value:'
+curl -X 'POST' \
+  'http://localhost:8089?key=key1&value=value1&key=key8&value=value8&mode=nx' \
+  -H 'accept: application/json' | jq
+curl -X 'PUT' \
+  'http://localhost:8089/keys/key8?mode=getset' \
+  -H 'accept: application/json' \
+  -d '{"value": "value8.1"}' | jq
+
+echo 'Updating only if nobody changed it since we read it:'
+version=$(curl -s 'http://localhost:8089/keys/hits' | jq -r '.versions.hits')
+curl -X 'PUT' \
+  "http://localhost:8089/keys/hits?if-version=$version" \
+  -H 'accept: application/json' \
+  -d '{"value": 100}' | jq
+curl -X 'PUT' \
+  'http://localhost:8089/keys/hits' \
+  -H 'accept: application/json' \
+  -H "If-Match: \"$version\"" \
+  -d '{"value": 200}' | jq
+
+echo 'A batch of operations:'
+curl -X 'POST' \
+  'http://localhost:8089/batch' \
+  -H 'accept: application/json' \
+  -d '{"operations": [{"op": "put", "keys": ["key6", "key7"], "values": ["value6", 7]}, {"op": "get", "keys": ["key6", "key7", "user:42"]}, {"op": "del", "key": "user:42"}]}' | jq
+
+echo 'Scanning the keys, the first page:'
+curl -X 'GET' \
+  'http://localhost:8089/scan?count=10' \
+  -H 'accept: application/json' | jq
+
+echo 'The keys from key1 to key8 in order:'
+curl -X 'GET' \
+  'http://localhost:8089/range?from=key1&to=key8&limit=10' \
+  -H 'accept: application/json' | jq
+
+echo 'Tagging records and invalidating them by a tag:'
+curl -X 'POST' \
+  'http://localhost:8089?key=profile:42&value=Ann&tag=user:42' \
+  -H 'accept: application/json' | jq
+curl -X 'PUT' \
+  'http://localhost:8089/keys/orders:42' \
+  -H 'accept: application/json' \
+  -d '{"value": [1, 2], "tags": ["user:42", "orders"]}' | jq
+curl -X 'DELETE' \
+  'http://localhost:8089/tags/user:42' \
+  -H 'accept: application/json' | jq
+
+echo 'Namespaces with a quota:'
+curl -X 'PUT' \
+  'http://localhost:8089/ns/team1?max_entries=100' \
+  -H 'accept: application/json' | jq
+curl -X 'PUT' \
+  'http://localhost:8089/ns/team1/keys/user:42' \
+  -H 'accept: application/json' \
+  -d '{"value": "team1 Ann"}' | jq
+curl -X 'GET' \
+  'http://localhost:8089/keys/user:42?ns=team1' \
+  -H 'accept: application/json' | jq
+curl -X 'GET' \
+  'http://localhost:8089/ns/team1' \
+  -H 'accept: application/json' | jq
+curl -X 'DELETE' \
+  'http://localhost:8089/ns/team1' \
+  -H 'accept: application/json' | jq
+
 echo 'Deleting cache:'
 curl -X 'DELETE' \
   'http://localhost:8089' \
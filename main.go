@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"github.com/andrewelkin/discap/CacheManager"
 	"github.com/andrewelkin/discap/DataNode"
+	"github.com/andrewelkin/discap/MemcacheServer"
+	"github.com/andrewelkin/discap/RespServer"
 	"github.com/andrewelkin/discap/SimpleWeb"
 	"log"
+	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -16,21 +20,96 @@ import (
 // * web server accepting GET POST and DELETE requests
 // * array of data nodes, each of them has a channel to receive requests
 // * cache manager which passes requests/responses between web server and the nodes
+// in the datanode mode it runs a single data node served over TCP instead,
+// the cache manager connects to such nodes when it is given their addresses
 
-// the main accepts three parameters, the cmd line syntax is:
-//  [-p=<port number>] [-s=<node size>] [-n=<number of nodes>]
+// the main accepts eighteen parameters, the cmd line syntax is:
+//  [-m=<mode>] [-p=<port number>] [-s=<node size>] [-b=<node size in bytes>] [-n=<number of nodes>] [-v=<virtual nodes per node>] [-e=<eviction policy>]
+//  [-r=<replicas>] [-w=<write quorum>] [-q=<read quorum>] [-a=<node addresses>] [-d=<data directory>] [-f=<fsync policy>]
+//  [-redis=<redis protocol port>] [-memcached=<memcached protocol port>] [-ns=<namespace quotas>]
+//  [-ordered=<ordered index>] [-range=<range boundaries>]
 // example:
-//   go run main.go -p=8080 -s=2048 -n=42
-// the defaults are 8089 , 50 and 3
+//   go run main.go -p=8080 -s=2048 -b=64M -n=42 -e=tinylfu -r=3
+//   go run main.go -m=datanode -p=9001 -s=2048
+//   go run main.go -a=localhost:9001,localhost:9002
+//   go run main.go -ns=team1:100:1M,team2:500
+//   go run main.go -range=g,n,t
+// the defaults are cache, 8089 , 50, no byte limit, 3, 160, lru, 1, the majority of the replicas for both quorums, no addresses,
+// no persistence, everysec, no redis and memcached protocol listeners, no namespace quotas, no ordered index and the hash ring
+// mode is cache or datanode, a datanode listens on the port for the cache manager
+// node size in bytes takes K, M and G suffixes
+// eviction policies: lru, lfu, arc, 2q, tinylfu
+// node addresses are comma separated host:port of the datanodes, -n is ignored then
+// with a data directory the nodes keep an append-only log and snapshots there and restore them on start
+// fsync policies: always, everysec, never
+// namespace quotas are comma separated name:entries[:bytes], the records and the bytes a namespace can take on every node,
+// zero meaning no limit, the bytes take K, M and G suffixes
+// with the ordered index (true or false) the nodes keep their keys in lexical order too, so the range queries read only
+// the keys they list
+// range boundaries are comma separated keys, the keys are placed by the ranges between them rather than on the hash ring
+// and the nodes keep the ordered index
 //
 
 func main() {
 
 	numberOfNodes := 3
 	nodeMaxSize := 50
+	var nodeMaxBytes int64
 	port := 8089
+	virtualNodes := CacheManager.DefaultVirtualNodes
+	policy := DataNode.PolicyNames[0]
+	var managerOptions CacheManager.ManagerOptions
+	mode := "cache"
+	dataDir := ""
+	fsync := DataNode.FsyncPolicies[0]
+	redisPort := 0
+	memcachedPort := 0
+	ordered := false
+	var splits []string
+	var addresses []string
+	quotas := make(map[string]DataNode.Quota)
 
 	for _, a := range os.Args[1:] {
+		if strings.HasPrefix(a, "-m=") {
+			mode = a[3:]
+		}
+		if strings.HasPrefix(a, "-a=") {
+			addresses = strings.Split(a[3:], ",")
+		}
+		if strings.HasPrefix(a, "-ns=") {
+			for _, q := range strings.Split(a[4:], ",") {
+				name, quota, err := parseQuota(q)
+				if err != nil {
+					log.Fatalf("bad namespace quota %q: %s", q, err)
+				}
+				quotas[name] = quota
+			}
+		}
+		if strings.HasPrefix(a, "-ordered=") {
+			if tmp, err := strconv.ParseBool(a[9:]); err == nil {
+				ordered = tmp
+			}
+		}
+		if strings.HasPrefix(a, "-range=") {
+			splits = strings.Split(a[7:], ",")
+			ordered = true
+		}
+		if strings.HasPrefix(a, "-d=") {
+			dataDir = a[3:]
+		}
+		if strings.HasPrefix(a, "-f=") {
+			fsync = a[3:]
+		}
+		if strings.HasPrefix(a, "-redis=") {
+			if tmp, err := strconv.ParseInt(a[7:], 10, 64); err == nil {
+				redisPort = int(tmp)
+			}
+		}
+		if strings.HasPrefix(a, "-memcached=") {
+			if tmp, err := strconv.ParseInt(a[11:], 10, 64); err == nil {
+				memcachedPort = int(tmp)
+			}
+		}
 		if strings.HasPrefix(a, "-p=") {
 			if tmp, err := strconv.ParseInt(a[3:], 10, 64); err == nil {
 				port = int(tmp)
@@ -41,28 +120,173 @@ func main() {
 				nodeMaxSize = int(tmp)
 			}
 		}
+		if strings.HasPrefix(a, "-b=") {
+			if tmp, err := parseBytes(a[3:]); err == nil {
+				nodeMaxBytes = tmp
+			}
+		}
 		if strings.HasPrefix(a, "-n=") {
 			if tmp, err := strconv.ParseInt(a[3:], 10, 64); err == nil {
 				numberOfNodes = int(tmp)
 			}
 		}
+		if strings.HasPrefix(a, "-v=") {
+			if tmp, err := strconv.ParseInt(a[3:], 10, 64); err == nil {
+				virtualNodes = int(tmp)
+			}
+		}
+		if strings.HasPrefix(a, "-e=") {
+			policy = a[3:]
+		}
+		if strings.HasPrefix(a, "-r=") {
+			if tmp, err := strconv.ParseInt(a[3:], 10, 64); err == nil {
+				managerOptions.Replicas = int(tmp)
+			}
+		}
+		if strings.HasPrefix(a, "-w=") {
+			if tmp, err := strconv.ParseInt(a[3:], 10, 64); err == nil {
+				managerOptions.WriteQuorum = int(tmp)
+			}
+		}
+		if strings.HasPrefix(a, "-q=") {
+			if tmp, err := strconv.ParseInt(a[3:], 10, 64); err == nil {
+				managerOptions.ReadQuorum = int(tmp)
+			}
+		}
+
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
+	nodeOptions := DataNode.NodeOptions{
+		MaxSize:  nodeMaxSize,
+		MaxBytes: nodeMaxBytes,
+		Policy:   policy,
+		DataDir:  dataDir,
+		Fsync:    fsync,
+		Quotas:   quotas,
+		Ordered:  ordered,
 	}
 
-	log.Printf("Cache manager and web server are starting on port %d, max size: %d, number of nodes: %d\n", port, nodeMaxSize, numberOfNodes)
+	if mode == "datanode" {
+		// a single node served over TCP, the cache manager runs elsewhere
+		log.Printf("Data node is starting on port %d, max size: %d, max bytes: %d, eviction policy: %s\n", port, nodeMaxSize, nodeMaxBytes, policy)
+		node, err := (&DataNode.SingleDataNode{}).NewWithOptions(ctx, fmt.Sprintf("node:%d", port), nodeOptions)
+		if err != nil {
+			log.Fatalf("error creating node: %s", err)
+		}
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			log.Fatalf("error listening: %s", err)
+		}
+		log.Fatal(DataNode.ServeTCP(ctx, ln, node.GetChannel()))
+	} else if mode != "cache" {
+		log.Fatalf("unknown mode %s, use cache or datanode", mode)
+	}
 
-	ctx, _ := context.WithCancel(context.Background())
+	log.Printf("Cache manager and web server are starting on port %d, max size: %d, max bytes: %d, number of nodes: %d, virtual nodes: %d, eviction policy: %s, replicas: %d\n", port, nodeMaxSize, nodeMaxBytes, numberOfNodes, virtualNodes, policy, max(managerOptions.Replicas, 1))
 
-	// create the data nodes and get their channels
-	nodeChannels := make([]chan<- DataNode.DNRequest, numberOfNodes)
-	for i := 0; i < numberOfNodes; i++ {
-		nodeChannels[i] = (&DataNode.SingleDataNode{}).New(ctx, fmt.Sprintf("%03d", i), nodeMaxSize).GetChannel()
+	// create the cache manager and give him the nodes, the keys are placed on a consistent hash ring or by their ranges
+	if len(splits) > 0 {
+		log.Printf("the keys are placed by the ranges between %v\n", splits)
+		managerOptions.Partitioner = (&CacheManager.RangePartitioner{}).New(splits)
+	} else {
+		managerOptions.Partitioner = (&CacheManager.HashRing{}).New(virtualNodes, 0)
+	}
+	var cacheManager *CacheManager.DateNodesManager
+	var err error
+	if len(addresses) > 0 {
+		// the nodes run as datanode processes
+		log.Printf("connecting to the data nodes %v\n", addresses)
+		if _, err = DataNode.NewEvictionPolicy(policy, nodeMaxSize); err != nil { // for the nodes added at runtime
+			log.Fatalf("error creating node: %s", err)
+		}
+		if !slices.Contains(DataNode.FsyncPolicies, fsync) {
+			log.Fatalf("error creating node: unknown fsync policy %s", fsync)
+		}
+		cacheManager, err = (&CacheManager.DateNodesManager{}).NewWithAddresses(ctx, addresses, managerOptions)
+	} else {
+		// create the data nodes and get their channels
+		nodeChannels := make([]chan<- DataNode.DNRequest, numberOfNodes)
+		for i := 0; i < numberOfNodes; i++ {
+			node, err := (&DataNode.SingleDataNode{}).NewWithOptions(ctx, fmt.Sprintf("%03d", i), nodeOptions)
+			if err != nil {
+				log.Fatalf("error creating node: %s", err)
+			}
+			nodeChannels[i] = node.GetChannel()
+		}
+		cacheManager, err = (&CacheManager.DateNodesManager{}).NewWithOptions(ctx, nodeChannels, managerOptions)
+	}
+	if err != nil {
+		log.Fatalf("error creating cache manager: %s", err)
+	}
+	for name, quota := range quotas { // the manager gives them to the remote nodes and the ones added at runtime
+		if _, err = cacheManager.SetQuota(name, quota); err != nil {
+			log.Fatalf("error setting the quota of %s: %s", name, err)
+		}
 	}
 
-	// create the cache manager and give him the channels of the nodes
-	cacheManager := (&CacheManager.DateNodesManager{}).New(ctx, nodeChannels)
+	// nodes added at runtime with the admin requests
+	nodeFactory := func(id string, maxSize int) (chan<- DataNode.DNRequest, context.CancelFunc) {
+		opts := nodeOptions
+		if maxSize > 0 {
+			opts.MaxSize = maxSize
+		}
+		nodeCtx, nodeCancel := context.WithCancel(ctx)
+		node, _ := (&DataNode.SingleDataNode{}).NewWithOptions(nodeCtx, id, opts) // the options were checked at startup
+		return node.GetChannel(), nodeCancel
+	}
+
+	// redis and memcached clients talk to the same cache manager
+	if redisPort > 0 {
+		go (&RespServer.RespServer{}).StartAndServe(redisPort, cacheManager)
+	}
+	if memcachedPort > 0 {
+		go (&MemcacheServer.MemcacheServer{}).StartAndServe(memcachedPort, cacheManager)
+	}
 
 	// start the simplest web server and give him the Cache manager
-	(&SimpleWeb.JustWebServer{}).StartAndServe(port, cacheManager)
+	(&SimpleWeb.JustWebServer{}).SetNodeFactory(nodeFactory).StartAndServe(port, cacheManager)
+
+}
+
+// parses a number of bytes with an optional K, M or G suffix
+func parseBytes(s string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-min(len(s), 1):]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	tmp, err := strconv.ParseInt(s, 10, 64)
+	return tmp * multiplier, err
+}
 
+// parses a namespace quota name:entries[:bytes]
+func parseQuota(s string) (string, DataNode.Quota, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", DataNode.Quota{}, fmt.Errorf("expected name:entries[:bytes]")
+	}
+	if err := DataNode.CheckNamespace(parts[0]); err != nil {
+		return "", DataNode.Quota{}, err
+	}
+	var quota DataNode.Quota
+	var err error
+	if quota.MaxSize, err = strconv.Atoi(parts[1]); err != nil || quota.MaxSize < 0 {
+		return "", DataNode.Quota{}, fmt.Errorf("bad number of entries %q", parts[1])
+	}
+	if len(parts) == 3 {
+		if quota.MaxBytes, err = parseBytes(parts[2]); err != nil || quota.MaxBytes < 0 {
+			return "", DataNode.Quota{}, fmt.Errorf("bad number of bytes %q", parts[2])
+		}
+	}
+	return parts[0], quota, nil
 }